@@ -0,0 +1,559 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	adminUsersPerPage    = 50
+	adminUsersMaxPerPage = 500
+	// adminExportFlushRows is how many rows are written between flushes,
+	// their channels are loaded together
+	adminExportFlushRows = 1000
+	// adminExportWriteTimeout is how long writing a batch of rows may take,
+	// the export as a whole can run past the server's WriteTimeout
+	adminExportWriteTimeout = 30 * time.Second
+
+	githubAuthURL  = "https://github.com/login/oauth/authorize"
+	githubTokenURL = "https://github.com/login/oauth/access_token"
+	githubUserURL  = "https://api.github.com/user"
+
+	// ADMINSERVICE is used for pending admin logins
+	ADMINSERVICE = "github-admin"
+)
+
+// GitHubUser ...
+type GitHubUser struct {
+	ID    int    `json:"id"`
+	Login string `json:"login"`
+	Name  string `json:"name"`
+}
+
+type githubTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	Scope            string `json:"scope"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// adminClaims are the claims of the admin session, kept apart from the
+// opt-out sessions.
+type adminClaims struct {
+	Login string `json:"login"`
+	Admin bool   `json:"admin"`
+	jwt.StandardClaims
+}
+
+// AdminPayload ...
+type AdminPayload struct {
+	Login     string
+	Forbidden bool
+}
+
+func (ur *UnRustleLogs) adminEnabled() bool {
+	return ur.config.Admin.ClientID != ""
+}
+
+func (ur *UnRustleLogs) setupAdmin() error {
+	if !ur.adminEnabled() {
+		return nil
+	}
+	if ur.config.Admin.Cookie == "" {
+		ur.config.Admin.Cookie = "admin"
+	}
+	if len(ur.config.Admin.Admins) == 0 {
+		logrus.Warn("admin login is configured but admin.admins is empty, nobody can log in")
+	}
+	return nil
+}
+
+func (ur *UnRustleLogs) isAdmin(login string) bool {
+	for _, admin := range ur.config.Admin.Admins {
+		// github logins are case insensitive
+		if strings.EqualFold(admin, login) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ur *UnRustleLogs) getGitHubAccessToken(code, redirectURI string) (*githubTokenResponse, error) {
+	v := url.Values{}
+	v.Set("client_id", ur.config.Admin.ClientID)
+	v.Set("client_secret", ur.config.Admin.ClientSecret)
+	v.Set("code", code)
+	v.Set("redirect_uri", redirectURI)
+
+	req, err := http.NewRequest("POST", githubTokenURL, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	response, err := ur.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting github access_token, status: %d, body: %s", response.StatusCode, body)
+	}
+	var token githubTokenResponse
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return nil, err
+	}
+	// github answers 200 with an error field for bad codes
+	if token.Error != "" {
+		return nil, fmt.Errorf("error getting github access_token: %s: %s", token.Error, token.ErrorDescription)
+	}
+	return &token, nil
+}
+
+func (ur *UnRustleLogs) getGitHubUser(accessToken string) (*GitHubUser, error) {
+	req, err := http.NewRequest("GET", githubUserURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	req.Header.Add("Accept", "application/vnd.github+json")
+
+	response, err := ur.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting github user, status: %d, body: %s", response.StatusCode, body)
+	}
+	var user GitHubUser
+	err = json.Unmarshal(body, &user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// AdminLoginHandle ...
+func (ur *UnRustleLogs) AdminLoginHandle(c *gin.Context) {
+	redirectURI, err := ur.callbackURL(c, "/admin/callback", ur.config.Admin.RedirectURL)
+	if err != nil {
+		requestLog(c).Warnf("admin login from %q rejected: %v", c.Request.Host, err)
+		errorPage(c, http.StatusBadRequest, "Logins are not allowed from this host.")
+		return
+	}
+	state, err := generateSecureToken(stateBytes)
+	if err != nil {
+		requestLog(c).Errorf("failed generating admin state: %v", err)
+		errorPage(c, http.StatusInternalServerError, "Something went wrong, please try again.")
+		return
+	}
+	ip := ur.clientIP(c.Request)
+	if err := ur.putState(ADMINSERVICE, ip, state, "", "/admin/", false, ""); err != nil {
+		requestLog(c).Warnf("admin login from %s rejected: %v", ip, err)
+		errorPage(c, http.StatusTooManyRequests, "Too many pending logins, please try again in a few minutes.")
+		return
+	}
+
+	v := url.Values{}
+	v.Set("client_id", ur.config.Admin.ClientID)
+	v.Set("redirect_uri", redirectURI)
+	v.Set("scope", "read:user")
+	v.Set("state", state)
+	v.Set("allow_signup", "false")
+	authURL := fmt.Sprintf("%s?%s", githubAuthURL, v.Encode())
+
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// AdminCallbackHandle ...
+func (ur *UnRustleLogs) AdminCallbackHandle(c *gin.Context) {
+	state := c.Query("state")
+	if ur.handleCallbackError(c, ADMINSERVICE) {
+		ur.consumeState(ADMINSERVICE, state)
+		return
+	}
+	if _, err := ur.consumeState(ADMINSERVICE, state); err != nil {
+		c.Redirect(http.StatusFound, "/?error="+stateErrorCode(err))
+		return
+	}
+	redirectURI, err := ur.callbackURL(c, "/admin/callback", ur.config.Admin.RedirectURL)
+	if err != nil {
+		requestLog(c).Warnf("admin callback from %q rejected: %v", c.Request.Host, err)
+		errorPage(c, http.StatusBadRequest, "Logins are not allowed from this host.")
+		return
+	}
+
+	access, err := ur.getGitHubAccessToken(c.Query("code"), redirectURI)
+	if err != nil {
+		requestLog(c).Error(err)
+		c.Redirect(http.StatusFound, "/?error=server_error")
+		return
+	}
+	user, err := ur.getGitHubUser(access.AccessToken)
+	if err != nil {
+		requestLog(c).Error(err)
+		c.Redirect(http.StatusFound, "/?error=server_error")
+		return
+	}
+	if !ur.isAdmin(user.Login) {
+		requestLog(c).Warnf("github user %s tried to log into the admin area", user.Login)
+		c.HTML(http.StatusForbidden, "admin.tmpl", AdminPayload{Login: user.Login, Forbidden: true})
+		return
+	}
+
+	claims := &adminClaims{
+		Login: user.Login,
+		Admin: true,
+		StandardClaims: jwt.StandardClaims{
+			Id:        newJTI(),
+			Issuer:    ur.config.Server.JWTIssuer,
+			Audience:  ADMINSERVICE,
+			ExpiresAt: time.Now().Add(time.Hour * 12).Unix(),
+		},
+	}
+	t, err := ur.signJWT(claims)
+	if err != nil {
+		requestLog(c).Error(err)
+		errorPage(c, http.StatusInternalServerError, "Something went wrong, please try again.")
+		return
+	}
+
+	requestLog(c).Infof("admin %s logged in", user.Login)
+	ur.setCookie(c, ur.config.Admin.Cookie, t, "/admin", 43200)
+	c.Redirect(http.StatusFound, "/admin/")
+}
+
+// AdminLogoutHandle ...
+func (ur *UnRustleLogs) AdminLogoutHandle(c *gin.Context) {
+	if tokenString, err := c.Cookie(ur.config.Admin.Cookie); err == nil {
+		if token, err := ur.parseToken(tokenString, &adminClaims{}); err == nil && token.Valid {
+			claims := token.Claims.(*adminClaims)
+			ur.RevokeToken(claims.Id, claims.ExpiresAt)
+		}
+	}
+	ur.setCookie(c, ur.config.Admin.Cookie, "", "/admin", -1)
+	c.Redirect(http.StatusFound, "/")
+}
+
+// adminMiddleware only lets requests with a valid admin session through,
+// everyone else is sent to the GitHub login.
+func (ur *UnRustleLogs) adminMiddleware(c *gin.Context) {
+	tokenString, err := c.Cookie(ur.config.Admin.Cookie)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/admin/login")
+		c.Abort()
+		return
+	}
+	token, err := ur.parseToken(tokenString, &adminClaims{})
+	if err != nil {
+		c.Redirect(http.StatusFound, "/admin/login")
+		c.Abort()
+		return
+	}
+	claims, ok := token.Claims.(*adminClaims)
+	if !ok || !token.Valid || ur.tokenRevoked(claims.Id) || !claims.VerifyAudience(ADMINSERVICE, !ur.legacyTokensAllowed()) {
+		c.Redirect(http.StatusFound, "/admin/login")
+		c.Abort()
+		return
+	}
+	// the list is checked again so removed admins lose access right away
+	if !claims.Admin || !ur.isAdmin(claims.Login) {
+		c.HTML(http.StatusForbidden, "admin.tmpl", AdminPayload{Login: claims.Login, Forbidden: true})
+		c.Abort()
+		return
+	}
+	c.Set("admin", claims.Login)
+	c.Next()
+}
+
+func (ur *UnRustleLogs) adminIndexHandler(c *gin.Context) {
+	c.HTML(http.StatusOK, "admin.tmpl", AdminPayload{Login: c.GetString("admin")})
+}
+
+// AdminUser is an opt-out record as listed by /admin/users
+type AdminUser struct {
+	Name          string     `json:"name"`
+	Service       string     `json:"service"`
+	RequestedAt   time.Time  `json:"requested_at"`
+	Active        bool       `json:"active"`
+	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	AllChannels   bool       `json:"all_channels"`
+	// Channels are the channels the opt-out covers unless AllChannels
+	Channels []string `json:"channels,omitempty"`
+}
+
+// adminChannel reads the optional channel query parameter, reporting a 400
+// if it's invalid.
+func adminChannel(c *gin.Context) (string, bool) {
+	channel := c.Query("channel")
+	if channel == "" {
+		return "", true
+	}
+	channel, err := normalizeChannel(channel)
+	if err != nil {
+		apiError(c, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("invalid channel: %v", err))
+		return "", false
+	}
+	return channel, true
+}
+
+// adminUsersHandler lists the opt-outs, filtered by service, channel and a
+// substring of the name (q), per_page at a time. Undeleted users are only included
+// with include_inactive=1.
+func (ur *UnRustleLogs) adminUsersHandler(c *gin.Context) {
+	f := UserFilter{
+		Service:         c.Query("service"),
+		Query:           strings.TrimSpace(c.Query("q")),
+		IncludeInactive: c.Query("include_inactive") == "1",
+		Page:            1,
+		PerPage:         adminUsersPerPage,
+	}
+	if _, ok := ur.provider(f.Service); f.Service != "" && !ok {
+		apiError(c, http.StatusBadRequest, codeUnknownService, fmt.Sprintf("unknown service %q", f.Service))
+		return
+	}
+	channel, ok := adminChannel(c)
+	if !ok {
+		return
+	}
+	f.Channel = channel
+	if s := c.Query("page"); s != "" {
+		page, err := strconv.Atoi(s)
+		if err != nil || page < 1 {
+			apiError(c, http.StatusBadRequest, codeBadRequest, "page has to be a positive number")
+			return
+		}
+		f.Page = page
+	}
+	if s := c.Query("per_page"); s != "" {
+		perPage, err := strconv.Atoi(s)
+		if err != nil || perPage < 1 || perPage > adminUsersMaxPerPage {
+			apiError(c, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("per_page has to be between 1 and %d", adminUsersMaxPerPage))
+			return
+		}
+		f.PerPage = perPage
+	}
+	users, total, err := ur.ListUsers(f)
+	if err != nil {
+		requestLog(c).Errorf("failed listing users: %v", err)
+		apiError(c, http.StatusInternalServerError, codeInternal, "failed listing users")
+		return
+	}
+	now := time.Now().UTC()
+	list := make([]AdminUser, 0, len(users))
+	for _, u := range users {
+		au := AdminUser{
+			Name:          u.Name,
+			Service:       u.Service,
+			RequestedAt:   u.RequestedAt.UTC(),
+			Active:        u.optedOut(now),
+			DeactivatedAt: u.DeactivatedAt,
+			ExpiresAt:     u.ExpiresAt,
+			AllChannels:   u.AllChannels,
+		}
+		if !u.AllChannels {
+			if au.Channels, err = ur.UserChannels(u.ID); err != nil {
+				requestLog(c).Errorf("failed getting channels of %s user %s: %v", u.Service, u.Name, err)
+			}
+		}
+		list = append(list, au)
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"users":    list,
+		"total":    total,
+		"page":     f.Page,
+		"per_page": f.PerPage,
+	})
+}
+
+// exportRow is a user of the export waiting for its channels.
+type exportRow struct {
+	id        string
+	user      AdminUser
+	expiresAt string
+}
+
+// extendWriteDeadline lets the response be written for d from now, even
+// past the server's WriteTimeout.
+func extendWriteDeadline(c *gin.Context, d time.Duration) {
+	if conn := requestConn(c.Request); conn != nil {
+		conn.SetWriteDeadline(time.Now().Add(d))
+	}
+}
+
+// adminExportHandler streams every opt-out of the service, or of all services,
+// covering the channel if there is one, as a csv (default) or json download.
+// Undeleted and expired users are only included with include_inactive=1. The
+// channels of the csv are space separated. The number of rows is sent in the
+// X-Row-Count trailer once they are all written. If reading them fails the
+// stream stops and the X-Export-Error trailer is set, a json export isn't
+// closed then.
+func (ur *UnRustleLogs) adminExportHandler(c *gin.Context) {
+	service := c.Query("service")
+	if _, ok := ur.provider(service); service != "" && !ok {
+		apiError(c, http.StatusBadRequest, codeUnknownService, fmt.Sprintf("unknown service %q", service))
+		return
+	}
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "json" {
+		apiError(c, http.StatusBadRequest, codeBadRequest, "format has to be csv or json")
+		return
+	}
+	channel, ok := adminChannel(c)
+	if !ok {
+		return
+	}
+	q := ur.db.Model(&User{}).Select("id, name, service, requested_at, active, all_channels, expires_at")
+	if service != "" {
+		q = q.Where("service = ?", service)
+	}
+	now := time.Now().UTC()
+	if c.Query("include_inactive") != "1" {
+		q = unexpired(q.Where("active = ?", true), now)
+	}
+	q = ur.optedOutIn(q, channel)
+	rows, err := q.Order("requested_at desc, name, service").Rows()
+	if err != nil {
+		requestLog(c).Errorf("failed exporting users: %v", err)
+		apiError(c, http.StatusInternalServerError, codeInternal, "failed exporting users")
+		return
+	}
+	defer rows.Close()
+
+	filename := "optouts"
+	if service != "" {
+		filename += "-" + service
+	}
+	if channel != "" {
+		filename += "-" + channel
+	}
+	filename += "-" + time.Now().UTC().Format("20060102") + "." + format
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Header("Cache-Control", "no-store")
+	c.Header("Trailer", "X-Row-Count, X-Export-Error")
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		c.Header("Content-Type", "application/json; charset=utf-8")
+	}
+	c.Status(http.StatusOK)
+
+	var (
+		count int
+		w     = csv.NewWriter(c.Writer)
+		enc   = json.NewEncoder(c.Writer)
+		batch []exportRow
+	)
+	extendWriteDeadline(c, adminExportWriteTimeout)
+	if format == "csv" {
+		w.Write([]string{"name", "service", "requested_at", "active", "all_channels", "channels", "expires_at"})
+	} else {
+		c.Writer.WriteString("[")
+	}
+	// writeBatch writes the rows of batch with their channels and flushes,
+	// nothing is written if the channels can't be loaded
+	writeBatch := func() error {
+		var ids []string
+		for _, r := range batch {
+			if !r.user.AllChannels {
+				ids = append(ids, r.id)
+			}
+		}
+		channels, err := ur.UsersChannels(ids)
+		if err != nil {
+			return fmt.Errorf("failed exporting channels: %v", err)
+		}
+		extendWriteDeadline(c, adminExportWriteTimeout)
+		for _, r := range batch {
+			u := r.user
+			if !u.AllChannels {
+				u.Channels = channels[r.id]
+				if u.Channels == nil {
+					u.Channels = []string{}
+				}
+			}
+			if format == "csv" {
+				w.Write([]string{u.Name, u.Service, u.RequestedAt.Format(time.RFC3339), strconv.FormatBool(u.Active), strconv.FormatBool(u.AllChannels), strings.Join(u.Channels, " "), r.expiresAt})
+			} else {
+				if count > 0 {
+					c.Writer.WriteString(",")
+				}
+				enc.Encode(u)
+			}
+			count++
+		}
+		batch = batch[:0]
+		w.Flush()
+		c.Writer.Flush()
+		return nil
+	}
+	for err == nil && rows.Next() {
+		var r exportRow
+		var requestedAt *time.Time
+		u := &r.user
+		if err = rows.Scan(&r.id, &u.Name, &u.Service, &requestedAt, &u.Active, &u.AllChannels, &u.ExpiresAt); err != nil {
+			err = fmt.Errorf("failed exporting users: %v", err)
+			break
+		}
+		if requestedAt != nil {
+			u.RequestedAt = requestedAt.UTC()
+		}
+		if u.ExpiresAt != nil {
+			*u.ExpiresAt = u.ExpiresAt.UTC()
+			r.expiresAt = u.ExpiresAt.Format(time.RFC3339)
+			// not swept yet
+			if !u.ExpiresAt.After(now) {
+				u.Active = false
+			}
+		}
+		batch = append(batch, r)
+		if len(batch) == adminExportFlushRows {
+			err = writeBatch()
+		}
+	}
+	if err == nil {
+		if err = rows.Err(); err != nil {
+			err = fmt.Errorf("failed exporting users: %v", err)
+		}
+	}
+	if err == nil && len(batch) > 0 {
+		err = writeBatch()
+	}
+	c.Writer.Header().Set("X-Row-Count", strconv.Itoa(count))
+	if err != nil {
+		requestLog(c).Error(err)
+		c.Writer.Header().Set("X-Export-Error", "export incomplete")
+		return
+	}
+	if format != "csv" {
+		c.Writer.WriteString("]\n")
+	}
+	requestLog(c).Infof("admin %s exported %d users", c.GetString("admin"), count)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAdminExport(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		want   []string
+	}{
+		{name: "active", target: "/export?format=json", want: []string{"foo"}},
+		{name: "include inactive", target: "/export?format=json&include_inactive=1", want: []string{"bar", "foo"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := newTestRustle(t)
+			addTestUser(t, ur, TWITCHSERVICE, "foo")
+			addTestUser(t, ur, TWITCHSERVICE, "bar")
+			if err := ur.DeleteUser("bar", TWITCHSERVICE, "bar-id"); err != nil {
+				t.Fatal(err)
+			}
+			router := gin.New()
+			router.GET("/export", ur.adminExportHandler)
+			w := testRequest(router, http.MethodGet, tt.target, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			var users []AdminUser
+			if err := json.Unmarshal(w.Body.Bytes(), &users); err != nil {
+				t.Fatalf("%v: %s", err, w.Body)
+			}
+			got := map[string]bool{}
+			for _, u := range users {
+				got[u.Name] = true
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for _, name := range tt.want {
+				if !got[name] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAdminExportStopsOnErrors(t *testing.T) {
+	ur := newTestRustle(t)
+	id := addTestUser(t, ur, TWITCHSERVICE, "foo")
+	if err := ur.db.Model(&User{}).Where("id = ?", id).Update("all_channels", false).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := ur.db.Migrator().DropTable(&OptOutChannel{}); err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.GET("/export", ur.adminExportHandler)
+	w := testRequest(router, http.MethodGet, "/export?format=json", nil)
+	if got := w.Body.String(); got != "[" {
+		t.Fatalf("got %q, want the stream to stop after [", got)
+	}
+	if w.Result().Trailer.Get("X-Export-Error") == "" {
+		t.Fatal("the X-Export-Error trailer isn't set")
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCheckBatchLimit = 1000
+	// deletedPageSize is the default and deletedMaxPageSize the largest limit
+	// of /api/v1/deleted
+	deletedPageSize    = 1000
+	deletedMaxPageSize = 10000
+	// checkBytesPerName bounds the body of /api/v1/check, a name plus its
+	// JSON quoting
+	checkBytesPerName = 128
+)
+
+// MeUser is a logged in account as returned by /api/me
+type MeUser struct {
+	// Name is lowercased, names are matched case-insensitively
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+	// Deleting is set if the user's logs are opted out
+	Deleting bool `json:"deleting"`
+	// DeletingSince is when the opt-out was first requested
+	DeletingSince *time.Time `json:"deletingSince,omitempty"`
+	// ExpiresAt is when the opt-out ends, unset if it's permanent
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// AllChannels is unset if the opt-out only covers Channels
+	AllChannels bool     `json:"allChannels"`
+	Channels    []string `json:"channels,omitempty"`
+	Email       string   `json:"email,omitempty"`
+}
+
+// meHandler reports the session of every provider, null if the visitor
+// isn't logged in with it. The email is only included with include_email=1,
+// if it can't be decrypted the answer is a 500 email_unavailable.
+func (ur *UnRustleLogs) meHandler(c *gin.Context) {
+	includeEmail := c.Query("include_email") == "1"
+	me := make(map[string]*MeUser, len(ur.providers))
+	for _, p := range ur.providers {
+		user, ok := ur.getUserFromJWT(c, p.CookieName())
+		if !ok {
+			me[p.Service()] = nil
+			continue
+		}
+		if includeEmail {
+			// the session ignores emails that can't be decrypted
+			if _, err := ur.GetUser(user.ID); errors.Is(err, errEmailDecrypt) {
+				apiError(c, http.StatusInternalServerError, codeEmailUnavailable, fmt.Sprintf("the email of the %s user can't be read", p.Name()))
+				return
+			}
+		}
+		me[p.Service()] = ur.meUser(user, includeEmail)
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, me)
+}
+
+// meUser is the opt-out state of the user as reported by the API.
+func (ur *UnRustleLogs) meUser(user *User, includeEmail bool) *MeUser {
+	_, deleting := ur.UserIDInDatabase(user.UserID, user.Name, user.Service)
+	u := &MeUser{
+		Name:        user.Name,
+		DisplayName: user.DisplayName,
+		Deleting:    deleting,
+		AllChannels: user.AllChannels,
+	}
+	if !user.AllChannels {
+		channels, err := ur.UserChannels(user.ID)
+		if err != nil {
+			logrus.Errorf("failed getting channels of %s user %s: %v", user.Service, user.Name, err)
+		}
+		u.Channels = channels
+	}
+	if deleting && !user.RequestedAt.IsZero() {
+		since := user.RequestedAt.UTC()
+		u.DeletingSince = &since
+		u.ExpiresAt = user.ExpiresAt
+	}
+	if includeEmail {
+		u.Email = user.Email
+	}
+	return u
+}
+
+// CheckRequest is the body of /api/v1/check
+type CheckRequest struct {
+	Service string   `json:"service"`
+	Names   []string `json:"names"`
+	// Channel is optional, without it opt-outs of single channels count too
+	Channel string `json:"channel"`
+}
+
+// checkHandler reports which of up to server.check_batch_limit names opted
+// out of service, in the channel if there is one, keyed by the lowercased
+// name.
+func (ur *UnRustleLogs) checkHandler(c *gin.Context) {
+	limit := ur.config.Server.CheckBatchLimit
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(limit*checkBytesPerName+1024))
+	var req CheckRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			apiError(c, http.StatusRequestEntityTooLarge, codePayloadTooLarge, fmt.Sprintf("at most %d names can be checked at once", limit))
+			return
+		}
+		apiError(c, http.StatusBadRequest, codeBadRequest, "expected {\"service\": ..., \"names\": [...]}")
+		return
+	}
+	if len(req.Names) > limit {
+		apiError(c, http.StatusRequestEntityTooLarge, codePayloadTooLarge, fmt.Sprintf("at most %d names can be checked at once", limit))
+		return
+	}
+	if _, ok := ur.provider(req.Service); !ok {
+		apiError(c, http.StatusBadRequest, codeUnknownService, fmt.Sprintf("unknown service %q", req.Service))
+		return
+	}
+	if req.Channel != "" {
+		channel, err := normalizeChannel(req.Channel)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("invalid channel %q: %v", req.Channel, err))
+			return
+		}
+		req.Channel = channel
+	}
+	result, err := ur.UsersInDatabase(req.Names, req.Service, req.Channel)
+	if err != nil {
+		requestLog(c).Errorf("failed checking %d %s users: %v", len(req.Names), req.Service, err)
+		apiError(c, http.StatusInternalServerError, codeInternal, "failed checking users")
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, result)
+}
+
+// deletedHandler lists the active opt-outs of a service by name, limit at a
+// time, optionally only the ones covering channel. The cursor of the next
+// page is sent in X-Next-Cursor and a Link header until the last page. Polls
+// with the ETag of an unchanged page in If-None-Match get a 304. With since
+// only the changes after it are listed, see changesHandler.
+func (ur *UnRustleLogs) deletedHandler(c *gin.Context) {
+	service := c.Param("service")
+	if _, ok := ur.provider(service); !ok {
+		apiError(c, http.StatusNotFound, codeUnknownService, fmt.Sprintf("unknown service %q", service))
+		return
+	}
+	limit := deletedPageSize
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > deletedMaxPageSize {
+			apiError(c, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("limit has to be between 1 and %d", deletedMaxPageSize))
+			return
+		}
+		limit = n
+	}
+	if since, ok := c.GetQuery("since"); ok {
+		ur.changesHandler(c, service, since, limit)
+		return
+	}
+	after, err := decodeCursor(c.Query("cursor"))
+	if err != nil {
+		apiError(c, http.StatusBadRequest, codeBadRequest, "invalid cursor")
+		return
+	}
+	channel := c.Query("channel")
+	if channel != "" {
+		if channel, err = normalizeChannel(channel); err != nil {
+			apiError(c, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("invalid channel: %v", err))
+			return
+		}
+	}
+	lastChange, err := ur.lastChangeID()
+	if err != nil {
+		requestLog(c).Errorf("failed getting the last opt-out change: %v", err)
+		apiError(c, http.StatusInternalServerError, codeInternal, "failed listing opt-outs")
+		return
+	}
+	version, err := ur.OptOutsVersion(lastChange, service, channel)
+	if err != nil {
+		requestLog(c).Errorf("failed getting %s opt-outs version: %v", service, err)
+		apiError(c, http.StatusInternalServerError, codeInternal, "failed listing opt-outs")
+		return
+	}
+	// the changes since it are what a client has to apply to the list
+	c.Header("X-Change-Cursor", strconv.FormatUint(uint64(lastChange), 10))
+	etag := deletedETag(version, c.Request.URL.RawQuery)
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "no-cache")
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	// one more tells whether there is a next page
+	optOuts, err := ur.ListOptOuts(service, channel, after, limit+1)
+	if err != nil {
+		requestLog(c).Errorf("failed listing %s opt-outs: %v", service, err)
+		apiError(c, http.StatusInternalServerError, codeInternal, "failed listing opt-outs")
+		return
+	}
+	if len(optOuts) > limit {
+		optOuts = optOuts[:limit]
+		q := c.Request.URL.Query()
+		q.Set("cursor", encodeCursor(optOuts[len(optOuts)-1].Name))
+		next := c.Request.URL.Path + "?" + q.Encode()
+		c.Header("X-Next-Cursor", q.Get("cursor"))
+		c.Header("Link", "<"+next+">; rel=\"next\"")
+	}
+	c.JSON(http.StatusOK, optOuts)
+}
+
+// deletedNameHandler answers 204 if the name is actively opted out of the
+// service, optionally covering channel, and 404 if it isn't. gin can't route
+// /deleted/:service/:name next to /deleted/:service/bloom, so the name bloom
+// is the Bloom filter, it can be checked with /api/v1/check.
+func (ur *UnRustleLogs) deletedNameHandler(c *gin.Context) {
+	if c.Param("name") == "bloom" {
+		if ur.allowScope(c, scopeList) {
+			ur.bloomHandler(c)
+		}
+		return
+	}
+	if !ur.allowScope(c, scopeCheck) {
+		return
+	}
+	service := c.Param("service")
+	if _, ok := ur.provider(service); !ok {
+		apiError(c, http.StatusNotFound, codeUnknownService, fmt.Sprintf("unknown service %q", service))
+		return
+	}
+	channel := c.Query("channel")
+	if channel != "" {
+		var err error
+		if channel, err = normalizeChannel(channel); err != nil {
+			apiError(c, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("invalid channel: %v", err))
+			return
+		}
+	}
+	c.Header("Cache-Control", "max-age=30")
+	if _, ok := ur.UserInDatabase(c.Param("name"), service, channel); !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// changesHandler lists the opt-out changes of service after since, limit at
+// a time. Channels aren't tracked by the changes.
+func (ur *UnRustleLogs) changesHandler(c *gin.Context, service, since string, limit int) {
+	if c.Query("channel") != "" || c.Query("cursor") != "" {
+		apiError(c, http.StatusBadRequest, codeBadRequest, "since can't be combined with channel or cursor")
+		return
+	}
+	page, err := ur.ListChanges(service, since, limit)
+	if errors.Is(err, errChangeSince) {
+		apiError(c, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		requestLog(c).Errorf("failed listing %s opt-out changes: %v", service, err)
+		apiError(c, http.StatusInternalServerError, codeInternal, "failed listing opt-out changes")
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, page)
+}
+
+// deletedETag ties the version of the opt-outs to the page that was asked for.
+func deletedETag(version, query string) string {
+	sum := sha256.Sum256([]byte(version + "\x00" + query))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether the If-None-Match header contains etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeCursor hides that cursors are names, clients shouldn't build them.
+func encodeCursor(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	name, err := base64.RawURLEncoding.DecodeString(cursor)
+	return string(name), err
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func TestMeHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		loggedIn bool
+		optedIn  bool
+		query    string
+		want     map[string]*MeUser
+	}{
+		{name: "logged out", want: map[string]*MeUser{TWITCHSERVICE: nil, DESTINYGGSERVICE: nil}},
+		{
+			name:     "opted out",
+			loggedIn: true,
+			want:     map[string]*MeUser{TWITCHSERVICE: {Name: "foo", DisplayName: "Foo", Deleting: true, AllChannels: true}, DESTINYGGSERVICE: nil},
+		},
+		{
+			name:     "opted in",
+			loggedIn: true,
+			optedIn:  true,
+			want:     map[string]*MeUser{TWITCHSERVICE: {Name: "foo", DisplayName: "Foo", AllChannels: true}, DESTINYGGSERVICE: nil},
+		},
+		{
+			name:     "with the email",
+			loggedIn: true,
+			optedIn:  true,
+			query:    "?include_email=1",
+			want:     map[string]*MeUser{TWITCHSERVICE: {Name: "foo", DisplayName: "Foo", AllChannels: true, Email: "foo@example.com"}, DESTINYGGSERVICE: nil},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := newTestRustle(t)
+			router := newTestRouter(t, ur)
+			id, _, err := ur.AddUser(TWITCHSERVICE, &Identity{UserID: "foo-id", Name: "Foo", DisplayName: "Foo", Email: "foo@example.com"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.optedIn {
+				if err := ur.DeleteUser("foo", TWITCHSERVICE, "foo-id"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var cookies []*http.Cookie
+			if tt.loggedIn {
+				cookies = append(cookies, sessionCookie(t, ur, testProvider(t, ur, TWITCHSERVICE), id))
+			}
+			w := testRequest(router, http.MethodGet, "/api/me"+tt.query, nil, cookies...)
+			if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "no-store" {
+				t.Fatalf("status %d with Cache-Control %q", w.Code, w.Header().Get("Cache-Control"))
+			}
+			var got map[string]*MeUser
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if u := got[TWITCHSERVICE]; u != nil {
+				if u.Deleting != (u.DeletingSince != nil) {
+					t.Fatalf("deleting %v since %v", u.Deleting, u.DeletingSince)
+				}
+				u.DeletingSince = nil
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %s", w.Body)
+			}
+		})
+	}
+}
+
+func TestMeHandlerUndecryptableEmail(t *testing.T) {
+	ur := newTestRustle(t)
+	router := newTestRouter(t, ur)
+	useEmailKeys(t, ur, testEmailKey)
+	id, _, err := ur.AddUser(TWITCHSERVICE, &Identity{UserID: "foo-id", Name: "foo", Email: "foo@example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the key is gone, the email can't be decrypted
+	useEmailKeys(t, ur, testEmailNewKey)
+	cookie := sessionCookie(t, ur, testProvider(t, ur, TWITCHSERVICE), id)
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{query: "", status: http.StatusOK},
+		{query: "?include_email=1", status: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		w := testRequest(router, http.MethodGet, "/api/me"+tt.query, nil, cookie)
+		if w.Code != tt.status {
+			t.Fatalf("%q: status %d, want %d: %s", tt.query, w.Code, tt.status, w.Body)
+		}
+		if tt.status != http.StatusOK && !strings.Contains(w.Body.String(), codeEmailUnavailable) {
+			t.Fatalf("%q: got %s, want %s", tt.query, w.Body, codeEmailUnavailable)
+		}
+	}
+}
+
+// postCheck sends body as JSON to the check handler of ur.
+func postCheck(ur *UnRustleLogs, body string) *httptest.ResponseRecorder {
+	router := gin.New()
+	router.POST("/check", ur.checkHandler)
+	req := httptest.NewRequest(http.MethodPost, "/check", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestCheckHandler(t *testing.T) {
+	tooMany, _ := json.Marshal(CheckRequest{Service: TWITCHSERVICE, Names: make([]string, 3)})
+	tests := []struct {
+		name   string
+		body   string
+		limit  int
+		status int
+		want   map[string]bool
+	}{
+		{
+			name:   "mixed case",
+			body:   `{"service": "twitch", "names": ["foo", "Bar", "baz", "FOO"]}`,
+			limit:  4,
+			status: http.StatusOK,
+			want:   map[string]bool{"foo": true, "bar": true, "baz": false},
+		},
+		{name: "no names", body: `{"service": "twitch", "names": []}`, status: http.StatusOK, want: map[string]bool{}},
+		{name: "other service", body: `{"service": "destinygg", "names": ["foo"]}`, status: http.StatusOK, want: map[string]bool{"foo": false}},
+		{name: "unknown service", body: `{"service": "myspace", "names": ["foo"]}`, status: http.StatusBadRequest},
+		{name: "not json", body: `foo`, status: http.StatusBadRequest},
+		{name: "over the limit", body: string(tooMany), status: http.StatusRequestEntityTooLarge},
+		{name: "body over the limit", body: `{"service": "twitch", "names": ["` + strings.Repeat("a", 2*checkBytesPerName+1024) + `"]}`, status: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := newTestRustle(t)
+			ur.config.Server.CheckBatchLimit = 2
+			if tt.limit != 0 {
+				ur.config.Server.CheckBatchLimit = tt.limit
+			}
+			addTestUser(t, ur, TWITCHSERVICE, "foo")
+			addTestUser(t, ur, TWITCHSERVICE, "bar")
+			w := postCheck(ur, tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.want == nil {
+				return
+			}
+			var got map[string]bool
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// countQueries counts the queries ur runs from now on.
+func countQueries(t *testing.T, ur *UnRustleLogs) *int64 {
+	t.Helper()
+	var queries int64
+	err := ur.db.Callback().Query().After("gorm:query").Register("test:count", func(*gorm.DB) {
+		atomic.AddInt64(&queries, 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &queries
+}
+
+// checkNames are n names, every other one opted out of twitch.
+func checkNames(t testing.TB, ur *UnRustleLogs, n int) []string {
+	t.Helper()
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("user%d", i)
+		if i%2 == 0 {
+			if _, _, err := ur.AddUser(TWITCHSERVICE, &Identity{Name: names[i]}, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return names
+}
+
+// getDeleted polls target of the deleted list with ifNoneMatch.
+func getDeleted(ur *UnRustleLogs, target, ifNoneMatch string) *httptest.ResponseRecorder {
+	router := gin.New()
+	router.GET("/deleted/:service", ur.deletedHandler)
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestDeletedETag(t *testing.T) {
+	ur := newTestRustle(t)
+	addTestUser(t, ur, TWITCHSERVICE, "foo")
+	target := "/deleted/" + TWITCHSERVICE
+	var etag string
+	steps := []struct {
+		name   string
+		change func()
+		// fresh polls without If-None-Match
+		fresh bool
+		code  int
+		names []string
+	}{
+		{name: "first poll", fresh: true, code: http.StatusOK, names: []string{"foo"}},
+		{name: "unchanged", code: http.StatusNotModified},
+		{name: "delete", change: func() { addTestUser(t, ur, TWITCHSERVICE, "bar") }, code: http.StatusOK, names: []string{"bar", "foo"}},
+		{name: "unchanged after delete", code: http.StatusNotModified},
+		{name: "undelete", change: func() {
+			if err := ur.DeleteUser("bar", TWITCHSERVICE, "bar-id"); err != nil {
+				t.Fatal(err)
+			}
+		}, code: http.StatusOK, names: []string{"foo"}},
+		{name: "delete again", change: func() { addTestUser(t, ur, TWITCHSERVICE, "bar") }, code: http.StatusOK, names: []string{"bar", "foo"}},
+		// the change id is shared by every service
+		{name: "other service", change: func() { addTestUser(t, ur, DESTINYGGSERVICE, "baz") }, code: http.StatusOK, names: []string{"bar", "foo"}},
+		{name: "wildcard", change: func() { etag = "*" }, code: http.StatusNotModified},
+	}
+	for _, step := range steps {
+		if step.change != nil {
+			step.change()
+		}
+		ifNoneMatch := etag
+		if step.fresh {
+			ifNoneMatch = ""
+		}
+		w := getDeleted(ur, target, ifNoneMatch)
+		if w.Code != step.code {
+			t.Fatalf("%s: got %d, want %d", step.name, w.Code, step.code)
+		}
+		if w.Header().Get("ETag") == "" {
+			t.Fatalf("%s: no ETag", step.name)
+		}
+		if step.code == http.StatusNotModified {
+			if w.Body.Len() != 0 {
+				t.Fatalf("%s: 304 with a body", step.name)
+			}
+			continue
+		}
+		if w.Header().Get("ETag") == etag {
+			t.Fatalf("%s: the ETag didn't change", step.name)
+		}
+		etag = w.Header().Get("ETag")
+		var optOuts []struct{ Name string }
+		if err := json.Unmarshal(w.Body.Bytes(), &optOuts); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, optOut := range optOuts {
+			names = append(names, optOut.Name)
+		}
+		if !reflect.DeepEqual(names, step.names) {
+			t.Fatalf("%s: listed %v, want %v", step.name, names, step.names)
+		}
+	}
+
+	// every page has its own ETag
+	first := getDeleted(ur, target+"?limit=1", "").Header().Get("ETag")
+	if first == getDeleted(ur, target, "").Header().Get("ETag") {
+		t.Fatal("pages share an ETag")
+	}
+	if w := getDeleted(ur, target, first); w.Code != http.StatusOK {
+		t.Fatalf("the ETag of another page got %d", w.Code)
+	}
+
+	// channel settings aren't changes but change the lists of channels
+	channel := getDeleted(ur, target+"?channel=destiny", "").Header().Get("ETag")
+	id, _ := ur.UserInDatabase("foo", TWITCHSERVICE, "")
+	if err := ur.SetUserChannels(id, false, []string{"xqc"}); err != nil {
+		t.Fatal(err)
+	}
+	if w := getDeleted(ur, target+"?channel=destiny", channel); w.Code != http.StatusOK {
+		t.Fatalf("the channel list got %d after the channels changed", w.Code)
+	}
+}
+
+func TestUsersInDatabaseIsOneQuery(t *testing.T) {
+	ur := newTestRustle(t)
+	names := checkNames(t, ur, defaultCheckBatchLimit)
+	queries := countQueries(t, ur)
+	found, err := ur.UsersInDatabase(names, TWITCHSERVICE, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *queries != 1 {
+		t.Fatalf("%d queries, want 1", *queries)
+	}
+	if len(found) != len(names) || !found["user0"] || found["user1"] {
+		t.Fatalf("got %d results", len(found))
+	}
+}
+
+func BenchmarkCheckHandler(b *testing.B) {
+	ur := newTestRustle(b)
+	ur.config.Server.CheckBatchLimit = defaultCheckBatchLimit
+	body, err := json.Marshal(CheckRequest{Service: TWITCHSERVICE, Names: checkNames(b, ur, defaultCheckBatchLimit)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if w := postCheck(ur, string(body)); w.Code != http.StatusOK {
+			b.Fatalf("status %d", w.Code)
+		}
+	}
+}
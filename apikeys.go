@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	// scopeCheck allows POST /api/v1/check, scopeList GET /api/v1/deleted and
+	// scopeStats GET /stats when api.stats_require_key is set
+	scopeCheck = "check"
+	scopeList  = "list"
+	scopeStats = "stats"
+
+	apiKeySourceConfig = "config"
+	// minAPIKeyLength keeps guessable keys out of the config
+	minAPIKeyLength = 32
+	apiKeyBytes     = 32
+	apiKeyContext   = "api_key"
+)
+
+var apiScopes = []string{scopeCheck, scopeList, scopeStats}
+
+// APIKey is a key of the programmatic API, only the sha256 of the key is
+// stored.
+type APIKey struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	Label     string
+	KeyHash   string
+	// Scopes are comma separated
+	Scopes string
+	// Source is config for the keys seeded from api.keys
+	Source string
+}
+
+// TableName ...
+func (APIKey) TableName() string {
+	return "api_keys"
+}
+
+// APIKeyConfig ...
+type APIKeyConfig struct {
+	Label   string
+	Key     string
+	KeyFile string `toml:"key_file"`
+	Scopes  []string
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (k *APIKey) hasScope(scope string) bool {
+	for _, s := range strings.Split(k.Scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeysRequired reports whether /api/v1 needs a key, unless
+// api.require_keys is false it does.
+func (ur *UnRustleLogs) apiKeysRequired() bool {
+	return ur.config.API.RequireKeys == nil || *ur.config.API.RequireKeys
+}
+
+// setupAPIKeys stores the keys of api.keys, replacing the ones seeded
+// before, and loads every key.
+func (ur *UnRustleLogs) setupAPIKeys() error {
+	seen := make(map[string]bool, len(ur.config.API.Keys))
+	rows := make([]APIKey, 0, len(ur.config.API.Keys))
+	for i, k := range ur.config.API.Keys {
+		if k.Label == "" || seen[k.Label] {
+			return fmt.Errorf("api.keys[%d]: every key needs a unique label", i)
+		}
+		seen[k.Label] = true
+		if len(k.Key) < minAPIKeyLength {
+			return fmt.Errorf("api key %q must be at least %d characters, generate one with ./unrustlelogs apikey", k.Label, minAPIKeyLength)
+		}
+		if len(k.Scopes) == 0 {
+			return fmt.Errorf("api key %q has no scopes, use %s", k.Label, strings.Join(apiScopes, ", "))
+		}
+		for _, scope := range k.Scopes {
+			if !validScope(scope) {
+				return fmt.Errorf("api key %q has unknown scope %q, use %s", k.Label, scope, strings.Join(apiScopes, ", "))
+			}
+		}
+		rows = append(rows, APIKey{
+			Label:   k.Label,
+			KeyHash: hashAPIKey(k.Key),
+			Scopes:  strings.Join(k.Scopes, ","),
+			Source:  apiKeySourceConfig,
+		})
+	}
+	err := ur.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("source = ?", apiKeySourceConfig).Delete(&APIKey{}).Error; err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		return tx.Create(&rows).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed seeding api keys: %v", err)
+	}
+	if err := ur.loadAPIKeys(); err != nil {
+		return err
+	}
+	if ur.apiKeysRequired() && len(ur.apiKeys) == 0 {
+		logrus.Warn("no api keys configured, /api/v1 answers every request with 401")
+	}
+	return nil
+}
+
+func validScope(scope string) bool {
+	for _, s := range apiScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// loadAPIKeys replaces the keys in memory with the ones in the database.
+func (ur *UnRustleLogs) loadAPIKeys() error {
+	var keys []APIKey
+	if err := ur.db.Find(&keys).Error; err != nil {
+		return fmt.Errorf("failed loading api keys: %v", err)
+	}
+	ur.apiKeyMutex.Lock()
+	ur.apiKeys = keys
+	ur.apiKeyMutex.Unlock()
+	return nil
+}
+
+// findAPIKey compares the hash with every key so the time taken doesn't
+// depend on which key, if any, matched.
+func (ur *UnRustleLogs) findAPIKey(key string) (*APIKey, bool) {
+	hash := []byte(hashAPIKey(key))
+	ur.apiKeyMutex.RLock()
+	defer ur.apiKeyMutex.RUnlock()
+	var found *APIKey
+	for i := range ur.apiKeys {
+		if subtle.ConstantTimeCompare(hash, []byte(ur.apiKeys[i].KeyHash)) == 1 {
+			found = &ur.apiKeys[i]
+		}
+	}
+	return found, found != nil
+}
+
+// apiKeyAuth returns a middleware requiring an api key as
+// "Authorization: Bearer <key>" if required is set.
+func (ur *UnRustleLogs) apiKeyAuth(required bool) gin.HandlerFunc {
+	if !required {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return ur.apiKeyMiddleware
+}
+
+func (ur *UnRustleLogs) apiKeyMiddleware(c *gin.Context) {
+	key, bearer := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	key = strings.TrimSpace(key)
+	if !bearer || key == "" {
+		c.Header("WWW-Authenticate", `Bearer realm="unrustlelogs"`)
+		apiError(c, http.StatusUnauthorized, codeUnauthorized, "missing api key, send it as Authorization: Bearer <key>")
+		return
+	}
+	apiKey, ok := ur.findAPIKey(key)
+	if !ok {
+		c.Header("WWW-Authenticate", `Bearer realm="unrustlelogs", error="invalid_token"`)
+		apiError(c, http.StatusUnauthorized, codeInvalidAPIKey, "invalid api key")
+		return
+	}
+	c.Set(apiKeyContext, apiKey)
+	c.Next()
+}
+
+// requireScope rejects keys without scope after apiKeyAuth, requests are let
+// through if apiKeyAuth didn't require a key.
+func (ur *UnRustleLogs) requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ur.allowScope(c, scope) {
+			c.Next()
+		}
+	}
+}
+
+// allowScope is requireScope for handlers serving several scopes, the
+// request is aborted with a 403 if it returns false.
+func (ur *UnRustleLogs) allowScope(c *gin.Context, scope string) bool {
+	v, authed := c.Get(apiKeyContext)
+	if !authed {
+		return true
+	}
+	if apiKey, ok := v.(*APIKey); !ok || !apiKey.hasScope(scope) {
+		apiError(c, http.StatusForbidden, codeInsufficientScope, fmt.Sprintf("the api key lacks the %s scope", scope))
+		return false
+	}
+	return true
+}
+
+// apiKeyCommand prints a new random key to put in api.keys.
+func apiKeyCommand() {
+	key, err := generateSecureToken(apiKeyBytes)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	fmt.Fprintln(os.Stdout, key)
+}
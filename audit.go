@@ -0,0 +1,40 @@
+package main
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	auditRename          = "rename"
+	auditRenameDisplaced = "rename_displaced"
+)
+
+// AuditEntry records a change to a user that wasn't asked for directly,
+// e.g. a rename noticed at login.
+type AuditEntry struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	// UserRowID is the users id the entry is about
+	UserRowID string `gorm:"index"`
+	Service   string
+	Action    string
+	Detail    string
+}
+
+// TableName ...
+func (AuditEntry) TableName() string {
+	return "audit_log"
+}
+
+// audit writes an entry as part of tx.
+func audit(tx *gorm.DB, u *User, action, detail string) error {
+	return tx.Create(&AuditEntry{
+		CreatedAt: time.Now().UTC(),
+		UserRowID: u.ID,
+		Service:   u.Service,
+		Action:    action,
+		Detail:    detail,
+	}).Error
+}
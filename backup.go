@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// backupFormat is the version of the backup file layout. A backup is gzipped
+// JSON lines: a backupHeader, a backupLine per row and a backupLine trailer
+// with the row counts and the sha256 of every line before it.
+const backupFormat = 1
+
+// backupHeader is the first line of a backup
+type backupHeader struct {
+	Format        int       `json:"format"`
+	SchemaVersion int       `json:"schema_version"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// backupLine is a row of Table, or the trailer if SHA256 is set
+type backupLine struct {
+	Table  string          `json:"table,omitempty"`
+	Row    json.RawMessage `json:"row,omitempty"`
+	Rows   map[string]int  `json:"rows,omitempty"`
+	SHA256 string          `json:"sha256,omitempty"`
+}
+
+// backupUser is a users row as stored, emails stay encrypted so backups
+// need the same database.email_key. Keep it in sync with User.
+type backupUser struct {
+	ID            string `gorm:"primaryKey"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	Service       string
+	Name          string
+	DisplayName   string
+	Nick          string
+	UserID        string
+	Email         string
+	Active        bool
+	RequestedAt   time.Time
+	DeactivatedAt *time.Time
+	AllChannels   bool
+	ExpiresAt     *time.Time
+}
+
+// TableName ...
+func (backupUser) TableName() string {
+	return "users"
+}
+
+// backupTable is a table that is backed up, newRow returns a pointer to an
+// empty row of it.
+type backupTable struct {
+	name   string
+	newRow func() interface{}
+}
+
+// backupTables are restored in order. Sessions, tokens and oauth states are
+// left out, they only matter to running instances.
+var backupTables = []backupTable{
+	{"users", func() interface{} { return &backupUser{} }},
+	{"opt_out_channels", func() interface{} { return &OptOutChannel{} }},
+	{"account_links", func() interface{} { return &AccountLink{} }},
+	{"audit_log", func() interface{} { return &AuditEntry{} }},
+	{"opt_out_changes", func() interface{} { return &OptOutChange{} }},
+}
+
+// backupCommand runs the backup and restore subcommands against the
+// configured database and exits.
+func backupCommand(cmd string, args []string) {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	var path *string
+	if cmd == "backup" {
+		path = fs.String("out", "", "file to write the gzipped backup to")
+	} else {
+		path = fs.String("in", "", "backup file to restore into an empty database")
+	}
+	fs.Parse(args)
+	if *path == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	rustle := NewUnRustleLogs(context.Background())
+	rustle.LoadConfig("config.toml")
+	if err := rustle.setupEmailEncryption(); err != nil {
+		logrus.Fatal(err)
+	}
+	rustle.NewDatabase()
+	var err error
+	if cmd == "backup" {
+		err = rustle.backupToFile(*path)
+	} else {
+		err = rustle.restoreFromFile(*path)
+	}
+	if err != nil {
+		logrus.Fatalf("%s failed: %v", cmd, err)
+	}
+}
+
+// backupToFile writes the backup next to path first so a failed backup
+// never replaces a good one.
+func (ur *UnRustleLogs) backupToFile(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	counts, err := ur.backup(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	logrus.Infof("backed up %v to %s", counts, path)
+	return nil
+}
+
+// backup streams every backupTables row to w.
+func (ur *UnRustleLogs) backup(w io.Writer) (map[string]int, error) {
+	version, err := ur.schemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	zw := gzip.NewWriter(w)
+	sum := sha256.New()
+	out := io.MultiWriter(zw, sum)
+	enc := json.NewEncoder(out)
+	if err := enc.Encode(backupHeader{Format: backupFormat, SchemaVersion: version, CreatedAt: time.Now().UTC()}); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(backupTables))
+	// one repeatable read transaction keeps the tables consistent with each
+	// other, a read committed one would see changes between the tables
+	err = ur.db.Transaction(func(tx *gorm.DB) error {
+		for _, t := range backupTables {
+			n, err := backupRows(tx, t, enc)
+			if err != nil {
+				return fmt.Errorf("%s: %v", t.name, err)
+			}
+			counts[t.name] = n
+		}
+		return nil
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	trailer := backupLine{Rows: counts, SHA256: hex.EncodeToString(sum.Sum(nil))}
+	if err := json.NewEncoder(zw).Encode(trailer); err != nil {
+		return nil, err
+	}
+	return counts, zw.Close()
+}
+
+func backupRows(tx *gorm.DB, t backupTable, enc *json.Encoder) (int, error) {
+	rows, err := tx.Model(t.newRow()).Order("id").Rows()
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		row := t.newRow()
+		if err := tx.ScanRows(rows, row); err != nil {
+			return n, err
+		}
+		data, err := json.Marshal(row)
+		if err != nil {
+			return n, err
+		}
+		if err := enc.Encode(backupLine{Table: t.name, Row: data}); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+func (ur *UnRustleLogs) restoreFromFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	counts, err := ur.restore(f)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("restored %v from %s", counts, path)
+	return nil
+}
+
+// restore loads a backup into the database, which has to be empty and at
+// the schema version of the backup. Rows are inserted in one transaction
+// that is rolled back unless the checksum and row counts match.
+func (ur *UnRustleLogs) restore(r io.Reader) (map[string]int, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(zr)
+	sum := sha256.New()
+	line, err := readBackupLine(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading header: %v", err)
+	}
+	sum.Write(line)
+	var header backupHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %v", err)
+	}
+	if header.Format != backupFormat {
+		return nil, fmt.Errorf("unsupported backup format %d", header.Format)
+	}
+	version, err := ur.schemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if header.SchemaVersion != version {
+		return nil, fmt.Errorf("backup has schema version %d but the database %d, restore with the release that took the backup", header.SchemaVersion, version)
+	}
+	tables := make(map[string]backupTable, len(backupTables))
+	for _, t := range backupTables {
+		var n int64
+		if err := ur.db.Model(t.newRow()).Count(&n).Error; err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			return nil, fmt.Errorf("%s is not empty, restore into a new database", t.name)
+		}
+		tables[t.name] = t
+	}
+
+	counts := make(map[string]int, len(backupTables))
+	err = ur.db.Transaction(func(tx *gorm.DB) error {
+		for {
+			line, err := readBackupLine(br)
+			if err == io.EOF {
+				return errors.New("backup is truncated, the trailer is missing")
+			}
+			if err != nil {
+				return err
+			}
+			var l backupLine
+			if err := json.Unmarshal(line, &l); err != nil {
+				return fmt.Errorf("invalid line: %v", err)
+			}
+			if l.SHA256 != "" {
+				if err := checkBackupTrailer(l, sum, counts); err != nil {
+					return err
+				}
+				return resetChangeSequence(tx)
+			}
+			sum.Write(line)
+			t, ok := tables[l.Table]
+			if !ok {
+				return fmt.Errorf("unknown table %q", l.Table)
+			}
+			row := t.newRow()
+			if err := json.Unmarshal(l.Row, row); err != nil {
+				return fmt.Errorf("invalid %s row: %v", l.Table, err)
+			}
+			// the database assigns new ids, nothing references them. Change
+			// ids are the cursors of clients and kept.
+			switch row := row.(type) {
+			case *OptOutChannel:
+				row.ID = 0
+			case *AccountLink:
+				row.ID = 0
+			case *AuditEntry:
+				row.ID = 0
+			}
+			if err := tx.Create(row).Error; err != nil {
+				return fmt.Errorf("failed inserting %s row: %v", l.Table, err)
+			}
+			counts[l.Table]++
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// readBackupLine reads the next line including the newline, lines aren't
+// limited in length.
+func readBackupLine(br *bufio.Reader) ([]byte, error) {
+	line, err := br.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		return nil, errors.New("backup is truncated mid-line")
+	}
+	return line, err
+}
+
+// checkBackupTrailer compares the trailer with the lines read before it.
+func checkBackupTrailer(l backupLine, sum hash.Hash, counts map[string]int) error {
+	if got := hex.EncodeToString(sum.Sum(nil)); got != l.SHA256 {
+		return fmt.Errorf("checksum mismatch, the backup is corrupt: got %s, want %s", got, l.SHA256)
+	}
+	for table, n := range l.Rows {
+		if counts[table] != n {
+			return fmt.Errorf("backup has %d %s rows but the trailer says %d", counts[table], table, n)
+		}
+	}
+	return nil
+}
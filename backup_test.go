@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newBackupRustle is a database with rows in every backed up table.
+func newBackupRustle(t *testing.T) *UnRustleLogs {
+	t.Helper()
+	ur := newTestRustle(t)
+	foo := addTestUser(t, ur, TWITCHSERVICE, "foo")
+	bar := addTestUser(t, ur, DESTINYGGSERVICE, "bar")
+	addTestUser(t, ur, TWITCHSERVICE, "baz")
+	if err := ur.DeleteUser("baz", TWITCHSERVICE, "baz-id"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ur.SetUserChannels(foo, false, []string{"destiny"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ur.LinkAccounts(foo, bar); err != nil {
+		t.Fatal(err)
+	}
+	if err := ur.RenameUser(DESTINYGGSERVICE, bar, "qux"); err != nil {
+		t.Fatal(err)
+	}
+	return ur
+}
+
+// gunzip and regzip let tests change the lines of a backup.
+func gunzip(t *testing.T, data []byte) string {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(plain)
+}
+
+func regzip(t *testing.T, plain string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(plain)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	ur := newBackupRustle(t)
+	path := filepath.Join(t.TempDir(), "backup.json.gz")
+	if err := ur.backupToFile(path); err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestRustle(t)
+	if err := restored.restoreFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range backupTables {
+		var want, got int64
+		ur.db.Model(table.newRow()).Count(&want)
+		restored.db.Model(table.newRow()).Count(&got)
+		if want == 0 || got != want {
+			t.Errorf("%s: restored %d of %d rows", table.name, got, want)
+		}
+	}
+	var want, got []backupUser
+	ur.db.Order("id").Find(&want)
+	restored.db.Order("id").Find(&got)
+	// sqlite hands the times back in the local zone of the backup
+	for _, users := range [][]backupUser{want, got} {
+		for i := range users {
+			u := &users[i]
+			u.CreatedAt, u.UpdatedAt, u.RequestedAt = u.CreatedAt.UTC(), u.UpdatedAt.UTC(), u.RequestedAt.UTC()
+			for _, at := range []**time.Time{&u.DeactivatedAt, &u.ExpiresAt} {
+				if *at != nil {
+					utc := (*at).UTC()
+					*at = &utc
+				}
+			}
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored users differ:\n%+v\n%+v", got, want)
+	}
+	foo, _ := restored.UserInDatabase("foo", TWITCHSERVICE, "destiny")
+	if linked, ok := restored.LinkedUser(foo); !ok || linked.Name != "qux" {
+		t.Fatal("the link wasn't restored")
+	}
+	if _, ok := restored.UserInDatabase("foo", TWITCHSERVICE, "other"); ok {
+		t.Fatal("the channels of foo weren't restored")
+	}
+}
+
+func TestRestoreRejects(t *testing.T) {
+	ur := newBackupRustle(t)
+	var buf bytes.Buffer
+	if _, err := ur.backup(&buf); err != nil {
+		t.Fatal(err)
+	}
+	plain := gunzip(t, buf.Bytes())
+	lines := strings.SplitAfter(plain, "\n")
+	tests := []struct {
+		name   string
+		backup []byte
+		// into is the database restored into, a new one if nil
+		into *UnRustleLogs
+	}{
+		{name: "a non-empty database", backup: buf.Bytes(), into: ur},
+		{name: "a changed row", backup: regzip(t, strings.Replace(plain, `"foo"`, `"fob"`, 1))},
+		{name: "a missing row", backup: regzip(t, strings.Join(append(lines[:1:1], lines[2:]...), ""))},
+		{name: "a missing trailer", backup: regzip(t, strings.Join(lines[:len(lines)-2], ""))},
+		{name: "a truncated line", backup: regzip(t, plain[:len(plain)-10])},
+		{name: "a newer schema", backup: regzip(t, strings.Replace(plain, `"schema_version":`, `"schema_version":1`, 1))},
+		{name: "not gzip", backup: []byte(plain)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			into := tt.into
+			if into == nil {
+				into = newTestRustle(t)
+			}
+			if _, err := into.restore(bytes.NewReader(tt.backup)); err == nil {
+				t.Fatal("restore succeeded")
+			}
+			if tt.into != nil {
+				return
+			}
+			var users int64
+			into.db.Model(&User{}).Count(&users)
+			if users != 0 {
+				t.Fatalf("%d users were restored from the rejected backup", users)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tensei/unrustlelogs/client"
+)
+
+const (
+	defaultBloomFPR = 0.001
+	minBloomFPR     = 0.000001
+	maxBloomFPR     = 0.5
+	// maxCachedBlooms bounds the filters kept for different services and
+	// false positive rates
+	maxCachedBlooms = 32
+)
+
+// bloomCache keeps the encoded filters until the opt-outs change.
+type bloomCache struct {
+	mu      sync.Mutex
+	filters map[string]*cachedBloom
+}
+
+type cachedBloom struct {
+	version string
+	etag    string
+	blob    []byte
+}
+
+// bloomHandler returns a Bloom filter of the names of the service's active
+// opt-outs, see the client package for the format. It's rebuilt once the
+// opt-outs changed, polls with its ETag in If-None-Match get a 304.
+func (ur *UnRustleLogs) bloomHandler(c *gin.Context) {
+	service := c.Param("service")
+	if _, ok := ur.provider(service); !ok {
+		apiError(c, http.StatusNotFound, codeUnknownService, fmt.Sprintf("unknown service %q", service))
+		return
+	}
+	fpr := defaultBloomFPR
+	if s := c.Query("fpr"); s != "" {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || f < minBloomFPR || f > maxBloomFPR {
+			apiError(c, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("fpr has to be between %g and %g", minBloomFPR, maxBloomFPR))
+			return
+		}
+		fpr = f
+	}
+	filter, err := ur.bloomFilter(service, fpr)
+	if err != nil {
+		requestLog(c).Errorf("failed building %s bloom filter: %v", service, err)
+		apiError(c, http.StatusInternalServerError, codeInternal, "failed building the bloom filter")
+		return
+	}
+	c.Header("ETag", filter.etag)
+	c.Header("Cache-Control", "no-cache")
+	if etagMatches(c.GetHeader("If-None-Match"), filter.etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/octet-stream", filter.blob)
+}
+
+// bloomFilter returns the cached filter of service unless its opt-outs
+// changed since it was built. Builds happen one at a time.
+func (ur *UnRustleLogs) bloomFilter(service string, fpr float64) (*cachedBloom, error) {
+	lastChange, err := ur.lastChangeID()
+	if err != nil {
+		return nil, err
+	}
+	version, err := ur.OptOutsVersion(lastChange, service, "")
+	if err != nil {
+		return nil, err
+	}
+	key := service + " fpr=" + strconv.FormatFloat(fpr, 'g', -1, 64)
+	ur.blooms.mu.Lock()
+	defer ur.blooms.mu.Unlock()
+	if cached, ok := ur.blooms.filters[key]; ok && cached.version == version {
+		return cached, nil
+	}
+	names, err := ur.OptOutNames(service)
+	if err != nil {
+		return nil, err
+	}
+	filter := client.NewBloom(len(names), fpr)
+	for _, name := range names {
+		filter.Add(name)
+	}
+	cached := &cachedBloom{version: version, etag: deletedETag(version, key)}
+	filter.SetETag(cached.etag)
+	if cached.blob, err = filter.MarshalBinary(); err != nil {
+		return nil, err
+	}
+	if ur.blooms.filters == nil {
+		ur.blooms.filters = make(map[string]*cachedBloom)
+	}
+	if _, ok := ur.blooms.filters[key]; !ok && len(ur.blooms.filters) >= maxCachedBlooms {
+		for k := range ur.blooms.filters {
+			delete(ur.blooms.filters, k)
+			break
+		}
+	}
+	ur.blooms.filters[key] = cached
+	return cached, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tensei/unrustlelogs/client"
+)
+
+func TestBloomHandler(t *testing.T) {
+	ur := newTestRustle(t)
+	addTestUser(t, ur, TWITCHSERVICE, "Foo")
+	router := gin.New()
+	router.GET("/bloom/:service", ur.bloomHandler)
+	get := func(target, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	load := func(w *httptest.ResponseRecorder) *client.Bloom {
+		t.Helper()
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", w.Code, w.Body)
+		}
+		filter, err := client.ParseBloom(w.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filter.ETag() != w.Header().Get("ETag") {
+			t.Fatalf("the filter has ETag %s, the response %s", filter.ETag(), w.Header().Get("ETag"))
+		}
+		return filter
+	}
+
+	target := "/bloom/" + TWITCHSERVICE
+	w := get(target, "")
+	filter := load(w)
+	if !filter.Contains("foo") || filter.Len() != 1 {
+		t.Fatalf("the filter of %d names misses foo", filter.Len())
+	}
+	cached := ur.blooms.filters[TWITCHSERVICE+" fpr=0.001"]
+	if w := get(target, filter.ETag()); w.Code != http.StatusNotModified {
+		t.Fatalf("unchanged filter got %d", w.Code)
+	}
+	if get(target, ""); ur.blooms.filters[TWITCHSERVICE+" fpr=0.001"] != cached {
+		t.Fatal("the filter was rebuilt without changes")
+	}
+
+	addTestUser(t, ur, TWITCHSERVICE, "bar")
+	if w := get(target, filter.ETag()); w.Code != http.StatusOK {
+		t.Fatalf("changed filter got %d", w.Code)
+	}
+	filter = load(get(target, ""))
+	if !filter.Contains("foo") || !filter.Contains("BAR") || filter.Len() != 2 {
+		t.Fatalf("the rebuilt filter of %d names misses a name", filter.Len())
+	}
+	if other := load(get(target+"?fpr=0.1", "")); other.ETag() == filter.ETag() {
+		t.Fatal("filters of different rates share an ETag")
+	}
+
+	for _, target := range []string{target + "?fpr=0", target + "?fpr=0.9", target + "?fpr=x", "/bloom/nope"} {
+		if w := get(target, ""); w.Code != http.StatusBadRequest && w.Code != http.StatusNotFound {
+			t.Errorf("%s got %d", target, w.Code)
+		}
+	}
+}
+
+func TestBloomRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		scopes []string
+		status int
+	}{
+		{name: "deleted path", target: "/api/v1/deleted/twitch/bloom", scopes: []string{scopeList}, status: http.StatusOK},
+		{name: "alias", target: "/api/v1/bloom/twitch", scopes: []string{scopeList}, status: http.StatusOK},
+		{name: "deleted path needs list", target: "/api/v1/deleted/twitch/bloom", scopes: []string{scopeCheck}, status: http.StatusForbidden},
+		{name: "alias needs list", target: "/api/v1/bloom/twitch", scopes: []string{scopeCheck}, status: http.StatusForbidden},
+		{name: "names need check", target: "/api/v1/deleted/twitch/foo", scopes: []string{scopeList}, status: http.StatusForbidden},
+		{name: "names", target: "/api/v1/deleted/twitch/foo", scopes: []string{scopeCheck}, status: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := newTestRustle(t)
+			addTestUser(t, ur, TWITCHSERVICE, "foo")
+			key := strings.Repeat("k", minAPIKeyLength)
+			ur.config.API.Keys = []APIKeyConfig{{Label: "test", Key: key, Scopes: tt.scopes}}
+			if err := ur.setupAPIKeys(); err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Header.Set("Authorization", "Bearer "+key)
+			w := httptest.NewRecorder()
+			newTestRouter(t, ur).ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("got %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusOK {
+				if _, err := client.ParseBloom(w.Body.Bytes()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerWindow    = time.Minute
+	defaultBreakerCooldown  = time.Second * 30
+)
+
+// circuitBreaker stops logins of a provider for a cooldown once its API
+// failed threshold times in a row within window.
+type circuitBreaker struct {
+	mu           sync.Mutex
+	threshold    int
+	window       time.Duration
+	cooldown     time.Duration
+	failures     int
+	firstFailure time.Time
+	openUntil    time.Time
+}
+
+// breakerStatus is the /status view of a breaker
+type breakerStatus struct {
+	State     string     `json:"state"`
+	Failures  int        `json:"failures"`
+	OpenUntil *time.Time `json:"open_until,omitempty"`
+}
+
+// allow reports whether calls may be made, false while the breaker is open.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !time.Now().Before(b.openUntil)
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+// failure records a failed call and reports whether it opened the breaker.
+func (b *circuitBreaker) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.failures == 0 || now.Sub(b.firstFailure) > b.window {
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures++
+	if b.failures < b.threshold {
+		return false
+	}
+	b.failures = 0
+	b.openUntil = now.Add(b.cooldown)
+	return true
+}
+
+func (b *circuitBreaker) status() breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := breakerStatus{State: "closed", Failures: b.failures}
+	if time.Now().Before(b.openUntil) {
+		openUntil := b.openUntil
+		s.State = "open"
+		s.OpenUntil = &openUntil
+	}
+	return s
+}
+
+// breaker returns the circuit breaker of service, creating it on first use.
+func (ur *UnRustleLogs) breaker(service string) *circuitBreaker {
+	ur.breakerMutex.Lock()
+	defer ur.breakerMutex.Unlock()
+	b, ok := ur.breakers[service]
+	if !ok {
+		b = &circuitBreaker{
+			threshold: ur.config.Server.BreakerThreshold,
+			window:    ur.config.Server.BreakerWindow.Duration,
+			cooldown:  ur.config.Server.BreakerCooldown.Duration,
+		}
+		ur.breakers[service] = b
+	}
+	return b
+}
+
+// recordProviderResult feeds the outcome of a provider call into its breaker,
+// only transient errors count as failures.
+func (ur *UnRustleLogs) recordProviderResult(service string, err error) {
+	b := ur.breaker(service)
+	if err == nil {
+		b.success()
+		return
+	}
+	if isRetryable(err) && b.failure() {
+		logrus.Warnf("%s logins disabled for %s after repeated api failures", service, b.cooldown)
+	}
+}
+
+func (ur *UnRustleLogs) statusHandler(c *gin.Context) {
+	providers := map[string]breakerStatus{}
+	for _, p := range ur.providers {
+		providers[p.Service()] = ur.breaker(p.Service()).status()
+	}
+	c.JSON(http.StatusOK, gin.H{"providers": providers})
+}
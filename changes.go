@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	changeAdded   = "added"
+	changeRemoved = "removed"
+	// changePruned marks that the changes before it were pruned
+	changePruned = "pruned"
+
+	defaultChangeRetention = time.Hour * 24 * 30
+)
+
+// OptOutChange records a user of a service starting or ending to be listed
+// by /api/v1/deleted, the id is the cursor of ?since.
+type OptOutChange struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	Service   string
+	Name      string
+	Action    string
+}
+
+// TableName ...
+func (OptOutChange) TableName() string {
+	return "opt_out_changes"
+}
+
+// recordChange writes a change of u's listing as part of tx, under the name
+// u has at that point.
+func recordChange(tx *gorm.DB, u *User, action string) error {
+	return tx.Create(&OptOutChange{
+		CreatedAt: time.Now().UTC(),
+		Service:   u.Service,
+		Name:      u.Name,
+		Action:    action,
+	}).Error
+}
+
+// seedOptOutChanges starts the history with an added change for every
+// active user, so ?since=0 converges on databases that predate it.
+func seedOptOutChanges(tx *gorm.DB) error {
+	return tx.Exec(`INSERT INTO opt_out_changes (created_at, service, name, action) SELECT ?, service, name, ? FROM users WHERE active = ? ORDER BY requested_at, id`,
+		time.Now().UTC(), changeAdded, true).Error
+}
+
+// errChangeSince means since is neither a change id nor an RFC 3339 time
+var errChangeSince = errors.New("since has to be a change id or an RFC 3339 time")
+
+// ChangeEntry is a change as listed by /api/v1/deleted
+type ChangeEntry struct {
+	ID        uint      `json:"id"`
+	Name      string    `json:"name"`
+	Action    string    `json:"action"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// ChangesPage is the response of /api/v1/deleted with ?since
+type ChangesPage struct {
+	Changes []ChangeEntry `json:"changes"`
+	// Cursor is the since of the next poll
+	Cursor string `json:"cursor"`
+	// More is set if there are more changes right away
+	More bool `json:"more"`
+	// Resync is set if changes after since were pruned already, the
+	// client has to fetch the whole list again
+	Resync bool `json:"resync"`
+}
+
+// ListChanges returns up to limit changes of service after since, a change
+// id or an RFC 3339 time, oldest first.
+func (ur *UnRustleLogs) ListChanges(service, since string, limit int) (*ChangesPage, error) {
+	var first, last OptOutChange
+	if err := ur.db.Order("id").Limit(1).Find(&first).Error; err != nil {
+		return nil, err
+	}
+	if err := ur.db.Order("id desc").Limit(1).Find(&last).Error; err != nil {
+		return nil, err
+	}
+	// if changes were pruned the oldest one left is the marker
+	pruned := first.Action == changePruned
+	page := &ChangesPage{Changes: []ChangeEntry{}}
+	q := ur.db.Where("service = ?", service)
+	if id, err := strconv.ParseUint(since, 10, 64); err == nil {
+		// a cursor from before the pruned changes or of another database
+		page.Resync = (pruned && id < uint64(first.ID)) || id > uint64(last.ID)
+		q = q.Where("id > ?", id)
+	} else if t, err := time.Parse(time.RFC3339, since); err == nil {
+		page.Resync = pruned && t.Before(first.CreatedAt)
+		q = q.Where("created_at > ?", t.UTC())
+	} else {
+		return nil, errChangeSince
+	}
+	page.Cursor = strconv.FormatUint(uint64(last.ID), 10)
+	if page.Resync {
+		return page, nil
+	}
+	// one more tells whether there are more
+	var changes []OptOutChange
+	if err := q.Order("id").Limit(limit + 1).Find(&changes).Error; err != nil {
+		return nil, err
+	}
+	if len(changes) > limit {
+		changes = changes[:limit]
+		page.More = true
+	}
+	for _, c := range changes {
+		page.Changes = append(page.Changes, ChangeEntry{ID: c.ID, Name: c.Name, Action: c.Action, ChangedAt: c.CreatedAt.UTC()})
+	}
+	if n := len(page.Changes); n > 0 {
+		page.Cursor = strconv.FormatUint(uint64(page.Changes[n-1].ID), 10)
+	}
+	return page, nil
+}
+
+// lastChangeID is the cursor to poll ?since with after fetching the whole
+// list.
+func (ur *UnRustleLogs) lastChangeID() (uint, error) {
+	var last OptOutChange
+	err := ur.db.Select("id").Order("id desc").Limit(1).Find(&last).Error
+	return last.ID, err
+}
+
+// resetChangeSequence moves the id sequence of postgres past the restored
+// change ids, the other databases do that on their own.
+func resetChangeSequence(tx *gorm.DB) error {
+	if tx.Dialector.Name() != "postgres" {
+		return nil
+	}
+	return tx.Exec(`SELECT setval(pg_get_serial_sequence('opt_out_changes', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM opt_out_changes`).Error
+}
+
+// pruneChanges deletes changes from before cutoff, the newest of them is
+// turned into the marker telling clients with older cursors to resync. The
+// newest change is always kept so the cursors of idle clients stay valid.
+func pruneChanges(db *gorm.DB, cutoff time.Time) (int64, error) {
+	var last, marker OptOutChange
+	if err := db.Select("id").Order("id desc").Limit(1).Find(&last).Error; err != nil {
+		return 0, err
+	}
+	err := db.Where("created_at < ? and id < ?", cutoff, last.ID).Order("id desc").Limit(1).Find(&marker).Error
+	if err != nil || marker.ID == 0 || marker.Action == changePruned {
+		return 0, err
+	}
+	var n int64
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&marker).Updates(map[string]interface{}{"service": "", "name": "", "action": changePruned}).Error
+		if err != nil {
+			return err
+		}
+		res := tx.Where("id < ?", marker.ID).Delete(&OptOutChange{})
+		n = res.RowsAffected + 1
+		return res.Error
+	})
+	return n, err
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// maxUserChannels bounds how many channels a user can opt out of one by one
+const maxUserChannels = 100
+
+var (
+	channelPattern = regexp.MustCompile(`^[a-z0-9_]{1,64}$`)
+
+	errInvalidChannel  = errors.New("channel names can only contain letters, numbers and _")
+	errTooManyChannels = fmt.Errorf("at most %d channels can be configured, opt out of all channels instead", maxUserChannels)
+)
+
+// OptOutChannel is a channel a user opted out of while User.AllChannels is
+// unset. The rows are kept while AllChannels is set, the user gets them back
+// when limiting the opt-out again.
+type OptOutChannel struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserRowID string `gorm:"uniqueIndex:uix_opt_out_channels_user_channel"`
+	Channel   string `gorm:"uniqueIndex:uix_opt_out_channels_user_channel;index"`
+	CreatedAt time.Time
+}
+
+// TableName ...
+func (OptOutChannel) TableName() string {
+	return "opt_out_channels"
+}
+
+// normalizeChannel lowercases the channel and strips the # chat clients show.
+func normalizeChannel(channel string) (string, error) {
+	channel = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(channel), "#"))
+	if !channelPattern.MatchString(channel) {
+		return "", errInvalidChannel
+	}
+	return channel, nil
+}
+
+// optedOutIn limits q to users whose opt-out covers channel, either all
+// channels or that one. An empty channel matches every opt-out.
+func (ur *UnRustleLogs) optedOutIn(q *gorm.DB, channel string) *gorm.DB {
+	if channel == "" {
+		return q
+	}
+	sub := ur.db.Model(&OptOutChannel{}).Select("user_row_id").Where("channel = ?", channel)
+	return q.Where("all_channels = ? or id in (?)", true, sub)
+}
+
+// UserChannels returns the channels the user opted out of one by one, sorted.
+func (ur *UnRustleLogs) UserChannels(id string) ([]string, error) {
+	channels := []string{}
+	err := ur.db.Model(&OptOutChannel{}).Where("user_row_id = ?", id).Order("channel").Pluck("channel", &channels).Error
+	return channels, err
+}
+
+// UsersChannels is UserChannels for several users at once, keyed by their
+// id. Users without channels are missing.
+func (ur *UnRustleLogs) UsersChannels(ids []string) (map[string][]string, error) {
+	result := make(map[string][]string, len(ids))
+	if len(ids) == 0 {
+		return result, nil
+	}
+	var rows []OptOutChannel
+	err := ur.db.Where("user_row_id in ?", ids).Order("user_row_id, channel").Find(&rows).Error
+	for _, r := range rows {
+		result[r.UserRowID] = append(result[r.UserRowID], r.Channel)
+	}
+	return result, err
+}
+
+// SetUserChannels sets whether the opt-out of the user covers all channels
+// and replaces the channels it covers otherwise.
+func (ur *UnRustleLogs) SetUserChannels(id string, allChannels bool, channels []string) error {
+	if len(channels) > maxUserChannels {
+		return errTooManyChannels
+	}
+	u, err := ur.GetUser(id)
+	if err != nil && !errors.Is(err, errEmailDecrypt) {
+		return err
+	}
+	err = ur.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(u).Update("all_channels", allChannels).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_row_id = ?", id).Delete(&OptOutChannel{}).Error; err != nil {
+			return err
+		}
+		if len(channels) == 0 {
+			return nil
+		}
+		now := time.Now().UTC()
+		rows := make([]OptOutChannel, 0, len(channels))
+		for _, channel := range channels {
+			rows = append(rows, OptOutChannel{UserRowID: id, Channel: channel, CreatedAt: now})
+		}
+		return tx.Create(&rows).Error
+	})
+	ur.userCache.invalidate(userCacheKey(u.Name, u.Service))
+	return err
+}
+
+// parseChannels splits the channels of the settings form, one per line or
+// separated by commas or spaces, dropping duplicates.
+func parseChannels(s string) ([]string, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	})
+	seen := make(map[string]bool, len(fields))
+	channels := make([]string, 0, len(fields))
+	for _, field := range fields {
+		channel, err := normalizeChannel(field)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", field, err)
+		}
+		if !seen[channel] {
+			seen[channel] = true
+			channels = append(channels, channel)
+		}
+	}
+	return channels, nil
+}
+
+// SettingsPayload ...
+type SettingsPayload struct {
+	CSRF      string
+	Error     string
+	Saved     bool
+	Providers []SettingsProvider
+}
+
+// SettingsProvider is the opt-out of a logged in provider.
+type SettingsProvider struct {
+	Service     string
+	Provider    string
+	Name        string
+	AllChannels bool
+	Channels    string
+}
+
+// settingsHandler shows which channels the opt-outs of the logged in
+// providers cover.
+func (ur *UnRustleLogs) settingsHandler(c *gin.Context) {
+	ur.renderSettings(c, http.StatusOK, "", c.Query("saved") == "1")
+}
+
+func (ur *UnRustleLogs) renderSettings(c *gin.Context, status int, errMsg string, saved bool) {
+	payload := SettingsPayload{CSRF: ur.csrfToken(c), Error: errMsg, Saved: saved}
+	for _, p := range ur.providers {
+		user, _, ok := ur.getSession(c, p.CookieName())
+		if !ok {
+			continue
+		}
+		channels, err := ur.UserChannels(user.ID)
+		if err != nil {
+			requestLog(c).Errorf("failed getting channels of %s user %s: %v", user.Service, user.Name, err)
+		}
+		payload.Providers = append(payload.Providers, SettingsProvider{
+			Service:     p.Service(),
+			Provider:    p.Name(),
+			Name:        user.DisplayName,
+			AllChannels: user.AllChannels,
+			Channels:    strings.Join(channels, "\n"),
+		})
+	}
+	if len(payload.Providers) == 0 {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	c.HTML(status, "settings.tmpl", payload)
+}
+
+// saveSettingsHandler stores the channels of the provider in the service
+// form field.
+func (ur *UnRustleLogs) saveSettingsHandler(c *gin.Context) {
+	p, ok := ur.provider(c.PostForm("service"))
+	if !ok {
+		c.Redirect(http.StatusFound, "/settings")
+		return
+	}
+	user, _, ok := ur.getSession(c, p.CookieName())
+	if !ok {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	channels, err := parseChannels(c.PostForm("channels"))
+	if err == nil && len(channels) > maxUserChannels {
+		err = errTooManyChannels
+	}
+	allChannels := c.PostForm("all_channels") == "1"
+	if err == nil && !allChannels && len(channels) == 0 {
+		err = errors.New("enter at least one channel or opt out of all channels")
+	}
+	if err != nil {
+		ur.renderSettings(c, http.StatusBadRequest, err.Error(), false)
+		return
+	}
+	if err := ur.SetUserChannels(user.ID, allChannels, channels); err != nil {
+		requestLog(c).Errorf("failed saving channels of %s user %s: %v", user.Service, user.Name, err)
+		ur.renderSettings(c, http.StatusInternalServerError, "failed saving your settings, please try again", false)
+		return
+	}
+	c.Redirect(http.StatusFound, "/settings?saved=1")
+}
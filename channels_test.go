@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChannelOptOuts(t *testing.T) {
+	tests := []struct {
+		name        string
+		allChannels bool
+		channels    []string
+		// optedOut are the channels foo counts as opted out of
+		optedOut map[string]bool
+	}{
+		{name: "all channels", allChannels: true, optedOut: map[string]bool{"": true, "destiny": true, "other": true}},
+		{name: "some channels", channels: []string{"destiny", "mine"}, optedOut: map[string]bool{"": true, "destiny": true, "mine": true, "other": false}},
+		// the rows are kept for when the user limits the opt-out again
+		{name: "all channels with rows", allChannels: true, channels: []string{"destiny"}, optedOut: map[string]bool{"": true, "destiny": true, "other": true}},
+		{name: "no channels", optedOut: map[string]bool{"": true, "destiny": false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := newTestRustle(t)
+			id := addTestUser(t, ur, TWITCHSERVICE, "foo")
+			addTestUser(t, ur, TWITCHSERVICE, "bar")
+			if err := ur.SetUserChannels(id, tt.allChannels, tt.channels); err != nil {
+				t.Fatal(err)
+			}
+			for channel, want := range tt.optedOut {
+				if _, ok := ur.UserInDatabase("foo", TWITCHSERVICE, channel); ok != want {
+					t.Errorf("UserInDatabase in %q: %v, want %v", channel, ok, want)
+				}
+				found, err := ur.UsersInDatabase([]string{"foo", "bar"}, TWITCHSERVICE, channel)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(found, map[string]bool{"foo": want, "bar": true}) {
+					t.Errorf("UsersInDatabase in %q: %v", channel, found)
+				}
+				optOuts, err := ur.ListOptOuts(TWITCHSERVICE, channel, "", 10)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if listed := len(optOuts) == 2; listed != want {
+					t.Errorf("ListOptOuts in %q: %v", channel, optOuts)
+				}
+			}
+			channels, err := ur.UserChannels(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(channels) != len(tt.channels) {
+				t.Fatalf("kept the channels %v, want %v", channels, tt.channels)
+			}
+		})
+	}
+}
+
+func TestTooManyChannels(t *testing.T) {
+	ur := newTestRustle(t)
+	id := addTestUser(t, ur, TWITCHSERVICE, "foo")
+	if err := ur.SetUserChannels(id, false, make([]string, maxUserChannels+1)); err != errTooManyChannels {
+		t.Fatalf("got %v, want %v", err, errTooManyChannels)
+	}
+}
+
+func TestParseChannels(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "", want: []string{}},
+		{in: "destiny", want: []string{"destiny"}},
+		{in: "#Destiny, mine\nother\r\n\tdestiny", want: []string{"destiny", "mine", "other"}},
+		{in: "  a  b ", want: []string{"a", "b"}},
+		{in: "no-dashes", wantErr: true},
+		{in: "destiny, ../admin", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseChannels(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want one: %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+// Package client helps consumers of the unrustlelogs API.
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+)
+
+// A Bloom filter of GET /api/v1/deleted/:service/bloom is encoded as, all
+// integers big endian:
+//
+//	magic      4 bytes   "URBF"
+//	version    1 byte    1
+//	hashes     1 byte    k, the number of bit positions per name
+//	etag len   2 bytes
+//	bits       8 bytes   m, the length of the bit array
+//	names      8 bytes   n, the number of names added
+//	etag       etag len bytes, the ETag of the response
+//	bit array  ceil(m/8) bytes, bit i is bit i%8 (least significant first)
+//	           of byte i/8
+//
+// The positions of a lowercased name are (h1 + i*h2) mod m for i < k, in
+// wrapping 64 bit arithmetic, where h is the 64 bit FNV-1a hash of the name,
+// h1 is splitmix64(h) and h2 is splitmix64(h + 0x9e3779b97f4a7c15), with
+//
+//	splitmix64(x): x ^= x >> 30; x *= 0xbf58476d1ce4e5b9
+//	               x ^= x >> 27; x *= 0x94d049bb133111eb
+//	               x ^= x >> 31
+const (
+	bloomMagic      = "URBF"
+	bloomVersion    = 1
+	bloomHeaderSize = 4 + 1 + 1 + 2 + 8 + 8
+	bloomMaxHashes  = 30
+)
+
+// Bloom is a set of names that may report names it doesn't contain, at the
+// false positive rate it was built for, but never misses one it does.
+type Bloom struct {
+	bits []byte
+	m    uint64
+	k    uint8
+	n    uint64
+	etag string
+}
+
+// NewBloom returns an empty filter sized for n names at the false positive
+// rate fpr.
+func NewBloom(n int, fpr float64) *Bloom {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpr) / (math.Ln2 * math.Ln2)))
+	if m < 8 {
+		m = 8
+	}
+	k := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	} else if k > bloomMaxHashes {
+		k = bloomMaxHashes
+	}
+	return &Bloom{bits: make([]byte, (m+7)/8), m: m, k: uint8(k)}
+}
+
+func bloomHash(name string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToLower(name)))
+	sum := h.Sum64()
+	return splitmix64(sum), splitmix64(sum + 0x9e3779b97f4a7c15)
+}
+
+// splitmix64 spreads the bits of x, FNV alone leaves too many collisions in
+// the positions of similar names.
+func splitmix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// Add puts the name in the filter, ignoring case.
+func (b *Bloom) Add(name string) {
+	h1, h2 := bloomHash(name)
+	for i := uint64(0); i < uint64(b.k); i++ {
+		pos := (h1 + i*h2) % b.m
+		b.bits[pos/8] |= 1 << (pos % 8)
+	}
+	b.n++
+}
+
+// Contains reports whether the name may be in the filter, ignoring case.
+func (b *Bloom) Contains(name string) bool {
+	h1, h2 := bloomHash(name)
+	for i := uint64(0); i < uint64(b.k); i++ {
+		pos := (h1 + i*h2) % b.m
+		if b.bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Len is the number of names added.
+func (b *Bloom) Len() int {
+	return int(b.n)
+}
+
+// ETag is the ETag of the response the filter was loaded from, send it as
+// If-None-Match to only download it again once it changed.
+func (b *Bloom) ETag() string {
+	return b.etag
+}
+
+// SetETag sets the ETag that MarshalBinary includes.
+func (b *Bloom) SetETag(etag string) {
+	b.etag = etag
+}
+
+// MarshalBinary encodes the filter in the format described above.
+func (b *Bloom) MarshalBinary() ([]byte, error) {
+	if len(b.etag) > math.MaxUint16 {
+		return nil, errors.New("etag too long")
+	}
+	out := make([]byte, bloomHeaderSize, bloomHeaderSize+len(b.etag)+len(b.bits))
+	copy(out, bloomMagic)
+	out[4] = bloomVersion
+	out[5] = b.k
+	binary.BigEndian.PutUint16(out[6:], uint16(len(b.etag)))
+	binary.BigEndian.PutUint64(out[8:], b.m)
+	binary.BigEndian.PutUint64(out[16:], b.n)
+	out = append(out, b.etag...)
+	return append(out, b.bits...), nil
+}
+
+// UnmarshalBinary loads a filter encoded by MarshalBinary.
+func (b *Bloom) UnmarshalBinary(data []byte) error {
+	if len(data) < bloomHeaderSize || string(data[:4]) != bloomMagic {
+		return errors.New("not a bloom filter")
+	}
+	if data[4] != bloomVersion {
+		return fmt.Errorf("unsupported bloom filter version %d", data[4])
+	}
+	k := data[5]
+	etagLen := int(binary.BigEndian.Uint16(data[6:]))
+	m := binary.BigEndian.Uint64(data[8:])
+	n := binary.BigEndian.Uint64(data[16:])
+	if k < 1 || k > bloomMaxHashes || m == 0 {
+		return errors.New("invalid bloom filter header")
+	}
+	rest := data[bloomHeaderSize:]
+	if uint64(len(rest)) != uint64(etagLen)+(m+7)/8 {
+		return errors.New("bloom filter is truncated")
+	}
+	*b = Bloom{
+		bits: append([]byte(nil), rest[etagLen:]...),
+		m:    m,
+		k:    k,
+		n:    n,
+		etag: string(rest[:etagLen]),
+	}
+	return nil
+}
+
+// ParseBloom loads a filter as returned by the bloom endpoint.
+func ParseBloom(data []byte) (*Bloom, error) {
+	b := &Bloom{}
+	if err := b.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestBloomHasNoFalseNegatives(t *testing.T) {
+	tests := []struct {
+		n   int
+		fpr float64
+	}{
+		{n: 0, fpr: 0.001},
+		{n: 1, fpr: 0.001},
+		{n: 1000, fpr: 0.5},
+		{n: 1000, fpr: 0.001},
+		{n: 100000, fpr: 0.01},
+		{n: 10000, fpr: 0.000001},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d names at %g", tt.n, tt.fpr), func(t *testing.T) {
+			b := NewBloom(tt.n, tt.fpr)
+			for i := 0; i < tt.n; i++ {
+				b.Add(fmt.Sprintf("User%d", i))
+			}
+			b.SetETag(`"v1"`)
+			blob, err := b.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := ParseBloom(blob)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loaded.Len() != tt.n || loaded.ETag() != `"v1"` {
+				t.Fatalf("loaded %d names with ETag %s", loaded.Len(), loaded.ETag())
+			}
+			for _, filter := range []*Bloom{b, loaded} {
+				for i := 0; i < tt.n; i++ {
+					name := fmt.Sprintf("User%d", i)
+					if !filter.Contains(name) || !filter.Contains(strings.ToLower(name)) || !filter.Contains(strings.ToUpper(name)) {
+						t.Fatalf("%s is missing", name)
+					}
+				}
+			}
+
+			if tt.n < 1000 {
+				return
+			}
+			// the rate is random, allow some slack over what it was built for
+			const others = 100000
+			positives := 0
+			for i := 0; i < others; i++ {
+				if loaded.Contains(fmt.Sprintf("other%d", i)) {
+					positives++
+				}
+			}
+			if rate := float64(positives) / others; rate > 2*tt.fpr+0.0005 {
+				t.Fatalf("false positive rate %g, built for %g", rate, tt.fpr)
+			}
+		})
+	}
+}
+
+func TestParseBloomRejects(t *testing.T) {
+	b := NewBloom(10, 0.01)
+	b.Add("foo")
+	b.SetETag(`"v1"`)
+	blob, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	change := func(f func(data []byte) []byte) []byte {
+		return f(append([]byte(nil), blob...))
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty"},
+		{name: "short header", data: blob[:bloomHeaderSize-1]},
+		{name: "magic", data: change(func(data []byte) []byte { data[0] = 'X'; return data })},
+		{name: "version", data: change(func(data []byte) []byte { data[4] = bloomVersion + 1; return data })},
+		{name: "no hashes", data: change(func(data []byte) []byte { data[5] = 0; return data })},
+		{name: "too many hashes", data: change(func(data []byte) []byte { data[5] = bloomMaxHashes + 1; return data })},
+		{name: "no bits", data: change(func(data []byte) []byte { copy(data[8:16], make([]byte, 8)); return data })},
+		{name: "truncated", data: blob[:len(blob)-1]},
+		{name: "trailing bytes", data: append(append([]byte(nil), blob...), 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseBloom(tt.data); err == nil {
+				t.Fatal("parsed")
+			}
+		})
+	}
+}
@@ -1,35 +1,374 @@
 package main
 
 import (
+	"errors"
+	"io/fs"
+	"time"
+
 	"github.com/BurntSushi/toml"
+	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 )
 
 // Config ...
 type Config struct {
 	Twitch struct {
-		ClientID     string `toml:"client_id"`
-		ClientSecret string `toml:"client_secret"`
-		RedirectURL  string `toml:"redirect_url"`
-		Scopes       []string
-		Cookie       string
+		ClientID         string `toml:"client_id"`
+		ClientSecret     string `toml:"client_secret"`
+		ClientSecretFile string `toml:"client_secret_file"`
+		RedirectURL      string `toml:"redirect_url"`
+		Scopes           []string
+		Cookie           string
+		RevokeOnLogout   bool `toml:"revoke_on_logout"`
+		// RequireVerifiedEmail refuses logins of accounts without a verified email
+		RequireVerifiedEmail bool `toml:"require_verified_email"`
 	}
 	Destinygg struct {
-		ClientID     string `toml:"client_id"`
-		ClientSecret string `toml:"client_secret"`
-		RedirectURL  string `toml:"redirect_url"`
-		Cookie       string
+		ClientID         string `toml:"client_id"`
+		ClientSecret     string `toml:"client_secret"`
+		ClientSecretFile string `toml:"client_secret_file"`
+		RedirectURL      string `toml:"redirect_url"`
+		Cookie           string
+		RevokeOnLogout   bool   `toml:"revoke_on_logout"`
+		RevokeURL        string `toml:"revoke_url"`
+		// CodeChallengeMethod is S256, plain or legacy for older dgg versions
+		CodeChallengeMethod string `toml:"code_challenge_method"`
+	}
+	Discord struct {
+		ClientID         string `toml:"client_id"`
+		ClientSecret     string `toml:"client_secret"`
+		ClientSecretFile string `toml:"client_secret_file"`
+		RedirectURL      string `toml:"redirect_url"`
+		Scopes           []string
+		Cookie           string
+	}
+	YouTube struct {
+		ClientID         string `toml:"client_id"`
+		ClientSecret     string `toml:"client_secret"`
+		ClientSecretFile string `toml:"client_secret_file"`
+		RedirectURL      string `toml:"redirect_url"`
+		Scopes           []string
+		Cookie           string
+	}
+	Kick struct {
+		ClientID         string `toml:"client_id"`
+		ClientSecret     string `toml:"client_secret"`
+		ClientSecretFile string `toml:"client_secret_file"`
+		RedirectURL      string `toml:"redirect_url"`
+		Scopes           []string
+		Cookie           string
+	}
+	// Admin is the GitHub OAuth app used to log into /admin
+	Admin struct {
+		ClientID         string `toml:"client_id"`
+		ClientSecret     string `toml:"client_secret"`
+		ClientSecretFile string `toml:"client_secret_file"`
+		RedirectURL      string `toml:"redirect_url"`
+		Cookie           string
+		// Admins are the GitHub logins allowed in
+		Admins []string
 	}
 	Server struct {
-		Address   string
-		JWTSecret string `toml:"jwt_secret"`
+		// Address is host:port, or unix: and the path of a unix socket with
+		// SocketMode as its permissions
+		Address    string
+		SocketMode string `toml:"socket_mode"`
+		// Mode is gin's release (default), debug or test mode
+		Mode string
+		// DrainDelay is how long /readyz fails before the server shuts
+		// down, negative to shut down right away
+		DrainDelay duration `toml:"drain_delay"`
+		// EnablePprof serves net/http/pprof under /debug/pprof to admins
+		EnablePprof bool `toml:"enable_pprof"`
+		// AssetsMaxAge is how long browsers cache /assets without a
+		// fingerprint in the url
+		AssetsMaxAge duration `toml:"assets_max_age"`
+		// LogAssets logs requests to /assets too, on unless false
+		LogAssets *bool `toml:"log_assets"`
+		// GRPCAddress serves the opt-out lookups over gRPC, off unless set
+		GRPCAddress string `toml:"grpc_address"`
+		// LegacyGetLinks keeps GET /link, /unlink and the /delete and
+		// /undelete of every provider working without a csrf token
+		LegacyGetLinks bool   `toml:"legacy_get_links"`
+		JWTSecret      string `toml:"jwt_secret"`
+		JWTSecretFile  string `toml:"jwt_secret_file"`
+		// JWTSecrets replace JWTSecret to rotate HS256 keys, the first one signs
+		JWTSecrets []JWTSecretConfig `toml:"jwt_secrets"`
+		// JWTAlgorithm is HS256 (default) or RS256, which signs with the key files
+		JWTAlgorithm      string `toml:"jwt_algorithm"`
+		JWTPrivateKeyFile string `toml:"jwt_private_key_file"`
+		JWTPublicKeyFile  string `toml:"jwt_public_key_file"`
+		// JWTTTL is how long remembered sessions last before they have to be
+		// refreshed, SessionTTL is the same for the others
+		JWTTTL     duration `toml:"jwt_ttl"`
+		SessionTTL duration `toml:"session_ttl"`
+		// JWTLeeway is the clock skew allowed when checking exp, iat and nbf
+		JWTLeeway duration `toml:"jwt_leeway"`
+		// JWTIssuer is set as iss and required from every token once
+		// JWTLegacyUntil is past, from then on aud is too. Unset it's
+		// JWTTTL after the upgrade of a database with users
+		JWTIssuer      string    `toml:"jwt_issuer"`
+		JWTLegacyUntil time.Time `toml:"jwt_legacy_until"`
+		// SessionSliding renews sessions past half their lifetime, but never
+		// beyond SessionAbsoluteMax after the login
+		SessionSliding     bool     `toml:"session_sliding"`
+		SessionAbsoluteMax duration `toml:"session_absolute_max"`
+		// SessionBackend is jwt (default) or database, which only puts a
+		// random id in the cookie
+		SessionBackend     string   `toml:"session_backend"`
+		SessionIdleTimeout duration `toml:"session_idle_timeout"`
+		// TokenKey is a hex encoded AES key used to encrypt stored provider tokens
+		TokenKey     string `toml:"token_key"`
+		TokenKeyFile string `toml:"token_key_file"`
+		// HTTPTimeout bounds every outbound provider request
+		HTTPTimeout duration `toml:"http_timeout"`
+		// CallbackBaseURL overrides the base of every OAuth redirect_uri
+		CallbackBaseURL string `toml:"callback_base_url"`
+		// AllowedHosts enables deriving the redirect_uri from the request host
+		AllowedHosts []string `toml:"allowed_hosts"`
+		// TrustedProxies may set X-Forwarded-* headers, IPs or CIDRs
+		TrustedProxies []string `toml:"trusted_proxies"`
+		// StateTTL is how long a started login can be finished
+		StateTTL duration `toml:"state_ttl"`
+		// MaxPendingStatesPerIP limits unfinished logins per client IP
+		MaxPendingStatesPerIP int `toml:"max_pending_states_per_ip"`
+		// MaxPendingStates limits unfinished logins overall
+		MaxPendingStates int `toml:"max_pending_states"`
+		// BreakerThreshold failed provider calls within BreakerWindow
+		// disable logins with that provider for BreakerCooldown
+		BreakerThreshold int      `toml:"breaker_threshold"`
+		BreakerWindow    duration `toml:"breaker_window"`
+		BreakerCooldown  duration `toml:"breaker_cooldown"`
+		// CheckBatchLimit is the most names /api/v1/check takes at once
+		CheckBatchLimit int `toml:"check_batch_limit"`
+		// TLS serves https directly instead of behind a proxy
+		TLS TLSConfig `toml:"tls"`
+	}
+	Database struct {
+		// Dialect is sqlite3 (default), postgres or mysql
+		Dialect string
+		// DSN defaults to /data/users.db for sqlite3
+		DSN     string
+		DSNFile string `toml:"dsn_file"`
+		// Wait retries connecting for WaitTimeout, on unless set to false
+		Wait        *bool
+		WaitTimeout duration `toml:"wait_timeout"`
+		// UserCache keeps opt-out lookups in memory for UserCacheTTL, on
+		// unless set to false
+		UserCache    *bool    `toml:"user_cache"`
+		UserCacheTTL duration `toml:"user_cache_ttl"`
+		// EmailKey is a hex encoded AES key emails are encrypted with.
+		// EmailOldKeys are still used to decrypt.
+		EmailKey     string   `toml:"email_key"`
+		EmailKeyFile string   `toml:"email_key_file"`
+		EmailOldKeys []string `toml:"email_old_keys"`
+	}
+	// Maintenance prunes rows every Interval once they are past their
+	// retention
+	Maintenance struct {
+		Interval duration
+		// InactiveUserRetention is how long undeleted users are kept, forever
+		// unless set
+		InactiveUserRetention duration `toml:"inactive_user_retention"`
+		// StateRetention keeps expired oauth states, defaults to state_ttl
+		StateRetention        duration `toml:"state_retention"`
+		RevokedTokenRetention duration `toml:"revoked_token_retention"`
+		// ChangeRetention is how far back ?since of /api/v1/deleted works
+		ChangeRetention duration `toml:"change_retention"`
 	}
+	Cookies struct {
+		// Secure defaults to whether the request came in over https
+		Secure *bool
+		// SameSite is lax (default), strict or none
+		SameSite string `toml:"same_site"`
+		// Domain defaults to the request host
+		Domain string
+		// Path is prepended to every cookie path when served under a subpath
+		Path string
+	}
+	// API guards the programmatic endpoints under /api/v1
+	API struct {
+		// RequireKeys needs one of Keys on /api/v1, on unless set to false
+		RequireKeys *bool `toml:"require_keys"`
+		// StatsRequireKey also puts /stats behind a key with the stats scope
+		StatsRequireKey bool `toml:"stats_require_key"`
+		Keys            []APIKeyConfig
+	}
+	// RateLimit limits the requests per client of the api and the logins,
+	// on unless Enabled is false
+	RateLimit struct {
+		Enabled *bool
+		API     RateLimitConfig `toml:"api"`
+		Login   RateLimitConfig `toml:"login"`
+	} `toml:"ratelimit"`
+	// CORS lets browsers on AllowedOrigins call /api
+	CORS struct {
+		AllowedOrigins []string `toml:"allowed_origins"`
+		AllowedMethods []string `toml:"allowed_methods"`
+		// AllowCredentials sends the session cookies to /api from origins
+		// listed exactly
+		AllowCredentials bool `toml:"allow_credentials"`
+	} `toml:"cors"`
+	OIDCProviders []OIDCProviderConfig `toml:"oidc_providers"`
+	// Webhooks are told about every opt-out and undelete
+	Webhooks []WebhookConfig
+}
+
+// OIDCProviderConfig ...
+type OIDCProviderConfig struct {
+	// Slug is used in the /auth/:slug routes and stored as the service
+	Slug             string
+	Name             string
+	Issuer           string
+	ClientID         string `toml:"client_id"`
+	ClientSecret     string `toml:"client_secret"`
+	ClientSecretFile string `toml:"client_secret_file"`
+	RedirectURL      string `toml:"redirect_url"`
+	Scopes           []string
+	Cookie           string
+	UsernameClaim    string `toml:"username_claim"`
+	DisplayNameClaim string `toml:"display_name_claim"`
+	EmailClaim       string `toml:"email_claim"`
 }
 
-// LoadConfig ...
+// JWTSecretConfig is an HS256 key, ID is sent as the kid header
+type JWTSecretConfig struct {
+	ID         string
+	Secret     string
+	SecretFile string `toml:"secret_file"`
+}
+
+// duration lets time.Duration values be written as strings like "10s"
+type duration struct {
+	time.Duration
+}
+
+// UnmarshalText ...
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// fatalConfig logs every problem of ConfigErrors and exits.
+func fatalConfig(err error) {
+	if problems, ok := err.(ConfigErrors); ok {
+		for _, p := range problems {
+			logrus.Error(p)
+		}
+		logrus.Fatal("the config isn't valid, see above")
+	}
+	logrus.Fatal(err)
+}
+
+// LoadConfig reads file and then the UNRUSTLE_ environment variables, see
+// applyEnv, and the secrets of the _file options. Without the file
+// everything comes from the environment.
 func (ur *UnRustleLogs) LoadConfig(file string) {
-	_, err := toml.DecodeFile(file, &ur.config)
-	if err != nil {
+	ur.config = &Config{}
+	_, err := toml.DecodeFile(file, ur.config)
+	if errors.Is(err, fs.ErrNotExist) {
+		logrus.Infof("no %s, using the environment only", file)
+	} else if err != nil {
 		logrus.Fatal(err)
 	}
+	if err := ur.loadEnv(); err != nil {
+		logrus.Fatal(err)
+	}
+	if err := ur.config.loadSecretFiles(); err != nil {
+		fatalConfig(err)
+	}
+	if err := ur.config.Validate(); err != nil {
+		fatalConfig(err)
+	}
+	if ur.config.Server.HTTPTimeout.Duration > 0 {
+		ur.httpClient.Timeout = ur.config.Server.HTTPTimeout.Duration
+	}
+	if ur.config.Database.UserCacheTTL.Duration <= 0 {
+		ur.config.Database.UserCacheTTL.Duration = defaultUserCacheTTL
+	}
+	if ur.config.Database.WaitTimeout.Duration <= 0 {
+		ur.config.Database.WaitTimeout.Duration = defaultDatabaseWaitTimeout
+	}
+	if ur.config.Server.JWTTTL.Duration <= 0 {
+		ur.config.Server.JWTTTL.Duration = defaultJWTTTL
+	}
+	if ur.config.Server.JWTIssuer == "" {
+		ur.config.Server.JWTIssuer = defaultJWTIssuer
+	}
+	if ur.config.Server.JWTLeeway.Duration <= 0 {
+		ur.config.Server.JWTLeeway.Duration = defaultJWTLeeway
+	}
+	if ur.config.Server.SessionTTL.Duration <= 0 {
+		ur.config.Server.SessionTTL.Duration = defaultSessionTTL
+	}
+	if ur.config.Server.SessionAbsoluteMax.Duration <= 0 {
+		ur.config.Server.SessionAbsoluteMax.Duration = defaultSessionAbsoluteMax
+	}
+	if ur.config.Server.SessionIdleTimeout.Duration <= 0 {
+		ur.config.Server.SessionIdleTimeout.Duration = defaultSessionIdleTimeout
+	}
+	if ur.config.Server.StateTTL.Duration == 0 {
+		ur.config.Server.StateTTL.Duration = defaultStateTTL
+	}
+	if ur.config.Server.MaxPendingStatesPerIP <= 0 {
+		ur.config.Server.MaxPendingStatesPerIP = defaultMaxPendingStatesPerIP
+	}
+	if ur.config.Server.MaxPendingStates <= 0 {
+		ur.config.Server.MaxPendingStates = defaultMaxPendingStates
+	}
+	if ur.config.Server.BreakerThreshold <= 0 {
+		ur.config.Server.BreakerThreshold = defaultBreakerThreshold
+	}
+	if ur.config.Server.BreakerWindow.Duration <= 0 {
+		ur.config.Server.BreakerWindow.Duration = defaultBreakerWindow
+	}
+	if ur.config.Server.BreakerCooldown.Duration <= 0 {
+		ur.config.Server.BreakerCooldown.Duration = defaultBreakerCooldown
+	}
+	if ur.config.Server.CheckBatchLimit <= 0 {
+		ur.config.Server.CheckBatchLimit = defaultCheckBatchLimit
+	}
+	if ur.config.RateLimit.API.Rate <= 0 {
+		ur.config.RateLimit.API.Rate = defaultAPIRate
+	}
+	if ur.config.RateLimit.API.Burst <= 0 {
+		ur.config.RateLimit.API.Burst = defaultAPIBurst
+	}
+	if ur.config.RateLimit.Login.Rate <= 0 {
+		ur.config.RateLimit.Login.Rate = defaultLoginRate
+	}
+	if ur.config.RateLimit.Login.Burst <= 0 {
+		ur.config.RateLimit.Login.Burst = defaultLoginBurst
+	}
+	if ur.config.Server.Mode == "" {
+		ur.config.Server.Mode = gin.ReleaseMode
+	}
+	if ur.config.Server.AssetsMaxAge.Duration <= 0 {
+		ur.config.Server.AssetsMaxAge.Duration = defaultAssetsMaxAge
+	}
+	if ur.config.Server.DrainDelay.Duration == 0 {
+		ur.config.Server.DrainDelay.Duration = defaultDrainDelay
+	}
+	if ur.config.Server.SocketMode == "" {
+		ur.config.Server.SocketMode = defaultSocketMode
+	}
+	if ur.config.Server.TLS.CacheDir == "" {
+		ur.config.Server.TLS.CacheDir = defaultACMECacheDir
+	}
+	if ur.config.Server.TLS.HTTPAddress == "" {
+		ur.config.Server.TLS.HTTPAddress = defaultACMEHTTPAddress
+	}
+	if len(ur.config.CORS.AllowedMethods) == 0 {
+		ur.config.CORS.AllowedMethods = defaultCORSMethods
+	}
+	if ur.config.Maintenance.ChangeRetention.Duration <= 0 {
+		ur.config.Maintenance.ChangeRetention.Duration = defaultChangeRetention
+	}
+	if ur.config.Maintenance.Interval.Duration <= 0 {
+		ur.config.Maintenance.Interval.Duration = defaultMaintenanceInterval
+	}
+	if ur.config.Maintenance.StateRetention.Duration <= 0 {
+		ur.config.Maintenance.StateRetention.Duration = ur.config.Server.StateTTL.Duration
+	}
 }
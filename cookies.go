@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (ur *UnRustleLogs) setupCookies() error {
+	if p := ur.config.Cookies.Path; p != "" && !strings.HasPrefix(p, "/") {
+		return fmt.Errorf("cookies.path %q has to start with /", p)
+	}
+	switch strings.ToLower(ur.config.Cookies.SameSite) {
+	case "", "lax":
+		ur.sameSite = http.SameSiteLaxMode
+	case "strict":
+		ur.sameSite = http.SameSiteStrictMode
+	case "none":
+		if s := ur.config.Cookies.Secure; s != nil && !*s {
+			return fmt.Errorf("cookies.same_site = \"none\" requires secure cookies")
+		}
+		ur.sameSite = http.SameSiteNoneMode
+	default:
+		return fmt.Errorf("invalid cookies.same_site %q, use lax, strict or none", ur.config.Cookies.SameSite)
+	}
+	return nil
+}
+
+// secureCookies reports whether cookies get the Secure attribute, by default
+// only if the request came in over https.
+func (ur *UnRustleLogs) secureCookies(r *http.Request) bool {
+	if s := ur.config.Cookies.Secure; s != nil {
+		return *s
+	}
+	if ur.sameSite == http.SameSiteNoneMode {
+		return true
+	}
+	scheme, _ := ur.requestBaseURL(r)
+	return scheme == "https"
+}
+
+// cookieDomain is cookies.domain, or the request host if it's not set.
+func (ur *UnRustleLogs) cookieDomain(r *http.Request) string {
+	if ur.config.Cookies.Domain != "" {
+		return ur.config.Cookies.Domain
+	}
+	return fmt.Sprintf("%s", r.Host)
+}
+
+// cookiePath prefixes path, which is relative to the app, with cookies.path
+// for deployments under a subpath.
+func (ur *UnRustleLogs) cookiePath(path string) string {
+	base := strings.TrimSuffix(ur.config.Cookies.Path, "/")
+	if base == "" {
+		return path
+	}
+	if path == "/" {
+		return base
+	}
+	return base + path
+}
+
+// setCookie sets an HttpOnly cookie with the configured attributes. Every
+// cookie has to go through here, browsers only delete a cookie if the
+// attributes match the ones it was set with.
+func (ur *UnRustleLogs) setCookie(c *gin.Context, name, value, path string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    url.QueryEscape(value),
+		MaxAge:   maxAge,
+		Path:     ur.cookiePath(path),
+		Domain:   ur.cookieDomain(c.Request),
+		Secure:   ur.secureCookies(c.Request),
+		HttpOnly: true,
+		SameSite: ur.sameSite,
+	})
+}
+
+func (ur *UnRustleLogs) deleteCookie(c *gin.Context, cookie string) {
+	ur.setCookie(c, cookie, "", "/", -1)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// findCookie is the cookie called name that w set.
+func findCookie(t *testing.T, w *httptest.ResponseRecorder, name string) *http.Cookie {
+	t.Helper()
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	t.Fatalf("no %s cookie in %q", name, w.Header()["Set-Cookie"])
+	return nil
+}
+
+func TestSessionCookieAttributes(t *testing.T) {
+	secure, insecure := true, false
+	tests := []struct {
+		name     string
+		secure   *bool
+		sameSite string
+		path     string
+		tls      bool
+		// the attributes the session cookie gets
+		wantSecure   bool
+		wantSameSite http.SameSite
+		wantPath     string
+	}{
+		{name: "http", wantSameSite: http.SameSiteLaxMode, wantPath: "/"},
+		{name: "https", tls: true, wantSecure: true, wantSameSite: http.SameSiteLaxMode, wantPath: "/"},
+		{name: "secure forced", secure: &secure, wantSecure: true, wantSameSite: http.SameSiteLaxMode, wantPath: "/"},
+		{name: "secure disabled on https", secure: &insecure, tls: true, wantSameSite: http.SameSiteLaxMode, wantPath: "/"},
+		{name: "strict", sameSite: "Strict", wantSameSite: http.SameSiteStrictMode, wantPath: "/"},
+		{name: "none is secure", sameSite: "none", wantSecure: true, wantSameSite: http.SameSiteNoneMode, wantPath: "/"},
+		{name: "subpath", path: "/unrustle/", wantSameSite: http.SameSiteLaxMode, wantPath: "/unrustle"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := newStateRustle(t)
+			ur.config.Cookies.Secure = tt.secure
+			ur.config.Cookies.SameSite = tt.sameSite
+			ur.config.Cookies.Path = tt.path
+			if err := ur.setupCookies(); err != nil {
+				t.Fatal(err)
+			}
+			p := &stubProvider{
+				Provider: testProvider(t, ur, TWITCHSERVICE),
+				ident:    &Identity{UserID: "foo-id", Name: "foo"},
+			}
+			router := gin.New()
+			router.GET("/twitch/callback", ur.callbackHandler(p))
+			router.GET("/twitch/logout", ur.logoutHandler(p))
+			if err := ur.putState(TWITCHSERVICE, "192.0.2.1", "state", "verifier", "/", false, ""); err != nil {
+				t.Fatal(err)
+			}
+			send := func(target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodGet, target, nil)
+				if tt.tls {
+					req.TLS = &tls.ConnectionState{}
+				}
+				for _, cookie := range cookies {
+					req.AddCookie(cookie)
+				}
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				return w
+			}
+
+			session := findCookie(t, send("/twitch/callback?state=state&code=code"), "twitch")
+			deleted := findCookie(t, send("/twitch/logout", session), "twitch")
+			for _, cookie := range []*http.Cookie{session, deleted} {
+				if !cookie.HttpOnly || cookie.Secure != tt.wantSecure || cookie.SameSite != tt.wantSameSite || cookie.Path != tt.wantPath || cookie.Domain != "example.com" {
+					t.Fatalf("got %s", cookie)
+				}
+			}
+			if session.Value == "" || deleted.MaxAge >= 0 {
+				t.Fatalf("the session %s wasn't deleted by %s", session, deleted)
+			}
+		})
+	}
+}
+
+func TestInvalidCookieConfig(t *testing.T) {
+	insecure := false
+	tests := []struct {
+		name     string
+		secure   *bool
+		sameSite string
+		path     string
+	}{
+		{name: "unknown same_site", sameSite: "sometimes"},
+		{name: "none without secure", sameSite: "none", secure: &insecure},
+		{name: "relative path", path: "unrustle"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := newTestRustle(t)
+			ur.config.Cookies.Secure = tt.secure
+			ur.config.Cookies.SameSite = tt.sameSite
+			ur.config.Cookies.Path = tt.path
+			if err := ur.setupCookies(); err == nil {
+				t.Fatal("setupCookies accepted the config")
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const corsMaxAge = "600"
+
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodDelete}
+	// corsHeaders are the request headers the API reads
+	corsHeaders = "Authorization, Content-Type, If-None-Match, X-Request-ID"
+	// corsExposedHeaders are the response headers clients of the API need
+	corsExposedHeaders = "ETag, Link, Retry-After, X-Change-Cursor, X-Next-Cursor, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, X-Request-ID"
+)
+
+// corsOrigin is an entry of cors.allowed_origins, either an exact origin or
+// one with a *. prefix on the host matching every subdomain of the rest.
+type corsOrigin struct {
+	any      bool
+	scheme   string
+	host     string
+	wildcard bool
+}
+
+func parseCORSOrigin(s string) (corsOrigin, error) {
+	if s == "*" {
+		return corsOrigin{any: true}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return corsOrigin{}, fmt.Errorf("cors origin %q has to be like https://example.com", s)
+	}
+	o := corsOrigin{scheme: u.Scheme, host: strings.ToLower(u.Host)}
+	if rest, ok := strings.CutPrefix(o.host, "*."); ok {
+		o.host, o.wildcard = rest, true
+	}
+	if strings.Contains(o.host, "*") {
+		return corsOrigin{}, fmt.Errorf("cors origin %q may only have a wildcard as the first label", s)
+	}
+	return o, nil
+}
+
+// matches reports whether the Origin header origin is allowed by o.
+func (o corsOrigin) matches(origin string) bool {
+	if o.any {
+		return true
+	}
+	scheme, host, ok := strings.Cut(strings.ToLower(origin), "://")
+	if !ok || scheme != o.scheme {
+		return false
+	}
+	if o.wildcard {
+		return strings.HasSuffix(host, "."+o.host)
+	}
+	return host == o.host
+}
+
+// setupCORS parses cors.allowed_origins, CORS headers are only sent once
+// there are some.
+func (ur *UnRustleLogs) setupCORS() error {
+	for _, s := range ur.config.CORS.AllowedOrigins {
+		o, err := parseCORSOrigin(s)
+		if err != nil {
+			return err
+		}
+		ur.corsOrigins = append(ur.corsOrigins, o)
+	}
+	for i, m := range ur.config.CORS.AllowedMethods {
+		ur.config.CORS.AllowedMethods[i] = strings.ToUpper(m)
+	}
+	return nil
+}
+
+// corsMiddleware sets the CORS headers of requests to /api from allowed
+// origins and answers their preflights. Credentials, the session cookies,
+// are only allowed for origins listed exactly, never for * or wildcards.
+func (ur *UnRustleLogs) corsMiddleware(c *gin.Context) {
+	origin := c.GetHeader("Origin")
+	if len(ur.corsOrigins) == 0 || origin == "" || !isAPIRequest(c) {
+		c.Next()
+		return
+	}
+	c.Writer.Header().Add("Vary", "Origin")
+	preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+	allowed, exact := false, false
+	for _, o := range ur.corsOrigins {
+		if o.matches(origin) {
+			allowed = true
+			exact = exact || (!o.any && !o.wildcard)
+		}
+	}
+	if allowed && preflight && !ur.corsMethodAllowed(c.GetHeader("Access-Control-Request-Method")) {
+		allowed = false
+	}
+	if allowed {
+		// the origin is echoed instead of sending *, which browsers reject
+		// together with credentials
+		c.Header("Access-Control-Allow-Origin", origin)
+		if ur.config.CORS.AllowCredentials && exact {
+			c.Header("Access-Control-Allow-Credentials", "true")
+		}
+	}
+	if !preflight {
+		if allowed {
+			c.Header("Access-Control-Expose-Headers", corsExposedHeaders)
+		}
+		c.Next()
+		return
+	}
+	if allowed {
+		c.Header("Access-Control-Allow-Methods", strings.Join(ur.config.CORS.AllowedMethods, ", "))
+		c.Header("Access-Control-Allow-Headers", corsHeaders)
+		c.Header("Access-Control-Max-Age", corsMaxAge)
+	}
+	c.AbortWithStatus(http.StatusNoContent)
+}
+
+func (ur *UnRustleLogs) corsMethodAllowed(method string) bool {
+	for _, m := range ur.config.CORS.AllowedMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+var urlSafe = regexp.MustCompile(`^[A-Za-z0-9_-]*$`)
+
+func TestGenerateSecureToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		nBytes int
+		length int
+	}{
+		{name: "state", nBytes: stateBytes, length: 43},
+		{name: "verifier", nBytes: verifierBytes, length: 64},
+		{name: "one byte", nBytes: 1, length: 2},
+		{name: "empty", nBytes: 0, length: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := generateSecureToken(tt.nBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(token) != tt.length {
+				t.Fatalf("length %d, want %d", len(token), tt.length)
+			}
+			if !urlSafe.MatchString(token) {
+				t.Fatalf("%q isn't url safe", token)
+			}
+		})
+	}
+}
+
+func TestGenerateSecureTokenIsUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		token, err := generateSecureToken(stateBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[token] {
+			t.Fatalf("%q was generated twice", token)
+		}
+		seen[token] = true
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("no entropy")
+}
+
+func TestLoginFailsWithoutEntropy(t *testing.T) {
+	ur := newStateRustle(t)
+	// only the login handler, the middlewares need entropy too
+	router := gin.New()
+	router.HTMLRender = newTestRouter(t, ur).HTMLRender
+	router.GET("/login", ur.loginHandler(testProvider(t, ur, TWITCHSERVICE)))
+	reader := rand.Reader
+	rand.Reader = failingReader{}
+	defer func() {
+		rand.Reader = reader
+	}()
+	if _, err := generateSecureToken(stateBytes); err == nil {
+		t.Fatal("generateSecureToken didn't fail")
+	}
+	if w := testRequest(router, http.MethodGet, "/login", nil); w.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
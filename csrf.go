@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// csrfCookie holds the token forms have to submit as csrfField
+	csrfCookie = "csrf"
+	csrfField  = "csrf"
+	csrfBytes  = 32
+)
+
+// csrfToken returns the CSRF token of the visitor, setting the cookie if
+// there is none yet.
+func (ur *UnRustleLogs) csrfToken(c *gin.Context) string {
+	if token, err := c.Cookie(csrfCookie); err == nil && token != "" {
+		return token
+	}
+	token, err := generateSecureToken(csrfBytes)
+	if err != nil {
+		requestLog(c).Errorf("failed generating csrf token: %v", err)
+		return ""
+	}
+	ur.setCookie(c, csrfCookie, token, "/", 0)
+	return token
+}
+
+// ConfirmPayload ...
+type ConfirmPayload struct {
+	Message string
+	Action  string
+	Button  string
+	CSRF    string
+}
+
+// confirmations are shown when an action is opened with a GET, e.g. by a
+// link preview bot, instead of performing it
+var confirmations = map[string]ConfirmPayload{
+	"/link":   {Message: "Link your Twitch and Destiny.gg accounts?", Button: "Link accounts"},
+	"/unlink": {Message: "Unlink your Twitch and Destiny.gg accounts?", Button: "Unlink accounts"},
+}
+
+// confirmation returns the confirmation of the action at path, the delete
+// and undelete ones exist for every provider.
+func (ur *UnRustleLogs) confirmation(path string) ConfirmPayload {
+	if payload, ok := confirmations[path]; ok {
+		return payload
+	}
+	for _, p := range ur.providers {
+		switch strings.TrimPrefix(path, p.Path()) {
+		case "/delete":
+			return ConfirmPayload{Message: "Hide your " + p.Name() + " chat logs again?", Button: "Opt out"}
+		case "/undelete":
+			return ConfirmPayload{Message: "Stop hiding your " + p.Name() + " chat logs?", Button: "Opt back in"}
+		}
+	}
+	return ConfirmPayload{}
+}
+
+// csrfMiddleware protects endpoints that change state. POSTs need the token
+// of the csrf cookie in the form, browsers get an error page without it and
+// API clients the error envelope. GETs render a confirmation page, or a 405
+// for API clients, unless server.legacy_get_links is set for scripts that
+// still use the old links.
+func (ur *UnRustleLogs) csrfMiddleware(c *gin.Context) {
+	if c.Request.Method == http.MethodGet {
+		if !ur.config.Server.LegacyGetLinks {
+			c.Header("Allow", http.MethodPost)
+			if c.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) == gin.MIMEJSON {
+				apiError(c, http.StatusMethodNotAllowed, codeMethodNotAllowed, c.Request.URL.Path+" only changes anything on POST with a csrf form field matching the csrf cookie")
+				return
+			}
+			payload := ur.confirmation(c.Request.URL.Path)
+			payload.Action = c.Request.URL.Path
+			payload.CSRF = ur.csrfToken(c)
+			c.HTML(http.StatusOK, "confirm.tmpl", payload)
+			c.Abort()
+			return
+		}
+		requestLog(c).Warnf("deprecated GET %s from %s, use a POST with a csrf token", c.Request.URL.Path, ur.clientIP(c.Request))
+		c.Next()
+		return
+	}
+	cookie, err := c.Cookie(csrfCookie)
+	form := c.PostForm(csrfField)
+	if err != nil || cookie == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(form)) != 1 {
+		if isAPIRequest(c) {
+			apiError(c, http.StatusForbidden, codeInvalidCSRF, "invalid or missing csrf token, reload the page and try again")
+			return
+		}
+		errorPage(c, http.StatusForbidden, "This form expired, go back, reload the page and try again.")
+		return
+	}
+	c.Next()
+}
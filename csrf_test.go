@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCSRFDoubleSubmit(t *testing.T) {
+	tests := []struct {
+		name   string
+		cookie string
+		form   url.Values
+		// api posts to an /api path, which answers with the error envelope
+		api    bool
+		status int
+	}{
+		{name: "matching token", cookie: "token", form: url.Values{csrfField: {"token"}}, status: http.StatusOK},
+		{name: "missing form token", cookie: "token", form: url.Values{}, status: http.StatusForbidden},
+		{name: "empty form token", cookie: "token", form: url.Values{csrfField: {""}}, status: http.StatusForbidden},
+		{name: "mismatched token", cookie: "token", form: url.Values{csrfField: {"other"}}, status: http.StatusForbidden},
+		{name: "token prefix", cookie: "token", form: url.Values{csrfField: {"tok"}}, status: http.StatusForbidden},
+		{name: "missing cookie", form: url.Values{csrfField: {"token"}}, status: http.StatusForbidden},
+		{name: "both empty", form: url.Values{csrfField: {""}}, status: http.StatusForbidden},
+		{name: "api without a token", cookie: "token", form: url.Values{}, api: true, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := newTestRustle(t)
+			next := false
+			router := gin.New()
+			router.HTMLRender = newTestRouter(t, ur).HTMLRender
+			handler := func(c *gin.Context) {
+				next = true
+				c.Status(http.StatusOK)
+			}
+			router.POST("/twitch/delete", ur.csrfMiddleware, handler)
+			router.POST("/api/v1/delete", ur.csrfMiddleware, handler)
+			target := "/twitch/delete"
+			if tt.api {
+				target = "/api/v1/delete"
+			}
+			req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(tt.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: csrfCookie, Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.status || next != (tt.status == http.StatusOK) {
+				t.Fatalf("status %d and the handler ran: %v, want %d", w.Code, next, tt.status)
+			}
+			if w.Code == http.StatusOK {
+				return
+			}
+			// browsers get a page, API clients the envelope
+			html := strings.HasPrefix(w.Header().Get("Content-Type"), "text/html")
+			if html == tt.api || tt.api != strings.Contains(w.Body.String(), codeInvalidCSRF) {
+				t.Fatalf("got %s: %s", w.Header().Get("Content-Type"), w.Body)
+			}
+		})
+	}
+}
+
+func TestCSRFConfirmation(t *testing.T) {
+	ur := newTestRustle(t)
+	router := newTestRouter(t, ur)
+	w := testRequest(router, http.MethodGet, "/twitch/delete", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+	}
+	token := findCookie(t, w, csrfCookie).Value
+	if token == "" || !strings.Contains(w.Body.String(), token) {
+		t.Fatal("the confirmation form doesn't submit the csrf cookie")
+	}
+	if !strings.Contains(w.Body.String(), "Hide your Twitch.tv chat logs again?") {
+		t.Fatalf("the confirmation doesn't ask about the action: %s", w.Body)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/twitch/delete", nil)
+	req.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != http.MethodPost {
+		t.Fatalf("API clients got %d with Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+}
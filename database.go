@@ -1,96 +1,653 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
-	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"github.com/sirupsen/logrus"
+	gormmysql "gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	defaultDatabaseWaitTimeout = time.Minute
+	databaseRetryMin           = time.Millisecond * 500
+	databaseRetryMax           = time.Second * 10
 )
 
 // User ...
 type User struct {
-	ID        string `gorm:"primary_key"`
+	ID        string `gorm:"primaryKey"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
 
-	Service     string
-	Name        string
+	Service     string `gorm:"uniqueIndex:uix_users_name_service"`
+	Name        string `gorm:"uniqueIndex:uix_users_name_service"`
 	DisplayName string
 	Nick        string
-	UserID      string
-	Email       string
+	// UserID is the provider's id of the user, empty for users stored
+	// before it was
+	UserID string
+	// Email is encrypted with database.email_key if it's set
+	Email string `gorm:"serializer:email"`
+
+	// Active is unset once the user undeleted, the row is kept as a record
+	// of the opt-out
+	Active        bool
+	RequestedAt   time.Time
+	DeactivatedAt *time.Time
+	// AllChannels is unset if the opt-out only covers the user's
+	// OptOutChannels
+	AllChannels bool
+	// ExpiresAt is when the opt-out ends, nil if it's permanent. Expired
+	// users count as undeleted before sweepExpiredOptOuts deactivates them.
+	ExpiresAt *time.Time
 }
 
 // NewDatabase ...
 func (ur *UnRustleLogs) NewDatabase() {
-	file := "/data/users.db"
-	if runtime.GOOS == "windows" {
-		file = "users.db"
+	dialect, dsn := ur.config.Database.Dialect, ur.config.Database.DSN
+	if dialect == "" {
+		dialect = "sqlite3"
+	}
+	if dsn == "" && dialect == "sqlite3" {
+		dsn = "/data/users.db"
+		if runtime.GOOS == "windows" {
+			dsn = "users.db"
+		}
+	}
+	switch dialect {
+	case "sqlite3", "postgres":
+	case "mysql":
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			logrus.Fatalf("invalid mysql database.dsn %s: %v", redactDSN(dialect, dsn), err)
+		}
+		dsn = mysqlDSN(cfg)
+	default:
+		logrus.Fatalf("unsupported database.dialect %q, use sqlite3, postgres or mysql", dialect)
 	}
 	var err error
-	ur.db, err = gorm.Open("sqlite3", file)
+	ur.db, err = ur.openDatabase(dialect, dsn)
 	if err != nil {
+		logrus.Fatalf("failed opening %s database %s: %v", dialect, redactDSN(dialect, dsn), err)
+	}
+
+	if err := ur.migrate(); err != nil {
 		logrus.Fatal(err)
 	}
+	ur.ready.migrated.Store(true)
+	if err := ur.encryptStoredEmails(); err != nil {
+		logrus.Fatal(err)
+	}
+	if ur.config.Database.UserCache == nil || *ur.config.Database.UserCache {
+		ur.userCache = newUserCache(ur.config.Database.UserCacheTTL.Duration)
+	}
+}
 
-	ur.db.AutoMigrate(&User{})
+// gormLogger logs failed and slow queries like gorm v1 did, a missing row is
+// a normal result of First.
+var gormLogger = logger.New(logrus.StandardLogger(), logger.Config{
+	SlowThreshold:             time.Second,
+	LogLevel:                  logger.Warn,
+	IgnoreRecordNotFoundError: true,
+})
+
+// dialector maps database.dialect to the gorm driver.
+func dialector(dialect, dsn string) gorm.Dialector {
+	switch dialect {
+	case "postgres":
+		return postgres.Open(dsn)
+	case "mysql":
+		return gormmysql.Open(dsn)
+	default:
+		return sqlite.Open(dsn)
+	}
 }
 
-// AddTwitchUser ...
-func (ur *UnRustleLogs) AddTwitchUser(user *TwitchUser) string {
-	if id, ok := ur.UserInDatabase(user.Name, TWITCHSERVICE); ok {
-		return id
+// openDatabase connects to the database. Unless database.wait is false it
+// retries with exponential backoff until database.wait_timeout, the database
+// container is often still starting when we do. A shutdown signal stops the
+// waiting.
+func (ur *UnRustleLogs) openDatabase(dialect, dsn string) (*gorm.DB, error) {
+	wait := ur.config.Database.Wait == nil || *ur.config.Database.Wait
+	deadline := time.Now().Add(ur.config.Database.WaitTimeout.Duration)
+	backoff := databaseRetryMin
+	for attempt := 1; ; attempt++ {
+		db, err := gorm.Open(dialector(dialect, dsn), &gorm.Config{Logger: gormLogger})
+		if err == nil {
+			return db, nil
+		}
+		left := time.Until(deadline)
+		if !wait || left <= 0 {
+			return nil, err
+		}
+		if backoff > left {
+			backoff = left
+		}
+		logrus.Warnf("database not ready (attempt %d), retrying in %s: %v", attempt, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ur.workerCtx.Done():
+			return nil, fmt.Errorf("stopped waiting for the database: %v", err)
+		}
+		backoff *= 2
+		if backoff > databaseRetryMax {
+			backoff = databaseRetryMax
+		}
 	}
-	id, _ := uuid.NewRandom()
-	ur.db.Create(&User{
-		ID:          id.String(),
-		Name:        user.Name,
-		DisplayName: user.DisplayName,
-		Email:       user.Email,
-		UserID:      user.ID,
-		Service:     TWITCHSERVICE,
-	})
-	return id.String()
 }
 
-// AddDggUser ...
-func (ur *UnRustleLogs) AddDggUser(user *DestinyggUser) string {
-	if id, ok := ur.UserInDatabase(user.Username, DESTINYGGSERVICE); ok {
-		return id
+// dsnPassword matches the password of key=value DSNs
+var dsnPassword = regexp.MustCompile(`(?i)(password=)('[^']*'|\S+)`)
+
+// mysqlDSN makes the driver scan DATETIME columns into time.Time and
+// store usernames as utf8mb4, which the DSN can't opt out of.
+func mysqlDSN(cfg *mysql.Config) string {
+	cfg.ParseTime = true
+	if cfg.Loc == nil || cfg.Loc == time.Local {
+		cfg.Loc = time.UTC
+	}
+	if !strings.HasPrefix(cfg.Collation, "utf8mb4") {
+		cfg.Collation = "utf8mb4_unicode_ci"
+	}
+	return cfg.FormatDSN()
+}
+
+// redactDSN hides the password of a DSN so it can be logged.
+func redactDSN(dialect, dsn string) string {
+	if dialect == "mysql" {
+		if cfg, err := mysql.ParseDSN(dsn); err == nil {
+			if cfg.Passwd != "" {
+				cfg.Passwd = "xxxxx"
+			}
+			return cfg.FormatDSN()
+		}
+		return "(unparsable dsn)"
+	}
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return dsnPassword.ReplaceAllString(dsn, "${1}xxxxx")
+}
+
+// normalizeName is how names are stored and looked up, login names of the
+// providers are case-insensitive.
+func normalizeName(name string) string {
+	return strings.ToLower(name)
+}
+
+// findUser looks the user up by the provider's user id, which survives
+// renames, and by name for rows from before the id was stored or providers
+// without one.
+func findUser(db *gorm.DB, service, userID, name string) User {
+	var u User
+	if userID != "" {
+		db.Where("service = ? and user_id = ?", service, userID).Order("active desc").First(&u)
+		if u.ID != "" {
+			return u
+		}
+	}
+	db.Where("name = ? and service = ?", name, service).First(&u)
+	if userID != "" && u.UserID != "" && u.UserID != userID {
+		// the name was given up by someone else
+		return User{}
+	}
+	return u
+}
+
+// AddUser stores the identity as a user of service unless it's already known
+// and returns the user's id, reactivating the user if it undeleted before.
+// A known user whose name changed since is renamed, the old name is
+// returned then. The opt-out ends at expiresAt unless it's nil, an active
+// user's expiry is only changed by a non-nil one. Concurrent logins of the
+// same user end up with the same row, the loser of the insert race reads the
+// winner's. The user linked to it, if any, is opted out the same way.
+func (ur *UnRustleLogs) AddUser(service string, ident *Identity, expiresAt *time.Time) (id, renamedFrom string, err error) {
+	id, renamedFrom, err = ur.addUser(service, ident, expiresAt)
+	if err != nil {
+		return "", "", err
+	}
+	if linked, ok := ur.LinkedUser(id); ok {
+		linkedIdent := &Identity{UserID: linked.UserID, Name: linked.Name, DisplayName: linked.DisplayName, Nick: linked.Nick, Email: linked.Email}
+		if _, _, err := ur.addUser(linked.Service, linkedIdent, expiresAt); err != nil {
+			return "", "", err
+		}
+	}
+	return id, renamedFrom, nil
+}
+
+// LoginUser returns the id of the user of the identity that just logged in.
+// Unknown users are added opted out until expiresAt like AddUser does, known
+// ones keep their opt-out state, so logging in after opting back in doesn't
+// hide the logs again. A known user whose name changed since is renamed, the
+// old name is returned then.
+func (ur *UnRustleLogs) LoginUser(service string, ident *Identity, expiresAt *time.Time) (id, renamedFrom string, err error) {
+	name := normalizeName(ident.Name)
+	u := findUser(ur.db, service, ident.UserID, name)
+	if u.ID == "" {
+		return ur.AddUser(service, ident, expiresAt)
+	}
+	setUserID := u.UserID == "" && ident.UserID != ""
+	if u.Name == name && !setUserID {
+		return u.ID, "", nil
 	}
-	id, _ := uuid.NewRandom()
-	ur.db.Create(&User{
-		ID:          id.String(),
-		Name:        user.Username,
-		DisplayName: user.Nick,
-		UserID:      user.UserID,
-		Service:     DESTINYGGSERVICE,
+	oldName := u.Name
+	var events []WebhookEvent
+	err = ur.db.Transaction(func(tx *gorm.DB) (err error) {
+		if setUserID {
+			if err := tx.Model(&u).Update("user_id", ident.UserID).Error; err != nil {
+				return err
+			}
+		}
+		events, err = renameUser(tx, &u, name, ident.DisplayName)
+		return err
 	})
-	return id.String()
+	ur.userCache.invalidate(userCacheKey(oldName, service), userCacheKey(name, service))
+	if err != nil {
+		return "", "", fmt.Errorf("failed updating %s user %s: %v", service, name, err)
+	}
+	ur.notifyAll(events)
+	if oldName != name {
+		renamedFrom = oldName
+	}
+	return u.ID, renamedFrom, nil
 }
 
-// DeleteUser ...
-func (ur *UnRustleLogs) DeleteUser(name, service string) {
+// addUser is AddUser without the linked user.
+func (ur *UnRustleLogs) addUser(service string, ident *Identity, expiresAt *time.Time) (id, renamedFrom string, err error) {
+	name := normalizeName(ident.Name)
+	now := time.Now().UTC()
+	tx := ur.db.Begin()
+	u := findUser(tx, service, ident.UserID, name)
+	if u.ID != "" {
+		updates := map[string]interface{}{}
+		reactivated := !u.optedOut(now)
+		// an expired user that wasn't swept yet is still listed
+		listed := reactivated && !u.Active
+		if reactivated {
+			updates["active"] = true
+			updates["requested_at"] = now
+			updates["deactivated_at"] = nil
+			updates["expires_at"] = expiresAt
+		} else if expiresAt != nil {
+			updates["expires_at"] = expiresAt
+		}
+		if u.UserID == "" && ident.UserID != "" {
+			updates["user_id"] = ident.UserID
+		}
+		if len(updates) == 0 && u.Name == name {
+			tx.Rollback()
+			return u.ID, "", nil
+		}
+		oldName := u.Name
+		keys := []string{userCacheKey(oldName, service), userCacheKey(name, service)}
+		var events []WebhookEvent
+		if len(updates) > 0 {
+			err = tx.Model(&u).Updates(updates).Error
+		}
+		if err == nil && oldName != name {
+			renamedFrom = oldName
+			// the old name of a reactivated user wasn't listed, the new
+			// one is added below
+			u.Active = u.Active && !listed
+			events, err = renameUser(tx, &u, name, ident.DisplayName)
+		}
+		if err == nil && listed {
+			err = recordChange(tx, &u, changeAdded)
+		}
+		if err == nil {
+			err = tx.Commit().Error
+		} else {
+			tx.Rollback()
+		}
+		ur.userCache.invalidate(keys...)
+		if err != nil {
+			return "", "", fmt.Errorf("failed updating %s user %s: %v", service, name, err)
+		}
+		ur.notifyAll(events)
+		// renameUser notified the move of a user that was listed already
+		if listed || (reactivated && oldName == name) {
+			ur.notify(service, name, webhookOptOut)
+		}
+		return u.ID, renamedFrom, nil
+	}
+	uid, err := uuid.NewRandom()
+	if err != nil {
+		tx.Rollback()
+		return "", "", err
+	}
+	err = tx.Create(&User{
+		ID:          uid.String(),
+		Name:        name,
+		DisplayName: ident.DisplayName,
+		Nick:        ident.Nick,
+		Email:       ident.Email,
+		UserID:      ident.UserID,
+		Service:     service,
+		Active:      true,
+		RequestedAt: now,
+		AllChannels: true,
+		ExpiresAt:   expiresAt,
+	}).Error
+	if err == nil {
+		err = recordChange(tx, &User{Service: service, Name: name}, changeAdded)
+	}
+	if err == nil {
+		err = tx.Commit().Error
+	} else {
+		tx.Rollback()
+	}
+	ur.userCache.invalidate(userCacheKey(name, service))
+	if err != nil {
+		if existing, ok := ur.UserInDatabase(name, service, ""); ok {
+			return existing, "", nil
+		}
+		return "", "", fmt.Errorf("failed adding %s user %s: %v", service, name, err)
+	}
+	ur.notify(service, name, webhookOptOut)
+	return uid.String(), "", nil
+}
+
+// RenameUser changes the name of the user with the row id, see renameUser.
+func (ur *UnRustleLogs) RenameUser(service, id, newName string) error {
+	newName = normalizeName(newName)
+	tx := ur.db.Begin()
 	var u User
-	ur.db.Where("name = ? and service = ?", name, service).First(&u)
-	if name == u.Name && service == u.Service {
-		ur.db.Delete(&u)
+	if err := tx.Where("id = ? and service = ?", id, service).First(&u).Error; err != nil {
+		tx.Rollback()
+		return err
 	}
+	oldName := u.Name
+	events, err := renameUser(tx, &u, newName, u.DisplayName)
+	if err == nil {
+		err = tx.Commit().Error
+	} else {
+		tx.Rollback()
+	}
+	ur.userCache.invalidate(userCacheKey(oldName, service), userCacheKey(newName, service))
+	if err != nil {
+		return err
+	}
+	ur.notifyAll(events)
+	return nil
 }
 
-// UserInDatabase ...
-func (ur *UnRustleLogs) UserInDatabase(name, service string) (string, bool) {
+// displacedName is what a row is renamed to when its name is taken over,
+// providers don't allow ~ in names so it can't collide.
+func displacedName(u *User) string {
+	return "~" + u.ID
+}
+
+// renameUser renames u as part of tx and writes an audit entry. Another row
+// holding the new name is stale, its owner renamed and the name was taken
+// by u since, so that row gives the name up. Active users move to the new
+// name in the opt-out changes, the returned events are the same moves for
+// notifyAll once tx is committed.
+func renameUser(tx *gorm.DB, u *User, newName, displayName string) ([]WebhookEvent, error) {
+	if u.Name == newName {
+		return nil, nil
+	}
+	var events []WebhookEvent
+	var other User
+	tx.Where("name = ? and service = ? and id <> ?", newName, u.Service, u.ID).First(&other)
+	if other.ID != "" {
+		if other.Active {
+			if err := recordChange(tx, &other, changeRemoved); err != nil {
+				return nil, err
+			}
+			events = append(events, WebhookEvent{Service: other.Service, Name: other.Name, Action: webhookOptIn})
+		}
+		err := tx.Model(&other).Update("name", displacedName(&other)).Error
+		if err != nil {
+			return nil, err
+		}
+		if err := audit(tx, &other, auditRenameDisplaced, fmt.Sprintf("%s taken over by user %s", newName, u.ID)); err != nil {
+			return nil, err
+		}
+	}
+	oldName := u.Name
+	if u.Active {
+		if err := recordChange(tx, u, changeRemoved); err != nil {
+			return nil, err
+		}
+		events = append(events, WebhookEvent{Service: u.Service, Name: oldName, Action: webhookOptIn})
+	}
+	err := tx.Model(u).Updates(map[string]interface{}{"name": newName, "display_name": displayName}).Error
+	if err != nil {
+		return nil, err
+	}
+	if u.Active {
+		if err := recordChange(tx, u, changeAdded); err != nil {
+			return nil, err
+		}
+		events = append(events, WebhookEvent{Service: u.Service, Name: newName, Action: webhookOptOut})
+	}
+	return events, audit(tx, u, auditRename, fmt.Sprintf("%s -> %s", oldName, newName))
+}
+
+// DeleteUser deactivates the user and the user linked to it, if any. The
+// user is matched by the provider's userID if it's known, by name otherwise.
+// The rows and the link are kept so it stays known that they opted out
+// before, and opting out again covers both.
+func (ur *UnRustleLogs) DeleteUser(name, service, userID string) error {
+	name = normalizeName(name)
+	u := findUser(ur.db, service, userID, name)
+	if u.ID == "" || !u.Active {
+		return nil
+	}
+	ids := []string{u.ID}
+	keys := []string{userCacheKey(u.Name, u.Service)}
+	deactivated := []User{u}
+	if linked, ok := ur.LinkedUser(u.ID); ok {
+		ids = append(ids, linked.ID)
+		keys = append(keys, userCacheKey(linked.Name, linked.Service))
+		if linked.Active {
+			deactivated = append(deactivated, *linked)
+		}
+	}
+	err := ur.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&User{}).Where("id in (?)", ids).Updates(map[string]interface{}{
+			"active":         false,
+			"deactivated_at": time.Now().UTC(),
+		}).Error
+		if err != nil {
+			return err
+		}
+		for i := range deactivated {
+			if err := recordChange(tx, &deactivated[i], changeRemoved); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	ur.userCache.invalidate(keys...)
+	if err != nil {
+		return fmt.Errorf("failed deactivating %s user %s: %v", service, name, err)
+	}
+	for _, d := range deactivated {
+		ur.notify(d.Service, d.Name, webhookOptIn)
+	}
+	return nil
+}
+
+// UserInDatabase looks the active user up by name, ignoring case. Names are
+// stored lowercased so the result doesn't depend on the collation of the
+// database. With a channel only users whose opt-out covers it are found, the
+// channel has to be normalized already.
+func (ur *UnRustleLogs) UserInDatabase(name, service, channel string) (string, bool) {
+	name = normalizeName(name)
+	key := userCacheKey(name, service)
+	id, ok, hit, generation := ur.userCache.get(key, channel)
+	if hit {
+		return id, ok
+	}
 	var u User
-	ur.db.Where("name = ? and service = ?", name, service).First(&u)
-	return u.ID, u.Name == name && u.Service == service
+	q := unexpired(ur.db.Where("name = ? and service = ? and active = ?", name, service, true), time.Now().UTC())
+	err := ur.optedOutIn(q, channel).First(&u).Error
+	ok = u.ID != "" && u.Name == name && u.Service == service
+	if err == nil || errors.Is(err, gorm.ErrRecordNotFound) {
+		ur.userCache.put(key, channel, u.ID, ok, generation)
+	}
+	return u.ID, ok
+}
+
+// UsersInDatabase reports for each name whether it's an active user of
+// service whose opt-out covers channel, see UserInDatabase, keyed by the
+// normalized name. It's a single query however many names there are.
+func (ur *UnRustleLogs) UsersInDatabase(names []string, service, channel string) (map[string]bool, error) {
+	result := make(map[string]bool, len(names))
+	for _, name := range names {
+		result[normalizeName(name)] = false
+	}
+	if len(result) == 0 {
+		return result, nil
+	}
+	normalized := make([]string, 0, len(result))
+	for name := range result {
+		normalized = append(normalized, name)
+	}
+	var found []string
+	q := ur.db.Model(&User{}).Where("service = ? and active = ? and name in ?", service, true, normalized)
+	q = unexpired(q, time.Now().UTC())
+	err := ur.optedOutIn(q, channel).Pluck("name", &found).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range found {
+		result[name] = true
+	}
+	return result, nil
+}
+
+// UserIDInDatabase is UserInDatabase for the provider's user id, falling back
+// to the name for users stored before the id was.
+func (ur *UnRustleLogs) UserIDInDatabase(userID, name, service string) (string, bool) {
+	u := findUser(ur.db, service, userID, normalizeName(name))
+	return u.ID, u.ID != "" && u.optedOut(time.Now().UTC())
 }
 
-// GetUser ...
-func (ur *UnRustleLogs) GetUser(id string) (*User, bool) {
+// OptOut is an active opt-out as published to log sites
+type OptOut struct {
+	Name        string    `json:"name"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// ListOptOuts returns up to limit active opt-outs of service covering
+// channel, if there is one, ordered by name and starting after the name
+// after.
+func (ur *UnRustleLogs) ListOptOuts(service, channel, after string, limit int) ([]OptOut, error) {
+	q := ur.db.Model(&User{}).Where("service = ? and active = ? and name > ?", service, true, after)
+	q = ur.optedOutIn(unexpired(q, time.Now().UTC()), channel)
+	optOuts := []OptOut{}
+	err := q.Select("name, requested_at").Order("name").Limit(limit).Scan(&optOuts).Error
+	for i := range optOuts {
+		optOuts[i].RequestedAt = optOuts[i].RequestedAt.UTC()
+	}
+	return optOuts, err
+}
+
+// OptOutNames returns the names of every active opt-out of service.
+func (ur *UnRustleLogs) OptOutNames(service string) ([]string, error) {
+	var names []string
+	q := unexpired(ur.db.Model(&User{}).Where("service = ? and active = ?", service, true), time.Now().UTC())
+	err := q.Pluck("name", &names).Error
+	return names, err
+}
+
+// OptOutsVersion returns a token that changes whenever the opt-outs
+// ListOptOuts returns for service and channel do, given the lastChangeID.
+// Opt-outs, deletions, renames and the expiry sweep all write a change, so
+// the id only grows with the list. Channel settings aren't changes, for a
+// channel the latest updated_at of the service's users, which
+// SetUserChannels bumps, is added.
+func (ur *UnRustleLogs) OptOutsVersion(lastChange uint, service, channel string) (string, error) {
+	version := strconv.FormatUint(uint64(lastChange), 10)
+	if channel == "" {
+		return version, nil
+	}
+	// the type of MAX differs by driver, a string compares all the same
+	var latest sql.NullString
+	err := ur.db.Model(&User{}).Where("service = ?", service).Select("max(updated_at)").Row().Scan(&latest)
+	if err != nil {
+		return "", err
+	}
+	return version + "-" + latest.String, nil
+}
+
+// UserFilter selects the users ListUsers returns.
+type UserFilter struct {
+	Service string
+	// Query is a substring of the name
+	Query string
+	// Channel limits the users to the ones whose opt-out covers it
+	Channel         string
+	IncludeInactive bool
+	Page            int
+	PerPage         int
+}
+
+// likeEscaper escapes the LIKE wildcards with !, which needs no escaping in
+// the string literals of any dialect
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// ListUsers returns a page of the users matching the filter, newest opt-outs
+// first, and how many match in total. Pages start at 1.
+func (ur *UnRustleLogs) ListUsers(f UserFilter) ([]User, int, error) {
+	q := ur.db.Model(&User{})
+	if f.Service != "" {
+		q = q.Where("service = ?", f.Service)
+	}
+	if f.Query != "" {
+		q = q.Where("name LIKE ? ESCAPE '!'", "%"+likeEscaper.Replace(normalizeName(f.Query))+"%")
+	}
+	if !f.IncludeInactive {
+		q = unexpired(q.Where("active = ?", true), time.Now().UTC())
+	}
+	q = ur.optedOutIn(q, f.Channel)
+	// a gorm v2 chain is changed by running it, Count and Find each get
+	// their own
+	q = q.Session(&gorm.Session{})
+	var total int64
+	if err := q.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	users := []User{}
+	err := q.Order("requested_at desc, name, service").
+		Offset((f.Page - 1) * f.PerPage).
+		Limit(f.PerPage).
+		Find(&users).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return users, int(total), nil
+}
+
+// GetUser returns the user with the row id, gorm.ErrRecordNotFound if there
+// is none. An email that can't be decrypted is logged, the user is returned
+// without it then together with an error wrapping errEmailDecrypt, callers
+// that don't need the email can ignore that one.
+func (ur *UnRustleLogs) GetUser(id string) (*User, error) {
 	var u User
-	ur.db.Where("id = ?", id).First(&u)
-	return &u, u.ID == id
+	err := ur.db.Where("id = ?", id).First(&u).Error
+	if errors.Is(err, errEmailDecrypt) {
+		logrus.Errorf("user %s: %v", id, err)
+		return &u, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
 }
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAddUserTwiceIsNoop(t *testing.T) {
+	ur := newTestRustle(t)
+	first := addTestUser(t, ur, TWITCHSERVICE, "Foo")
+	second := addTestUser(t, ur, TWITCHSERVICE, "foo")
+	if first != second {
+		t.Fatalf("second AddUser returned %s, want %s", second, first)
+	}
+	var users, changes int64
+	ur.db.Model(&User{}).Count(&users)
+	ur.db.Model(&OptOutChange{}).Count(&changes)
+	if users != 1 || changes != 1 {
+		t.Fatalf("%d users and %d changes, want 1 each", users, changes)
+	}
+}
+
+func TestConcurrentAddUser(t *testing.T) {
+	// the in-memory databases fail concurrent writes instead of waiting
+	ur := newTestRustleDSN(t, "file:"+filepath.Join(t.TempDir(), "test.db")+"?_txlock=immediate&_busy_timeout=5000")
+	const logins = 20
+	ids := make(chan string, logins)
+	var wg sync.WaitGroup
+	for i := 0; i < logins; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, _, err := ur.AddUser(TWITCHSERVICE, &Identity{UserID: "foo-id", Name: "foo"}, nil)
+			if err != nil {
+				t.Error(err)
+			}
+			ids <- id
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	first := <-ids
+	for id := range ids {
+		if id != first {
+			t.Fatalf("logins got the users %s and %s", first, id)
+		}
+	}
+	var users int64
+	ur.db.Model(&User{}).Where("name = ? and service = ?", "foo", TWITCHSERVICE).Count(&users)
+	if users != 1 {
+		t.Fatalf("%d rows, want 1", users)
+	}
+	if err := ur.DeleteUser("foo", TWITCHSERVICE, "foo-id"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ur.UserInDatabase("foo", TWITCHSERVICE, ""); ok {
+		t.Fatal("still opted out after one DeleteUser")
+	}
+}
+
+func TestMixedCaseNames(t *testing.T) {
+	tests := []struct {
+		write, read string
+	}{
+		{write: "FooBar", read: "foobar"},
+		{write: "foobar", read: "FOOBAR"},
+		{write: "FOOBAR", read: "FooBar"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.write+" "+tt.read, func(t *testing.T) {
+			ur := newTestRustle(t)
+			id := addTestUser(t, ur, TWITCHSERVICE, tt.write)
+			if u, err := ur.GetUser(id); err != nil || u.Name != "foobar" {
+				t.Fatalf("stored %v %v", u, err)
+			}
+			if found, ok := ur.UserInDatabase(tt.read, TWITCHSERVICE, ""); !ok || found != id {
+				t.Fatalf("UserInDatabase(%q) = %q, %v", tt.read, found, ok)
+			}
+			found, err := ur.UsersInDatabase([]string{tt.read}, TWITCHSERVICE, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !found["foobar"] {
+				t.Fatalf("UsersInDatabase(%q) = %v", tt.read, found)
+			}
+			if err := ur.DeleteUser(tt.read, TWITCHSERVICE, ""); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := ur.UserInDatabase(tt.write, TWITCHSERVICE, ""); ok {
+				t.Fatalf("DeleteUser(%q) didn't opt %q in", tt.read, tt.write)
+			}
+		})
+	}
+}
+
+func TestListUsersPages(t *testing.T) {
+	ur := newTestRustle(t)
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	// b and c opted out at the same time, the name breaks the tie
+	requested := map[string]time.Time{
+		"a": base, "b": base.Add(time.Hour), "c": base.Add(time.Hour), "d": base.Add(2 * time.Hour), "e_x": base.Add(3 * time.Hour),
+	}
+	for name, at := range requested {
+		id := addTestUser(t, ur, TWITCHSERVICE, name)
+		if err := ur.db.Model(&User{}).Where("id = ?", id).Update("requested_at", at).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	addTestUser(t, ur, DESTINYGGSERVICE, "f")
+	if err := ur.DeleteUser("d", TWITCHSERVICE, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter UserFilter
+		want   []string
+		total  int
+	}{
+		{name: "first page", filter: UserFilter{Service: TWITCHSERVICE, Page: 1, PerPage: 2}, want: []string{"e_x", "b"}, total: 4},
+		{name: "last full page", filter: UserFilter{Service: TWITCHSERVICE, Page: 2, PerPage: 2}, want: []string{"c", "a"}, total: 4},
+		{name: "past the last page", filter: UserFilter{Service: TWITCHSERVICE, Page: 3, PerPage: 2}, want: []string{}, total: 4},
+		{name: "partial last page", filter: UserFilter{Service: TWITCHSERVICE, Page: 2, PerPage: 3}, want: []string{"a"}, total: 4},
+		{name: "inactive users", filter: UserFilter{Service: TWITCHSERVICE, IncludeInactive: true, Page: 1, PerPage: 2}, want: []string{"e_x", "d"}, total: 5},
+		{name: "all services", filter: UserFilter{Page: 1, PerPage: 1}, want: []string{"f"}, total: 5},
+		{name: "search", filter: UserFilter{Query: "X", Page: 1, PerPage: 10}, want: []string{"e_x"}, total: 1},
+		{name: "wildcards are literal", filter: UserFilter{Query: "_", Page: 1, PerPage: 10}, want: []string{"e_x"}, total: 1},
+		{name: "no match", filter: UserFilter{Query: "%", Page: 1, PerPage: 10}, want: []string{}, total: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, total, err := ur.ListUsers(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := []string{}
+			for _, u := range users {
+				names = append(names, u.Name)
+			}
+			if !reflect.DeepEqual(names, tt.want) || total != tt.total {
+				t.Fatalf("got %v of %d, want %v of %d", names, total, tt.want, tt.total)
+			}
+		})
+	}
+}
+
+func TestRenameUser(t *testing.T) {
+	tests := []struct {
+		name string
+		// taken is whether another row holds the new name, otherActive
+		// whether it's opted out
+		taken, otherActive bool
+		// events are the name and action of every notification
+		events []string
+	}{
+		{name: "free name", events: []string{"foo opt_in", "bar opt_out"}},
+		{name: "name of an opted in user", taken: true, events: []string{"foo opt_in", "bar opt_out"}},
+		{name: "name of an opted out user", taken: true, otherActive: true, events: []string{"bar opt_in", "foo opt_in", "bar opt_out"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := newTestRustle(t)
+			id := addTestUser(t, ur, TWITCHSERVICE, "foo")
+			var other string
+			if tt.taken {
+				other = addTestUser(t, ur, TWITCHSERVICE, "bar")
+				if !tt.otherActive {
+					if err := ur.DeleteUser("bar", TWITCHSERVICE, "bar-id"); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			sub := ur.changes.subscribe(TWITCHSERVICE)
+			if err := ur.RenameUser(TWITCHSERVICE, id, "Bar"); err != nil {
+				t.Fatal(err)
+			}
+			ur.changes.unsubscribe(sub)
+			var events []string
+			for e := range sub.events {
+				events = append(events, e.Name+" "+e.Action)
+			}
+			if !reflect.DeepEqual(events, tt.events) {
+				t.Fatalf("notified %v, want %v", events, tt.events)
+			}
+			if found, ok := ur.UserInDatabase("bar", TWITCHSERVICE, ""); !ok || found != id {
+				t.Fatalf("bar is %q, %v, want the renamed user", found, ok)
+			}
+			if _, ok := ur.UserInDatabase("foo", TWITCHSERVICE, ""); ok {
+				t.Fatal("the old name is still opted out")
+			}
+			var renames int64
+			ur.db.Model(&AuditEntry{}).Where("user_row_id = ? and action = ?", id, auditRename).Count(&renames)
+			if renames != 1 {
+				t.Fatalf("%d rename audit entries, want 1", renames)
+			}
+			if other == "" {
+				return
+			}
+			displaced, err := ur.GetUser(other)
+			if err != nil || displaced.Name != "~"+other {
+				t.Fatalf("the other row is %v %v", displaced, err)
+			}
+			var entries int64
+			ur.db.Model(&AuditEntry{}).Where("user_row_id = ? and action = ?", other, auditRenameDisplaced).Count(&entries)
+			if entries != 1 {
+				t.Fatalf("%d displaced audit entries, want 1", entries)
+			}
+			// log sites following the changes must not hide bar twice
+			var added, removed int64
+			ur.db.Model(&OptOutChange{}).Where("name = ? and action = ?", "bar", changeAdded).Count(&added)
+			ur.db.Model(&OptOutChange{}).Where("name = ? and action = ?", "bar", changeRemoved).Count(&removed)
+			if added-removed != 1 {
+				t.Fatalf("bar was added %d and removed %d times", added, removed)
+			}
+		})
+	}
+}
+
+func TestLoginUser(t *testing.T) {
+	tests := []struct {
+		name  string
+		login string
+		// optedIn is whether foo opted back in before the login
+		optedIn     bool
+		renamedFrom string
+		want        bool
+		events      []string
+	}{
+		{name: "opted out", login: "foo", want: true},
+		{name: "opted back in", login: "foo", optedIn: true, want: false},
+		{name: "renamed", login: "Baz", renamedFrom: "foo", want: true, events: []string{"foo opt_in", "baz opt_out"}},
+		{name: "renamed after opting back in", login: "Baz", optedIn: true, renamedFrom: "foo", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := newTestRustle(t)
+			id := addTestUser(t, ur, TWITCHSERVICE, "foo")
+			if tt.optedIn {
+				if err := ur.DeleteUser("foo", TWITCHSERVICE, "foo-id"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sub := ur.changes.subscribe(TWITCHSERVICE)
+			got, renamedFrom, err := ur.LoginUser(TWITCHSERVICE, &Identity{UserID: "foo-id", Name: tt.login}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ur.changes.unsubscribe(sub)
+			var events []string
+			for e := range sub.events {
+				events = append(events, e.Name+" "+e.Action)
+			}
+			if !reflect.DeepEqual(events, tt.events) {
+				t.Fatalf("notified %v, want %v", events, tt.events)
+			}
+			if got != id || renamedFrom != tt.renamedFrom {
+				t.Fatalf("got %s renamed from %q, want %s renamed from %q", got, renamedFrom, id, tt.renamedFrom)
+			}
+			if _, ok := ur.UserInDatabase(tt.login, TWITCHSERVICE, ""); ok != tt.want {
+				t.Fatalf("%s opted out %v, want %v", tt.login, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginUserAddsNewUsers(t *testing.T) {
+	ur := newTestRustle(t)
+	id, _, err := ur.LoginUser(TWITCHSERVICE, &Identity{UserID: "foo-id", Name: "foo"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := ur.UserInDatabase("foo", TWITCHSERVICE, ""); !ok || got != id {
+		t.Fatalf("got %q %v, want %s opted out", got, ok, id)
+	}
+}
@@ -1,27 +1,44 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"time"
+	"net/url"
 
-	"github.com/dgrijalva/jwt-go"
-	"github.com/sirupsen/logrus"
-
-	"github.com/dchest/uniuri"
-	"github.com/gin-gonic/gin"
 	"github.com/tensei/dggoauth"
 )
 
+// dggRevokeURL is used when no revoke_url is configured
+const dggRevokeURL = "https://www.destiny.gg/oauth/revoke"
+
+// code_challenge_method values for dgg, legacy is the challenge derived from
+// the client secret that older dgg versions expect
+const (
+	dggChallengeS256   = "S256"
+	dggChallengePlain  = "plain"
+	dggChallengeLegacy = "legacy"
+)
+
 var destinggClient *dggoauth.Client
 
 func (ur *UnRustleLogs) setupDestinyggClient() error {
+	switch ur.config.Destinygg.CodeChallengeMethod {
+	case "":
+		ur.config.Destinygg.CodeChallengeMethod = dggChallengeS256
+	case dggChallengeS256, dggChallengePlain, dggChallengeLegacy:
+	default:
+		return fmt.Errorf("invalid destinygg.code_challenge_method %q", ur.config.Destinygg.CodeChallengeMethod)
+	}
 	c, err := dggoauth.NewClient(&dggoauth.Options{
 		ClientID:     ur.config.Destinygg.ClientID,
 		ClientSecret: ur.config.Destinygg.ClientSecret,
 		RedirectURI:  ur.config.Destinygg.RedirectURL,
+		HTTPClient:   ur.httpClient,
 	})
 	if err != nil {
 		return err
@@ -30,65 +47,99 @@ func (ur *UnRustleLogs) setupDestinyggClient() error {
 	return nil
 }
 
-// DestinyggLoginHandle ...
-func (ur *UnRustleLogs) DestinyggLoginHandle(c *gin.Context) {
-	state := uniuri.NewLen(60)
-	url, verifier := destinggClient.GetAuthorizationURL(state)
-	ur.addDggState(state, verifier)
+// dggCodeChallenge derives the PKCE challenge sent to dgg for verifier.
+func (ur *UnRustleLogs) dggCodeChallenge(verifier string) string {
+	switch ur.config.Destinygg.CodeChallengeMethod {
+	case dggChallengePlain:
+		return verifier
+	case dggChallengeLegacy:
+		secret := fmt.Sprintf("%x", sha256.Sum256([]byte(ur.config.Destinygg.ClientSecret)))
+		sum := fmt.Sprintf("%x", sha256.Sum256([]byte(verifier+secret)))
+		return base64.StdEncoding.EncodeToString([]byte(sum))
+	}
+	return codeChallengeS256(verifier)
+}
+
+type dggProvider struct {
+	ur *UnRustleLogs
+}
+
+// Service ...
+func (p *dggProvider) Service() string {
+	return DESTINYGGSERVICE
+}
+
+// Name ...
+func (p *dggProvider) Name() string {
+	return "Destiny.gg"
+}
+
+// Path ...
+func (p *dggProvider) Path() string {
+	return "/dgg"
+}
+
+// CookieName ...
+func (p *dggProvider) CookieName() string {
+	return p.ur.config.Destinygg.Cookie
+}
 
-	c.Header("Location", url)
-	c.Redirect(http.StatusFound, url)
+// RedirectURL ...
+func (p *dggProvider) RedirectURL() string {
+	return p.ur.config.Destinygg.RedirectURL
 }
 
-// DestinyggCallbackHandle ...
-func (ur *UnRustleLogs) DestinyggCallbackHandle(c *gin.Context) {
-	state := c.Query("state")
-	verifier, ok := ur.hasDggState(state)
-	if !ok {
-		c.Redirect(http.StatusFound, "/")
-		return
+// AuthURL ...
+func (p *dggProvider) AuthURL(req authRequest) string {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ur.config.Destinygg.ClientID)
+	v.Set("redirect_uri", req.RedirectURI)
+	v.Set("state", req.State)
+	v.Set("code_challenge", p.ur.dggCodeChallenge(req.Verifier))
+	// legacy dgg doesn't know the parameter
+	if m := p.ur.config.Destinygg.CodeChallengeMethod; m != dggChallengeLegacy {
+		v.Set("code_challenge_method", m)
 	}
-	go ur.deleteDggState(state)
-	code := c.Query("code")
-	access, err := destinggClient.GetAccessToken(code, verifier)
+	return fmt.Sprintf("%s?%s", dggoauth.AuthURL, v.Encode())
+}
+
+// Exchange ...
+func (p *dggProvider) Exchange(ctx context.Context, redirectURI, code, verifier string) (*Identity, error) {
+	var access *dggoauth.AccessTokenResponse
+	err := withRetry(ctx, DESTINYGGSERVICE, "token exchange", func() (err error) {
+		access, err = p.ur.getDggAccessToken(ctx, code, verifier, redirectURI)
+		return err
+	})
 	if err != nil {
-		logrus.Error(err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"message": "something went wrong try again",
-		})
-		return
+		return nil, err
 	}
-	user, err := ur.getDggUser(access.AccessToken)
+	var user *DestinyggUser
+	err = withRetry(ctx, DESTINYGGSERVICE, "userinfo", func() (err error) {
+		user, err = p.ur.getDggUser(ctx, access.AccessToken)
+		return err
+	})
 	if err != nil {
-		logrus.Error(err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"message": "failed getting userinfo",
-		})
-		return
-	}
-
-	id := ur.AddDggUser(user)
-	// Set custom claims
-	claims := &jwtClaims{
-		id,
-		jwt.StandardClaims{
-			// 1 month expire
-			ExpiresAt: time.Now().Add((time.Hour * 24) * 31).Unix(),
-		},
+		return nil, err
 	}
+	return &Identity{
+		UserID:       user.UserID,
+		Name:         user.Username,
+		DisplayName:  user.Nick,
+		AccessToken:  access.AccessToken,
+		RefreshToken: access.RefreshToken,
+		ExpiresIn:    access.ExpiresIn,
+	}, nil
+}
 
-	// Create token with claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	// Generate encoded token and send it as response.
-	t, err := token.SignedString([]byte(ur.config.Server.JWTSecret))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed signing jwt"})
-		return
-	}
+// RevokeOnLogout ...
+func (p *dggProvider) RevokeOnLogout() bool {
+	return p.ur.config.Destinygg.RevokeOnLogout
+}
 
-	c.SetCookie(ur.config.Destinygg.Cookie, t, 604800, "/", fmt.Sprintf("%s", c.Request.Host), c.Request.URL.Scheme == "https", false)
-	c.Redirect(http.StatusFound, "/")
+// Revoke ...
+func (p *dggProvider) Revoke(userID string) error {
+	return p.ur.revokeDggToken(userID)
 }
 
 // DestinyggUser ...
@@ -103,9 +154,47 @@ type DestinyggUser struct {
 	Username string `json:"username"`
 }
 
-func (ur *UnRustleLogs) getDggUser(accessToken string) (*DestinyggUser, error) {
+// getDggAccessToken exchanges the code like dggoauth's GetAccessToken, but
+// with ctx and a *statusError for non 200 responses so 5xx ones are retried.
+func (ur *UnRustleLogs) getDggAccessToken(ctx context.Context, code, verifier, redirectURI string) (*dggoauth.AccessTokenResponse, error) {
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("client_id", ur.config.Destinygg.ClientID)
+	v.Set("redirect_uri", redirectURI)
+	v.Set("code_verifier", verifier)
+	req, err := http.NewRequestWithContext(ctx, "GET", dggoauth.TokenURL+"?"+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := ur.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, &statusError{Service: DESTINYGGSERVICE, StatusCode: response.StatusCode, Body: string(body)}
+	}
+	var token dggoauth.AccessTokenResponse
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (ur *UnRustleLogs) getDggUser(ctx context.Context, accessToken string) (*DestinyggUser, error) {
 	dggURL := fmt.Sprintf("https://destiny.gg/api/userinfo?token=%s", accessToken)
-	response, err := http.Get(dggURL)
+	req, err := http.NewRequestWithContext(ctx, "GET", dggURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := ur.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -115,6 +204,9 @@ func (ur *UnRustleLogs) getDggUser(accessToken string) (*DestinyggUser, error) {
 	if err != nil {
 		return nil, err
 	}
+	if response.StatusCode != http.StatusOK {
+		return nil, &statusError{Service: DESTINYGGSERVICE, StatusCode: response.StatusCode, Body: string(body)}
+	}
 	var userinfo DestinyggUser
 	err = json.Unmarshal(body, &userinfo)
 	if err != nil {
@@ -123,8 +215,27 @@ func (ur *UnRustleLogs) getDggUser(accessToken string) (*DestinyggUser, error) {
 	return &userinfo, nil
 }
 
-// DestinyggLogoutHandle ...
-func (ur *UnRustleLogs) DestinyggLogoutHandle(c *gin.Context) {
-	ur.deleteCookie(c, ur.config.Destinygg.Cookie)
-	c.Redirect(http.StatusFound, "/")
+// revokeDggToken revokes the stored OAuth grant of a user on dgg's side.
+func (ur *UnRustleLogs) revokeDggToken(userID string) error {
+	accessToken, err := ur.storedAccessToken(DESTINYGGSERVICE, userID)
+	if err != nil {
+		return err
+	}
+	revokeURL := ur.config.Destinygg.RevokeURL
+	if revokeURL == "" {
+		revokeURL = dggRevokeURL
+	}
+	response, err := ur.httpClient.PostForm(revokeURL, url.Values{
+		"client_id": {ur.config.Destinygg.ClientID},
+		"token":     {accessToken},
+	})
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("error revoking dgg token, status: %d", response.StatusCode)
+	}
+	ur.DeleteToken(DESTINYGGSERVICE, userID)
+	return nil
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// the example of RFC 7636 appendix B
+const (
+	rfc7636Verifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	rfc7636Challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+func TestCodeChallengeS256(t *testing.T) {
+	if got := codeChallengeS256(rfc7636Verifier); got != rfc7636Challenge {
+		t.Fatalf("got %q, want %q", got, rfc7636Challenge)
+	}
+}
+
+func TestDggCodeChallenge(t *testing.T) {
+	secret := fmt.Sprintf("%x", sha256.Sum256([]byte("secret")))
+	legacy := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%x", sha256.Sum256([]byte(rfc7636Verifier+secret)))))
+	tests := []struct {
+		method    string
+		challenge string
+		// sentMethod is the code_challenge_method of the auth url
+		sentMethod string
+	}{
+		{method: "", challenge: rfc7636Challenge, sentMethod: dggChallengeS256},
+		{method: dggChallengeS256, challenge: rfc7636Challenge, sentMethod: dggChallengeS256},
+		{method: dggChallengePlain, challenge: rfc7636Verifier, sentMethod: dggChallengePlain},
+		{method: dggChallengeLegacy, challenge: legacy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			ur := newDggRustle(t, tt.method, nil)
+			p := testProvider(t, ur, DESTINYGGSERVICE)
+			u, err := url.Parse(p.AuthURL(authRequest{RedirectURI: "http://localhost/dgg/callback", State: "state", Verifier: rfc7636Verifier}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := u.Query().Get("code_challenge"); got != tt.challenge {
+				t.Errorf("challenge %q, want %q", got, tt.challenge)
+			}
+			if got := u.Query().Get("code_challenge_method"); got != tt.sentMethod {
+				t.Errorf("method %q, want %q", got, tt.sentMethod)
+			}
+		})
+	}
+}
+
+func TestInvalidDggCodeChallengeMethod(t *testing.T) {
+	ur := newTestRustle(t)
+	ur.config.Destinygg.CodeChallengeMethod = "S512"
+	if err := ur.setupDestinyggClient(); err == nil {
+		t.Fatal("setupDestinyggClient accepted S512")
+	}
+}
+
+// roundTripperFunc lets a function answer the requests of an http.Client
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// newDggRustle is newTestRustle with a dgg client using the challenge
+// method whose requests go to transport.
+func newDggRustle(t *testing.T, method string, transport http.RoundTripper) *UnRustleLogs {
+	t.Helper()
+	ur := newTestRustle(t)
+	ur.config.Destinygg.ClientID = "client"
+	ur.config.Destinygg.ClientSecret = "secret"
+	ur.config.Destinygg.RedirectURL = "http://localhost/dgg/callback"
+	ur.config.Destinygg.CodeChallengeMethod = method
+	ur.httpClient = &http.Client{Transport: transport}
+	if err := ur.setupDestinyggClient(); err != nil {
+		t.Fatal(err)
+	}
+	return ur
+}
+
+// fakeDgg answers token exchanges like dgg, the verifier has to match the
+// S256 challenge.
+func fakeDgg(challenge string) http.RoundTripper {
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		status, body := http.StatusOK, `{"userId":"1","username":"Foo","nick":"Foo"}`
+		if r.URL.Path == "/oauth/token" {
+			body = `{"access_token":"token","expires_in":3600}`
+			if codeChallengeS256(r.URL.Query().Get("code_verifier")) != challenge {
+				status, body = http.StatusBadRequest, `{"error":"invalid_grant","message":"code verifier mismatch","code":400}`
+			}
+		}
+		return &http.Response{
+			StatusCode: status,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    r,
+		}, nil
+	})
+}
+
+func TestDggExchangeVerifier(t *testing.T) {
+	tests := []struct {
+		name     string
+		verifier string
+		wantErr  bool
+	}{
+		{name: "matching verifier", verifier: rfc7636Verifier},
+		{name: "mismatched verifier", verifier: strings.Repeat("a", 43), wantErr: true},
+		{name: "no verifier", verifier: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := newDggRustle(t, dggChallengeS256, fakeDgg(rfc7636Challenge))
+			p := testProvider(t, ur, DESTINYGGSERVICE)
+			ident, err := p.Exchange(context.Background(), "http://localhost/dgg/callback", "code", tt.verifier)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want one: %v", err, tt.wantErr)
+			}
+			if err == nil && ident.Name != "Foo" {
+				t.Fatalf("got user %q", ident.Name)
+			}
+		})
+	}
+}
+
+func TestDggExchangeRetriesTokenErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		calls   int
+		wantErr bool
+	}{
+		{name: "bad gateway", status: http.StatusBadGateway, calls: 2},
+		{name: "bad request", status: http.StatusBadRequest, calls: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dgg := fakeDgg(rfc7636Challenge)
+			calls := 0
+			ur := newDggRustle(t, dggChallengeS256, roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				if r.URL.Path != "/oauth/token" {
+					return dgg.RoundTrip(r)
+				}
+				if calls++; calls == 1 {
+					return &http.Response{StatusCode: tt.status, Body: io.NopCloser(strings.NewReader("")), Request: r}, nil
+				}
+				return dgg.RoundTrip(r)
+			}))
+			p := testProvider(t, ur, DESTINYGGSERVICE)
+			_, err := p.Exchange(context.Background(), "http://localhost/dgg/callback", "code", rfc7636Verifier)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want one: %v", err, tt.wantErr)
+			}
+			if calls != tt.calls {
+				t.Fatalf("token endpoint called %d times, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
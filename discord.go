@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	discordAuthURL  = "https://discord.com/api/oauth2/authorize"
+	discordTokenURL = "https://discord.com/api/oauth2/token"
+	discordUserURL  = "https://discord.com/api/users/@me"
+)
+
+// DiscordUser ...
+type DiscordUser struct {
+	ID            string `json:"id"`
+	Username      string `json:"username"`
+	Discriminator string `json:"discriminator"`
+	GlobalName    string `json:"global_name"`
+	Email         string `json:"email"`
+	Verified      bool   `json:"verified"`
+}
+
+type discordTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+func (ur *UnRustleLogs) discordEnabled() bool {
+	return ur.config.Discord.ClientID != ""
+}
+
+func (ur *UnRustleLogs) getDiscordAccessToken(ctx context.Context, code, redirectURI string) (*discordTokenResponse, error) {
+	v := url.Values{}
+	v.Set("client_id", ur.config.Discord.ClientID)
+	v.Set("client_secret", ur.config.Discord.ClientSecret)
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", redirectURI)
+
+	response, err := postForm(ctx, ur.httpClient, discordTokenURL, v)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting discord access_token, status: %d, body: %s", response.StatusCode, body)
+	}
+	var token discordTokenResponse
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (ur *UnRustleLogs) getDiscordUser(ctx context.Context, accessToken string) (*DiscordUser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", discordUserURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+
+	response, err := ur.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting discord user, status: %d, body: %s", response.StatusCode, body)
+	}
+	var user DiscordUser
+	err = json.Unmarshal(body, &user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+type discordProvider struct {
+	ur *UnRustleLogs
+}
+
+// Service ...
+func (p *discordProvider) Service() string {
+	return DISCORDSERVICE
+}
+
+// Name ...
+func (p *discordProvider) Name() string {
+	return "Discord"
+}
+
+// Path ...
+func (p *discordProvider) Path() string {
+	return "/discord"
+}
+
+// CookieName ...
+func (p *discordProvider) CookieName() string {
+	return p.ur.config.Discord.Cookie
+}
+
+// RedirectURL ...
+func (p *discordProvider) RedirectURL() string {
+	return p.ur.config.Discord.RedirectURL
+}
+
+// AuthURL ...
+func (p *discordProvider) AuthURL(req authRequest) string {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ur.config.Discord.ClientID)
+	v.Set("redirect_uri", req.RedirectURI)
+	v.Set("scope", strings.Join(p.ur.config.Discord.Scopes, " "))
+	v.Set("state", req.State)
+	return fmt.Sprintf("%s?%s", discordAuthURL, v.Encode())
+}
+
+// Exchange ...
+func (p *discordProvider) Exchange(ctx context.Context, redirectURI, code, verifier string) (*Identity, error) {
+	access, err := p.ur.getDiscordAccessToken(ctx, code, redirectURI)
+	if err != nil {
+		return nil, err
+	}
+	user, err := p.ur.getDiscordUser(ctx, access.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	displayName := user.GlobalName
+	if displayName == "" {
+		displayName = user.Username
+	}
+	return &Identity{
+		UserID:       user.ID,
+		Name:         user.Username,
+		DisplayName:  displayName,
+		Email:        user.Email,
+		AccessToken:  access.AccessToken,
+		RefreshToken: access.RefreshToken,
+		ExpiresIn:    access.ExpiresIn,
+	}, nil
+}
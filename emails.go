@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// encryptedEmailPrefix marks encrypted emails, followed by the key id, a
+// colon and encryptString's output. Emails without it are plaintext ones
+// from before database.email_key was set.
+const encryptedEmailPrefix = "enc:"
+
+var (
+	// errEmailDecrypt is returned by queries loading an email that can't be
+	// decrypted, the other fields of the user are still set
+	errEmailDecrypt    = errors.New("failed decrypting stored email")
+	errEmailKeyMissing = fmt.Errorf("%w, it's encrypted but no database.email_key is configured", errEmailDecrypt)
+
+	// emailKeys is used by the email serializer of every database, gorm
+	// has no way to hand it per connection
+	emailKeys atomic.Pointer[emailKeyring]
+)
+
+func init() {
+	schema.RegisterSerializer("email", emailSerializer{})
+}
+
+// emailKeyring encrypts with the current key and decrypts with any key that
+// is or was configured.
+type emailKeyring struct {
+	currentID string
+	keys      map[string]cipher.AEAD
+}
+
+// emailKeyID names a key in stored values without revealing it.
+func emailKeyID(hexKey string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(hexKey)))
+	return hex.EncodeToString(sum[:4])
+}
+
+func newEmailKeyring(current string, old []string) (*emailKeyring, error) {
+	k := &emailKeyring{currentID: emailKeyID(current), keys: make(map[string]cipher.AEAD, len(old)+1)}
+	for _, hexKey := range append([]string{current}, old...) {
+		aead, err := newAEAD(hexKey)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[emailKeyID(hexKey)] = aead
+	}
+	return k, nil
+}
+
+// encrypt returns what is stored for email, itself without a keyring.
+func (k *emailKeyring) encrypt(email string) (string, error) {
+	if k == nil || email == "" {
+		return email, nil
+	}
+	sealed, err := encryptString(k.keys[k.currentID], email)
+	if err != nil {
+		return "", err
+	}
+	return encryptedEmailPrefix + k.currentID + ":" + sealed, nil
+}
+
+// decrypt reverses encrypt, failures wrap errEmailDecrypt.
+func (k *emailKeyring) decrypt(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedEmailPrefix) {
+		return stored, nil
+	}
+	if k == nil {
+		return "", errEmailKeyMissing
+	}
+	id, sealed, ok := strings.Cut(strings.TrimPrefix(stored, encryptedEmailPrefix), ":")
+	aead, known := k.keys[id]
+	if !ok || !known {
+		return "", fmt.Errorf("%w, key %s is not configured", errEmailDecrypt, id)
+	}
+	email, err := decryptString(aead, sealed)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errEmailDecrypt, err)
+	}
+	return email, nil
+}
+
+// emailSerializer encrypts the fields tagged serializer:email with emailKeys.
+type emailSerializer struct{}
+
+// Scan ...
+func (emailSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var stored string
+	switch v := dbValue.(type) {
+	case nil:
+	case string:
+		stored = v
+	case []byte:
+		stored = string(v)
+	default:
+		return fmt.Errorf("unsupported email value %T", dbValue)
+	}
+	email, err := emailKeys.Load().decrypt(stored)
+	if err != nil {
+		return err
+	}
+	field.ReflectValueOf(ctx, dst).SetString(email)
+	return nil
+}
+
+// Value ...
+func (emailSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	email, _ := fieldValue.(string)
+	return emailKeys.Load().encrypt(email)
+}
+
+// setupEmailEncryption loads database.email_key, which LoadConfig read from
+// database.email_key_file if set. Without one emails are stored in plaintext.
+func (ur *UnRustleLogs) setupEmailEncryption() error {
+	key := strings.TrimSpace(ur.config.Database.EmailKey)
+	if key == "" {
+		if len(ur.config.Database.EmailOldKeys) > 0 {
+			return errors.New("database.email_old_keys requires database.email_key")
+		}
+		logrus.Warn("no database.email_key configured, emails are stored in plaintext")
+		emailKeys.Store(nil)
+		return nil
+	}
+	keys, err := newEmailKeyring(key, ur.config.Database.EmailOldKeys)
+	if err != nil {
+		return fmt.Errorf("invalid email key: %v", err)
+	}
+	emailKeys.Store(keys)
+	return nil
+}
+
+// storedEmail is a users row as stored, without the serializer
+type storedEmail struct {
+	ID    string
+	Email string
+}
+
+// encryptStoredEmails encrypts the emails that are still in plaintext or
+// encrypted with an old key with the current one, so rotated keys can be
+// dropped from database.email_old_keys after a restart.
+func (ur *UnRustleLogs) encryptStoredEmails() error {
+	keys := emailKeys.Load()
+	if keys == nil {
+		return nil
+	}
+	current := encryptedEmailPrefix + keys.currentID + ":%"
+	var rows []storedEmail
+	n := 0
+	res := ur.db.Model(&User{}).Select("id, email").
+		Where("email <> '' and email not like ?", current).
+		FindInBatches(&rows, 500, func(tx *gorm.DB, batch int) error {
+			for _, row := range rows {
+				email, err := keys.decrypt(row.Email)
+				if err != nil {
+					return fmt.Errorf("user %s: %w", row.ID, err)
+				}
+				encrypted, err := keys.encrypt(email)
+				if err != nil {
+					return err
+				}
+				if err := ur.db.Exec("UPDATE users SET email = ? WHERE id = ?", encrypted, row.ID).Error; err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		})
+	if res.Error != nil {
+		return fmt.Errorf("failed encrypting stored emails: %w", res.Error)
+	}
+	if n > 0 {
+		logrus.Infof("encrypted %d stored emails with the current email key", n)
+	}
+	return nil
+}
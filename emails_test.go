@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const (
+	testEmailKey    = "000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f"
+	testEmailNewKey = "f0e0d0c0b0a090807060504030201000f0e0d0c0b0a090807060504030201000"
+)
+
+// useEmailKeys configures the email keys until the test ends.
+func useEmailKeys(t *testing.T, ur *UnRustleLogs, current string, old ...string) {
+	t.Helper()
+	ur.config.Database.EmailKey = current
+	ur.config.Database.EmailOldKeys = old
+	if err := ur.setupEmailEncryption(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		emailKeys.Store(nil)
+	})
+}
+
+// rawEmail is the email column of the user as stored.
+func rawEmail(t *testing.T, ur *UnRustleLogs, id string) string {
+	t.Helper()
+	var row storedEmail
+	if err := ur.db.Raw("SELECT id, email FROM users WHERE id = ?", id).Scan(&row).Error; err != nil {
+		t.Fatal(err)
+	}
+	return row.Email
+}
+
+func TestEmailRoundTrip(t *testing.T) {
+	keys, err := newEmailKeyring(testEmailKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range []string{"foo@example.com", "", "ünïcode@example.com"} {
+		stored, err := keys.encrypt(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if email != "" && (!strings.HasPrefix(stored, encryptedEmailPrefix) || strings.Contains(stored, email)) {
+			t.Fatalf("%q is stored as %q", email, stored)
+		}
+		again, err := keys.encrypt(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if email != "" && again == stored {
+			t.Fatal("encrypting twice gave the same value")
+		}
+		got, err := keys.decrypt(stored)
+		if err != nil || got != email {
+			t.Fatalf("decrypted %q, %v, want %q", got, err, email)
+		}
+	}
+}
+
+func TestEmailDecryptErrors(t *testing.T) {
+	keys, err := newEmailKeyring(testEmailKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newEmailKeyring(testEmailNewKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := keys.encrypt("foo@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := stored[:len(stored)-4] + "AAAA"
+	tests := []struct {
+		name   string
+		keys   *emailKeyring
+		stored string
+	}{
+		{name: "no keys", stored: stored},
+		{name: "unknown key", keys: other, stored: stored},
+		{name: "tampered", keys: keys, stored: tampered},
+		{name: "no key id", keys: keys, stored: encryptedEmailPrefix + "garbage"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.keys.decrypt(tt.stored); !errors.Is(err, errEmailDecrypt) {
+				t.Fatalf("got %v, want %v", err, errEmailDecrypt)
+			}
+		})
+	}
+}
+
+func TestEmailKeyRotation(t *testing.T) {
+	ur := newTestRustle(t)
+	// stored in plaintext before a key was configured
+	plain, _, err := ur.AddUser(TWITCHSERVICE, &Identity{UserID: "foo-id", Name: "foo", Email: "foo@example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useEmailKeys(t, ur, testEmailKey)
+	if err := ur.encryptStoredEmails(); err != nil {
+		t.Fatal(err)
+	}
+	old, _, err := ur.AddUser(TWITCHSERVICE, &Identity{UserID: "bar-id", Name: "bar", Email: "bar@example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID := encryptedEmailPrefix + emailKeyID(testEmailKey) + ":"
+	for _, id := range []string{plain, old} {
+		if raw := rawEmail(t, ur, id); !strings.HasPrefix(raw, oldID) {
+			t.Fatalf("stored %q, want it encrypted with the first key", raw)
+		}
+	}
+
+	useEmailKeys(t, ur, testEmailNewKey, testEmailKey)
+	if u, err := ur.GetUser(old); err != nil || u.Email != "bar@example.com" {
+		t.Fatalf("got %v with the old key in email_old_keys", err)
+	}
+	if err := ur.encryptStoredEmails(); err != nil {
+		t.Fatal(err)
+	}
+	useEmailKeys(t, ur, testEmailNewKey)
+	for id, want := range map[string]string{plain: "foo@example.com", old: "bar@example.com"} {
+		if u, err := ur.GetUser(id); err != nil || u.Email != want {
+			t.Fatalf("got %v after dropping the old key, want %q", err, want)
+		}
+	}
+
+	useEmailKeys(t, ur, testEmailKey)
+	u, err := ur.GetUser(old)
+	if !errors.Is(err, errEmailDecrypt) || u == nil || u.Name != "bar" || u.Email != "" {
+		t.Fatalf("got user %v and error %v without the key, want the user without its email and %v", u, err, errEmailDecrypt)
+	}
+}
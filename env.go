@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// envPrefix starts the environment variables overriding the config
+const envPrefix = "UNRUSTLE_"
+
+// applyEnv overrides fields of cfg with the environment variables named
+// after their path in Config, uppercased and joined by _ after envPrefix,
+// e.g. UNRUSTLE_SERVER_JWTSECRET for Server.JWTSecret. Lists are comma
+// separated, durations like "12h". Lists of tables like webhooks can only be
+// set in the file. Variables with the prefix that match no field are
+// logged, they are most likely typos.
+func applyEnv(cfg *Config, environ []string) error {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, envPrefix) {
+			env[k] = v
+		}
+	}
+	used := make(map[string]bool)
+	if err := applyEnvStruct(reflect.ValueOf(cfg).Elem(), strings.TrimSuffix(envPrefix, "_"), env, used); err != nil {
+		return err
+	}
+	for k := range env {
+		if !used[k] {
+			logrus.Warnf("environment variable %s doesn't match any config option", k)
+		}
+	}
+	return nil
+}
+
+func applyEnvStruct(v reflect.Value, prefix string, env map[string]string, used map[string]bool) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(field.Name)
+		fv := v.Field(i)
+		if _, ok := fv.Addr().Interface().(encoding.TextUnmarshaler); !ok && fv.Kind() == reflect.Struct {
+			if err := applyEnvStruct(fv, name, env, used); err != nil {
+				return err
+			}
+			continue
+		}
+		s, ok := env[name]
+		if !ok {
+			continue
+		}
+		used[name] = true
+		if err := setEnvValue(fv, s); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// setEnvValue parses s into v, which has one of the types used in Config.
+func setEnvValue(v reflect.Value, s string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q isn't true or false", s)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q isn't a number", s)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("%q isn't a number", s)
+		}
+		v.SetFloat(f)
+	case reflect.Ptr:
+		p := reflect.New(v.Type().Elem())
+		if err := setEnvValue(p.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(p)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("can only be set in the config file")
+		}
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("can only be set in the config file")
+	}
+	return nil
+}
+
+// loadEnv is applyEnv on the environment of the process.
+func (ur *UnRustleLogs) loadEnv() error {
+	return applyEnv(ur.config, os.Environ())
+}
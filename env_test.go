@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const testConfigFile = `
+[twitch]
+client_secret = "from the file"
+cookie = "twitch"
+
+[server]
+jwt_ttl = "1h"
+session_sliding = true
+trusted_proxies = ["127.0.0.1"]
+max_pending_states = 10
+`
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   []string
+		check func(t *testing.T, cfg *Config)
+		// wantErr names the variable of the error
+		wantErr string
+	}{
+		{name: "file without variables", check: func(t *testing.T, cfg *Config) {
+			if cfg.Twitch.ClientSecret != "from the file" || cfg.Server.JWTTTL.Duration != time.Hour {
+				t.Fatalf("the file was changed: %+v", cfg.Twitch)
+			}
+		}},
+		{name: "env beats the file", env: []string{
+			"UNRUSTLE_TWITCH_CLIENTSECRET=from the env",
+			"UNRUSTLE_SERVER_JWTTTL=90m",
+			"UNRUSTLE_SERVER_SESSIONSLIDING=false",
+			"UNRUSTLE_SERVER_TRUSTEDPROXIES=10.0.0.0/8, ::1,",
+			"UNRUSTLE_SERVER_MAXPENDINGSTATES=20",
+		}, check: func(t *testing.T, cfg *Config) {
+			if cfg.Twitch.ClientSecret != "from the env" {
+				t.Errorf("client secret %q", cfg.Twitch.ClientSecret)
+			}
+			if cfg.Server.JWTTTL.Duration != 90*time.Minute {
+				t.Errorf("jwt ttl %s", cfg.Server.JWTTTL.Duration)
+			}
+			if cfg.Server.SessionSliding {
+				t.Error("session sliding is still on")
+			}
+			if !reflect.DeepEqual(cfg.Server.TrustedProxies, []string{"10.0.0.0/8", "::1"}) {
+				t.Errorf("trusted proxies %q", cfg.Server.TrustedProxies)
+			}
+			if cfg.Server.MaxPendingStates != 20 {
+				t.Errorf("max pending states %d", cfg.Server.MaxPendingStates)
+			}
+			if cfg.Twitch.Cookie != "twitch" {
+				t.Errorf("cookie %q, options without variables have to keep the file's value", cfg.Twitch.Cookie)
+			}
+		}},
+		{name: "coercion", env: []string{
+			"UNRUSTLE_API_REQUIREKEYS=0",
+			"UNRUSTLE_DATABASE_USERCACHE=TRUE",
+			"UNRUSTLE_DATABASE_USERCACHETTL=1h30m5s",
+			"UNRUSTLE_RATELIMIT_API_RATE=2.5",
+			"UNRUSTLE_RATELIMIT_API_BURST=7",
+			"UNRUSTLE_SERVER_JWTLEGACYUNTIL=2026-01-02T03:04:05Z",
+			"UNRUSTLE_SERVER_ENABLEPPROF=1",
+		}, check: func(t *testing.T, cfg *Config) {
+			if cfg.API.RequireKeys == nil || *cfg.API.RequireKeys {
+				t.Errorf("require keys %v", cfg.API.RequireKeys)
+			}
+			if cfg.Database.UserCache == nil || !*cfg.Database.UserCache {
+				t.Errorf("user cache %v", cfg.Database.UserCache)
+			}
+			if want := time.Hour + 30*time.Minute + 5*time.Second; cfg.Database.UserCacheTTL.Duration != want {
+				t.Errorf("user cache ttl %s", cfg.Database.UserCacheTTL.Duration)
+			}
+			if cfg.RateLimit.API != (RateLimitConfig{Rate: 2.5, Burst: 7}) {
+				t.Errorf("api rate limit %+v", cfg.RateLimit.API)
+			}
+			if !cfg.Server.JWTLegacyUntil.Equal(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)) {
+				t.Errorf("jwt legacy until %s", cfg.Server.JWTLegacyUntil)
+			}
+			if !cfg.Server.EnablePprof {
+				t.Error("pprof is off")
+			}
+		}},
+		{name: "unknown variables are ignored", env: []string{"UNRUSTLE_SERVER_JWTSECRT=typo", "OTHER_SERVER_JWTSECRET=x"}, check: func(t *testing.T, cfg *Config) {
+			if cfg.Server.JWTSecret != "" {
+				t.Fatalf("jwt secret %q", cfg.Server.JWTSecret)
+			}
+		}},
+		{name: "invalid duration", env: []string{"UNRUSTLE_SERVER_JWTTTL=12"}, wantErr: "UNRUSTLE_SERVER_JWTTTL"},
+		{name: "invalid bool", env: []string{"UNRUSTLE_SERVER_SESSIONSLIDING=yes"}, wantErr: "UNRUSTLE_SERVER_SESSIONSLIDING"},
+		{name: "invalid bool pointer", env: []string{"UNRUSTLE_API_REQUIREKEYS=no"}, wantErr: "UNRUSTLE_API_REQUIREKEYS"},
+		{name: "invalid int", env: []string{"UNRUSTLE_SERVER_MAXPENDINGSTATES=many"}, wantErr: "UNRUSTLE_SERVER_MAXPENDINGSTATES"},
+		{name: "invalid float", env: []string{"UNRUSTLE_RATELIMIT_API_RATE=fast"}, wantErr: "UNRUSTLE_RATELIMIT_API_RATE"},
+		{name: "list of tables", env: []string{"UNRUSTLE_WEBHOOKS=https://example.com"}, wantErr: "UNRUSTLE_WEBHOOKS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			if _, err := toml.Decode(testConfigFile, cfg); err != nil {
+				t.Fatal(err)
+			}
+			err := applyEnv(cfg, tt.env)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr+":") {
+					t.Fatalf("got error %v, want one of %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
+
+func TestLoadConfigWithoutFile(t *testing.T) {
+	environ := []string{
+		"UNRUSTLE_SERVER_JWTSECRET=0123456789abcdef0123456789abcdef",
+		"UNRUSTLE_SERVER_SESSIONTTL=48h",
+		"UNRUSTLE_TWITCH_CLIENTID=twitch-id",
+		"UNRUSTLE_TWITCH_CLIENTSECRET=twitch-secret",
+		"UNRUSTLE_TWITCH_REDIRECTURL=https://example.com/twitch/callback",
+		"UNRUSTLE_TWITCH_COOKIE=twitch",
+		"UNRUSTLE_DESTINYGG_CLIENTID=dgg-id",
+		"UNRUSTLE_DESTINYGG_CLIENTSECRET=dgg-secret",
+		"UNRUSTLE_DESTINYGG_REDIRECTURL=https://example.com/destinygg/callback",
+		"UNRUSTLE_DESTINYGG_COOKIE=dgg",
+		"UNRUSTLE_DATABASE_DSN=file:env.db",
+		"UNRUSTLE_RATELIMIT_ENABLED=false",
+	}
+	// LoadConfig exits on invalid configs, fail the test instead
+	cfg := &Config{}
+	if err := applyEnv(cfg, environ); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range environ {
+		k, v, _ := strings.Cut(kv, "=")
+		t.Setenv(k, v)
+	}
+
+	ur := NewUnRustleLogs(context.Background())
+	ur.LoadConfig(filepath.Join(t.TempDir(), "config.toml"))
+	if ur.config.Twitch.ClientSecret != "twitch-secret" || ur.config.Destinygg.ClientID != "dgg-id" || ur.config.Database.DSN != "file:env.db" {
+		t.Fatalf("the environment wasn't loaded: %+v", ur.config)
+	}
+	if ur.config.Server.SessionTTL.Duration != 48*time.Hour {
+		t.Fatalf("session ttl %s, the default replaced the environment", ur.config.Server.SessionTTL.Duration)
+	}
+	if ur.config.Server.JWTTTL.Duration != defaultJWTTTL {
+		t.Fatalf("jwt ttl %s, options without variables get the defaults", ur.config.Server.JWTTTL.Duration)
+	}
+	if ur.rateLimitsEnabled() {
+		t.Fatal("rate limits are on")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"runtime/debug"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// The code of an error response, clients can rely on them not changing
+const (
+	codeBadRequest        = "bad_request"
+	codeUnknownService    = "unknown_service"
+	codeUnauthorized      = "unauthorized"
+	codeInvalidAPIKey     = "invalid_api_key"
+	codeInsufficientScope = "insufficient_scope"
+	codeInvalidCSRF       = "invalid_csrf"
+	codeNotFound          = "not_found"
+	codeMethodNotAllowed  = "method_not_allowed"
+	codePayloadTooLarge   = "payload_too_large"
+	// codeUnsupportedMediaType is set on bodies that aren't JSON
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeRateLimited          = "rate_limited"
+	codeInternal             = "internal_error"
+	// codeEmailUnavailable is set when a stored email can't be decrypted
+	codeEmailUnavailable = "email_unavailable"
+
+	requestIDHeader  = "X-Request-ID"
+	requestIDContext = "request_id"
+	// requestLogContext is the logger of requestLog
+	requestLogContext = "request_log"
+	// maxRequestIDLength bounds the ids taken from proxies
+	maxRequestIDLength = 64
+)
+
+// APIError is the body of every JSON error response
+type APIError struct {
+	Error APIErrorDetail `json:"error"`
+}
+
+// APIErrorDetail ...
+type APIErrorDetail struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+// apiError aborts the request with status and the error envelope.
+func apiError(c *gin.Context, status int, code, message string) {
+	c.AbortWithStatusJSON(status, APIError{Error: APIErrorDetail{
+		Code:      code,
+		Message:   message,
+		RequestID: c.GetString(requestIDContext),
+	}})
+}
+
+// requestIDMiddleware sets X-Request-ID on every response, keeping the one
+// of a proxy in front if it sent a sane one.
+func requestIDMiddleware(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if !validRequestID(id) {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			logrus.Errorf("failed generating request id: %v", err)
+		}
+		id = hex.EncodeToString(b)
+	}
+	c.Set(requestIDContext, id)
+	c.Set(requestLogContext, logrus.WithField("request_id", id))
+	c.Header(requestIDHeader, id)
+	c.Next()
+}
+
+// requestLog is the logger of handlers, its entries carry the request id.
+func requestLog(c *gin.Context) *logrus.Entry {
+	if v, ok := c.Get(requestLogContext); ok {
+		if entry, ok := v.(*logrus.Entry); ok {
+			return entry
+		}
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// ErrorPayload is the page of failed requests outside of the API.
+type ErrorPayload struct {
+	Message   string
+	RequestID string
+}
+
+// errorPage answers requests outside of the API that failed with a page
+// showing the request id, for users to quote in reports.
+func errorPage(c *gin.Context, status int, message string) {
+	c.HTML(status, "error.tmpl", ErrorPayload{Message: message, RequestID: c.GetString(requestIDContext)})
+	c.Abort()
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// isAPIRequest reports whether the path is one of the JSON endpoints, the
+// others render templates.
+func isAPIRequest(c *gin.Context) bool {
+	return c.Request.URL.Path == "/api" || strings.HasPrefix(c.Request.URL.Path, "/api/")
+}
+
+// noRouteHandler answers unknown /api paths with the error envelope and
+// the rest with a plain 404.
+func noRouteHandler(c *gin.Context) {
+	if isAPIRequest(c) {
+		apiError(c, http.StatusNotFound, codeNotFound, "no endpoint at "+c.Request.URL.Path)
+		return
+	}
+	c.String(http.StatusNotFound, "404 page not found")
+}
+
+// noMethodHandler answers requests with a method none of the routes of the
+// path has, listing the ones it has in Allow.
+func (ur *UnRustleLogs) noMethodHandler(c *gin.Context) {
+	c.Header("Allow", strings.Join(allowedMethods(ur.routes, c.Request.URL.Path), ", "))
+	if isAPIRequest(c) {
+		apiError(c, http.StatusMethodNotAllowed, codeMethodNotAllowed, c.Request.Method+" isn't allowed on "+c.Request.URL.Path)
+		return
+	}
+	c.String(http.StatusMethodNotAllowed, "405 method not allowed")
+}
+
+// allowedMethods are the methods of the routes matching path.
+func allowedMethods(routes gin.RoutesInfo, path string) []string {
+	var methods []string
+	for _, r := range routes {
+		if routeMatches(r.Path, path) {
+			methods = append(methods, r.Method)
+		}
+	}
+	return methods
+}
+
+// routeMatches reports whether path is one of the gin route pattern, with
+// :params standing for one segment and a *catch-all for the rest.
+func routeMatches(pattern, path string) bool {
+	ps, xs := strings.Split(pattern, "/"), strings.Split(path, "/")
+	for i, p := range ps {
+		if strings.HasPrefix(p, "*") {
+			return true
+		}
+		if i >= len(xs) {
+			return false
+		}
+		if strings.HasPrefix(p, ":") {
+			if xs[i] == "" {
+				return false
+			}
+			continue
+		}
+		if p != xs[i] {
+			return false
+		}
+	}
+	return len(ps) == len(xs)
+}
+
+// recovery logs panics of handlers and answers with a 500, the error
+// envelope for API requests and the error page for the others.
+func recovery(c *gin.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			requestLog(c).Errorf("panic serving %s: %v\n%s", c.Request.URL.Path, err, debug.Stack())
+			if isAPIRequest(c) {
+				apiError(c, http.StatusInternalServerError, codeInternal, "something went wrong, try again")
+				return
+			}
+			errorPage(c, http.StatusInternalServerError, "Something went wrong, please try again.")
+		}
+	}()
+	c.Next()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorEnvelope(t *testing.T) {
+	noKeys := func(ur *UnRustleLogs) {
+		required := false
+		ur.config.API.RequireKeys = &required
+	}
+	tests := []struct {
+		name   string
+		setup  func(ur *UnRustleLogs)
+		target string
+		header string
+		// before is the number of requests sent ahead of the checked one
+		before int
+		status int
+		code   string
+	}{
+		{name: "missing api key", target: "/api/v1/deleted/twitch", status: http.StatusUnauthorized, code: codeUnauthorized},
+		{name: "invalid api key", target: "/api/v1/deleted/twitch", header: "Bearer nope", status: http.StatusUnauthorized, code: codeInvalidAPIKey},
+		{name: "no session", target: "/api/v1/me/twitch", status: http.StatusUnauthorized, code: codeUnauthorized},
+		{name: "unknown endpoint", target: "/api/v1/nope", status: http.StatusNotFound, code: codeNotFound},
+		{name: "unknown service", setup: noKeys, target: "/api/v1/deleted/nope", status: http.StatusNotFound, code: codeUnknownService},
+		{name: "rate limited", setup: func(ur *UnRustleLogs) {
+			noKeys(ur)
+			ur.config.RateLimit.API = RateLimitConfig{Rate: 0.001, Burst: 1}
+			ur.setupRateLimits()
+		}, target: "/api/v1/deleted/twitch", before: 1, status: http.StatusTooManyRequests, code: codeRateLimited},
+		{name: "database down", setup: func(ur *UnRustleLogs) {
+			noKeys(ur)
+			db, err := ur.db.DB()
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Close()
+		}, target: "/api/v1/deleted/twitch", status: http.StatusInternalServerError, code: codeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := newTestRustle(t)
+			if tt.setup != nil {
+				tt.setup(ur)
+			}
+			router := newTestRouter(t, ur)
+			var w *httptest.ResponseRecorder
+			for i := 0; i <= tt.before; i++ {
+				req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+				if tt.header != "" {
+					req.Header.Set("Authorization", tt.header)
+				}
+				w = httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+			}
+			if w.Code != tt.status {
+				t.Fatalf("got %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Fatalf("Content-Type %s", ct)
+			}
+			var body APIError
+			dec := json.NewDecoder(bytes.NewReader(w.Body.Bytes()))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&body); err != nil {
+				t.Fatalf("%v: %s", err, w.Body)
+			}
+			if body.Error.Code != tt.code || body.Error.Message == "" {
+				t.Fatalf("got code %q and message %q, want code %q", body.Error.Code, body.Error.Message, tt.code)
+			}
+			if id := w.Header().Get(requestIDHeader); id == "" || body.Error.RequestID != id {
+				t.Fatalf("request_id %q, X-Request-ID %q", body.Error.RequestID, id)
+			}
+		})
+	}
+}
+
+func TestErrorsOutsideTheAPIArentJSON(t *testing.T) {
+	router := newTestRouter(t, newTestRustle(t))
+	w := testRequest(router, http.MethodGet, "/nope", nil)
+	if w.Code != http.StatusNotFound || strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("got %d with %s", w.Code, w.Header().Get("Content-Type"))
+	}
+}
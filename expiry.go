@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	// expirySweepInterval is how often expired opt-outs are deactivated,
+	// lookups ignore them before already
+	expirySweepInterval = time.Minute * 5
+
+	auditExpired = "expired"
+)
+
+// OptOutDuration is a choice for how long an opt-out lasts.
+type OptOutDuration struct {
+	Key      string
+	Label    string
+	Duration time.Duration
+}
+
+// optOutDurations are offered on the login and index page, permanent
+// opt-outs are the default and have no key
+var optOutDurations = []OptOutDuration{
+	{"1d", "1 day", time.Hour * 24},
+	{"7d", "7 days", time.Hour * 24 * 7},
+	{"30d", "30 days", time.Hour * 24 * 30},
+	{"90d", "90 days", time.Hour * 24 * 90},
+}
+
+// optOutDuration looks up the key of a duration form field, "" is permanent.
+func optOutDuration(key string) (time.Duration, bool) {
+	if key == "" {
+		return 0, true
+	}
+	for _, d := range optOutDurations {
+		if d.Key == key {
+			return d.Duration, true
+		}
+	}
+	return 0, false
+}
+
+// optOutExpiry returns when an opt-out of duration d requested at now ends,
+// nil if it's permanent.
+func optOutExpiry(now time.Time, d time.Duration) *time.Time {
+	if d <= 0 {
+		return nil
+	}
+	expiresAt := now.Add(d)
+	return &expiresAt
+}
+
+// optedOut reports whether the opt-out of the user is in effect at now.
+func (u *User) optedOut(now time.Time) bool {
+	return u.Active && (u.ExpiresAt == nil || u.ExpiresAt.After(now))
+}
+
+// unexpired limits q to users whose opt-out hasn't expired at now.
+func unexpired(q *gorm.DB, now time.Time) *gorm.DB {
+	return q.Where("expires_at is null or expires_at > ?", now)
+}
+
+// SetUserExpiry changes when the opt-out of the active user ends, nil makes
+// it permanent.
+func (ur *UnRustleLogs) SetUserExpiry(id string, expiresAt *time.Time) error {
+	u, err := ur.GetUser(id)
+	if err != nil && !errors.Is(err, errEmailDecrypt) {
+		return err
+	}
+	if !u.optedOut(time.Now().UTC()) {
+		return gorm.ErrRecordNotFound
+	}
+	err = ur.db.Model(u).Update("expires_at", expiresAt).Error
+	ur.userCache.invalidate(userCacheKey(u.Name, u.Service))
+	return err
+}
+
+// expiryHandler changes how long the opt-out of the provider in the service
+// form field lasts, counting from now.
+func (ur *UnRustleLogs) expiryHandler(c *gin.Context) {
+	p, ok := ur.provider(c.PostForm("service"))
+	if !ok {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	user, _, ok := ur.getSession(c, p.CookieName())
+	if !ok {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	d, ok := optOutDuration(c.PostForm("duration"))
+	if !ok {
+		c.Redirect(http.StatusFound, "/?error=invalid_duration")
+		return
+	}
+	if err := ur.SetUserExpiry(user.ID, optOutExpiry(time.Now().UTC(), d)); err != nil {
+		requestLog(c).Errorf("failed changing expiry of %s user %s: %v", user.Service, user.Name, err)
+		c.Redirect(http.StatusFound, "/?error=server_error")
+		return
+	}
+	c.Redirect(http.StatusFound, "/")
+}
+
+// sweepExpiredOptOuts deactivates expired opt-outs until ctx is done.
+func (ur *UnRustleLogs) sweepExpiredOptOuts(ctx context.Context) {
+	ticker := time.NewTicker(expirySweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, err := ur.deactivateExpired(time.Now().UTC())
+			if err != nil {
+				logrus.Errorf("failed deactivating expired opt-outs: %v", err)
+			} else if n > 0 {
+				logrus.Infof("deactivated %d expired opt-outs", n)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deactivateExpired deactivates the opt-outs that expired by now, with an
+// audit entry each.
+func (ur *UnRustleLogs) deactivateExpired(now time.Time) (int, error) {
+	var users []User
+	err := ur.db.Where("active = ? and expires_at <= ?", true, now).Find(&users).Error
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i := range users {
+		u := &users[i]
+		deactivated := false
+		err := ur.db.Transaction(func(tx *gorm.DB) error {
+			// a login may have extended it since
+			res := tx.Model(&User{}).Where("id = ? and active = ? and expires_at <= ?", u.ID, true, now).Updates(map[string]interface{}{
+				"active":         false,
+				"deactivated_at": now,
+			})
+			if res.Error != nil || res.RowsAffected == 0 {
+				return res.Error
+			}
+			deactivated = true
+			if err := recordChange(tx, u, changeRemoved); err != nil {
+				return err
+			}
+			return audit(tx, u, auditExpired, "opt-out expired at "+u.ExpiresAt.UTC().Format(time.RFC3339))
+		})
+		ur.userCache.invalidate(userCacheKey(u.Name, u.Service))
+		if err != nil {
+			return n, err
+		}
+		if deactivated {
+			n++
+			ur.notify(u.Service, u.Name, webhookOptIn)
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative optoutpb/optout.proto
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tensei/unrustlelogs/optoutpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// changeBuffer is how many events a change stream may fall behind before
+// it's ended
+const changeBuffer = 256
+
+// setupGRPC listens on server.grpc_address, the gRPC server is disabled
+// unless it's set.
+func (ur *UnRustleLogs) setupGRPC() error {
+	if ur.config.Server.GRPCAddress == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", ur.config.Server.GRPCAddress)
+	if err != nil {
+		return err
+	}
+	ur.grpcServer = grpc.NewServer()
+	optoutpb.RegisterOptOutsServer(ur.grpcServer, &optOutsServer{ur: ur})
+	logrus.Infof("starting grpc server adress: %q", ur.config.Server.GRPCAddress)
+	go func() {
+		if err := ur.grpcServer.Serve(listener); err != nil {
+			logrus.Error(err)
+		}
+	}()
+	return nil
+}
+
+// stopGRPC ends the change streams and waits for the other calls to finish
+// until ctx is done.
+func (ur *UnRustleLogs) stopGRPC(ctx context.Context) {
+	if ur.grpcServer == nil {
+		return
+	}
+	ur.changes.close()
+	done := make(chan struct{})
+	go func() {
+		ur.grpcServer.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		ur.grpcServer.Stop()
+	}
+}
+
+// optOutsServer implements optoutpb.OptOutsServer on top of the same
+// lookups as /api/v1/check.
+type optOutsServer struct {
+	optoutpb.UnimplementedOptOutsServer
+	ur *UnRustleLogs
+}
+
+// lookup validates the service and normalizes the channel of a request.
+func (s *optOutsServer) lookup(service, channel string) (string, error) {
+	if _, ok := s.ur.provider(service); !ok {
+		return "", status.Errorf(codes.InvalidArgument, "unknown service %q", service)
+	}
+	if channel == "" {
+		return "", nil
+	}
+	channel, err := normalizeChannel(channel)
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "invalid channel: %v", err)
+	}
+	return channel, nil
+}
+
+// Check ...
+func (s *optOutsServer) Check(ctx context.Context, req *optoutpb.CheckRequest) (*optoutpb.CheckResponse, error) {
+	channel, err := s.lookup(req.Service, req.Channel)
+	if err != nil {
+		return nil, err
+	}
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+	_, ok := s.ur.UserInDatabase(req.Name, req.Service, channel)
+	return &optoutpb.CheckResponse{OptedOut: ok}, nil
+}
+
+// BulkCheck ...
+func (s *optOutsServer) BulkCheck(ctx context.Context, req *optoutpb.BulkCheckRequest) (*optoutpb.BulkCheckResponse, error) {
+	channel, err := s.lookup(req.Service, req.Channel)
+	if err != nil {
+		return nil, err
+	}
+	if limit := s.ur.config.Server.CheckBatchLimit; len(req.Names) > limit {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d names can be checked at once", limit)
+	}
+	result, err := s.ur.UsersInDatabase(req.Names, req.Service, channel)
+	if err != nil {
+		logrus.Errorf("failed checking %d %s users: %v", len(req.Names), req.Service, err)
+		return nil, status.Error(codes.Internal, "failed checking users")
+	}
+	return &optoutpb.BulkCheckResponse{OptedOut: result}, nil
+}
+
+// StreamChanges ...
+func (s *optOutsServer) StreamChanges(req *optoutpb.StreamChangesRequest, stream optoutpb.OptOuts_StreamChangesServer) error {
+	if _, err := s.lookup(req.Service, ""); err != nil {
+		return err
+	}
+	sub := s.ur.changes.subscribe(req.Service)
+	if sub == nil {
+		return status.Error(codes.Unavailable, "shutting down")
+	}
+	defer s.ur.changes.unsubscribe(sub)
+	for {
+		select {
+		case event, ok := <-sub.events:
+			if !ok {
+				if sub.slow {
+					return status.Error(codes.ResourceExhausted, "fell too far behind the changes")
+				}
+				return status.Error(codes.Unavailable, "shutting down")
+			}
+			err := stream.Send(&optoutpb.Change{
+				Service:   event.Service,
+				Name:      event.Name,
+				Action:    event.Action,
+				Timestamp: timestamppb.New(event.Timestamp),
+			})
+			if err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// changeFeed fans the events of notify out to the change streams.
+type changeFeed struct {
+	mutex       sync.Mutex
+	subscribers map[*changeSubscriber]struct{}
+	closed      bool
+}
+
+type changeSubscriber struct {
+	service string
+	// events is closed when the feed is, or once slow is set
+	events chan WebhookEvent
+	slow   bool
+}
+
+// subscribe returns nil once the feed is closed.
+func (f *changeFeed) subscribe(service string) *changeSubscriber {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return nil
+	}
+	if f.subscribers == nil {
+		f.subscribers = make(map[*changeSubscriber]struct{})
+	}
+	sub := &changeSubscriber{service: service, events: make(chan WebhookEvent, changeBuffer)}
+	f.subscribers[sub] = struct{}{}
+	return sub
+}
+
+func (f *changeFeed) unsubscribe(sub *changeSubscriber) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.subscribers[sub]; ok {
+		delete(f.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// publish never blocks, subscribers whose buffer is full are dropped.
+func (f *changeFeed) publish(event WebhookEvent) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for sub := range f.subscribers {
+		if sub.service != event.Service {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			sub.slow = true
+			delete(f.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+func (f *changeFeed) close() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closed = true
+	for sub := range f.subscribers {
+		delete(f.subscribers, sub)
+		close(sub.events)
+	}
+}
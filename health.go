@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// healthTimeout is how long the database may take to answer
+	healthTimeout = time.Second * 2
+	// healthCacheTTL keeps aggressive health checkers from adding load, the
+	// database is pinged at most this often
+	healthCacheTTL = time.Second
+	// defaultDrainDelay is long enough for a few failed readiness probes
+	defaultDrainDelay = time.Second * 5
+)
+
+// healthCheck caches the result of the last database ping.
+type healthCheck struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// pingDatabase runs SELECT 1, reusing the last result while it's fresh.
+func (ur *UnRustleLogs) pingDatabase() error {
+	h := &ur.dbHealth
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if time.Since(h.checked) < healthCacheTTL {
+		return h.err
+	}
+	if ur.db == nil {
+		h.err = errors.New("not connected")
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+		var one int
+		h.err = ur.db.WithContext(ctx).Raw("SELECT 1").Scan(&one).Error
+		cancel()
+	}
+	if h.err != nil {
+		logrus.Errorf("health check: database: %v", h.err)
+	}
+	h.checked = time.Now()
+	return h.err
+}
+
+// readiness is what /readyz checks besides the database.
+type readiness struct {
+	// migrated is set once the migrations ran
+	migrated atomic.Bool
+	// draining is set once the shutdown began
+	draining atomic.Bool
+}
+
+// startDraining fails /readyz and waits server.drain_delay, so load
+// balancers take us out before the server stops accepting connections.
+func (ur *UnRustleLogs) startDraining() {
+	ur.ready.draining.Store(true)
+	if delay := ur.config.Server.DrainDelay.Duration; delay > 0 {
+		logrus.Infof("draining for %s", delay)
+		time.Sleep(delay)
+	}
+}
+
+// healthzHandler is the liveness check, 200 while the process serves
+// requests. It doesn't touch the database, a restart doesn't fix that.
+func (ur *UnRustleLogs) healthzHandler(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "checks": gin.H{"process": "ok"}})
+}
+
+// readyzHandler is the readiness check for load balancers, 200 if the
+// database answers, is migrated and we aren't shutting down, 503 naming the
+// failing checks otherwise.
+func (ur *UnRustleLogs) readyzHandler(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	checks := gin.H{"database": "ok", "migrations": "ok", "draining": "ok"}
+	ready := true
+	if err := ur.pingDatabase(); err != nil {
+		checks["database"], ready = err.Error(), false
+	}
+	if !ur.ready.migrated.Load() {
+		checks["migrations"], ready = "not applied", false
+	}
+	if ur.ready.draining.Load() {
+		checks["draining"], ready = "shutting down", false
+	}
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "checks": checks})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "checks": checks})
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	jwtHS256 = "HS256"
+	jwtRS256 = "RS256"
+
+	// defaultJWTLeeway is the clock skew allowed unless server.jwt_leeway
+	// is set
+	defaultJWTLeeway = time.Second * 30
+	defaultJWTIssuer = "unrustlelogs"
+	// defaultJWTTTL is how long remembered sessions last unless
+	// server.jwt_ttl is set
+	defaultJWTTTL = time.Hour * 720
+	// defaultSessionTTL is the same for sessions without remember me
+	defaultSessionTTL = time.Hour * 12
+	// defaultSessionAbsoluteMax bounds renewals unless
+	// server.session_absolute_max is set
+	defaultSessionAbsoluteMax = time.Hour * 720
+)
+
+// jwk is a public key as served by /.well-known/jwks.json
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// setupJWT loads the RS256 key pair if server.jwt_algorithm asks for it.
+func (ur *UnRustleLogs) setupJWT() error {
+	if err := ur.setupJWTLegacyUntil(); err != nil {
+		return err
+	}
+	alg := strings.ToUpper(ur.config.Server.JWTAlgorithm)
+	switch alg {
+	case "", jwtHS256:
+		ur.config.Server.JWTAlgorithm = jwtHS256
+		return ur.setupJWTSecrets()
+	case jwtRS256:
+		ur.config.Server.JWTAlgorithm = jwtRS256
+	default:
+		return fmt.Errorf("unsupported server.jwt_algorithm %q, use HS256 or RS256", ur.config.Server.JWTAlgorithm)
+	}
+
+	if ur.config.Server.JWTPrivateKeyFile == "" || ur.config.Server.JWTPublicKeyFile == "" {
+		return errors.New("RS256 requires server.jwt_private_key_file and server.jwt_public_key_file")
+	}
+	data, err := ioutil.ReadFile(ur.config.Server.JWTPrivateKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed reading jwt private key: %v", err)
+	}
+	private, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+	if err != nil {
+		return fmt.Errorf("failed parsing jwt private key: %v", err)
+	}
+	data, err = ioutil.ReadFile(ur.config.Server.JWTPublicKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed reading jwt public key: %v", err)
+	}
+	public, err := jwt.ParseRSAPublicKeyFromPEM(data)
+	if err != nil {
+		return fmt.Errorf("failed parsing jwt public key: %v", err)
+	}
+	if public.N.Cmp(private.N) != 0 || public.E != private.E {
+		return errors.New("jwt public key does not belong to the private key")
+	}
+	ur.jwtPrivateKey = private
+	ur.jwtPublicKey = public
+	return nil
+}
+
+// setupJWTSecrets validates server.jwt_secrets, without them jwt_secret is
+// used as the only key and tokens carry no kid.
+func (ur *UnRustleLogs) setupJWTSecrets() error {
+	secrets := ur.config.Server.JWTSecrets
+	if len(secrets) == 0 {
+		ur.jwtSecrets = []JWTSecretConfig{{Secret: ur.config.Server.JWTSecret}}
+		return nil
+	}
+	if ur.config.Server.JWTSecret != "" {
+		logrus.Warn("server.jwt_secret is ignored since server.jwt_secrets is set")
+	}
+	seen := make(map[string]bool)
+	for i, s := range secrets {
+		if s.ID == "" || s.Secret == "" {
+			return fmt.Errorf("server.jwt_secrets[%d] needs an id and a secret", i)
+		}
+		if seen[s.ID] {
+			return fmt.Errorf("duplicate server.jwt_secrets id %q", s.ID)
+		}
+		seen[s.ID] = true
+	}
+	ur.jwtSecrets = secrets
+	return nil
+}
+
+// signJWT signs claims with the configured algorithm.
+func (ur *UnRustleLogs) signJWT(claims jwt.Claims) (string, error) {
+	if ur.jwtPrivateKey != nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = jwkThumbprint(ur.jwtPublicKey)
+		return token.SignedString(ur.jwtPrivateKey)
+	}
+	key := ur.jwtSecrets[0]
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	return token.SignedString([]byte(key.Secret))
+}
+
+// jwtKeyFunc only accepts tokens signed with the configured algorithm, the
+// algorithm in the token header must not decide how it is verified.
+func (ur *UnRustleLogs) jwtKeyFunc(token *jwt.Token) (interface{}, error) {
+	if ur.jwtPublicKey != nil {
+		if token.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected jwt signing method %v", token.Header["alg"])
+		}
+		return ur.jwtPublicKey, nil
+	}
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected jwt signing method %v", token.Header["alg"])
+	}
+	kid, hasKid := token.Header["kid"]
+	if !hasKid {
+		// legacy token, parseToken tries the other secrets
+		return []byte(ur.jwtSecrets[0].Secret), nil
+	}
+	for _, s := range ur.jwtSecrets {
+		if s.ID != "" && s.ID == kid {
+			return []byte(s.Secret), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown jwt kid %v", kid)
+}
+
+// jwtParser leaves exp, iat and nbf to checkTokenTimes so they get leeway
+var jwtParser = &jwt.Parser{SkipClaimsValidation: true}
+
+// timedClaims is implemented by every claims type embedding
+// jwt.StandardClaims.
+type timedClaims interface {
+	VerifyExpiresAt(cmp int64, req bool) bool
+	VerifyIssuedAt(cmp int64, req bool) bool
+	VerifyNotBefore(cmp int64, req bool) bool
+	VerifyIssuer(cmp string, req bool) bool
+}
+
+// parseToken verifies a JWT into claims, allowing server.jwt_leeway of clock
+// skew for its timestamps.
+func (ur *UnRustleLogs) parseToken(jwtString string, claims jwt.Claims) (*jwt.Token, error) {
+	token, err := ur.verifyToken(jwtString, claims)
+	if err != nil {
+		return token, err
+	}
+	if err := ur.checkTokenTimes(claims); err != nil {
+		token.Valid = false
+		return token, err
+	}
+	if timed, ok := claims.(timedClaims); ok && !timed.VerifyIssuer(ur.config.Server.JWTIssuer, !ur.legacyTokensAllowed()) {
+		token.Valid = false
+		return token, errors.New("jwt has the wrong issuer")
+	}
+	return token, nil
+}
+
+// setupJWTLegacyUntil defaults server.jwt_legacy_until to server.jwt_ttl
+// after the settings migration ran on a database with users, when the
+// longest sessions without iss and aud have expired. It's stored so restarts
+// don't extend it, new databases get no grace.
+func (ur *UnRustleLogs) setupJWTLegacyUntil() error {
+	if !ur.config.Server.JWTLegacyUntil.IsZero() {
+		return nil
+	}
+	value, ok, err := ur.setting(settingJWTLegacySince)
+	if err != nil || !ok {
+		return err
+	}
+	since, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return fmt.Errorf("invalid %s setting %q: %v", settingJWTLegacySince, value, err)
+	}
+	ur.config.Server.JWTLegacyUntil = since.Add(ur.config.Server.JWTTTL.Duration)
+	return nil
+}
+
+// legacyTokensAllowed reports whether tokens from before iss and aud were
+// set are still accepted, until server.jwt_legacy_until. It's a fixed time
+// so restarts don't extend it.
+func (ur *UnRustleLogs) legacyTokensAllowed() bool {
+	return ur.now().Before(ur.config.Server.JWTLegacyUntil)
+}
+
+// audienceMatches reports whether claims were issued for service.
+func (ur *UnRustleLogs) audienceMatches(claims *jwtClaims, service string) bool {
+	return claims.VerifyAudience(service, !ur.legacyTokensAllowed())
+}
+
+// checkTokenTimes is jwt.StandardClaims.Valid with server.jwt_leeway.
+func (ur *UnRustleLogs) checkTokenTimes(claims jwt.Claims) error {
+	timed, ok := claims.(timedClaims)
+	if !ok {
+		return claims.Valid()
+	}
+	now := jwt.TimeFunc().Unix()
+	leeway := int64(ur.config.Server.JWTLeeway.Seconds())
+	if !timed.VerifyExpiresAt(now-leeway, false) {
+		return jwt.NewValidationError("token is expired", jwt.ValidationErrorExpired)
+	}
+	if !timed.VerifyIssuedAt(now+leeway, false) {
+		return jwt.NewValidationError("token used before issued", jwt.ValidationErrorIssuedAt)
+	}
+	if !timed.VerifyNotBefore(now+leeway, false) {
+		return jwt.NewValidationError("token is not valid yet", jwt.ValidationErrorNotValidYet)
+	}
+	return nil
+}
+
+// verifyToken only checks the signature of a JWT. Tokens without a kid were
+// signed before rotation was configured, so every secret is tried for them.
+func (ur *UnRustleLogs) verifyToken(jwtString string, claims jwt.Claims) (*jwt.Token, error) {
+	token, err := jwtParser.ParseWithClaims(jwtString, claims, ur.jwtKeyFunc)
+	if err == nil || token == nil || ur.jwtPublicKey != nil {
+		return token, err
+	}
+	if _, hasKid := token.Header["kid"]; hasKid || !signatureInvalid(err) {
+		return token, err
+	}
+	for _, s := range ur.jwtSecrets[1:] {
+		secret := []byte(s.Secret)
+		token, err = jwtParser.ParseWithClaims(jwtString, claims, func(t *jwt.Token) (interface{}, error) {
+			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected jwt signing method %v", t.Header["alg"])
+			}
+			return secret, nil
+		})
+		if err == nil || !signatureInvalid(err) {
+			return token, err
+		}
+	}
+	return token, err
+}
+
+// tokenExpired reports whether err only says the token is past its expiry.
+func tokenExpired(err error) bool {
+	verr, ok := err.(*jwt.ValidationError)
+	return ok && verr.Errors == jwt.ValidationErrorExpired
+}
+
+func signatureInvalid(err error) bool {
+	verr, ok := err.(*jwt.ValidationError)
+	return ok && verr.Errors&jwt.ValidationErrorSignatureInvalid != 0
+}
+
+// parseClaims verifies a session JWT and returns its claims.
+func (ur *UnRustleLogs) parseClaims(jwtString string) (*jwtClaims, error) {
+	token, err := ur.parseToken(jwtString, &jwtClaims{})
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(*jwtClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid jwt")
+	}
+	return claims, nil
+}
+
+func encodeJWKInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+// jwkThumbprint is the RFC 7638 thumbprint of key, used as its kid.
+func jwkThumbprint(key *rsa.PublicKey) string {
+	e := encodeJWKInt(big.NewInt(int64(key.E)))
+	n := encodeJWKInt(key.N)
+	sum := sha256.Sum256([]byte(fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, e, n)))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// jwksHandler publishes the RS256 public key, the list is empty with HS256
+// since the shared secret can't be published.
+func (ur *UnRustleLogs) jwksHandler(c *gin.Context) {
+	keys := []jwk{}
+	if ur.jwtPublicKey != nil {
+		keys = append(keys, jwk{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: jwtRS256,
+			Kid: jwkThumbprint(ur.jwtPublicKey),
+			N:   encodeJWKInt(ur.jwtPublicKey.N),
+			E:   encodeJWKInt(big.NewInt(int64(ur.jwtPublicKey.E))),
+		})
+	}
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+// testClaims are valid session claims of the user with the row id.
+func testClaims(ur *UnRustleLogs, id string) *jwtClaims {
+	claims := &jwtClaims{ID: id}
+	claims.Audience = TWITCHSERVICE
+	claims.Issuer = ur.config.Server.JWTIssuer
+	claims.IssuedAt = time.Now().Unix()
+	claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+	return claims
+}
+
+// signTestToken signs claims with method and key, failing the test on errors.
+func signTestToken(t *testing.T, method jwt.SigningMethod, key interface{}, claims jwt.Claims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// writeRSAKeys writes a new key pair as PEM files and returns the key.
+func writeRSAKeys(t *testing.T) (key *rsa.PrivateKey, privateFile, publicFile string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	privateFile = filepath.Join(dir, "jwt.key")
+	publicFile = filepath.Join(dir, "jwt.pub")
+	files := map[string]*pem.Block{
+		privateFile: {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)},
+		publicFile:  {Type: "PUBLIC KEY", Bytes: public},
+	}
+	for name, block := range files {
+		if err := os.WriteFile(name, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return key, privateFile, publicFile
+}
+
+func TestParseClaimsSigningMethod(t *testing.T) {
+	ur := newTestRustle(t)
+	secret := []byte(ur.config.Server.JWTSecret)
+	key, _, _ := writeRSAKeys(t)
+	claims := testClaims(ur, "id")
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "HS256", token: signTestToken(t, jwt.SigningMethodHS256, secret, claims)},
+		{name: "alg none", token: signTestToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, claims), wantErr: true},
+		{name: "RS256", token: signTestToken(t, jwt.SigningMethodRS256, key, claims), wantErr: true},
+		{name: "other secret", token: signTestToken(t, jwt.SigningMethodHS256, []byte("another secret of at least 32 bytes"), claims), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ur.parseClaims(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want one: %v", err, tt.wantErr)
+			}
+			if err == nil && got.ID != "id" {
+				t.Fatalf("got id %q", got.ID)
+			}
+		})
+	}
+}
+
+func TestParseClaimsSigningMethodRS256(t *testing.T) {
+	ur := newTestRustle(t)
+	key, privateFile, publicFile := writeRSAKeys(t)
+	ur.config.Server.JWTAlgorithm = jwtRS256
+	ur.config.Server.JWTPrivateKeyFile = privateFile
+	ur.config.Server.JWTPublicKeyFile = publicFile
+	if err := ur.setupJWT(); err != nil {
+		t.Fatal(err)
+	}
+	publicPEM, err := os.ReadFile(publicFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := testClaims(ur, "id")
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "RS256", token: signTestToken(t, jwt.SigningMethodRS256, key, claims)},
+		{name: "alg none", token: signTestToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, claims), wantErr: true},
+		// the classic confusion, HMAC keyed with the public key
+		{name: "HS256 with the public key", token: signTestToken(t, jwt.SigningMethodHS256, publicPEM, claims), wantErr: true},
+		{name: "HS256 with the secret", token: signTestToken(t, jwt.SigningMethodHS256, []byte(ur.config.Server.JWTSecret), claims), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ur.parseClaims(tt.token); (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want one: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	old := JWTSecretConfig{ID: "old", Secret: "the old secret of at least 32 bytes"}
+	next := JWTSecretConfig{ID: "new", Secret: "the new secret of at least 32 bytes"}
+	rustle := func(t *testing.T, secrets ...JWTSecretConfig) *UnRustleLogs {
+		ur := newTestRustle(t)
+		ur.config.Server.JWTSecrets = secrets
+		if err := ur.setupJWT(); err != nil {
+			t.Fatal(err)
+		}
+		return ur
+	}
+	// tokens signed before and after jwt_secrets was set
+	before := rustle(t)
+	legacy, err := before.signJWT(testClaims(before, "id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyOld := signTestToken(t, jwt.SigningMethodHS256, []byte(old.Secret), testClaims(before, "id"))
+	signedOld, err := rustle(t, old).signJWT(testClaims(before, "id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		secrets []JWTSecretConfig
+		token   string
+		wantErr bool
+	}{
+		{name: "old key before the rotation", secrets: []JWTSecretConfig{old}, token: signedOld},
+		{name: "old key during the overlap", secrets: []JWTSecretConfig{next, old}, token: signedOld},
+		{name: "old key after its removal", secrets: []JWTSecretConfig{next}, token: signedOld, wantErr: true},
+		{name: "legacy token of a listed secret", secrets: []JWTSecretConfig{next, old}, token: legacyOld},
+		{name: "legacy token after its removal", secrets: []JWTSecretConfig{next}, token: legacyOld, wantErr: true},
+		{name: "jwt_secret token once jwt_secrets is set", secrets: []JWTSecretConfig{next, old}, token: legacy, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := rustle(t, tt.secrets...)
+			if _, err := ur.parseClaims(tt.token); (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want one: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJWTKeyRotationSignsWithTheFirstKey(t *testing.T) {
+	ur := newTestRustle(t)
+	ur.config.Server.JWTSecrets = []JWTSecretConfig{{ID: "new", Secret: "new"}, {ID: "old", Secret: "old"}}
+	if err := ur.setupJWT(); err != nil {
+		t.Fatal(err)
+	}
+	signed, err := ur.signJWT(testClaims(ur, "id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := jwt.Parse(signed, func(*jwt.Token) (interface{}, error) {
+		return []byte("new"), nil
+	})
+	if token == nil || !token.Valid || token.Header["kid"] != "new" {
+		t.Fatalf("token isn't signed with the first key: %v", token)
+	}
+}
+
+func TestJWTLeeway(t *testing.T) {
+	const leeway = defaultJWTLeeway
+	within, beyond := leeway-5*time.Second, leeway+5*time.Second
+	tests := []struct {
+		name    string
+		claims  func(claims *jwtClaims, now time.Time)
+		wantErr bool
+	}{
+		{name: "issued within the leeway", claims: func(c *jwtClaims, now time.Time) { c.IssuedAt = now.Add(within).Unix() }},
+		{name: "issued beyond the leeway", claims: func(c *jwtClaims, now time.Time) { c.IssuedAt = now.Add(beyond).Unix() }, wantErr: true},
+		{name: "valid within the leeway", claims: func(c *jwtClaims, now time.Time) { c.NotBefore = now.Add(within).Unix() }},
+		{name: "valid beyond the leeway", claims: func(c *jwtClaims, now time.Time) { c.NotBefore = now.Add(beyond).Unix() }, wantErr: true},
+		{name: "expired within the leeway", claims: func(c *jwtClaims, now time.Time) { c.ExpiresAt = now.Add(-within).Unix() }},
+		{name: "expired beyond the leeway", claims: func(c *jwtClaims, now time.Time) { c.ExpiresAt = now.Add(-beyond).Unix() }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := newTestRustle(t)
+			ur.config.Server.JWTLeeway.Duration = leeway
+			claims := testClaims(ur, "id")
+			claims.IssuedAt = 0
+			tt.claims(claims, time.Now())
+			token := signTestToken(t, jwt.SigningMethodHS256, []byte(ur.config.Server.JWTSecret), claims)
+			if _, err := ur.parseClaims(token); (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want one: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExpiredSessionClearsCookie(t *testing.T) {
+	ur := newTestRustle(t)
+	ur.config.Server.JWTLeeway.Duration = defaultJWTLeeway
+	claims := testClaims(ur, addTestUser(t, ur, TWITCHSERVICE, "foo"))
+	claims.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	token := signTestToken(t, jwt.SigningMethodHS256, []byte(ur.config.Server.JWTSecret), claims)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	c.Request.AddCookie(&http.Cookie{Name: "twitch", Value: token})
+	if _, ok := ur.getUserFromJWT(c, "twitch"); ok {
+		t.Fatal("the expired session is valid")
+	}
+	if cookie := findCookie(t, w, "twitch"); cookie.MaxAge >= 0 {
+		t.Fatalf("the cookie wasn't cleared: %s", cookie)
+	}
+}
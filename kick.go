@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	kickAuthURL  = "https://id.kick.com/oauth/authorize"
+	kickTokenURL = "https://id.kick.com/oauth/token"
+	kickUserURL  = "https://api.kick.com/public/v1/users"
+)
+
+// KickUser ...
+type KickUser struct {
+	UserID         int    `json:"user_id"`
+	Name           string `json:"name"`
+	Email          string `json:"email"`
+	ProfilePicture string `json:"profile_picture"`
+}
+
+type kickUsersResponse struct {
+	Data    []KickUser `json:"data"`
+	Message string     `json:"message"`
+}
+
+type kickTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+func (ur *UnRustleLogs) kickEnabled() bool {
+	return ur.config.Kick.ClientID != ""
+}
+
+func (ur *UnRustleLogs) getKickAccessToken(ctx context.Context, code, verifier, redirectURI string) (*kickTokenResponse, error) {
+	v := url.Values{}
+	v.Set("client_id", ur.config.Kick.ClientID)
+	v.Set("client_secret", ur.config.Kick.ClientSecret)
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", redirectURI)
+	v.Set("code_verifier", verifier)
+
+	response, err := postForm(ctx, ur.httpClient, kickTokenURL, v)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting kick access_token, status: %d, body: %s", response.StatusCode, body)
+	}
+	var token kickTokenResponse
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (ur *UnRustleLogs) getKickUser(ctx context.Context, accessToken string) (*KickUser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", kickUserURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+
+	response, err := ur.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting kick user, status: %d, body: %s", response.StatusCode, body)
+	}
+	var users kickUsersResponse
+	err = json.Unmarshal(body, &users)
+	if err != nil {
+		return nil, err
+	}
+	if len(users.Data) == 0 {
+		return nil, errors.New("kick returned no user for access token")
+	}
+	return &users.Data[0], nil
+}
+
+type kickProvider struct {
+	ur *UnRustleLogs
+}
+
+// Service ...
+func (p *kickProvider) Service() string {
+	return KICKSERVICE
+}
+
+// Name ...
+func (p *kickProvider) Name() string {
+	return "Kick"
+}
+
+// Path ...
+func (p *kickProvider) Path() string {
+	return "/kick"
+}
+
+// CookieName ...
+func (p *kickProvider) CookieName() string {
+	return p.ur.config.Kick.Cookie
+}
+
+// RedirectURL ...
+func (p *kickProvider) RedirectURL() string {
+	return p.ur.config.Kick.RedirectURL
+}
+
+// AuthURL ...
+func (p *kickProvider) AuthURL(req authRequest) string {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ur.config.Kick.ClientID)
+	v.Set("redirect_uri", req.RedirectURI)
+	v.Set("scope", strings.Join(p.ur.config.Kick.Scopes, " "))
+	v.Set("state", req.State)
+	v.Set("code_challenge", codeChallengeS256(req.Verifier))
+	v.Set("code_challenge_method", "S256")
+	return fmt.Sprintf("%s?%s", kickAuthURL, v.Encode())
+}
+
+// Exchange ...
+func (p *kickProvider) Exchange(ctx context.Context, redirectURI, code, verifier string) (*Identity, error) {
+	access, err := p.ur.getKickAccessToken(ctx, code, verifier, redirectURI)
+	if err != nil {
+		return nil, err
+	}
+	user, err := p.ur.getKickUser(ctx, access.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		UserID:       strconv.Itoa(user.UserID),
+		Name:         user.Name,
+		DisplayName:  user.Name,
+		Email:        user.Email,
+		AccessToken:  access.AccessToken,
+		RefreshToken: access.RefreshToken,
+		ExpiresIn:    access.ExpiresIn,
+	}, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AccountLink ties a twitch and a dgg user together
+type AccountLink struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+
+	TwitchUserID    string `gorm:"uniqueIndex"`
+	DestinyggUserID string `gorm:"uniqueIndex"`
+}
+
+// LinkAccounts links the twitch and dgg users, replacing older links of either.
+func (ur *UnRustleLogs) LinkAccounts(twitchUserID, dggUserID string) error {
+	tx := ur.db.Begin()
+	err := tx.Where("twitch_user_id = ? or destinygg_user_id = ?", twitchUserID, dggUserID).Delete(&AccountLink{}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Create(&AccountLink{TwitchUserID: twitchUserID, DestinyggUserID: dggUserID}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// UnlinkAccounts removes any link the user is part of.
+func (ur *UnRustleLogs) UnlinkAccounts(userID string) error {
+	return ur.db.Where("twitch_user_id = ? or destinygg_user_id = ?", userID, userID).Delete(&AccountLink{}).Error
+}
+
+// LinkedUser returns the user linked to the given one.
+func (ur *UnRustleLogs) LinkedUser(userID string) (*User, bool) {
+	var link AccountLink
+	ur.db.Where("twitch_user_id = ? or destinygg_user_id = ?", userID, userID).First(&link)
+	if link.ID == 0 {
+		return nil, false
+	}
+	linkedID := link.TwitchUserID
+	if link.TwitchUserID == userID {
+		linkedID = link.DestinyggUserID
+	}
+	u, err := ur.GetUser(linkedID)
+	if err != nil && !errors.Is(err, errEmailDecrypt) {
+		return nil, false
+	}
+	return u, true
+}
+
+func (ur *UnRustleLogs) linkHandler(c *gin.Context) {
+	twitch, ok := ur.getUserFromJWT(c, ur.config.Twitch.Cookie)
+	if !ok || twitch.Service != TWITCHSERVICE {
+		c.Redirect(http.StatusFound, "/?error=link_requires_both")
+		return
+	}
+	dgg, ok := ur.getUserFromJWT(c, ur.config.Destinygg.Cookie)
+	if !ok || dgg.Service != DESTINYGGSERVICE {
+		c.Redirect(http.StatusFound, "/?error=link_requires_both")
+		return
+	}
+	if err := ur.LinkAccounts(twitch.ID, dgg.ID); err != nil {
+		requestLog(c).Error(err)
+		c.Redirect(http.StatusFound, "/?error=server_error")
+		return
+	}
+	requestLog(c).Infof("linked twitch user %s with dgg user %s", twitch.Name, dgg.Name)
+	c.Redirect(http.StatusFound, "/")
+}
+
+func (ur *UnRustleLogs) unlinkHandler(c *gin.Context) {
+	for _, cookie := range []string{ur.config.Twitch.Cookie, ur.config.Destinygg.Cookie} {
+		if user, ok := ur.getUserFromJWT(c, cookie); ok {
+			if err := ur.UnlinkAccounts(user.ID); err != nil {
+				requestLog(c).Errorf("failed unlinking %s user %s: %v", user.Service, user.Name, err)
+				c.Redirect(http.StatusFound, "/?error=server_error")
+				return
+			}
+		}
+	}
+	c.Redirect(http.StatusFound, "/")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestLinkedOptOuts(t *testing.T) {
+	ur := newTestRustle(t)
+	twitch := addTestUser(t, ur, TWITCHSERVICE, "foo")
+	dgg := addTestUser(t, ur, DESTINYGGSERVICE, "bar")
+	if err := ur.LinkAccounts(twitch, dgg); err != nil {
+		t.Fatal(err)
+	}
+	optedOut := func(service, name string) bool {
+		_, ok := ur.UserInDatabase(name, service, "")
+		return ok
+	}
+
+	if err := ur.DeleteUser("foo", TWITCHSERVICE, "foo-id"); err != nil {
+		t.Fatal(err)
+	}
+	if optedOut(TWITCHSERVICE, "foo") || optedOut(DESTINYGGSERVICE, "bar") {
+		t.Fatal("deleting the twitch user kept an opt-out")
+	}
+	if linked, ok := ur.LinkedUser(twitch); !ok || linked.ID != dgg {
+		t.Fatal("the link didn't survive the delete")
+	}
+
+	if _, _, err := ur.AddUser(DESTINYGGSERVICE, &Identity{UserID: "bar-id", Name: "bar"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !optedOut(TWITCHSERVICE, "foo") || !optedOut(DESTINYGGSERVICE, "bar") {
+		t.Fatal("undeleting the dgg user didn't opt both out")
+	}
+
+	if err := ur.UnlinkAccounts(dgg); err != nil {
+		t.Fatal(err)
+	}
+	if err := ur.DeleteUser("bar", DESTINYGGSERVICE, "bar-id"); err != nil {
+		t.Fatal(err)
+	}
+	if !optedOut(TWITCHSERVICE, "foo") || optedOut(DESTINYGGSERVICE, "bar") {
+		t.Fatal("deleting after unlinking reached the other user")
+	}
+}
+
+func TestLinkHandlerRequiresBothSessions(t *testing.T) {
+	ur := newTestRustle(t)
+	router := newTestRouter(t, ur)
+	twitch := addTestUser(t, ur, TWITCHSERVICE, "foo")
+	dgg := addTestUser(t, ur, DESTINYGGSERVICE, "bar")
+	twitchCookie := sessionCookie(t, ur, testProvider(t, ur, TWITCHSERVICE), twitch)
+	dggCookie := sessionCookie(t, ur, testProvider(t, ur, DESTINYGGSERVICE), dgg)
+	expired := *dggCookie
+	expired.Value = "expired"
+
+	tests := []struct {
+		name     string
+		cookies  []*http.Cookie
+		location string
+		linked   bool
+	}{
+		{name: "twitch only", cookies: []*http.Cookie{twitchCookie}, location: "/?error=link_requires_both"},
+		{name: "dgg only", cookies: []*http.Cookie{dggCookie}, location: "/?error=link_requires_both"},
+		{name: "invalid dgg session", cookies: []*http.Cookie{twitchCookie, &expired}, location: "/?error=link_requires_both"},
+		{name: "both", cookies: []*http.Cookie{twitchCookie, dggCookie}, location: "/", linked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := testRequest(router, http.MethodPost, "/link", url.Values{}, tt.cookies...)
+			if w.Code != http.StatusFound || w.Header().Get("Location") != tt.location {
+				t.Fatalf("got %d to %q, want a redirect to %q", w.Code, w.Header().Get("Location"), tt.location)
+			}
+			if _, linked := ur.LinkedUser(twitch); linked != tt.linked {
+				t.Fatalf("linked: %v, want %v", linked, tt.linked)
+			}
+		})
+	}
+}
+
+func TestLinkHandlersReportErrors(t *testing.T) {
+	ur := newTestRustle(t)
+	router := newTestRouter(t, ur)
+	twitch := addTestUser(t, ur, TWITCHSERVICE, "foo")
+	dgg := addTestUser(t, ur, DESTINYGGSERVICE, "bar")
+	cookies := []*http.Cookie{
+		sessionCookie(t, ur, testProvider(t, ur, TWITCHSERVICE), twitch),
+		sessionCookie(t, ur, testProvider(t, ur, DESTINYGGSERVICE), dgg),
+	}
+	if err := ur.db.Migrator().DropTable(&AccountLink{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"/link", "/unlink"} {
+		w := testRequest(router, http.MethodPost, target, url.Values{}, cookies...)
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "/?error=server_error" {
+			t.Errorf("%s got %d to %q, want a redirect to /?error=server_error", target, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// unixPrefix marks a server.address as the path of a unix socket
+	unixPrefix        = "unix:"
+	defaultSocketMode = "0660"
+)
+
+type connKey struct{}
+
+// listen returns a TCP listener on address, or one on the unix socket of an
+// address starting with unix:, with server.socket_mode as its permissions.
+// A socket left behind by a server that didn't shut down cleanly is removed.
+func (ur *UnRustleLogs) listen(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+	mode, err := strconv.ParseUint(ur.config.Server.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return nil, fmt.Errorf("server.socket_mode %q has to be octal permissions like 0660", ur.config.Server.SocketMode)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed removing stale socket: %v", err)
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed setting the permissions of %s: %v", path, err)
+	}
+	return listener, nil
+}
+
+// removeSocket removes the unix socket of address after the server stopped.
+func (ur *UnRustleLogs) removeSocket(address string) {
+	path, ok := strings.CutPrefix(address, unixPrefix)
+	if !ok {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		logrus.Errorf("failed removing socket: %v", err)
+	}
+}
+
+// connContext is the ConnContext of the server, it keeps the connection of
+// requests for requestConn.
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// requestConn is the connection r came in on, nil outside of the server.
+func requestConn(r *http.Request) net.Conn {
+	conn, _ := r.Context().Value(connKey{}).(net.Conn)
+	return conn
+}
+
+func overUnixSocket(r *http.Request) bool {
+	conn := requestConn(r)
+	if conn == nil {
+		return false
+	}
+	_, unix := conn.LocalAddr().(*net.UnixAddr)
+	return unix
+}
+
+// serve starts srv, over https if server.tls is configured. With acme the
+// challenges are answered on server.tls.http_address.
+func (ur *UnRustleLogs) serve(srv *http.Server) error {
+	listener, err := ur.listen(srv.Addr)
+	if err != nil {
+		return err
+	}
+	if ur.acme != nil {
+		ur.challengeServer = &http.Server{
+			Addr:         ur.config.Server.TLS.HTTPAddress,
+			Handler:      ur.acme.HTTPHandler(nil),
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
+		logrus.Infof("starting acme challenge server adress: %q", ur.challengeServer.Addr)
+		go func() {
+			if err := ur.challengeServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logrus.Error(err)
+			}
+		}()
+	}
+	srv.TLSConfig = ur.tlsConfig
+	logrus.Infof("starting server adress: %q tls: %v", srv.Addr, ur.tlsConfig != nil)
+	go func() {
+		var err error
+		if ur.tlsConfig != nil {
+			// the certificates are in the TLSConfig
+			err = srv.ServeTLS(listener, "", "")
+		} else {
+			err = srv.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logrus.Error(err)
+		}
+	}()
+	return nil
+}
+
+// shutdown waits for the requests of srv and the challenge server to
+// finish until ctx is done.
+func (ur *UnRustleLogs) shutdown(ctx context.Context, srv *http.Server) {
+	if err := srv.Shutdown(ctx); err != nil {
+		logrus.Error("Server Shutdown:", err)
+	}
+	if ur.challengeServer != nil {
+		if err := ur.challengeServer.Shutdown(ctx); err != nil {
+			logrus.Error("Challenge Server Shutdown:", err)
+		}
+	}
+	ur.removeSocket(srv.Addr)
+}
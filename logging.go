@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// requestLogger logs every request through logrus instead of gin's own
+// format, /assets only if server.log_assets isn't false.
+func (ur *UnRustleLogs) requestLogger(c *gin.Context) {
+	start := time.Now()
+	path := c.Request.URL.Path
+	if la := ur.config.Server.LogAssets; la != nil && !*la && strings.HasPrefix(path, "/assets/") {
+		c.Next()
+		return
+	}
+	c.Next()
+
+	status := c.Writer.Status()
+	fields := logrus.Fields{
+		"method":     c.Request.Method,
+		"path":       path,
+		"status":     status,
+		"latency":    time.Since(start).String(),
+		"client_ip":  ur.clientIP(c.Request),
+		"user_agent": c.Request.UserAgent(),
+		"bytes":      c.Writer.Size(),
+	}
+	if user := requestUser(c); user != "" {
+		fields["user"] = user
+	}
+	entry := requestLog(c).WithFields(fields)
+	switch {
+	case status >= http.StatusInternalServerError:
+		entry.Error("request")
+	case len(c.Errors) > 0:
+		entry.WithField("errors", c.Errors.String()).Warn("request")
+	default:
+		entry.Info("request")
+	}
+}
+
+// requestUser is who the request was authenticated as, service/name for
+// sessions, the login for admins and the label for api keys.
+func requestUser(c *gin.Context) string {
+	if v, ok := c.Get("user"); ok {
+		if user, ok := v.(*User); ok {
+			return user.Service + "/" + user.Name
+		}
+	}
+	if admin := c.GetString("admin"); admin != "" {
+		return "admin/" + admin
+	}
+	if v, ok := c.Get(apiKeyContext); ok {
+		if apiKey, ok := v.(*APIKey); ok {
+			return "apikey/" + apiKey.Label
+		}
+	}
+	return ""
+}
@@ -2,36 +2,124 @@ package main
 
 import (
 	"context"
+	"crypto/cipher"
+	"crypto/rsa"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/jinzhu/gorm"
+	"gorm.io/gorm"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/grpc"
 )
 
 // UnRustleLogs ...
 type UnRustleLogs struct {
-	config *Config
-	db     *gorm.DB
-
-	dggStates     map[string]*state
-	dggStateMutex sync.RWMutex
-
-	twitchStates     map[string]struct{}
-	twitchStateMutex sync.RWMutex
+	config     *Config
+	db         *gorm.DB
+	tokenAEAD  cipher.AEAD
+	httpClient *http.Client
+
+	trustedProxies []*net.IPNet
+
+	sessions SessionManager
+	// now is time.Now, replaceable to move the session clock
+	now func() time.Time
+
+	// sameSite is applied to every cookie, see setCookie
+	sameSite http.SameSite
+
+	// jwtSecrets are the HS256 keys, the first one signs
+	jwtSecrets []JWTSecretConfig
+	// jwtPrivateKey and jwtPublicKey are only set with RS256
+	jwtPrivateKey *rsa.PrivateKey
+	jwtPublicKey  *rsa.PublicKey
+
+	// states is only used while the database is unavailable
+	states     map[string]*state
+	stateMutex sync.RWMutex
+	// pendingLogins are counted for the max_pending_states limits
+	pendingLogins pendingLogins
+
+	// providers are the registered login backends in index page order
+	providers []Provider
+
+	breakers     map[string]*circuitBreaker
+	breakerMutex sync.Mutex
+
+	dbHealth healthCheck
+	ready    readiness
+	// userCache is nil if database.user_cache is false
+	userCache *userCache
+	// stats are the opt-out counts of /stats
+	stats optOutStats
+	// blooms are the filters of /api/v1/deleted/:service/bloom
+	blooms bloomCache
+	// webhooks is nil unless any are configured
+	webhooks *webhooks
+	// changes feeds the gRPC change streams
+	changes changeFeed
+	// grpcServer is nil unless server.grpc_address is set
+	grpcServer *grpc.Server
+
+	// workers are the background goroutines started with goWorker, Stop
+	// ends and waits for them
+	workers     sync.WaitGroup
+	workerCtx   context.Context
+	stopWorkers context.CancelFunc
+	closeOnce   sync.Once
+
+	// revoked caches the jtis of logged out sessions with their expiry
+	revoked      map[string]time.Time
+	revokedMutex sync.RWMutex
+
+	// rateLimiters are keyed by route group, empty if ratelimit.enabled is
+	// false
+	rateLimiters map[string]*rateLimiter
+	// tlsConfig is set if server.tls is, acme and challengeServer only
+	// with server.tls.acme
+	tlsConfig       *tls.Config
+	acme            *autocert.Manager
+	challengeServer *http.Server
+	// corsOrigins are parsed from cors.allowed_origins
+	corsOrigins []corsOrigin
+	// openAPI is the document of /api/openapi.json and apiDocs the
+	// endpoints in it, see setupOpenAPI
+	openAPI []byte
+	apiDocs []APIDocsEntry
+	// routes are the registered routes, for the Allow header of 405s
+	routes gin.RoutesInfo
+
+	// apiKeys are every key of the programmatic API, see setupAPIKeys
+	apiKeys     []APIKey
+	apiKeyMutex sync.RWMutex
 }
 
 type state struct {
 	service  string
 	verifier string
+	ip       string
+	// redirect is where the callback sends the user after logging in
+	redirect string
+	// remember asks for a persistent cookie instead of a browser session one
+	remember bool
+	// duration is the optOutDurations key the opt-out lasts for, "" if it's
+	// permanent
+	duration string
 	time     time.Time
 }
 
@@ -40,21 +128,101 @@ const (
 	TWITCHSERVICE = "twitch"
 	// DESTINYGGSERVICE ...
 	DESTINYGGSERVICE = "destinygg"
+	// DISCORDSERVICE ...
+	DISCORDSERVICE = "discord"
+	// YOUTUBESERVICE ...
+	YOUTUBESERVICE = "youtube"
+	// KICKSERVICE ...
+	KICKSERVICE = "kick"
 )
 
+// defaultHTTPTimeout is used for outbound provider calls unless
+// server.http_timeout is configured
+const defaultHTTPTimeout = 10 * time.Second
+
+// maxMultipartMemory is what form uploads may buffer in memory, nothing
+// takes files so it's small
+const maxMultipartMemory = 1 << 20
+
 // jwtCustomClaims are custom claims extending default ones.
 type jwtClaims struct {
 	ID string `json:"id"`
+	// EmailVerified is what the provider reported at login
+	EmailVerified bool `json:"email_verified"`
+	// Remember is set if the user asked to stay logged in
+	Remember bool `json:"remember"`
+	// AuthTime is when the user logged in, renewals keep it
+	AuthTime int64 `json:"auth_time,omitempty"`
 	jwt.StandardClaims
 }
 
 func main() {
-	gin.SetMode(gin.ReleaseMode)
-	rustle := NewUnRustleLogs()
+	if len(os.Args) > 1 && os.Args[1] == "apikey" {
+		apiKeyCommand()
+		return
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "backup" || os.Args[1] == "restore") {
+		backupCommand(os.Args[1], os.Args[2:])
+		return
+	}
+	migrateOnly := flag.Bool("migrate-only", false, "apply database migrations and exit")
+	failFast := flag.Bool("fail-fast", false, "exit right away if the database is unreachable, same as database.wait = false")
+	templatesDir := flag.String("templates-dir", "", "load the templates from this directory instead of the binary")
+	assetsDir := flag.String("assets-dir", "", "serve /assets from this directory instead of the binary")
+	flag.Parse()
+
+	// SIGINT is Ctrl+C and SIGTERM how docker, systemd and kubernetes stop
+	// us, either stops the background workers and shuts the server down.
+	// A second one kills the server as usual.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// NotifyContext doesn't tell which signal it was
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, os.Interrupt, syscall.SIGTERM)
+
+	rustle := NewUnRustleLogs(ctx)
 	rustle.LoadConfig("config.toml")
+	gin.SetMode(rustle.config.Server.Mode)
+	if *failFast {
+		wait := false
+		rustle.config.Database.Wait = &wait
+	}
 
+	if err := rustle.setupEmailEncryption(); err != nil {
+		logrus.Fatal(err)
+	}
 	rustle.NewDatabase()
-	err := rustle.setupTwitchClient()
+	if *migrateOnly {
+		logrus.Info("database is up to date")
+		return
+	}
+	rustle.loadRevokedTokens()
+	err := rustle.setupTokenStore()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	err = rustle.setupCookies()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	err = rustle.setupJWT()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	err = rustle.setupSessions()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	err = rustle.setupTrustedProxies()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	err = rustle.setupTwitchClient()
 	if err != nil {
 		logrus.Fatal(err)
 	}
@@ -64,30 +232,52 @@ func main() {
 		logrus.Fatal(err)
 	}
 
-	router := gin.Default()
-	router.LoadHTMLGlob("templates/*")
+	err = rustle.setupProviders()
+	if err != nil {
+		logrus.Fatal(err)
+	}
 
-	router.GET("/", rustle.indexHandler)
-	router.GET("/verify", rustle.verifyHandler)
-	router.GET("/robots.txt", func(c *gin.Context) {
-		c.String(200, "User-agent: *\nDisallow: /")
-	})
+	err = rustle.setupOIDCProviders()
+	if err != nil {
+		logrus.Fatal(err)
+	}
 
-	twitch := router.Group("/twitch")
-	{
-		twitch.GET("/login", rustle.TwitchLoginHandle)
-		twitch.GET("/logout", rustle.TwitchLogoutHandle)
-		twitch.GET("/callback", rustle.TwitchCallbackHandle)
+	err = rustle.setupAdmin()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	err = rustle.setupAPIKeys()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	err = rustle.setupWebhooks()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	err = rustle.setupGRPC()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	err = rustle.setupTLS()
+	if err != nil {
+		logrus.Fatal(err)
 	}
 
-	dgg := router.Group("/dgg")
-	{
-		dgg.GET("/login", rustle.DestinyggLoginHandle)
-		dgg.GET("/logout", rustle.DestinyggLogoutHandle)
-		dgg.GET("/callback", rustle.DestinyggCallbackHandle)
+	err = rustle.setupCORS()
+	if err != nil {
+		logrus.Fatal(err)
 	}
 
-	router.Static("/assets", "./assets")
+	rustle.setupRateLimits()
+
+	router, err := rustle.newRouter(*templatesDir, *assetsDir)
+	if err != nil {
+		logrus.Fatal(err)
+	}
 
 	srv := &http.Server{
 		Handler: router,
@@ -95,71 +285,318 @@ func main() {
 		// Good practice: enforce timeouts for servers you create!
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
+		ConnContext:  connContext,
 	}
 
-	logrus.Infof("starting server adress: %q", rustle.config.Server.Address)
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logrus.Error(err)
-		}
-	}()
-
-	c := make(chan os.Signal, 1)
-	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
-	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
-	signal.Notify(c, os.Interrupt)
+	rustle.Start()
+	err = rustle.serve(srv)
+	if err != nil {
+		logrus.Fatal(err)
+	}
 
-	// Block until we receive our signal.
-	<-c
+	sig := <-received
+	stop()
+	signal.Stop(received)
+	logrus.Infof("received %v, shutting down", sig)
+	rustle.startDraining()
 
 	// Create a deadline to wait for.
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
 	defer cancel()
 	// Doesn't block if no connections, but will otherwise wait
 	// until the timeout deadline.
-	if err := srv.Shutdown(ctx); err != nil {
-		logrus.Fatal("Server Shutdown:", err)
+	rustle.shutdown(ctx, srv)
+	rustle.stopGRPC(ctx)
+	if err := rustle.Close(ctx); err != nil {
+		logrus.Error(err)
 	}
 	logrus.Info("Server exiting")
 }
 
-// NewUnRustleLogs ...
-func NewUnRustleLogs() *UnRustleLogs {
+// newRouter registers every route, the templates and the assets come from
+// the directories instead of the binary if they are set.
+func (ur *UnRustleLogs) newRouter(templatesDir, assetsDir string) (*gin.Engine, error) {
+	router := gin.New()
+	router.MaxMultipartMemory = maxMultipartMemory
+	// X-Forwarded-For is only believed from server.trusted_proxies, see
+	// clientIP
+	router.ForwardedByClientIP = false
+	router.HandleMethodNotAllowed = true
+	router.Use(requestIDMiddleware, ur.requestLogger, recovery, ur.corsMiddleware)
+	router.NoRoute(noRouteHandler)
+	router.NoMethod(ur.noMethodHandler)
+
+	router.GET("/", ur.indexHandler)
+	router.GET("/verify", ur.verifyHandler)
+	router.GET("/link", ur.csrfMiddleware, ur.linkHandler)
+	router.POST("/link", ur.csrfMiddleware, ur.linkHandler)
+	router.GET("/unlink", ur.csrfMiddleware, ur.unlinkHandler)
+	router.POST("/unlink", ur.csrfMiddleware, ur.unlinkHandler)
+	router.GET("/status", ur.statusHandler)
+	router.GET("/healthz", ur.healthzHandler)
+	router.GET("/readyz", ur.readyzHandler)
+	router.GET("/stats", ur.rateLimit(rateLimitAPI), ur.apiKeyAuth(ur.config.API.StatsRequireKey), ur.requireScope(scopeStats), ur.statsHandler)
+	router.GET("/.well-known/jwks.json", ur.jwksHandler)
+	router.GET("/api/me", ur.meHandler)
+	router.GET("/api/openapi.json", ur.openAPIHandler)
+	router.GET("/api/docs", ur.apiDocsHandler)
+	v1 := router.Group("/api/v1", ur.rateLimit(rateLimitAPI))
+	keyed := v1.Group("", ur.apiKeyAuth(ur.apiKeysRequired()))
+	keyed.POST("/check", ur.requireScope(scopeCheck), ur.checkHandler)
+	keyed.GET("/deleted/:service", ur.requireScope(scopeList), ur.deletedHandler)
+	keyed.GET("/deleted/:service/:name", ur.deletedNameHandler)
+	keyed.HEAD("/deleted/:service/:name", ur.deletedNameHandler)
+	// the filter's first path, kept for the clients using it
+	keyed.GET("/bloom/:service", ur.requireScope(scopeList), ur.bloomHandler)
+	me := v1.Group("/me/:service", ur.sessionMiddleware)
+	me.GET("", ur.optOutStatusHandler)
+	me.POST("/optout", ur.optOutHandler)
+	me.DELETE("/optout", ur.optInHandler)
+	router.GET("/settings", ur.settingsHandler)
+	router.POST("/settings", ur.csrfMiddleware, ur.saveSettingsHandler)
+	router.POST("/expiry", ur.csrfMiddleware, ur.expiryHandler)
+	router.GET("/logout", ur.logoutAllHandler)
+	router.GET("/robots.txt", func(c *gin.Context) {
+		c.String(200, "User-agent: *\nDisallow: /")
+	})
+
+	for _, p := range ur.providers {
+		group := router.Group(p.Path())
+		{
+			group.GET("/login", ur.rateLimit(rateLimitLogin), ur.loginHandler(p))
+			group.GET("/logout", ur.logoutHandler(p))
+			group.GET("/callback", ur.rateLimit(rateLimitLogin), ur.callbackHandler(p))
+			group.GET("/refresh", ur.refreshHandler(p))
+			group.GET("/delete", ur.csrfMiddleware, ur.deleteHandler(p))
+			group.POST("/delete", ur.csrfMiddleware, ur.deleteHandler(p))
+			group.GET("/undelete", ur.csrfMiddleware, ur.undeleteHandler(p))
+			group.POST("/undelete", ur.csrfMiddleware, ur.undeleteHandler(p))
+		}
+	}
+
+	if ur.adminEnabled() {
+		router.GET("/admin/login", ur.rateLimit(rateLimitLogin), ur.AdminLoginHandle)
+		router.GET("/admin/callback", ur.rateLimit(rateLimitLogin), ur.AdminCallbackHandle)
+		router.GET("/admin/logout", ur.AdminLogoutHandle)
+
+		admin := router.Group("/admin", ur.adminMiddleware)
+		{
+			admin.GET("/", ur.adminIndexHandler)
+			admin.GET("/users", ur.adminUsersHandler)
+			admin.GET("/export", ur.adminExportHandler)
+		}
+	}
+
+	if err := ur.setupPprof(router); err != nil {
+		return nil, err
+	}
+	if err := ur.setupWeb(router, templatesDir, assetsDir); err != nil {
+		return nil, err
+	}
+	ur.routes = router.Routes()
+	if err := ur.setupOpenAPI(ur.routes); err != nil {
+		return nil, err
+	}
+	return router, nil
+}
+
+// NewUnRustleLogs ... The background workers stop once ctx is done or on
+// Close.
+func NewUnRustleLogs(ctx context.Context) *UnRustleLogs {
+	workerCtx, stopWorkers := context.WithCancel(ctx)
 	return &UnRustleLogs{
-		dggStates:    make(map[string]*state),
-		twitchStates: make(map[string]struct{}),
+		workerCtx:   workerCtx,
+		stopWorkers: stopWorkers,
+		httpClient: &http.Client{
+			Timeout: defaultHTTPTimeout,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConns:        100,
+				MaxIdleConnsPerHost: 10,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+		},
+		states:   make(map[string]*state),
+		breakers: make(map[string]*circuitBreaker),
+		revoked:  make(map[string]time.Time),
+		now:      time.Now,
 	}
 }
 
-// Payload ...
-type Payload struct {
-	Twitch struct {
-		ID       string
-		Name     string
-		Email    string
-		LoggedIn bool
+// goWorker runs work in the background until Close or the shutdown signal.
+func (ur *UnRustleLogs) goWorker(work func(ctx context.Context)) {
+	ur.workers.Add(1)
+	go func() {
+		defer ur.workers.Done()
+		work(ur.workerCtx)
+	}()
+}
+
+// Start runs the background jobs, once everything they use is set up.
+func (ur *UnRustleLogs) Start() {
+	ur.goWorker(ur.sweepStates)
+	ur.goWorker(ur.sweepExpiredOptOuts)
+	ur.goWorker(ur.refreshStats)
+	ur.goWorker(ur.maintenance)
+	ur.goWorker(ur.refreshRevokedTokens)
+	ur.goWorker(ur.sweepSessions)
+	ur.goWorker(ur.sweepRateLimits)
+}
+
+// Stop ends the background workers, also done by the context passed to
+// NewUnRustleLogs, and waits for them until ctx is done.
+func (ur *UnRustleLogs) Stop(ctx context.Context) error {
+	if ur.stopWorkers != nil {
+		ur.stopWorkers()
 	}
-	Destinygg struct {
-		ID       string
-		Name     string
-		LoggedIn bool
+	done := make(chan struct{})
+	go func() {
+		ur.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.New("background workers didn't stop in time")
 	}
 }
 
+// Close stops the background workers, waiting for them and the queued
+// webhook events until ctx is done, and closes the database. Only the first call does anything.
+func (ur *UnRustleLogs) Close(ctx context.Context) error {
+	var err error
+	ur.closeOnce.Do(func() {
+		err = ur.Stop(ctx)
+		if ur.webhooks != nil {
+			if hookErr := ur.webhooks.close(ctx); hookErr != nil {
+				err = hookErr
+			}
+		}
+		if ur.db != nil {
+			sqlDB, dbErr := ur.db.DB()
+			if dbErr == nil {
+				dbErr = sqlDB.Close()
+			}
+			if dbErr != nil {
+				err = fmt.Errorf("failed closing database: %v", dbErr)
+			}
+		}
+	})
+	return err
+}
+
+// Payload ...
+type Payload struct {
+	Error string
+	// CanLink is set when logged in with both twitch and dgg
+	CanLink     bool
+	Linked      bool
+	AnyLoggedIn bool
+	Providers   []ProviderPayload
+	// CSRF has to be submitted with every form
+	CSRF string
+	// Durations are the choices besides a permanent opt-out
+	Durations []OptOutDuration
+	// OptOuts is the number of active opt-outs of all services, 0 until
+	// they were counted
+	OptOuts int64
+}
+
+// ProviderPayload ...
+type ProviderPayload struct {
+	Service  string
+	Provider string
+	Path     string
+	Icon     string
+	ID       string
+	UserID   string
+	Name     string
+	Email    string
+	LoggedIn bool
+	// DeletingSince is when the user opted out, unset if the user undeleted
+	DeletingSince time.Time
+	// ExpiresInDays is how long the session is valid for
+	ExpiresInDays int
+	Remember      bool
+	// Unavailable is set while the provider's circuit breaker is open
+	Unavailable bool
+	// RenamedFrom is the old name if the login just noticed a rename
+	RenamedFrom string
+	// AllChannels is unset if the opt-out only covers Channels
+	AllChannels bool
+	Channels    []string
+	// ExpiresAt is when the opt-out ends, nil if it's permanent
+	ExpiresAt *time.Time
+}
+
+// providerIcons are the font awesome icons shown next to provider names
+var providerIcons = map[string]string{
+	TWITCHSERVICE:  "fab fa-twitch",
+	DISCORDSERVICE: "fab fa-discord",
+	YOUTUBESERVICE: "fab fa-youtube",
+}
+
 func (ur *UnRustleLogs) indexHandler(c *gin.Context) {
-	payload := Payload{}
-	twitch, ok := ur.getUserFromJWT(c, ur.config.Twitch.Cookie)
-	if ok {
-		payload.Twitch.Name = twitch.DisplayName
-		payload.Twitch.Email = twitch.Email
-		payload.Twitch.LoggedIn = true
-		payload.Twitch.ID = twitch.ID
-	}
-	dgg, ok := ur.getUserFromJWT(c, ur.config.Destinygg.Cookie)
-	if ok {
-		payload.Destinygg.Name = dgg.DisplayName
-		payload.Destinygg.LoggedIn = true
-		payload.Destinygg.ID = dgg.ID
+	payload := Payload{CSRF: ur.csrfToken(c), Durations: optOutDurations}
+	active, _ := ur.stats.snapshot()
+	for _, p := range ur.providers {
+		payload.OptOuts += active[p.Service()]
+	}
+	if errorCode := c.Query("error"); errorCode != "" {
+		msg, ok := loginErrorMessages[errorCode]
+		if !ok {
+			msg = loginErrorMessages["unknown"]
+		}
+		payload.Error = msg
+	}
+	loggedIn := map[string]*User{}
+	for _, p := range ur.providers {
+		pp := ProviderPayload{
+			Service:  p.Service(),
+			Provider: p.Name(),
+			Path:     p.Path(),
+			Icon:     providerIcons[p.Service()],
+
+			Unavailable: !ur.breaker(p.Service()).allow(),
+		}
+		if user, claims, ok := ur.getSession(c, p.CookieName()); ok {
+			pp.ExpiresInDays = int(time.Until(time.Unix(claims.ExpiresAt, 0)).Hours() / 24)
+			pp.Remember = claims.Remember
+			pp.ID = user.ID
+			pp.UserID = user.UserID
+			pp.Name = user.DisplayName
+			pp.Email = user.Email
+			if user.optedOut(time.Now().UTC()) {
+				pp.DeletingSince = user.RequestedAt
+				pp.ExpiresAt = user.ExpiresAt
+			}
+			pp.AllChannels = user.AllChannels
+			if !user.AllChannels {
+				channels, err := ur.UserChannels(user.ID)
+				if err != nil {
+					requestLog(c).Errorf("failed getting channels of %s user %s: %v", user.Service, user.Name, err)
+				}
+				pp.Channels = channels
+			}
+			if from, err := c.Cookie(renamedCookie(p)); err == nil {
+				if from != user.Name {
+					pp.RenamedFrom = from
+				}
+				ur.deleteCookie(c, renamedCookie(p))
+			}
+			pp.LoggedIn = true
+			loggedIn[p.Service()] = user
+			payload.AnyLoggedIn = true
+		}
+		payload.Providers = append(payload.Providers, pp)
+	}
+	twitch, dgg := loggedIn[TWITCHSERVICE], loggedIn[DESTINYGGSERVICE]
+	if twitch != nil && dgg != nil {
+		payload.CanLink = true
+		linked, ok := ur.LinkedUser(twitch.ID)
+		payload.Linked = ok && linked.ID == dgg.ID
 	}
 	c.HTML(http.StatusOK, "index.tmpl", payload)
 }
@@ -185,8 +622,12 @@ func (ur *UnRustleLogs) verifyHandler(c *gin.Context) {
 			c.HTML(http.StatusBadRequest, "verify.tmpl", payload)
 			return
 		}
-		user, ok := ur.GetUser(uid.String())
-		if !ok {
+		user, err := ur.GetUser(uid.String())
+		if errors.Is(err, errEmailDecrypt) {
+			errorPage(c, http.StatusInternalServerError, "The email of this user can't be read right now, please try again later.")
+			return
+		}
+		if err != nil {
 			c.HTML(http.StatusBadRequest, "verify.tmpl", payload)
 			return
 		}
@@ -201,113 +642,87 @@ func (ur *UnRustleLogs) verifyHandler(c *gin.Context) {
 	c.HTML(http.StatusOK, "verify.tmpl", payload)
 }
 
-func (ur *UnRustleLogs) getUserFromJWT(c *gin.Context, cookiename string) (*User, bool) {
-	cookie, err := c.Cookie(cookiename)
-	if err != nil {
-		return nil, false
-	}
-	token, err := jwt.ParseWithClaims(cookie, &jwtClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(ur.config.Server.JWTSecret), nil
-	})
-	if err != nil {
-		logrus.Error(err)
-		ur.deleteCookie(c, cookie)
-		return nil, false
-	}
-
-	if claims, ok := token.Claims.(*jwtClaims); ok && token.Valid {
-		// idk if i have to manually check if the jwt is expired or not
-		// might be that .Valid is only true if it's not expired also
-		now := time.Now()
-		expires := time.Unix(claims.ExpiresAt, 0)
-		if now.After(expires) {
-			ur.deleteCookie(c, cookie)
-			return nil, false
-		}
-		return ur.GetUser(claims.ID)
-	}
-	return nil, false
+// loginErrorMessages maps the error codes the callbacks redirect to / with
+// to the message shown on the index page.
+var loginErrorMessages = map[string]string{
+	"access_denied":           "Login was cancelled.",
+	"missing_code":            "The login provider did not return an authorization code, please try again.",
+	"missing_scope":           "Not all requested permissions were granted, please try again and accept them.",
+	"invalid_state":           "This login is unknown or has already been used, please log in again.",
+	"login_expired":           "Your login expired, please try again.",
+	"email_missing":           "Your account has no email address we could read. Please allow access to your email address, we need it to verify opt-out requests.",
+	"email_unverified":        "The email address of your account is not verified. Please verify it with the provider first, we need it to verify opt-out requests.",
+	"link_requires_both":      "You need to be logged in with both Twitch and Destiny.gg to link accounts, one of your sessions is missing or expired.",
+	"server_error":            "The login provider had an error, please try again later.",
+	"temporarily_unavailable": "The login provider is temporarily unavailable, please try again later.",
+	"invalid_duration":        "Please choose one of the offered durations.",
+	"unknown":                 "Login failed, please try again.",
 }
 
-func (ur *UnRustleLogs) parseJWT(jwtString string) (*jwtClaims, bool) {
-	token, err := jwt.ParseWithClaims(jwtString, &jwtClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(ur.config.Server.JWTSecret), nil
-	})
-	if err != nil {
-		logrus.Error(err)
-		return nil, false
+// handleCallbackError checks an OAuth callback for error parameters or a
+// missing code and redirects to / with a friendly message if there are any.
+func (ur *UnRustleLogs) handleCallbackError(c *gin.Context, service string) bool {
+	errorCode := c.Query("error")
+	if errorCode == "" {
+		if c.Query("code") != "" {
+			return false
+		}
+		errorCode = "missing_code"
 	}
-
-	if claims, ok := token.Claims.(*jwtClaims); ok && token.Valid {
-		return claims, true
+	if _, ok := loginErrorMessages[errorCode]; !ok {
+		requestLog(c).Warnf("%s oauth callback error %q: %s", service, errorCode, c.Query("error_description"))
+		errorCode = "unknown"
 	}
-	return nil, false
+	c.Redirect(http.StatusFound, "/?error="+errorCode)
+	return true
 }
 
-func (ur *UnRustleLogs) addDggState(s, verifier string) {
-	ur.dggStateMutex.Lock()
-	defer ur.dggStateMutex.Unlock()
-	ur.dggStates[s] = &state{
-		verifier: verifier,
-		service:  DESTINYGGSERVICE,
-		time:     time.Now().UTC(),
-	}
-	// delete dgg state after 5 minutes
-	go func() {
-		time.Sleep(time.Minute * 5)
-		ur.deleteDggState(s)
-	}()
+func (ur *UnRustleLogs) getUserFromJWT(c *gin.Context, cookieName string) (*User, bool) {
+	user, _, ok := ur.getSession(c, cookieName)
+	return user, ok
 }
 
-func (ur *UnRustleLogs) hasDggState(state string) (string, bool) {
-	if strings.TrimSpace(state) == "" {
-		return "", false
+// getSession is getUserFromJWT that also returns the claims of the session.
+// Expired sessions count as logged out and their cookie is removed.
+func (ur *UnRustleLogs) getSession(c *gin.Context, cookieName string) (*User, *jwtClaims, bool) {
+	value, err := c.Cookie(cookieName)
+	if err != nil {
+		return nil, nil, false
 	}
-	ur.dggStateMutex.RLock()
-	defer ur.dggStateMutex.RUnlock()
-	s, ok := ur.dggStates[state]
-	if !ok {
-		return "", false
+	claims, err := ur.sessions.Get(value)
+	if err == errSessionExpired || err == errSessionRevoked || err == errSessionUnknown {
+		ur.deleteCookie(c, cookieName)
+		return nil, nil, false
 	}
-	return s.verifier, ok
-}
-
-func (ur *UnRustleLogs) deleteDggState(state string) {
-	ur.dggStateMutex.Lock()
-	defer ur.dggStateMutex.Unlock()
-	_, ok := ur.dggStates[state]
-	if ok {
-		logrus.Infof("deleting dgg state %s", state)
-		delete(ur.dggStates, state)
+	if err != nil {
+		requestLog(c).Error(err)
+		ur.deleteCookie(c, cookieName)
+		return nil, nil, false
 	}
-}
-
-func (ur *UnRustleLogs) addTwitchState(s string) {
-	ur.twitchStateMutex.Lock()
-	defer ur.twitchStateMutex.Unlock()
-	ur.twitchStates[s] = struct{}{}
-	go func() {
-		time.Sleep(time.Minute * 5)
-		ur.deleteTwitchState(s)
-	}()
-}
-
-func (ur *UnRustleLogs) hasTwitchState(state string) bool {
-	if strings.TrimSpace(state) == "" {
-		return false
+	if ur.config.Server.SessionSliding && ur.sessionHalfSpent(claims) {
+		if renewed, err := ur.renewSession(c, cookieName, claims); err != nil {
+			requestLog(c).Errorf("failed renewing session: %v", err)
+		} else {
+			claims = renewed
+		}
+	}
+	// the session doesn't need the email, meHandler checks it
+	user, err := ur.GetUser(claims.ID)
+	ok := err == nil || errors.Is(err, errEmailDecrypt)
+	if ok && !ur.audienceMatches(claims, user.Service) {
+		requestLog(c).Errorf("session of %s user %s has audience %q", user.Service, user.Name, claims.Audience)
+		ur.destroySession(c, cookieName, claims)
+		ur.deleteCookie(c, cookieName)
+		return nil, nil, false
 	}
-	ur.twitchStateMutex.RLock()
-	defer ur.twitchStateMutex.RUnlock()
-	_, ok := ur.twitchStates[state]
-	return ok
+	return user, claims, ok
 }
 
-func (ur *UnRustleLogs) deleteTwitchState(state string) {
-	ur.twitchStateMutex.Lock()
-	defer ur.twitchStateMutex.Unlock()
-	_, ok := ur.twitchStates[state]
-	if ok {
-		logrus.Infof("deleting twitch state %s", state)
-		delete(ur.twitchStates, state)
+func (ur *UnRustleLogs) parseJWT(jwtString string) (*jwtClaims, bool) {
+	claims, err := ur.parseClaims(jwtString)
+	if err != nil {
+		logrus.Error(err)
+		return nil, false
 	}
+	return claims, true
 }
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	logrus.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testDatabases numbers the in-memory databases, every test gets its own
+var testDatabases int64
+
+// testDSN is a fresh in-memory sqlite database, shared by the connections
+// of one pool.
+func testDSN() string {
+	return fmt.Sprintf("file:test%d?mode=memory&cache=shared", atomic.AddInt64(&testDatabases, 1))
+}
+
+// newTestRustle returns an UnRustleLogs with a migrated in-memory database
+// and the twitch and dgg providers, closed when the test ends.
+func newTestRustle(t testing.TB) *UnRustleLogs {
+	t.Helper()
+	return newTestRustleDSN(t, testDSN())
+}
+
+// newTestRustleDSN is newTestRustle with the sqlite database at dsn.
+func newTestRustleDSN(t testing.TB, dsn string) *UnRustleLogs {
+	t.Helper()
+	ur := NewUnRustleLogs(context.Background())
+	ur.config = &Config{}
+	ur.config.Database.Dialect = "sqlite3"
+	ur.config.Database.DSN = dsn
+	ur.config.Twitch.Cookie = "twitch"
+	ur.config.Destinygg.Cookie = "dgg"
+	ur.config.Server.JWTSecret = "0123456789abcdef0123456789abcdef"
+	ur.config.Server.JWTIssuer = defaultJWTIssuer
+	ur.config.Server.JWTTTL.Duration = defaultJWTTTL
+	ur.config.Server.SessionTTL.Duration = defaultSessionTTL
+	ur.config.Server.SessionAbsoluteMax.Duration = defaultSessionAbsoluteMax
+	ur.config.Server.StateTTL.Duration = defaultStateTTL
+	ur.NewDatabase()
+	t.Cleanup(func() {
+		ur.Close(context.Background())
+	})
+	for _, setup := range []func() error{ur.setupProviders, ur.setupCookies, ur.setupJWT, ur.setupSessions} {
+		if err := setup(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ur
+}
+
+// addTestUser opts name out of service, failing the test on errors.
+func addTestUser(t *testing.T, ur *UnRustleLogs, service, name string) string {
+	t.Helper()
+	id, _, err := ur.AddUser(service, &Identity{UserID: name + "-id", Name: name, DisplayName: name}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// newTestRouter is the router of ur with the embedded templates.
+func newTestRouter(t *testing.T, ur *UnRustleLogs) *gin.Engine {
+	t.Helper()
+	router, err := ur.newRouter("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return router
+}
+
+// sessionCookie logs the user with the row id in to p.
+func sessionCookie(t *testing.T, ur *UnRustleLogs, p Provider, id string) *http.Cookie {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	claims := &jwtClaims{ID: id}
+	claims.Audience = p.Service()
+	if err := ur.setSessionCookie(c, p.CookieName(), claims); err != nil {
+		t.Fatal(err)
+	}
+	return findCookie(t, w, p.CookieName())
+}
+
+// testCSRF is the token the csrf cookie and form field of testRequest get
+const testCSRF = "test-csrf-token"
+
+// testRequest sends a request to router, a form is posted with testCSRF
+// in it and in the csrf cookie.
+func testRequest(router http.Handler, method, target string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	var body io.Reader
+	if form != nil {
+		form.Set(csrfField, testCSRF)
+		body = strings.NewReader(form.Encode())
+		cookies = append(cookies, &http.Cookie{Name: csrfCookie, Value: testCSRF})
+	}
+	req := httptest.NewRequest(method, target, body)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// testProvider is the registered provider of service.
+func testProvider(t *testing.T, ur *UnRustleLogs, service string) Provider {
+	t.Helper()
+	p, ok := ur.provider(service)
+	if !ok {
+		t.Fatalf("no %s provider", service)
+	}
+	return p
+}
+
+func TestClose(t *testing.T) {
+	ur := newTestRustle(t)
+	addTestUser(t, ur, TWITCHSERVICE, "foo")
+	for i := 0; i < 2; i++ {
+		if err := ur.Close(context.Background()); err != nil {
+			t.Fatalf("Close %d: %v", i+1, err)
+		}
+	}
+	var users int64
+	if err := ur.db.Model(&User{}).Count(&users).Error; err == nil {
+		t.Fatal("a query succeeded after Close")
+	}
+}
+
+// goroutineDump is the stack of every goroutine.
+func goroutineDump() string {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// runningWorkers counts the goroutines started by goWorker that are running.
+func runningWorkers() int {
+	return strings.Count(goroutineDump(), ".(*UnRustleLogs).goWorker.func1(")
+}
+
+func TestStopEndsEveryWorker(t *testing.T) {
+	tests := []struct {
+		name string
+		// stop ends the workers of ur started with the context cancel ends
+		stop func(t *testing.T, ur *UnRustleLogs, cancel context.CancelFunc)
+	}{
+		{name: "Stop", stop: func(t *testing.T, ur *UnRustleLogs, _ context.CancelFunc) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := ur.Stop(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "shutdown signal", stop: func(t *testing.T, ur *UnRustleLogs, cancel context.CancelFunc) {
+			cancel()
+			ur.workers.Wait()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if n := runningWorkers(); n != 0 {
+				t.Fatalf("%d workers of other tests are running", n)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ur := newTestRustle(t)
+			// as NewUnRustleLogs(ctx) would
+			ur.workerCtx, ur.stopWorkers = context.WithCancel(ctx)
+			ur.config.Maintenance.Interval.Duration = time.Hour
+			ur.setupRateLimits()
+			ur.Start()
+			if n := runningWorkers(); n != 7 {
+				t.Fatalf("%d workers are running after Start, want every one of them", n)
+			}
+			tt.stop(t, ur, cancel)
+			if n := runningWorkers(); n != 0 {
+				t.Fatalf("%d workers outlived stopping", n)
+			}
+		})
+	}
+}
+
+// TestShutdownEndsEveryGoroutine shuts down as main does, the servers and the
+// webhook worker don't run through goWorker.
+func TestShutdownEndsEveryGoroutine(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ur := newTestRustle(t)
+	ur.workerCtx, ur.stopWorkers = context.WithCancel(context.Background())
+	ur.config.Maintenance.Interval.Duration = time.Hour
+	ur.config.Webhooks = []WebhookConfig{{URL: "http://127.0.0.1:1/hook"}}
+	ur.config.Server.GRPCAddress = "127.0.0.1:0"
+	ur.config.Server.TLS.HTTPAddress = "127.0.0.1:0"
+	ur.acme = &autocert.Manager{}
+	ur.setupRateLimits()
+	if err := ur.setupWebhooks(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ur.setupGRPC(); err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Addr: "127.0.0.1:0", Handler: http.NotFoundHandler()}
+	if err := ur.serve(srv); err != nil {
+		t.Fatal(err)
+	}
+	ur.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ur.shutdown(ctx, srv)
+	ur.stopGRPC(ctx)
+	if err := ur.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the servers return from Serve after Shutdown does
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines before, %d after shutting down:\n%s", before, runtime.NumGoroutine(), goroutineDump())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCloseWithoutDatabase(t *testing.T) {
+	ur := NewUnRustleLogs(context.Background())
+	ur.config = &Config{}
+	for i := 0; i < 2; i++ {
+		if err := ur.Close(context.Background()); err != nil {
+			t.Fatalf("Close %d: %v", i+1, err)
+		}
+	}
+}
+
+func TestCloseWaitsForWorkers(t *testing.T) {
+	ur := NewUnRustleLogs(context.Background())
+	ur.config = &Config{}
+	release := make(chan struct{})
+	t.Cleanup(func() {
+		close(release)
+		ur.workers.Wait()
+	})
+	ur.goWorker(func(ctx context.Context) {
+		<-ctx.Done()
+		// cleaning up takes longer than Close allows
+		<-release
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := ur.Close(ctx); err == nil {
+		t.Fatal("Close didn't report the worker that is still running")
+	}
+}
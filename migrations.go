@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// migration is a schema change, migrations are applied once in version order
+// and never edited after being released.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *gorm.DB) error
+}
+
+// migrations has to stay sorted by version.
+var migrations = []migration{
+	// the schema AutoMigrate used to keep up to date, the statements don't
+	// fail on databases created by it
+	{1, "initial schema", execMigration(map[string][]string{
+		"sqlite": {
+			`CREATE TABLE IF NOT EXISTS "users" ("id" varchar(255),"created_at" datetime,"updated_at" datetime,"service" varchar(255),"name" varchar(255),"display_name" varchar(255),"nick" varchar(255),"user_id" varchar(255),"email" varchar(255) , PRIMARY KEY ("id"))`,
+			`CREATE TABLE IF NOT EXISTS "tokens" ("id" integer primary key autoincrement,"created_at" datetime,"updated_at" datetime,"service" varchar(255),"user_id" varchar(255),"access_token" varchar(255),"refresh_token" varchar(255),"expiry" datetime )`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_token_service_user ON "tokens"("service", user_id)`,
+			`CREATE TABLE IF NOT EXISTS "account_links" ("id" integer primary key autoincrement,"created_at" datetime,"twitch_user_id" varchar(255),"destinygg_user_id" varchar(255) )`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS uix_account_links_twitch_user_id ON "account_links"(twitch_user_id)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS uix_account_links_destinygg_user_id ON "account_links"(destinygg_user_id)`,
+			`CREATE TABLE IF NOT EXISTS "oauth_states" ("state" varchar(255),"verifier" varchar(255),"service" varchar(255),"client_ip" varchar(255),"redirect" varchar(255),"remember" bool,"created_at" datetime , PRIMARY KEY ("state"))`,
+			`CREATE INDEX IF NOT EXISTS idx_oauth_states_client_ip ON "oauth_states"(client_ip)`,
+			`CREATE TABLE IF NOT EXISTS "revoked_tokens" ("jti" varchar(255),"expires_at" datetime , PRIMARY KEY ("jti"))`,
+			`CREATE TABLE IF NOT EXISTS "sessions" ("id" varchar(255),"user_id" varchar(255),"audience" varchar(255),"email_verified" bool,"remember" bool,"auth_time" datetime,"created_at" datetime,"last_seen" datetime,"expires_at" datetime , PRIMARY KEY ("id"))`,
+			`CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON "sessions"(user_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON "sessions"(expires_at)`,
+		},
+		"postgres": {
+			`CREATE TABLE IF NOT EXISTS "users" ("id" text,"created_at" timestamp with time zone,"updated_at" timestamp with time zone,"service" text,"name" text,"display_name" text,"nick" text,"user_id" text,"email" text, PRIMARY KEY ("id"))`,
+			`CREATE TABLE IF NOT EXISTS "tokens" ("id" serial,"created_at" timestamp with time zone,"updated_at" timestamp with time zone,"service" text,"user_id" text,"access_token" text,"refresh_token" text,"expiry" timestamp with time zone, PRIMARY KEY ("id"))`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_token_service_user ON "tokens"("service", user_id)`,
+			`CREATE TABLE IF NOT EXISTS "account_links" ("id" serial,"created_at" timestamp with time zone,"twitch_user_id" text,"destinygg_user_id" text, PRIMARY KEY ("id"))`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS uix_account_links_twitch_user_id ON "account_links"(twitch_user_id)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS uix_account_links_destinygg_user_id ON "account_links"(destinygg_user_id)`,
+			`CREATE TABLE IF NOT EXISTS "oauth_states" ("state" text,"verifier" text,"service" text,"client_ip" text,"redirect" text,"remember" boolean,"created_at" timestamp with time zone, PRIMARY KEY ("state"))`,
+			`CREATE INDEX IF NOT EXISTS idx_oauth_states_client_ip ON "oauth_states"(client_ip)`,
+			`CREATE TABLE IF NOT EXISTS "revoked_tokens" ("jti" text,"expires_at" timestamp with time zone, PRIMARY KEY ("jti"))`,
+			`CREATE TABLE IF NOT EXISTS "sessions" ("id" text,"user_id" text,"audience" text,"email_verified" boolean,"remember" boolean,"auth_time" timestamp with time zone,"created_at" timestamp with time zone,"last_seen" timestamp with time zone,"expires_at" timestamp with time zone, PRIMARY KEY ("id"))`,
+			`CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON "sessions"(user_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON "sessions"(expires_at)`,
+		},
+		// InnoDB only indexes varchar(255) in utf8mb4 with the dynamic row
+		// format, the default since MySQL 5.7 and MariaDB 10.2
+		"mysql": {
+			"CREATE TABLE IF NOT EXISTS `users` (`id` varchar(255),`created_at` DATETIME NULL,`updated_at` DATETIME NULL,`service` varchar(255),`name` varchar(255),`display_name` varchar(255),`nick` varchar(255),`user_id` varchar(255),`email` varchar(255), PRIMARY KEY (`id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci",
+			"CREATE TABLE IF NOT EXISTS `tokens` (`id` int unsigned AUTO_INCREMENT,`created_at` DATETIME NULL,`updated_at` DATETIME NULL,`service` varchar(255),`user_id` varchar(255),`access_token` varchar(255),`refresh_token` varchar(255),`expiry` DATETIME NULL, PRIMARY KEY (`id`), UNIQUE INDEX `idx_token_service_user` (`service`,`user_id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci",
+			"CREATE TABLE IF NOT EXISTS `account_links` (`id` int unsigned AUTO_INCREMENT,`created_at` DATETIME NULL,`twitch_user_id` varchar(255),`destinygg_user_id` varchar(255), PRIMARY KEY (`id`), UNIQUE INDEX `uix_account_links_twitch_user_id` (`twitch_user_id`), UNIQUE INDEX `uix_account_links_destinygg_user_id` (`destinygg_user_id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci",
+			"CREATE TABLE IF NOT EXISTS `oauth_states` (`state` varchar(255),`verifier` varchar(255),`service` varchar(255),`client_ip` varchar(255),`redirect` varchar(255),`remember` boolean,`created_at` DATETIME NULL, PRIMARY KEY (`state`), INDEX `idx_oauth_states_client_ip` (`client_ip`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci",
+			"CREATE TABLE IF NOT EXISTS `revoked_tokens` (`jti` varchar(255),`expires_at` DATETIME NULL, PRIMARY KEY (`jti`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci",
+			"CREATE TABLE IF NOT EXISTS `sessions` (`id` varchar(255),`user_id` varchar(255),`audience` varchar(255),`email_verified` boolean,`remember` boolean,`auth_time` DATETIME NULL,`created_at` DATETIME NULL,`last_seen` DATETIME NULL,`expires_at` DATETIME NULL, PRIMARY KEY (`id`), INDEX `idx_sessions_user_id` (`user_id`), INDEX `idx_sessions_expires_at` (`expires_at`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci",
+		},
+	})},
+	// AddUser could race and store a user twice, only the oldest row of a
+	// name and service is kept
+	{2, "unique users name and service", dedupeUsers},
+	// names are stored lowercased since AddUser normalizes them, in Go
+	// because the lower() of sqlite only knows ASCII
+	{3, "lowercase user names", lowercaseUserNames},
+	// undeleting keeps the row, existing users are all still opted out
+	{4, "soft delete users", execMigration(map[string][]string{
+		"sqlite": {
+			`ALTER TABLE users ADD COLUMN active bool NOT NULL DEFAULT 1`,
+			`ALTER TABLE users ADD COLUMN requested_at datetime`,
+			`ALTER TABLE users ADD COLUMN deactivated_at datetime`,
+			`UPDATE users SET requested_at = created_at`,
+		},
+		"postgres": {
+			`ALTER TABLE users ADD COLUMN active boolean NOT NULL DEFAULT true`,
+			`ALTER TABLE users ADD COLUMN requested_at timestamp with time zone`,
+			`ALTER TABLE users ADD COLUMN deactivated_at timestamp with time zone`,
+			`UPDATE users SET requested_at = created_at`,
+		},
+		"mysql": {
+			"ALTER TABLE `users` ADD COLUMN `active` boolean NOT NULL DEFAULT 1, ADD COLUMN `requested_at` DATETIME NULL, ADD COLUMN `deactivated_at` DATETIME NULL",
+			"UPDATE `users` SET `requested_at` = `created_at`",
+		},
+	})},
+	// users are looked up by the provider's id first, renames keep it
+	{5, "index users by provider user id", execMigration(map[string][]string{
+		"sqlite":   {`CREATE INDEX idx_users_service_user_id ON users(service, user_id)`},
+		"postgres": {`CREATE INDEX idx_users_service_user_id ON users(service, user_id)`},
+		"mysql":    {"CREATE INDEX `idx_users_service_user_id` ON `users`(`service`, `user_id`)"},
+	})},
+	{6, "audit log", execMigration(map[string][]string{
+		"sqlite": {
+			`CREATE TABLE "audit_log" ("id" integer primary key autoincrement,"created_at" datetime,"user_row_id" varchar(255),"service" varchar(255),"action" varchar(255),"detail" varchar(255))`,
+			`CREATE INDEX idx_audit_log_user_row_id ON "audit_log"(user_row_id)`,
+		},
+		"postgres": {
+			`CREATE TABLE "audit_log" ("id" serial,"created_at" timestamp with time zone,"user_row_id" text,"service" text,"action" text,"detail" text, PRIMARY KEY ("id"))`,
+			`CREATE INDEX idx_audit_log_user_row_id ON "audit_log"(user_row_id)`,
+		},
+		"mysql": {
+			"CREATE TABLE `audit_log` (`id` int unsigned AUTO_INCREMENT,`created_at` DATETIME NULL,`user_row_id` varchar(255),`service` varchar(255),`action` varchar(255),`detail` varchar(255), PRIMARY KEY (`id`), INDEX `idx_audit_log_user_row_id` (`user_row_id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci",
+		},
+	})},
+	// existing opt-outs keep covering all channels
+	{7, "per channel opt-outs", execMigration(map[string][]string{
+		"sqlite": {
+			`ALTER TABLE users ADD COLUMN all_channels bool NOT NULL DEFAULT 1`,
+			`CREATE TABLE "opt_out_channels" ("id" integer primary key autoincrement,"user_row_id" varchar(255),"channel" varchar(255),"created_at" datetime)`,
+			`CREATE UNIQUE INDEX uix_opt_out_channels_user_channel ON "opt_out_channels"(user_row_id, channel)`,
+			`CREATE INDEX idx_opt_out_channels_channel ON "opt_out_channels"(channel)`,
+		},
+		"postgres": {
+			`ALTER TABLE users ADD COLUMN all_channels boolean NOT NULL DEFAULT true`,
+			`CREATE TABLE "opt_out_channels" ("id" serial,"user_row_id" text,"channel" text,"created_at" timestamp with time zone, PRIMARY KEY ("id"))`,
+			`CREATE UNIQUE INDEX uix_opt_out_channels_user_channel ON "opt_out_channels"(user_row_id, channel)`,
+			`CREATE INDEX idx_opt_out_channels_channel ON "opt_out_channels"(channel)`,
+		},
+		"mysql": {
+			"ALTER TABLE `users` ADD COLUMN `all_channels` boolean NOT NULL DEFAULT 1",
+			"CREATE TABLE `opt_out_channels` (`id` int unsigned AUTO_INCREMENT,`user_row_id` varchar(255),`channel` varchar(255),`created_at` DATETIME NULL, PRIMARY KEY (`id`), UNIQUE INDEX `uix_opt_out_channels_user_channel` (`user_row_id`, `channel`), INDEX `idx_opt_out_channels_channel` (`channel`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci",
+		},
+	})},
+	{8, "expiring opt-outs", execMigration(map[string][]string{
+		"sqlite": {
+			`ALTER TABLE users ADD COLUMN expires_at datetime`,
+			`CREATE INDEX idx_users_expires_at ON users(expires_at)`,
+			`ALTER TABLE oauth_states ADD COLUMN duration varchar(255)`,
+		},
+		"postgres": {
+			`ALTER TABLE users ADD COLUMN expires_at timestamp with time zone`,
+			`CREATE INDEX idx_users_expires_at ON users(expires_at)`,
+			`ALTER TABLE oauth_states ADD COLUMN duration text`,
+		},
+		"mysql": {
+			"ALTER TABLE `users` ADD COLUMN `expires_at` DATETIME NULL, ADD INDEX `idx_users_expires_at` (`expires_at`)",
+			"ALTER TABLE `oauth_states` ADD COLUMN `duration` varchar(255)",
+		},
+	})},
+	// encrypted emails are longer than the 254 characters an email can have
+	{9, "room for encrypted emails", execMigration(map[string][]string{
+		"sqlite":   {},
+		"postgres": {},
+		"mysql":    {"ALTER TABLE `users` MODIFY `email` varchar(512)"},
+	})},
+	{10, "api keys", execMigration(map[string][]string{
+		"sqlite": {
+			`CREATE TABLE "api_keys" ("id" integer primary key autoincrement,"created_at" datetime,"label" varchar(255),"key_hash" varchar(64),"scopes" varchar(255),"source" varchar(255))`,
+			`CREATE UNIQUE INDEX uix_api_keys_label ON "api_keys"(label)`,
+			`CREATE UNIQUE INDEX uix_api_keys_key_hash ON "api_keys"(key_hash)`,
+		},
+		"postgres": {
+			`CREATE TABLE "api_keys" ("id" serial,"created_at" timestamp with time zone,"label" text,"key_hash" varchar(64),"scopes" text,"source" text, PRIMARY KEY ("id"))`,
+			`CREATE UNIQUE INDEX uix_api_keys_label ON "api_keys"(label)`,
+			`CREATE UNIQUE INDEX uix_api_keys_key_hash ON "api_keys"(key_hash)`,
+		},
+		"mysql": {
+			"CREATE TABLE `api_keys` (`id` int unsigned AUTO_INCREMENT,`created_at` DATETIME NULL,`label` varchar(255),`key_hash` varchar(64),`scopes` varchar(255),`source` varchar(255), PRIMARY KEY (`id`), UNIQUE INDEX `uix_api_keys_label` (`label`), UNIQUE INDEX `uix_api_keys_key_hash` (`key_hash`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci",
+		},
+	})},
+	// the history starts with every current opt-out
+	{11, "opt-out changes", func(tx *gorm.DB) error {
+		err := execMigration(map[string][]string{
+			"sqlite": {
+				`CREATE TABLE "opt_out_changes" ("id" integer primary key autoincrement,"created_at" datetime,"service" varchar(255),"name" varchar(255),"action" varchar(255))`,
+				`CREATE INDEX idx_opt_out_changes_service_id ON "opt_out_changes"(service, id)`,
+			},
+			"postgres": {
+				`CREATE TABLE "opt_out_changes" ("id" serial,"created_at" timestamp with time zone,"service" text,"name" text,"action" text, PRIMARY KEY ("id"))`,
+				`CREATE INDEX idx_opt_out_changes_service_id ON "opt_out_changes"(service, id)`,
+			},
+			"mysql": {
+				"CREATE TABLE `opt_out_changes` (`id` int unsigned AUTO_INCREMENT,`created_at` DATETIME NULL,`service` varchar(255),`name` varchar(255),`action` varchar(255), PRIMARY KEY (`id`), INDEX `idx_opt_out_changes_service_id` (`service`, `id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci",
+			},
+		})(tx)
+		if err != nil {
+			return err
+		}
+		return seedOptOutChanges(tx)
+	}},
+	// the grace of server.jwt_legacy_until starts with this migration
+	{12, "settings", func(tx *gorm.DB) error {
+		err := execMigration(map[string][]string{
+			"sqlite":   {`CREATE TABLE "settings" ("name" varchar(255),"value" varchar(255), PRIMARY KEY ("name"))`},
+			"postgres": {`CREATE TABLE "settings" ("name" text,"value" text, PRIMARY KEY ("name"))`},
+			"mysql":    {"CREATE TABLE `settings` (`name` varchar(255),`value` varchar(255), PRIMARY KEY (`name`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci"},
+		})(tx)
+		if err != nil {
+			return err
+		}
+		return markLegacySessions(tx)
+	}},
+}
+
+// dedupeUsers removes the duplicates of a name and service before they get
+// a unique index. The ids are random, so the oldest row is kept by
+// created_at, see removeDuplicateUsers.
+func dedupeUsers(tx *gorm.DB) error {
+	_, err := removeDuplicateUsers(tx, func(u User) string {
+		return u.Service + "\x00" + u.Name
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Exec(`CREATE UNIQUE INDEX uix_users_name_service ON users(name, service)`).Error
+}
+
+// removeDuplicateUsers keeps the oldest user of each key, ties broken by id,
+// and removes the others with their links. It returns the kept users.
+func removeDuplicateUsers(tx *gorm.DB, key func(User) string) ([]User, error) {
+	var users []User
+	if err := tx.Order("created_at, id").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(users))
+	var kept []User
+	for _, u := range users {
+		k := key(u)
+		if !seen[k] {
+			seen[k] = true
+			kept = append(kept, u)
+			continue
+		}
+		err := tx.Where("twitch_user_id = ? or destinygg_user_id = ?", u.ID, u.ID).Delete(&AccountLink{}).Error
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Where("id = ?", u.ID).Delete(&User{}).Error; err != nil {
+			return nil, err
+		}
+	}
+	return kept, nil
+}
+
+// SchemaMigration records an applied migration
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// TableName ...
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// schemaMigrationsTable is the table gorm v1's AutoMigrate created, spelled
+// out so AutoMigrate of gorm v2 never alters it.
+var schemaMigrationsTable = map[string][]string{
+	"sqlite":   {`CREATE TABLE IF NOT EXISTS "schema_migrations" ("version" integer,"name" varchar(255),"applied_at" datetime , PRIMARY KEY ("version"))`},
+	"postgres": {`CREATE TABLE IF NOT EXISTS "schema_migrations" ("version" integer,"name" text,"applied_at" timestamp with time zone, PRIMARY KEY ("version"))`},
+	"mysql":    {"CREATE TABLE IF NOT EXISTS `schema_migrations` (`version` int,`name` varchar(255),`applied_at` DATETIME NULL, PRIMARY KEY (`version`))"},
+}
+
+// execMigration returns a migration running the statements for the dialect
+// of the database in order.
+func execMigration(statements map[string][]string) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		dialect := tx.Dialector.Name()
+		if _, ok := statements[dialect]; !ok {
+			return fmt.Errorf("no statements for %s", dialect)
+		}
+		for _, s := range statements[dialect] {
+			if err := tx.Exec(s).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// schemaVersion is the version of the last applied migration, 0 for a new
+// database.
+func (ur *UnRustleLogs) schemaVersion() (int, error) {
+	var last SchemaMigration
+	err := ur.db.Order("version desc").First(&last).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	return last.Version, err
+}
+
+// migrate applies the pending migrations, each in its own transaction. It
+// refuses to touch a database from a newer binary.
+func (ur *UnRustleLogs) migrate() error {
+	if err := execMigration(schemaMigrationsTable)(ur.db); err != nil {
+		return fmt.Errorf("failed creating schema_migrations: %v", err)
+	}
+	current, err := ur.schemaVersion()
+	if err != nil {
+		return fmt.Errorf("failed reading schema version: %v", err)
+	}
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than version %d this binary knows, refusing to start", current, latest)
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		tx := ur.db.Begin()
+		if err := m.up(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s) failed: %v", m.version, m.name, err)
+		}
+		err := tx.Create(&SchemaMigration{Version: m.version, Name: m.name, AppliedAt: time.Now().UTC()}).Error
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed recording migration %d: %v", m.version, err)
+		}
+		if err := tx.Commit().Error; err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.version, m.name, err)
+		}
+		logrus.Infof("applied migration %d: %s", m.version, m.name)
+	}
+	return nil
+}
+
+// lowercaseUserNames lowercases the names of existing users. When that makes
+// two rows collide the oldest is kept and the others removed with their
+// links, before renaming so the unique index never sees a duplicate.
+func lowercaseUserNames(tx *gorm.DB) error {
+	rename, err := removeDuplicateUsers(tx, func(u User) string {
+		return u.Service + "\x00" + normalizeName(u.Name)
+	})
+	if err != nil {
+		return err
+	}
+	for _, u := range rename {
+		if name := normalizeName(u.Name); name != u.Name {
+			if err := tx.Model(&User{}).Where("id = ?", u.ID).Update("name", name).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
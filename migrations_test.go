@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newVersion1Rustle returns an UnRustleLogs whose database only has the
+// initial schema, to insert rows the later migrations have to handle.
+func newVersion1Rustle(t *testing.T) *UnRustleLogs {
+	t.Helper()
+	ur := NewUnRustleLogs(context.Background())
+	ur.config = &Config{}
+	db, err := ur.openDatabase("sqlite3", testDSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ur.db = db
+	t.Cleanup(func() {
+		ur.Close(context.Background())
+	})
+	if err := execMigration(schemaMigrationsTable)(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrations[0].up(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&SchemaMigration{Version: 1, Name: migrations[0].name, AppliedAt: time.Now()}).Error; err != nil {
+		t.Fatal(err)
+	}
+	return ur
+}
+
+func TestMigrationsKeepOldestUser(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	type row struct {
+		id      string
+		service string
+		name    string
+		created time.Time
+	}
+	tests := []struct {
+		name string
+		rows []row
+		// kept are the ids left afterwards
+		kept []string
+	}{
+		{
+			name: "earliest created_at wins over the smaller id",
+			rows: []row{
+				{"b", TWITCHSERVICE, "foo", base},
+				{"a", TWITCHSERVICE, "foo", base.Add(time.Hour)},
+			},
+			kept: []string{"b"},
+		},
+		{
+			name: "same created_at keeps the smaller id",
+			rows: []row{
+				{"b", TWITCHSERVICE, "foo", base},
+				{"a", TWITCHSERVICE, "foo", base},
+			},
+			kept: []string{"a"},
+		},
+		{
+			name: "services are deduplicated separately",
+			rows: []row{
+				{"a", TWITCHSERVICE, "foo", base},
+				{"b", DESTINYGGSERVICE, "foo", base.Add(time.Hour)},
+			},
+			kept: []string{"a", "b"},
+		},
+		{
+			name: "names differing in case collapse to the oldest",
+			rows: []row{
+				{"a", TWITCHSERVICE, "Foo", base.Add(time.Hour)},
+				{"b", TWITCHSERVICE, "foo", base.Add(2 * time.Hour)},
+				{"c", TWITCHSERVICE, "FOO", base},
+			},
+			kept: []string{"c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := newVersion1Rustle(t)
+			for _, r := range tt.rows {
+				err := ur.db.Exec(`INSERT INTO users (id, created_at, updated_at, service, name) VALUES (?, ?, ?, ?, ?)`,
+					r.id, r.created, r.created, r.service, r.name).Error
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ur.migrate(); err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			if err := ur.db.Model(&User{}).Order("id").Pluck("id", &ids).Error; err != nil {
+				t.Fatal(err)
+			}
+			if len(ids) != len(tt.kept) {
+				t.Fatalf("kept %v, want %v", ids, tt.kept)
+			}
+			for i := range ids {
+				if ids[i] != tt.kept[i] {
+					t.Fatalf("kept %v, want %v", ids, tt.kept)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateTwiceIsNoop(t *testing.T) {
+	ur := newTestRustle(t)
+	if err := ur.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	version, err := ur.schemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := migrations[len(migrations)-1].version; version != want {
+		t.Fatalf("schema version %d, want %d", version, want)
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	ur := newTestRustle(t)
+	newer := migrations[len(migrations)-1].version + 1
+	if err := ur.db.Create(&SchemaMigration{Version: newer, Name: "from the future", AppliedAt: time.Now()}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := ur.migrate(); err == nil {
+		t.Fatal("migrate accepted a newer schema")
+	}
+}
+
+func TestMigrationsAreSorted(t *testing.T) {
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version <= migrations[i-1].version {
+			t.Fatalf("migration %d comes after %d", migrations[i].version, migrations[i-1].version)
+		}
+	}
+}
+
+func TestLegacySessionGrace(t *testing.T) {
+	tests := []struct {
+		name string
+		// users is whether the database had users before the upgrade
+		users      bool
+		configured time.Time
+		want       bool
+	}{
+		{name: "new database"},
+		{name: "upgraded database", users: true, want: true},
+		{name: "configured end", users: true, configured: time.Now().Add(-time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := newVersion1Rustle(t)
+			if tt.users {
+				err := ur.db.Exec(`INSERT INTO users (id, created_at, updated_at, service, name) VALUES (?, ?, ?, ?, ?)`,
+					"a", time.Now(), time.Now(), TWITCHSERVICE, "foo").Error
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ur.migrate(); err != nil {
+				t.Fatal(err)
+			}
+			ur.config.Server.JWTTTL.Duration = defaultJWTTTL
+			ur.config.Server.JWTLegacyUntil = tt.configured
+			if err := ur.setupJWTLegacyUntil(); err != nil {
+				t.Fatal(err)
+			}
+			if got := ur.legacyTokensAllowed(); got != tt.want {
+				t.Fatalf("legacy tokens allowed %v until %s, want %v", got, ur.config.Server.JWTLegacyUntil, tt.want)
+			}
+			if tt.want && ur.config.Server.JWTLegacyUntil.After(time.Now().Add(defaultJWTTTL)) {
+				t.Fatalf("grace until %s, longer than jwt_ttl", ur.config.Server.JWTLegacyUntil)
+			}
+		})
+	}
+}
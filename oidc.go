@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// oidcDiscovery is the subset of .well-known/openid-configuration we need.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+type oidcTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// OIDCUser ...
+type OIDCUser struct {
+	Subject     string
+	Username    string
+	DisplayName string
+	Email       string
+}
+
+type oidcProvider struct {
+	config    OIDCProviderConfig
+	discovery oidcDiscovery
+	client    *http.Client
+}
+
+func (ur *UnRustleLogs) setupOIDCProviders() error {
+	for _, pc := range ur.config.OIDCProviders {
+		if pc.Slug == "" {
+			return errors.New("oidc provider is missing a slug")
+		}
+		if _, ok := ur.provider(pc.Slug); ok {
+			return fmt.Errorf("duplicate oidc provider slug %q", pc.Slug)
+		}
+		switch pc.Slug {
+		case TWITCHSERVICE, DESTINYGGSERVICE, DISCORDSERVICE, YOUTUBESERVICE, KICKSERVICE, ADMINSERVICE:
+			return fmt.Errorf("oidc provider slug %q is reserved", pc.Slug)
+		}
+		if pc.UsernameClaim == "" {
+			pc.UsernameClaim = "preferred_username"
+		}
+		if pc.DisplayNameClaim == "" {
+			pc.DisplayNameClaim = "name"
+		}
+		if pc.EmailClaim == "" {
+			pc.EmailClaim = "email"
+		}
+		if len(pc.Scopes) == 0 {
+			pc.Scopes = []string{"openid", "profile", "email"}
+		}
+		if pc.Cookie == "" {
+			pc.Cookie = pc.Slug
+		}
+		d, err := discoverOIDC(ur.httpClient, pc.Issuer)
+		if err != nil {
+			return fmt.Errorf("oidc provider %q: %v", pc.Slug, err)
+		}
+		ur.providers = append(ur.providers, &oidcProvider{
+			config:    pc,
+			discovery: *d,
+			client:    ur.httpClient,
+		})
+		logrus.Infof("registered oidc provider %q (%s)", pc.Slug, d.Issuer)
+	}
+	return nil
+}
+
+func discoverOIDC(client *http.Client, issuer string) (*oidcDiscovery, error) {
+	wellKnown := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	response, err := client.Get(wellKnown)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching %s, status: %d", wellKnown, response.StatusCode)
+	}
+	var d oidcDiscovery
+	err = json.NewDecoder(response.Body).Decode(&d)
+	if err != nil {
+		return nil, err
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("incomplete discovery document at %s", wellKnown)
+	}
+	return &d, nil
+}
+
+// Service ...
+func (p *oidcProvider) Service() string {
+	return p.config.Slug
+}
+
+// Name ...
+func (p *oidcProvider) Name() string {
+	if p.config.Name == "" {
+		return p.config.Slug
+	}
+	return p.config.Name
+}
+
+// Path ...
+func (p *oidcProvider) Path() string {
+	return "/auth/" + p.config.Slug
+}
+
+// CookieName ...
+func (p *oidcProvider) CookieName() string {
+	return p.config.Cookie
+}
+
+// RedirectURL ...
+func (p *oidcProvider) RedirectURL() string {
+	return p.config.RedirectURL
+}
+
+// AuthURL ...
+func (p *oidcProvider) AuthURL(req authRequest) string {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.config.ClientID)
+	v.Set("redirect_uri", req.RedirectURI)
+	v.Set("scope", strings.Join(p.config.Scopes, " "))
+	v.Set("state", req.State)
+	v.Set("code_challenge", codeChallengeS256(req.Verifier))
+	v.Set("code_challenge_method", "S256")
+	return fmt.Sprintf("%s?%s", p.discovery.AuthorizationEndpoint, v.Encode())
+}
+
+// Exchange ...
+func (p *oidcProvider) Exchange(ctx context.Context, redirectURI, code, verifier string) (*Identity, error) {
+	access, err := p.accessToken(ctx, code, verifier, redirectURI)
+	if err != nil {
+		return nil, err
+	}
+	user, err := p.userinfo(ctx, access.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		UserID:       user.Subject,
+		Name:         user.Username,
+		DisplayName:  user.DisplayName,
+		Email:        user.Email,
+		AccessToken:  access.AccessToken,
+		RefreshToken: access.RefreshToken,
+		ExpiresIn:    access.ExpiresIn,
+	}, nil
+}
+
+func (p *oidcProvider) accessToken(ctx context.Context, code, verifier, redirectURI string) (*oidcTokenResponse, error) {
+	v := url.Values{}
+	v.Set("client_id", p.config.ClientID)
+	v.Set("client_secret", p.config.ClientSecret)
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", redirectURI)
+	v.Set("code_verifier", verifier)
+
+	response, err := postForm(ctx, p.client, p.discovery.TokenEndpoint, v)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting %s access_token, status: %d, body: %s", p.config.Slug, response.StatusCode, body)
+	}
+	var token oidcTokenResponse
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (p *oidcProvider) userinfo(ctx context.Context, accessToken string) (*OIDCUser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.discovery.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+
+	response, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting %s userinfo, status: %d, body: %s", p.config.Slug, response.StatusCode, body)
+	}
+	var claims map[string]interface{}
+	err = json.Unmarshal(body, &claims)
+	if err != nil {
+		return nil, err
+	}
+	user := &OIDCUser{
+		Subject:     claimString(claims, "sub"),
+		Username:    claimString(claims, p.config.UsernameClaim),
+		DisplayName: claimString(claims, p.config.DisplayNameClaim),
+		Email:       claimString(claims, p.config.EmailClaim),
+	}
+	if user.Username == "" {
+		return nil, fmt.Errorf("%s userinfo is missing the %q claim", p.config.Slug, p.config.UsernameClaim)
+	}
+	if user.DisplayName == "" {
+		user.DisplayName = user.Username
+	}
+	return user, nil
+}
+
+func claimString(claims map[string]interface{}, name string) string {
+	switch v := claims[name].(type) {
+	case string:
+		return v
+	case float64:
+		return fmt.Sprintf("%.0f", v)
+	}
+	return ""
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// The auth of an apiOperation, none if it's empty
+const (
+	// authKey is an api key unless api.require_keys is false
+	authKey = "key"
+	// authStats is an api key if api.stats_require_key is set
+	authStats = "stats"
+	// authSession is the session cookie of the service
+	authSession = "session"
+)
+
+// apiOperation documents a route in /api/openapi.json, the paths and
+// methods come from the router.
+type apiOperation struct {
+	Summary     string
+	Description string
+	Auth        string
+	Query       []apiParam
+	// Body is the schema of the JSON request body, if there is one
+	Body      string
+	Responses []apiResponse
+}
+
+type apiParam struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+type apiResponse struct {
+	Status      string
+	Description string
+	// Schema is the JSON response body, Binary an octet stream
+	Schema string
+	Binary bool
+}
+
+var channelParam = apiParam{"channel", "string", "only count opt-outs covering the channel"}
+
+// apiDocs are keyed by the method and gin path of the route
+var apiDocs = map[string]apiOperation{
+	"GET /api/me": {
+		Summary:     "The logged in user of every provider",
+		Description: "null for providers the visitor isn't logged in with.",
+		Query:       []apiParam{{"include_email", "string", "1 to include the email"}},
+		Responses:   []apiResponse{{"200", "the user per service", "MeUsers", false}},
+	},
+	"GET /api/v1/me/:service": {
+		Summary:   "The opt-out of the logged in user",
+		Auth:      authSession,
+		Responses: []apiResponse{{"200", "the user", "MeUser", false}},
+	},
+	"POST /api/v1/me/:service/optout": {
+		Summary:     "Opt the logged in user out",
+		Description: "Changes how long the opt-out lasts if the user opted out already.",
+		Auth:        authSession,
+		Body:        "OptOutRequest",
+		Responses:   []apiResponse{{"200", "the user after opting out", "MeUser", false}},
+	},
+	"DELETE /api/v1/me/:service/optout": {
+		Summary:     "Opt the logged in user back in",
+		Description: "The linked account is opted back in too.",
+		Auth:        authSession,
+		Responses:   []apiResponse{{"200", "the user after opting back in", "MeUser", false}},
+	},
+	"POST /api/v1/check": {
+		Summary:     "Check which of up to server.check_batch_limit names opted out",
+		Description: "Needs the check scope.",
+		Auth:        authKey,
+		Body:        "CheckRequest",
+		Responses:   []apiResponse{{"200", "whether each lowercased name opted out", "CheckResponse", false}},
+	},
+	"GET /api/v1/deleted/:service": {
+		Summary: "List the active opt-outs of a service",
+		Description: "Ordered by name, the cursor of the next page is in X-Next-Cursor and a Link header. " +
+			"With since only the changes after it are returned as a ChangesPage. Needs the list scope.",
+		Auth: authKey,
+		Query: []apiParam{
+			{"limit", "integer", "page size, 1000 by default and at most 10000"},
+			{"cursor", "string", "X-Next-Cursor of the previous page"},
+			channelParam,
+			{"since", "string", "a change id from X-Change-Cursor or an RFC 3339 time"},
+		},
+		Responses: []apiResponse{
+			{"200", "a page of opt-outs, or the changes with since", "OptOuts", false},
+			{"304", "the ETag in If-None-Match is still current", "", false},
+		},
+	},
+	"GET /api/v1/deleted/:service/:name": {
+		Summary: "Check whether a single name opted out",
+		Description: "Needs the check scope. The name bloom instead returns the opt-outs as a Bloom filter, " +
+			"see client/bloom.go, with the list scope and an fpr parameter.",
+		Auth:  authKey,
+		Query: []apiParam{channelParam, {"fpr", "number", "false positive rate of the bloom filter, 0.001 by default"}},
+		Responses: []apiResponse{
+			{"200", "the Bloom filter, for the name bloom", "", true},
+			{"204", "the name opted out", "", false},
+			{"404", "the name didn't opt out, or the service is unknown", "", false},
+		},
+	},
+	"HEAD /api/v1/deleted/:service/:name": {
+		Summary: "Check whether a single name opted out",
+		Auth:    authKey,
+		Query:   []apiParam{channelParam},
+		Responses: []apiResponse{
+			{"204", "the name opted out", "", false},
+			{"404", "the name didn't opt out", "", false},
+		},
+	},
+	"GET /api/v1/bloom/:service": {
+		Summary: "The active opt-outs of a service as a Bloom filter",
+		Description: "The filter of GET /api/v1/deleted/:service/bloom. See client/bloom.go for the format, the names " +
+			"it reports may not have opted out at the false positive rate fpr. Needs the list scope.",
+		Auth:  authKey,
+		Query: []apiParam{{"fpr", "number", "false positive rate of the bloom filter, 0.001 by default"}},
+		Responses: []apiResponse{
+			{"200", "the Bloom filter", "", true},
+			{"304", "the ETag in If-None-Match is still current", "", false},
+			{"404", "the service is unknown", "", false},
+		},
+	},
+	"GET /stats": {
+		Summary:   "The active opt-outs per service",
+		Auth:      authStats,
+		Responses: []apiResponse{{"200", "counts per service and updated_at", "Stats", false}},
+	},
+	"GET /api/openapi.json": {
+		Summary:   "This document",
+		Responses: []apiResponse{{"200", "the OpenAPI document", "", false}},
+	},
+	"GET /api/docs": {
+		Summary:   "An index of the endpoints",
+		Responses: []apiResponse{{"200", "an HTML page", "", false}},
+	},
+}
+
+// apiSchemas are the components of the bodies in apiDocs
+var apiSchemas = map[string]interface{}{
+	"Error": jsonObject(map[string]interface{}{
+		"error": jsonObject(map[string]interface{}{
+			"code":       jsonSchema("string", "stable code like unauthorized, see the README"),
+			"message":    jsonSchema("string", "for humans, may change"),
+			"request_id": jsonSchema("string", "also sent as X-Request-ID"),
+		}),
+	}),
+	"MeUser": jsonObject(map[string]interface{}{
+		"name":          jsonSchema("string", "lowercased"),
+		"displayName":   jsonSchema("string", ""),
+		"deleting":      jsonSchema("boolean", "whether the user's logs are opted out"),
+		"deletingSince": jsonDateTime("when the opt-out was first requested"),
+		"expiresAt":     jsonDateTime("when the opt-out ends, unset if it's permanent"),
+		"allChannels":   jsonSchema("boolean", "unset if the opt-out only covers channels"),
+		"channels":      jsonArray(jsonSchema("string", "")),
+		"email":         jsonSchema("string", "only with include_email=1"),
+	}),
+	"MeUsers": map[string]interface{}{
+		"type":                 "object",
+		"additionalProperties": schemaRef("MeUser"),
+	},
+	"OptOutRequest": jsonObject(map[string]interface{}{
+		"duration": jsonSchema("string", "1d, 7d, 30d or 90d, permanent if empty"),
+	}),
+	"CheckRequest": jsonObject(map[string]interface{}{
+		"service": jsonSchema("string", ""),
+		"names":   jsonArray(jsonSchema("string", "")),
+		"channel": jsonSchema("string", "only count opt-outs covering the channel"),
+	}),
+	"CheckResponse": map[string]interface{}{
+		"type":                 "object",
+		"additionalProperties": jsonSchema("boolean", ""),
+	},
+	"OptOuts": map[string]interface{}{
+		"oneOf": []interface{}{
+			jsonArray(jsonObject(map[string]interface{}{
+				"name":         jsonSchema("string", ""),
+				"requested_at": jsonDateTime(""),
+			})),
+			schemaRef("ChangesPage"),
+		},
+	},
+	"ChangesPage": jsonObject(map[string]interface{}{
+		"changes": jsonArray(jsonObject(map[string]interface{}{
+			"id":         jsonSchema("integer", ""),
+			"name":       jsonSchema("string", ""),
+			"action":     jsonSchema("string", "added or removed"),
+			"changed_at": jsonDateTime(""),
+		})),
+		"cursor": jsonSchema("string", "the since of the next poll"),
+		"more":   jsonSchema("boolean", "whether there are more changes right away"),
+		"resync": jsonSchema("boolean", "whether the changes were pruned and the whole list has to be fetched again"),
+	}),
+	"Stats": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"updated_at": jsonDateTime("null until the opt-outs were counted once"),
+		},
+		"additionalProperties": jsonObject(map[string]interface{}{
+			"active": jsonSchema("integer", ""),
+		}),
+	},
+}
+
+func jsonSchema(typ, description string) map[string]interface{} {
+	s := map[string]interface{}{"type": typ}
+	if description != "" {
+		s["description"] = description
+	}
+	return s
+}
+
+func jsonDateTime(description string) map[string]interface{} {
+	s := jsonSchema("string", description)
+	s["format"] = "date-time"
+	return s
+}
+
+func jsonObject(properties map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+func jsonArray(items interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "array", "items": items}
+}
+
+func schemaRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// documentedRoute reports whether the route belongs in /api/openapi.json
+func documentedRoute(path string) bool {
+	return strings.HasPrefix(path, "/api/") || path == "/stats"
+}
+
+// APIDocsEntry is an endpoint listed by /api/docs
+type APIDocsEntry struct {
+	Method  string
+	Path    string
+	Summary string
+}
+
+// setupOpenAPI builds /api/openapi.json from the routes of the router, so
+// a route can't be missing from it. Routes without an entry in apiDocs are
+// listed without details and logged.
+func (ur *UnRustleLogs) setupOpenAPI(routes gin.RoutesInfo) error {
+	paths := map[string]map[string]interface{}{}
+	ur.apiDocs = nil
+	for _, r := range routes {
+		if !documentedRoute(r.Path) {
+			continue
+		}
+		op, ok := apiDocs[r.Method+" "+r.Path]
+		if !ok {
+			logrus.Warnf("%s %s isn't documented in apiDocs", r.Method, r.Path)
+			op = apiOperation{Summary: "undocumented"}
+		}
+		path, operation := ur.openAPIOperation(r.Path, op)
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(r.Method)] = operation
+		ur.apiDocs = append(ur.apiDocs, APIDocsEntry{Method: r.Method, Path: path, Summary: op.Summary})
+	}
+	sort.Slice(ur.apiDocs, func(i, j int) bool {
+		if ur.apiDocs[i].Path != ur.apiDocs[j].Path {
+			return ur.apiDocs[i].Path < ur.apiDocs[j].Path
+		}
+		return ur.apiDocs[i].Method < ur.apiDocs[j].Method
+	})
+	cookie := ""
+	if len(ur.providers) > 0 {
+		cookie = ur.providers[0].CookieName()
+	}
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "unrustlelogs",
+			"version": "v1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": apiSchemas,
+			"securitySchemes": map[string]interface{}{
+				"apiKey": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "a key of api.keys, create one with ./unrustlelogs apikey",
+				},
+				"session": map[string]interface{}{
+					"type":        "apiKey",
+					"in":          "cookie",
+					"name":        cookie,
+					"description": "the session cookie of the service, set by logging in with it. every service has its own cookie",
+				},
+			},
+		},
+	}
+	var err error
+	ur.openAPI, err = json.MarshalIndent(doc, "", "  ")
+	return err
+}
+
+// openAPIOperation converts the gin path to an OpenAPI one and documents
+// its parameters along with op.
+func (ur *UnRustleLogs) openAPIOperation(ginPath string, op apiOperation) (string, map[string]interface{}) {
+	var params []interface{}
+	segments := strings.Split(ginPath, "/")
+	for i, s := range segments {
+		if !strings.HasPrefix(s, ":") && !strings.HasPrefix(s, "*") {
+			continue
+		}
+		name := s[1:]
+		segments[i] = "{" + name + "}"
+		params = append(params, map[string]interface{}{
+			"name": name, "in": "path", "required": true, "schema": jsonSchema("string", ""),
+		})
+	}
+	for _, q := range op.Query {
+		params = append(params, map[string]interface{}{
+			"name": q.Name, "in": "query", "description": q.Description, "schema": jsonSchema(q.Type, ""),
+		})
+	}
+	operation := map[string]interface{}{"summary": op.Summary}
+	if op.Description != "" {
+		operation["description"] = op.Description
+	}
+	if params != nil {
+		operation["parameters"] = params
+	}
+	if op.Body != "" {
+		operation["requestBody"] = map[string]interface{}{
+			"required": op.Auth != authSession,
+			"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": schemaRef(op.Body)}},
+		}
+	}
+	switch {
+	case op.Auth == authSession:
+		operation["security"] = []interface{}{map[string]interface{}{"session": []string{}}}
+	case op.Auth == authKey && ur.apiKeysRequired(), op.Auth == authStats && ur.config.API.StatsRequireKey:
+		operation["security"] = []interface{}{map[string]interface{}{"apiKey": []string{}}}
+	}
+	responses := map[string]interface{}{
+		"default": map[string]interface{}{
+			"description": "an error",
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": schemaRef("Error")}},
+		},
+	}
+	for _, r := range op.Responses {
+		response := map[string]interface{}{"description": r.Description}
+		if r.Schema != "" {
+			response["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": schemaRef(r.Schema)}}
+		} else if r.Binary {
+			response["content"] = map[string]interface{}{"application/octet-stream": map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}}}
+		}
+		responses[r.Status] = response
+	}
+	operation["responses"] = responses
+	return strings.Join(segments, "/"), operation
+}
+
+// openAPIHandler serves the document built by setupOpenAPI.
+func (ur *UnRustleLogs) openAPIHandler(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", ur.openAPI)
+}
+
+// apiDocsHandler lists the documented endpoints.
+func (ur *UnRustleLogs) apiDocsHandler(c *gin.Context) {
+	c.HTML(http.StatusOK, "apidocs.tmpl", ur.apiDocs)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// OptOutRequest is the optional body of POST /api/v1/me/:service/optout
+type OptOutRequest struct {
+	// Duration is one of the keys of optOutDurations, permanent if empty
+	Duration string `json:"duration"`
+}
+
+// optOut opts the user out for d, permanently if it's 0, the same as
+// logging in through the callback does. An active opt-out only gets the new
+// duration, like the expiry form. It returns the user as stored then.
+func (ur *UnRustleLogs) optOut(user *User, d time.Duration) (*User, error) {
+	now := time.Now().UTC()
+	expiresAt := optOutExpiry(now, d)
+	if user.optedOut(now) {
+		if err := ur.SetUserExpiry(user.ID, expiresAt); err != nil {
+			return nil, fmt.Errorf("failed changing expiry of %s user %s: %v", user.Service, user.Name, err)
+		}
+	} else {
+		ident := &Identity{UserID: user.UserID, Name: user.Name, DisplayName: user.DisplayName, Email: user.Email}
+		if _, _, err := ur.AddUser(user.Service, ident, expiresAt); err != nil {
+			return nil, err
+		}
+	}
+	return ur.reloadUser(user)
+}
+
+// optIn ends the opt-out of the user and of the user linked to it, and
+// returns the user as stored then.
+func (ur *UnRustleLogs) optIn(user *User) (*User, error) {
+	if err := ur.DeleteUser(user.Name, user.Service, user.UserID); err != nil {
+		return nil, err
+	}
+	return ur.reloadUser(user)
+}
+
+func (ur *UnRustleLogs) reloadUser(user *User) (*User, error) {
+	u, err := ur.GetUser(user.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%s user %s is gone", user.Service, user.Name)
+	}
+	if err != nil && !errors.Is(err, errEmailDecrypt) {
+		return nil, err
+	}
+	return u, nil
+}
+
+// sessionMiddleware only lets requests through that have a session of the
+// provider of the service parameter, the user is set as "user".
+func (ur *UnRustleLogs) sessionMiddleware(c *gin.Context) {
+	p, ok := ur.provider(c.Param("service"))
+	if !ok {
+		apiError(c, http.StatusNotFound, codeUnknownService, fmt.Sprintf("unknown service %q", c.Param("service")))
+		return
+	}
+	user, _, ok := ur.getSession(c, p.CookieName())
+	if !ok {
+		apiError(c, http.StatusUnauthorized, codeUnauthorized, "not logged in with "+p.Name())
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Set("user", user)
+	c.Next()
+}
+
+// optOutStatusHandler reports the opt-out of the logged in user.
+func (ur *UnRustleLogs) optOutStatusHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, ur.meUser(c.MustGet("user").(*User), false))
+}
+
+// optOutHandler opts the logged in user out for the duration of the body.
+// Bodies have to be JSON, which browsers don't send cross-site without the
+// site agreeing, so the session cookie can't be ridden by other sites.
+func (ur *UnRustleLogs) optOutHandler(c *gin.Context) {
+	if c.ContentType() != gin.MIMEJSON {
+		apiError(c, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "the body has to be application/json")
+		return
+	}
+	var req OptOutRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		apiError(c, http.StatusBadRequest, codeBadRequest, "expected {\"duration\": ...}")
+		return
+	}
+	d, ok := optOutDuration(req.Duration)
+	if !ok {
+		keys := make([]string, 0, len(optOutDurations))
+		for _, d := range optOutDurations {
+			keys = append(keys, d.Key)
+		}
+		apiError(c, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("duration has to be empty or one of %s", strings.Join(keys, ", ")))
+		return
+	}
+	user, err := ur.optOut(c.MustGet("user").(*User), d)
+	if err != nil {
+		requestLog(c).Error(err)
+		apiError(c, http.StatusInternalServerError, codeInternal, "failed opting out")
+		return
+	}
+	c.JSON(http.StatusOK, ur.meUser(user, false))
+}
+
+// optInHandler ends the opt-out of the logged in user.
+func (ur *UnRustleLogs) optInHandler(c *gin.Context) {
+	user, err := ur.optIn(c.MustGet("user").(*User))
+	if err != nil {
+		requestLog(c).Error(err)
+		apiError(c, http.StatusInternalServerError, codeInternal, "failed opting back in")
+		return
+	}
+	c.JSON(http.StatusOK, ur.meUser(user, false))
+}
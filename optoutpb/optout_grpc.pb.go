@@ -0,0 +1,219 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: optoutpb/optout.proto
+
+package optoutpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	OptOuts_Check_FullMethodName         = "/unrustlelogs.v1.OptOuts/Check"
+	OptOuts_BulkCheck_FullMethodName     = "/unrustlelogs.v1.OptOuts/BulkCheck"
+	OptOuts_StreamChanges_FullMethodName = "/unrustlelogs.v1.OptOuts/StreamChanges"
+)
+
+// OptOutsClient is the client API for OptOuts service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type OptOutsClient interface {
+	// Check reports whether the user opted out.
+	Check(ctx context.Context, in *CheckRequest, opts ...grpc.CallOption) (*CheckResponse, error)
+	// BulkCheck is Check for up to server.check_batch_limit names at once.
+	BulkCheck(ctx context.Context, in *BulkCheckRequest, opts ...grpc.CallOption) (*BulkCheckResponse, error)
+	// StreamChanges sends every opt-out and undelete of the service from now
+	// on, the stream ends with RESOURCE_EXHAUSTED if the client can't keep up.
+	StreamChanges(ctx context.Context, in *StreamChangesRequest, opts ...grpc.CallOption) (OptOuts_StreamChangesClient, error)
+}
+
+type optOutsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewOptOutsClient(cc grpc.ClientConnInterface) OptOutsClient {
+	return &optOutsClient{cc}
+}
+
+func (c *optOutsClient) Check(ctx context.Context, in *CheckRequest, opts ...grpc.CallOption) (*CheckResponse, error) {
+	out := new(CheckResponse)
+	err := c.cc.Invoke(ctx, OptOuts_Check_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *optOutsClient) BulkCheck(ctx context.Context, in *BulkCheckRequest, opts ...grpc.CallOption) (*BulkCheckResponse, error) {
+	out := new(BulkCheckResponse)
+	err := c.cc.Invoke(ctx, OptOuts_BulkCheck_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *optOutsClient) StreamChanges(ctx context.Context, in *StreamChangesRequest, opts ...grpc.CallOption) (OptOuts_StreamChangesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &OptOuts_ServiceDesc.Streams[0], OptOuts_StreamChanges_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &optOutsStreamChangesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type OptOuts_StreamChangesClient interface {
+	Recv() (*Change, error)
+	grpc.ClientStream
+}
+
+type optOutsStreamChangesClient struct {
+	grpc.ClientStream
+}
+
+func (x *optOutsStreamChangesClient) Recv() (*Change, error) {
+	m := new(Change)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// OptOutsServer is the server API for OptOuts service.
+// All implementations must embed UnimplementedOptOutsServer
+// for forward compatibility
+type OptOutsServer interface {
+	// Check reports whether the user opted out.
+	Check(context.Context, *CheckRequest) (*CheckResponse, error)
+	// BulkCheck is Check for up to server.check_batch_limit names at once.
+	BulkCheck(context.Context, *BulkCheckRequest) (*BulkCheckResponse, error)
+	// StreamChanges sends every opt-out and undelete of the service from now
+	// on, the stream ends with RESOURCE_EXHAUSTED if the client can't keep up.
+	StreamChanges(*StreamChangesRequest, OptOuts_StreamChangesServer) error
+	mustEmbedUnimplementedOptOutsServer()
+}
+
+// UnimplementedOptOutsServer must be embedded to have forward compatible implementations.
+type UnimplementedOptOutsServer struct {
+}
+
+func (UnimplementedOptOutsServer) Check(context.Context, *CheckRequest) (*CheckResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Check not implemented")
+}
+func (UnimplementedOptOutsServer) BulkCheck(context.Context, *BulkCheckRequest) (*BulkCheckResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BulkCheck not implemented")
+}
+func (UnimplementedOptOutsServer) StreamChanges(*StreamChangesRequest, OptOuts_StreamChangesServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamChanges not implemented")
+}
+func (UnimplementedOptOutsServer) mustEmbedUnimplementedOptOutsServer() {}
+
+// UnsafeOptOutsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to OptOutsServer will
+// result in compilation errors.
+type UnsafeOptOutsServer interface {
+	mustEmbedUnimplementedOptOutsServer()
+}
+
+func RegisterOptOutsServer(s grpc.ServiceRegistrar, srv OptOutsServer) {
+	s.RegisterService(&OptOuts_ServiceDesc, srv)
+}
+
+func _OptOuts_Check_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CheckRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OptOutsServer).Check(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OptOuts_Check_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OptOutsServer).Check(ctx, req.(*CheckRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OptOuts_BulkCheck_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BulkCheckRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OptOutsServer).BulkCheck(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OptOuts_BulkCheck_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OptOutsServer).BulkCheck(ctx, req.(*BulkCheckRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OptOuts_StreamChanges_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamChangesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(OptOutsServer).StreamChanges(m, &optOutsStreamChangesServer{stream})
+}
+
+type OptOuts_StreamChangesServer interface {
+	Send(*Change) error
+	grpc.ServerStream
+}
+
+type optOutsStreamChangesServer struct {
+	grpc.ServerStream
+}
+
+func (x *optOutsStreamChangesServer) Send(m *Change) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// OptOuts_ServiceDesc is the grpc.ServiceDesc for OptOuts service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var OptOuts_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "unrustlelogs.v1.OptOuts",
+	HandlerType: (*OptOutsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Check",
+			Handler:    _OptOuts_Check_Handler,
+		},
+		{
+			MethodName: "BulkCheck",
+			Handler:    _OptOuts_BulkCheck_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamChanges",
+			Handler:       _OptOuts_StreamChanges_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "optoutpb/optout.proto",
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pprofWriteMargin is added to the seconds a profile runs for writing it
+const pprofWriteMargin = 10 * time.Second
+
+// setupPprof mounts net/http/pprof under /admin/debug/pprof for admins if
+// server.enable_pprof is set, the admin cookie is only sent under /admin.
+func (ur *UnRustleLogs) setupPprof(router *gin.Engine) error {
+	if !ur.config.Server.EnablePprof {
+		return nil
+	}
+	if !ur.adminEnabled() {
+		return errors.New("server.enable_pprof needs the admin login, set admin.client_id")
+	}
+	group := router.Group("/admin/debug/pprof", ur.adminMiddleware)
+	group.GET("/*profile", pprofHandler)
+	group.POST("/*profile", pprofHandler)
+	return nil
+}
+
+// pprofHandler serves the pprof endpoints from one catch-all route. The
+// index links to the profiles relative to itself, pprof.Index only finds
+// them by name under /debug/pprof/ so they're looked up here.
+func pprofHandler(c *gin.Context) {
+	name := strings.TrimPrefix(c.Param("profile"), "/")
+	switch name {
+	case "cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "profile":
+		pprof.Profile(c.Writer, pprofLongRequest(c, 30))
+	case "trace":
+		pprof.Trace(c.Writer, pprofLongRequest(c, 1))
+	case "symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "":
+		pprof.Index(c.Writer, c.Request)
+	default:
+		pprof.Handler(name).ServeHTTP(c.Writer, pprofLongRequest(c, 0))
+	}
+}
+
+// pprofLongRequest lets profiles run for their seconds, def unless the query
+// has them, even when that is past the server's WriteTimeout. The write
+// deadline of the connection is moved and pprof no longer sees the server
+// to refuse the request.
+func pprofLongRequest(c *gin.Context, def int) *http.Request {
+	seconds := def
+	if s := c.Query("seconds"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			seconds = n
+		}
+	}
+	if seconds <= 0 {
+		return c.Request
+	}
+	extendWriteDeadline(c, time.Duration(seconds)*time.Second+pprofWriteMargin)
+	return c.Request.WithContext(context.WithValue(c.Request.Context(), http.ServerContextKey, &http.Server{}))
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+// Identity is the account a provider logged the user in as.
+type Identity struct {
+	UserID string
+	// Name is the unique name opt-outs are looked up by
+	Name        string
+	DisplayName string
+	Nick        string
+	Email       string
+	// EmailVerified is only reported by some providers
+	EmailVerified bool
+
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int
+}
+
+// authRequest holds what a provider needs to build its authorize URL.
+type authRequest struct {
+	RedirectURI string
+	State       string
+	Verifier    string
+	// Force asks the provider to let the user pick the account again
+	Force bool
+}
+
+// Provider is a login backend users can opt out with.
+type Provider interface {
+	// Service is stored on users and pending states
+	Service() string
+	// Name is shown on the index page
+	Name() string
+	// Path is the prefix of the login, logout and callback routes
+	Path() string
+	CookieName() string
+	// RedirectURL is the configured redirect_uri, see callbackURL
+	RedirectURL() string
+	AuthURL(req authRequest) string
+	Exchange(ctx context.Context, redirectURI, code, verifier string) (*Identity, error)
+}
+
+// tokenRevoker is implemented by providers that can revoke the stored
+// token of a user on logout.
+type tokenRevoker interface {
+	RevokeOnLogout() bool
+	Revoke(userID string) error
+}
+
+// Errors Exchange returns when the login was refused because of the account
+var (
+	errMissingScope    = errors.New("not all requested scopes were granted")
+	errEmailMissing    = errors.New("account has no email address")
+	errEmailUnverified = errors.New("account email address is not verified")
+)
+
+// rejectedLoginCodes maps the errors above to loginErrorMessages codes.
+var rejectedLoginCodes = map[error]string{
+	errMissingScope:    "missing_scope",
+	errEmailMissing:    "email_missing",
+	errEmailUnverified: "email_unverified",
+}
+
+// renamedCookieMaxAge is how long the index page waits to show a rename
+// noticed at login
+const renamedCookieMaxAge = 300
+
+// renamedCookie holds the old name after a login of p noticed a rename.
+func renamedCookie(p Provider) string {
+	return p.CookieName() + "_renamed"
+}
+
+// setupProviders registers the built-in providers, OIDC providers are added
+// by setupOIDCProviders.
+func (ur *UnRustleLogs) setupProviders() error {
+	ur.providers = []Provider{&twitchProvider{ur}, &dggProvider{ur}}
+	if ur.discordEnabled() {
+		ur.providers = append(ur.providers, &discordProvider{ur})
+	}
+	if ur.youtubeEnabled() {
+		ur.providers = append(ur.providers, &youtubeProvider{ur})
+	}
+	if ur.kickEnabled() {
+		ur.providers = append(ur.providers, &kickProvider{ur})
+	}
+	return nil
+}
+
+func (ur *UnRustleLogs) provider(service string) (Provider, bool) {
+	for _, p := range ur.providers {
+		if p.Service() == service {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+func (ur *UnRustleLogs) loginHandler(p Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !ur.breaker(p.Service()).allow() {
+			// the index page explains that the provider is unavailable
+			c.Redirect(http.StatusFound, "/")
+			return
+		}
+		redirectURI, err := ur.callbackURL(c, p.Path()+"/callback", p.RedirectURL())
+		if err != nil {
+			requestLog(c).Warnf("%s login from %q rejected: %v", p.Service(), c.Request.Host, err)
+			errorPage(c, http.StatusBadRequest, "Logins are not allowed from this host.")
+			return
+		}
+		state, err := generateSecureToken(stateBytes)
+		if err != nil {
+			requestLog(c).Errorf("failed generating %s state: %v", p.Service(), err)
+			errorPage(c, http.StatusInternalServerError, "Something went wrong, please try again.")
+			return
+		}
+		verifier, err := generateSecureToken(verifierBytes)
+		if err != nil {
+			requestLog(c).Errorf("failed generating %s verifier: %v", p.Service(), err)
+			errorPage(c, http.StatusInternalServerError, "Something went wrong, please try again.")
+			return
+		}
+		ip := ur.clientIP(c.Request)
+		redirect := safeRedirect(c.Query("redirect"))
+		remember := c.Query("remember") == "1"
+		duration := c.Query("duration")
+		if _, ok := optOutDuration(duration); !ok {
+			c.Redirect(http.StatusFound, "/?error=invalid_duration")
+			return
+		}
+		if err := ur.putState(p.Service(), ip, state, verifier, redirect, remember, duration); err != nil {
+			requestLog(c).Warnf("%s login from %s rejected: %v", p.Service(), ip, err)
+			errorPage(c, http.StatusTooManyRequests, "Too many pending logins, please try again in a few minutes.")
+			return
+		}
+
+		authURL := p.AuthURL(authRequest{
+			RedirectURI: redirectURI,
+			State:       state,
+			Verifier:    verifier,
+			Force:       c.Query("force") == "1",
+		})
+		c.Redirect(http.StatusFound, authURL)
+	}
+}
+
+func (ur *UnRustleLogs) logoutHandler(p Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ur.logout(c, p)
+		c.Redirect(http.StatusFound, "/")
+	}
+}
+
+// deleteHandler opts the logged in user of p out again for the duration
+// form field, permanently if it's empty.
+func (ur *UnRustleLogs) deleteHandler(p Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _, ok := ur.getSession(c, p.CookieName())
+		if !ok {
+			c.Redirect(http.StatusFound, "/")
+			return
+		}
+		d, ok := optOutDuration(c.PostForm("duration"))
+		if !ok {
+			c.Redirect(http.StatusFound, "/?error=invalid_duration")
+			return
+		}
+		if _, err := ur.optOut(user, d); err != nil {
+			requestLog(c).Error(err)
+			c.Redirect(http.StatusFound, "/?error=server_error")
+			return
+		}
+		c.Redirect(http.StatusFound, "/")
+	}
+}
+
+// undeleteHandler ends the opt-out of the logged in user of p.
+func (ur *UnRustleLogs) undeleteHandler(p Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, _, ok := ur.getSession(c, p.CookieName())
+		if !ok {
+			c.Redirect(http.StatusFound, "/")
+			return
+		}
+		if _, err := ur.optIn(user); err != nil {
+			requestLog(c).Error(err)
+			c.Redirect(http.StatusFound, "/?error=server_error")
+			return
+		}
+		c.Redirect(http.StatusFound, "/")
+	}
+}
+
+// logoutAllHandler logs out of every provider at once.
+func (ur *UnRustleLogs) logoutAllHandler(c *gin.Context) {
+	for _, p := range ur.providers {
+		ur.logout(c, p)
+	}
+	c.Redirect(http.StatusFound, "/")
+}
+
+// logout ends the session of p and revokes its provider token if configured.
+// The cookie is removed even if the session is broken.
+func (ur *UnRustleLogs) logout(c *gin.Context, p Provider) {
+	user, claims, ok := ur.getSession(c, p.CookieName())
+	if ok {
+		ur.destroySession(c, p.CookieName(), claims)
+		if r, isRevoker := p.(tokenRevoker); isRevoker && r.RevokeOnLogout() {
+			if err := r.Revoke(user.UserID); err != nil {
+				requestLog(c).Errorf("failed revoking %s token of %s: %v", p.Service(), user.Name, err)
+			}
+		}
+	}
+	ur.deleteCookie(c, p.CookieName())
+}
+
+func (ur *UnRustleLogs) callbackHandler(p Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		state := c.Query("state")
+		if ur.handleCallbackError(c, p.Service()) {
+			// the login is over either way, only a state of p is removed
+			ur.consumeState(p.Service(), state)
+			return
+		}
+		pending, err := ur.consumeState(p.Service(), state)
+		if err != nil {
+			c.Redirect(http.StatusFound, "/?error="+stateErrorCode(err))
+			return
+		}
+		redirectURI, err := ur.callbackURL(c, p.Path()+"/callback", p.RedirectURL())
+		if err != nil {
+			requestLog(c).Warnf("%s callback from %q rejected: %v", p.Service(), c.Request.Host, err)
+			errorPage(c, http.StatusBadRequest, "Logins are not allowed from this host.")
+			return
+		}
+
+		ident, err := p.Exchange(c.Request.Context(), redirectURI, c.Query("code"), pending.verifier)
+		ur.recordProviderResult(p.Service(), err)
+		if code, ok := rejectedLoginCodes[err]; ok {
+			requestLog(c).Warnf("%s login rejected: %v", p.Service(), err)
+			c.Redirect(http.StatusFound, "/?error="+code)
+			return
+		}
+		if err != nil {
+			requestLog(c).Errorf("%s login failed: %v", p.Service(), err)
+			c.Redirect(http.StatusFound, "/?error=server_error")
+			return
+		}
+
+		if ident.AccessToken != "" {
+			err = ur.SaveToken(p.Service(), ident.UserID, ident.AccessToken, ident.RefreshToken, ident.ExpiresIn)
+			if err != nil && err != errTokenStoreDisabled {
+				requestLog(c).Error(err)
+			}
+		}
+
+		// the duration was checked by loginHandler, it only applies to the
+		// first login, later ones keep the opt-out state
+		d, _ := optOutDuration(pending.duration)
+		id, renamedFrom, err := ur.LoginUser(p.Service(), ident, optOutExpiry(time.Now().UTC(), d))
+		if err != nil {
+			requestLog(c).Error(err)
+			c.Redirect(http.StatusFound, "/?error=server_error")
+			return
+		}
+		if renamedFrom != "" {
+			requestLog(c).Infof("%s user %s renamed from %s", p.Service(), normalizeName(ident.Name), renamedFrom)
+			ur.setCookie(c, renamedCookie(p), renamedFrom, "/", renamedCookieMaxAge)
+		}
+		claims := &jwtClaims{ID: id, EmailVerified: ident.EmailVerified, Remember: pending.remember}
+		claims.Audience = p.Service()
+		if err := ur.setSessionCookie(c, p.CookieName(), claims); err != nil {
+			requestLog(c).Error(err)
+			errorPage(c, http.StatusInternalServerError, "Something went wrong, please try again.")
+			return
+		}
+		c.Redirect(http.StatusFound, safeRedirect(pending.redirect))
+	}
+}
+
+// anyServiceMiddleware lets requests through that have a session of any
+// provider. If there are several, the first provider in ur.providers wins,
+// which is twitch, then dgg and then the optional ones. The user and service
+// are set as "user" and "service".
+func (ur *UnRustleLogs) anyServiceMiddleware(c *gin.Context) {
+	for _, p := range ur.providers {
+		if user, ok := ur.getUserFromJWT(c, p.CookieName()); ok {
+			c.Set("user", user)
+			c.Set("service", p.Service())
+			c.Next()
+			return
+		}
+	}
+	apiError(c, http.StatusUnauthorized, codeUnauthorized, "not logged in")
+}
+
+// refreshHandler issues a new session with a fresh expiry to logged in users.
+func (ur *UnRustleLogs) refreshHandler(p Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, claims, ok := ur.getSession(c, p.CookieName())
+		if !ok {
+			c.Redirect(http.StatusFound, "/")
+			return
+		}
+		if _, err := ur.renewSession(c, p.CookieName(), claims); err != nil {
+			requestLog(c).Error(err)
+			errorPage(c, http.StatusInternalServerError, "Something went wrong, please try again.")
+			return
+		}
+		c.Redirect(http.StatusFound, safeRedirect(c.Query("redirect")))
+	}
+}
+
+// setSessionCookie starts a session from claims and sets it as cookieName.
+// Remembered sessions last server.jwt_ttl in a persistent cookie, others
+// server.session_ttl in a cookie the browser drops on exit. Neither lasts
+// past server.session_absolute_max after the login. claims.Audience has to
+// be the service of the user.
+func (ur *UnRustleLogs) setSessionCookie(c *gin.Context, cookieName string, claims *jwtClaims) error {
+	// claims only have whole seconds, the max age has to match them
+	now := ur.now().Truncate(time.Second)
+	ttl := ur.config.Server.SessionTTL.Duration
+	if claims.Remember {
+		ttl = ur.config.Server.JWTTTL.Duration
+	}
+	if claims.AuthTime == 0 {
+		claims.AuthTime = now.Unix()
+	}
+	expires := now.Add(ttl)
+	if limit := time.Unix(claims.AuthTime, 0).Add(ur.config.Server.SessionAbsoluteMax.Duration); expires.After(limit) {
+		expires = limit
+	}
+	claims.StandardClaims = jwt.StandardClaims{
+		Id:        newJTI(),
+		Issuer:    ur.config.Server.JWTIssuer,
+		Audience:  claims.Audience,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expires.Unix(),
+	}
+	t, err := ur.sessions.Create(claims)
+	if err != nil {
+		return err
+	}
+	maxAge := 0
+	if claims.Remember {
+		maxAge = int(expires.Sub(now).Seconds())
+	}
+	ur.setCookie(c, cookieName, t, "/", maxAge)
+	return nil
+}
+
+// renewSession replaces the session in cookieName with one that has a fresh
+// expiry and returns its claims.
+func (ur *UnRustleLogs) renewSession(c *gin.Context, cookieName string, claims *jwtClaims) (*jwtClaims, error) {
+	// the replaced session shouldn't stay usable
+	ur.destroySession(c, cookieName, claims)
+	renewed := &jwtClaims{
+		ID:            claims.ID,
+		EmailVerified: claims.EmailVerified,
+		Remember:      claims.Remember,
+		AuthTime:      claims.AuthTime,
+	}
+	renewed.Audience = claims.Audience
+	if err := ur.setSessionCookie(c, cookieName, renewed); err != nil {
+		return nil, err
+	}
+	return renewed, nil
+}
+
+// destroySession ends the session in cookieName, claims are the ones
+// getSession returned for it.
+func (ur *UnRustleLogs) destroySession(c *gin.Context, cookieName string, claims *jwtClaims) {
+	if value, err := c.Cookie(cookieName); err == nil {
+		ur.sessions.Destroy(value, claims)
+	}
+}
+
+// safeRedirect returns raw if it is a local path and / otherwise, so the
+// redirect parameter can't send users to another site.
+func safeRedirect(raw string) string {
+	decoded, err := url.PathUnescape(raw)
+	if err != nil {
+		return "/"
+	}
+	for _, s := range []string{raw, decoded} {
+		if !strings.HasPrefix(s, "/") || strings.HasPrefix(s, "//") || strings.ContainsAny(s, "\\\r\n\t") {
+			return "/"
+		}
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return "/"
+	}
+	return raw
+}
+
+// postForm is http.Client.PostForm bound to ctx.
+func postForm(ctx context.Context, client *http.Client, endpoint string, v url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return client.Do(req)
+}
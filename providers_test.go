@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// stubProvider is a Provider whose Exchange returns ident or err without
+// talking to the provider.
+type stubProvider struct {
+	Provider
+	ident *Identity
+	err   error
+}
+
+func (p *stubProvider) Exchange(ctx context.Context, redirectURI, code, verifier string) (*Identity, error) {
+	return p.ident, p.err
+}
+
+func TestDeleteUndeleteHandlers(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		form   url.Values
+		// optedOut is whether the user starts opted out
+		optedOut bool
+		loggedIn bool
+		status   int
+		want     bool
+		// expires is whether the opt-out ends afterwards
+		expires bool
+	}{
+		{name: "undelete", method: http.MethodPost, path: "/twitch/undelete", form: url.Values{}, optedOut: true, loggedIn: true, status: http.StatusFound, want: false},
+		{name: "delete", method: http.MethodPost, path: "/twitch/delete", form: url.Values{}, loggedIn: true, status: http.StatusFound, want: true},
+		{name: "delete for a week", method: http.MethodPost, path: "/twitch/delete", form: url.Values{"duration": {"7d"}}, loggedIn: true, status: http.StatusFound, want: true, expires: true},
+		{name: "delete with an unknown duration", method: http.MethodPost, path: "/twitch/delete", form: url.Values{"duration": {"5y"}}, loggedIn: true, status: http.StatusFound, want: false},
+		{name: "undelete needs a session", method: http.MethodPost, path: "/twitch/undelete", form: url.Values{}, optedOut: true, status: http.StatusFound, want: true},
+		{name: "undelete needs the csrf token", method: http.MethodPost, path: "/twitch/undelete", optedOut: true, loggedIn: true, status: http.StatusForbidden, want: true},
+		{name: "GET only confirms", method: http.MethodGet, path: "/twitch/undelete", optedOut: true, loggedIn: true, status: http.StatusOK, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := newTestRustle(t)
+			router := newTestRouter(t, ur)
+			twitch := testProvider(t, ur, TWITCHSERVICE)
+			id := addTestUser(t, ur, TWITCHSERVICE, "foo")
+			if !tt.optedOut {
+				if err := ur.DeleteUser("foo", TWITCHSERVICE, "foo-id"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var cookies []*http.Cookie
+			if tt.loggedIn {
+				cookies = append(cookies, sessionCookie(t, ur, twitch, id))
+			}
+			w := testRequest(router, tt.method, tt.path, tt.form, cookies...)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			u, err := ur.GetUser(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := u.optedOut(time.Now().UTC()); got != tt.want {
+				t.Fatalf("opted out %v, want %v", got, tt.want)
+			}
+			if got := u.ExpiresAt != nil; got != tt.expires {
+				t.Fatalf("expires %v, want %v", got, tt.expires)
+			}
+		})
+	}
+}
+
+func TestCallbackStateIsSingleUse(t *testing.T) {
+	ur := newStateRustle(t)
+	p := &stubProvider{
+		Provider: testProvider(t, ur, TWITCHSERVICE),
+		ident:    &Identity{UserID: "foo-id", Name: "foo"},
+	}
+	router := gin.New()
+	router.GET("/callback", ur.callbackHandler(p))
+	if err := ur.putState(TWITCHSERVICE, "127.0.0.1", "state", "verifier", "/done", false, ""); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"/done", "/?error=invalid_state"} {
+		w := testRequest(router, http.MethodGet, "/callback?state=state&code=code", nil)
+		if w.Code != http.StatusFound || w.Header().Get("Location") != want {
+			t.Fatalf("callback %d: got %d to %q, want a redirect to %q", i+1, w.Code, w.Header().Get("Location"), want)
+		}
+	}
+}
+
+func TestSafeRedirect(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{raw: "", want: "/"},
+		{raw: "/", want: "/"},
+		{raw: "/channel/destiny", want: "/channel/destiny"},
+		{raw: "/search?q=foo#top", want: "/search?q=foo#top"},
+		{raw: "/a%20b", want: "/a%20b"},
+		{raw: "channel", want: "/"},
+		{raw: "https://evil.example/", want: "/"},
+		{raw: "//evil.example", want: "/"},
+		{raw: "///evil.example", want: "/"},
+		{raw: "/%2Fevil.example", want: "/"},
+		{raw: "%2F%2Fevil.example", want: "/"},
+		{raw: "/%2fevil.example", want: "/"},
+		{raw: "/\\evil.example", want: "/"},
+		{raw: "\\\\evil.example", want: "/"},
+		{raw: "/%5Cevil.example", want: "/"},
+		{raw: "/%0d%0aLocation:%20https://evil.example", want: "/"},
+		{raw: "/\tevil", want: "/"},
+		{raw: "/%zz", want: "/"},
+		{raw: "javascript:alert(1)", want: "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			if got := safeRedirect(tt.raw); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginKeepsSafeRedirect(t *testing.T) {
+	tests := []struct {
+		redirect string
+		want     string
+	}{
+		{redirect: "/channel/destiny", want: "/channel/destiny"},
+		{redirect: "//evil.example", want: "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.redirect, func(t *testing.T) {
+			ur := newStateRustle(t)
+			router := newTestRouter(t, ur)
+			w := testRequest(router, http.MethodGet, "/twitch/login?redirect="+url.QueryEscape(tt.redirect), nil)
+			if w.Code != http.StatusFound {
+				t.Fatalf("status %d, want %d", w.Code, http.StatusFound)
+			}
+			var row OAuthState
+			if err := ur.db.First(&row).Error; err != nil {
+				t.Fatal(err)
+			}
+			if row.Redirect != tt.want {
+				t.Fatalf("stored redirect %q, want %q", row.Redirect, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthFailureStopsTheChain(t *testing.T) {
+	ur := newTestRustle(t)
+	ur.config.Admin.Cookie = "admin"
+	id := addTestUser(t, ur, TWITCHSERVICE, "foo")
+	session := sessionCookie(t, ur, testProvider(t, ur, TWITCHSERVICE), id)
+	tests := []struct {
+		name       string
+		middleware gin.HandlerFunc
+		path       string
+		form       url.Values
+		cookies    []*http.Cookie
+		status     int
+		next       bool
+	}{
+		{name: "session without a cookie", middleware: ur.sessionMiddleware, path: "/twitch", status: http.StatusUnauthorized},
+		{name: "session of another provider", middleware: ur.sessionMiddleware, path: "/" + DESTINYGGSERVICE, cookies: []*http.Cookie{session}, status: http.StatusUnauthorized},
+		{name: "session of an unknown provider", middleware: ur.sessionMiddleware, path: "/myspace", cookies: []*http.Cookie{session}, status: http.StatusNotFound},
+		{name: "session", middleware: ur.sessionMiddleware, path: "/twitch", cookies: []*http.Cookie{session}, status: http.StatusOK, next: true},
+		{name: "any service without a cookie", middleware: ur.anyServiceMiddleware, path: "/twitch", status: http.StatusUnauthorized},
+		{name: "any service with an invalid cookie", middleware: ur.anyServiceMiddleware, path: "/twitch", cookies: []*http.Cookie{{Name: "dgg", Value: "forged"}}, status: http.StatusUnauthorized},
+		{name: "any service", middleware: ur.anyServiceMiddleware, path: "/twitch", cookies: []*http.Cookie{session}, status: http.StatusOK, next: true},
+		{name: "api key missing", middleware: ur.apiKeyMiddleware, path: "/twitch", status: http.StatusUnauthorized},
+		{name: "admin without a cookie", middleware: ur.adminMiddleware, path: "/twitch", status: http.StatusFound},
+		{name: "admin with a user session", middleware: ur.adminMiddleware, path: "/twitch", cookies: []*http.Cookie{{Name: "admin", Value: session.Value}}, status: http.StatusFound},
+		{name: "csrf GET confirms", middleware: ur.csrfMiddleware, path: "/twitch", status: http.StatusOK},
+		{name: "csrf", middleware: ur.csrfMiddleware, path: "/twitch", form: url.Values{}, status: http.StatusOK, next: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := false
+			router := gin.New()
+			router.HTMLRender = newTestRouter(t, ur).HTMLRender
+			router.Any("/:service", tt.middleware, func(c *gin.Context) {
+				next = true
+				c.Status(http.StatusOK)
+			})
+			method := http.MethodGet
+			if tt.form != nil {
+				method = http.MethodPost
+			}
+			w := testRequest(router, method, tt.path, tt.form, tt.cookies...)
+			if w.Code != tt.status || next != tt.next {
+				t.Fatalf("status %d and next ran: %v, want %d and %v", w.Code, next, tt.status, tt.next)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errHostNotAllowed = errors.New("host is not in server.allowed_hosts")
+
+func (ur *UnRustleLogs) setupTrustedProxies() error {
+	for _, p := range ur.config.Server.TrustedProxies {
+		if !strings.Contains(p, "/") {
+			if strings.Contains(p, ":") {
+				p += "/128"
+			} else {
+				p += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(p)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %v", p, err)
+		}
+		ur.trustedProxies = append(ur.trustedProxies, network)
+	}
+	return nil
+}
+
+// fromTrustedProxy reports whether the request was made by a configured
+// proxy. Requests over the unix socket are, only local processes allowed by
+// its permissions can connect.
+func (ur *UnRustleLogs) fromTrustedProxy(r *http.Request) bool {
+	if overUnixSocket(r) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return ur.trustedProxyIP(net.ParseIP(host))
+}
+
+// trustedProxyIP reports whether ip is in server.trusted_proxies.
+func (ur *UnRustleLogs) trustedProxyIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range ur.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestBaseURL returns scheme://host of the request, honouring the
+// X-Forwarded-Proto and X-Forwarded-Host headers only from trusted proxies.
+func (ur *UnRustleLogs) requestBaseURL(r *http.Request) (scheme, host string) {
+	scheme = "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host = r.Host
+	if ur.fromTrustedProxy(r) {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if fwdHost := r.Header.Get("X-Forwarded-Host"); fwdHost != "" {
+			host = strings.TrimSpace(strings.Split(fwdHost, ",")[0])
+		}
+	}
+	return scheme, host
+}
+
+// clientIP returns the address of the client, honouring X-Forwarded-For only
+// from trusted proxies. Everything keyed by client, rate limits, state caps
+// and the logs, has to use it. Proxies append the address they got the
+// request from, so the header is read from the right and the first address
+// that isn't a trusted proxy wins, the ones before it are whatever the
+// client sent.
+func (ur *UnRustleLogs) clientIP(r *http.Request) string {
+	if ur.fromTrustedProxy(r) {
+		var hops []string
+		for _, fwd := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(fwd, ",")...)
+		}
+		var last net.IP
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+			last = ip
+			if !ur.trustedProxyIP(ip) {
+				break
+			}
+		}
+		if last != nil {
+			return last.String()
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (ur *UnRustleLogs) hostAllowed(host string) bool {
+	for _, allowed := range ur.config.Server.AllowedHosts {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// callbackURL builds the OAuth redirect_uri for path. callback_base_url
+// wins if set, otherwise it is derived from the request as long as the host
+// is allowed. Without allowed_hosts the provider's redirect_url is used.
+func (ur *UnRustleLogs) callbackURL(c *gin.Context, path, redirectURL string) (string, error) {
+	if base := ur.config.Server.CallbackBaseURL; base != "" {
+		return strings.TrimSuffix(base, "/") + path, nil
+	}
+	if len(ur.config.Server.AllowedHosts) == 0 {
+		return redirectURL, nil
+	}
+	scheme, host := ur.requestBaseURL(c.Request)
+	if !ur.hostAllowed(host) {
+		return "", errHostNotAllowed
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, host, path), nil
+}
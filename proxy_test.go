@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newProxyRustle is an UnRustleLogs trusting the proxies, without a database.
+func newProxyRustle(t *testing.T, proxies ...string) *UnRustleLogs {
+	t.Helper()
+	ur := NewUnRustleLogs(context.Background())
+	ur.config = &Config{}
+	ur.config.Server.TrustedProxies = proxies
+	if err := ur.setupTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+	return ur
+}
+
+func TestCallbackURL(t *testing.T) {
+	tests := []struct {
+		name       string
+		baseURL    string
+		allowed    []string
+		remoteAddr string
+		tls        bool
+		headers    map[string]string
+		want       string
+		wantErr    bool
+	}{
+		{name: "configured redirect_url without allowed_hosts", remoteAddr: "203.0.113.1:1234", want: "http://configured/twitch/callback"},
+		{name: "callback_base_url wins", baseURL: "https://logs.example/", allowed: []string{"example.com"}, remoteAddr: "203.0.113.1:1234", want: "https://logs.example/twitch/callback"},
+		{name: "direct request", allowed: []string{"example.com"}, remoteAddr: "203.0.113.1:1234", want: "http://example.com/twitch/callback"},
+		{name: "direct tls request", allowed: []string{"example.com"}, remoteAddr: "203.0.113.1:1234", tls: true, want: "https://example.com/twitch/callback"},
+		{
+			name:       "proxied request",
+			allowed:    []string{"logs.example"},
+			remoteAddr: "10.0.0.2:1234",
+			headers:    map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "logs.example"},
+			want:       "https://logs.example/twitch/callback",
+		},
+		{
+			name:       "forwarded headers of untrusted peers are ignored",
+			allowed:    []string{"example.com", "logs.example"},
+			remoteAddr: "203.0.113.1:1234",
+			headers:    map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "logs.example"},
+			want:       "http://example.com/twitch/callback",
+		},
+		{name: "host not allowed", allowed: []string{"logs.example"}, remoteAddr: "203.0.113.1:1234", wantErr: true},
+		{
+			name:       "forwarded host not allowed",
+			allowed:    []string{"example.com"},
+			remoteAddr: "10.0.0.2:1234",
+			headers:    map[string]string{"X-Forwarded-Host": "evil.example"},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := newProxyRustle(t, "10.0.0.0/8")
+			ur.config.Server.CallbackBaseURL = tt.baseURL
+			ur.config.Server.AllowedHosts = tt.allowed
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/twitch/login", nil)
+			c.Request.RemoteAddr = tt.remoteAddr
+			if tt.tls {
+				c.Request.TLS = &tls.ConnectionState{}
+			}
+			for k, v := range tt.headers {
+				c.Request.Header.Set(k, v)
+			}
+			got, err := ur.callbackURL(c, "/twitch/callback", "http://configured/twitch/callback")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want one: %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// unixConn is a connection accepted on a unix socket.
+type unixConn struct{ net.Conn }
+
+func (unixConn) LocalAddr() net.Addr {
+	return &net.UnixAddr{Name: "/run/unrustlelogs.sock", Net: "unix"}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		proxies    []string
+		remoteAddr string
+		unix       bool
+		xff        []string
+		want       string
+	}{
+		{name: "direct", remoteAddr: "203.0.113.1:1234", want: "203.0.113.1"},
+		{name: "spoofed without trusted proxies", remoteAddr: "203.0.113.1:1234", xff: []string{"1.2.3.4"}, want: "203.0.113.1"},
+		{name: "spoofed by an untrusted peer", proxies: []string{"10.0.0.0/8"}, remoteAddr: "203.0.113.1:1234", xff: []string{"10.0.0.5"}, want: "203.0.113.1"},
+		{name: "trusted proxy", proxies: []string{"10.0.0.0/8"}, remoteAddr: "10.0.0.1:1234", xff: []string{"203.0.113.7"}, want: "203.0.113.7"},
+		{name: "trusted proxy without the header", proxies: []string{"10.0.0.0/8"}, remoteAddr: "10.0.0.1:1234", want: "10.0.0.1"},
+		{name: "spoofed entry ahead of the client", proxies: []string{"10.0.0.0/8"}, remoteAddr: "10.0.0.1:1234", xff: []string{"1.2.3.4, 203.0.113.7"}, want: "203.0.113.7"},
+		{name: "spoofed trusted entry ahead of the client", proxies: []string{"10.0.0.0/8"}, remoteAddr: "10.0.0.1:1234", xff: []string{"10.9.9.9,203.0.113.7"}, want: "203.0.113.7"},
+		{name: "chain of trusted proxies", proxies: []string{"10.0.0.0/8"}, remoteAddr: "10.0.0.1:1234", xff: []string{"1.2.3.4, 203.0.113.7, 10.0.0.3, 10.0.0.2"}, want: "203.0.113.7"},
+		{name: "only trusted proxies", proxies: []string{"10.0.0.0/8"}, remoteAddr: "10.0.0.1:1234", xff: []string{"10.0.0.3, 10.0.0.2"}, want: "10.0.0.3"},
+		{name: "several headers", proxies: []string{"10.0.0.0/8"}, remoteAddr: "10.0.0.1:1234", xff: []string{"1.2.3.4", "203.0.113.7"}, want: "203.0.113.7"},
+		{name: "garbage ahead of the client", proxies: []string{"10.0.0.0/8"}, remoteAddr: "10.0.0.1:1234", xff: []string{"nonsense, 203.0.113.7"}, want: "203.0.113.7"},
+		{name: "garbage last", proxies: []string{"10.0.0.0/8"}, remoteAddr: "10.0.0.1:1234", xff: []string{"203.0.113.7, nonsense"}, want: "10.0.0.1"},
+		{name: "single trusted address", proxies: []string{"127.0.0.1"}, remoteAddr: "127.0.0.1:1234", xff: []string{"203.0.113.7"}, want: "203.0.113.7"},
+		{name: "single address isn't a network", proxies: []string{"127.0.0.1"}, remoteAddr: "127.0.0.2:1234", xff: []string{"203.0.113.7"}, want: "127.0.0.2"},
+		{name: "ipv6 proxy", proxies: []string{"::1"}, remoteAddr: "[::1]:1234", xff: []string{"2001:db8::1"}, want: "2001:db8::1"},
+		{name: "unix socket", unix: true, remoteAddr: "@", xff: []string{"203.0.113.7"}, want: "203.0.113.7"},
+		{name: "unix socket with a spoofed entry", unix: true, remoteAddr: "@", xff: []string{"1.2.3.4, 203.0.113.7"}, want: "203.0.113.7"},
+		{name: "unix socket without the header", unix: true, remoteAddr: "@", want: "@"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := newProxyRustle(t, tt.proxies...)
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, xff := range tt.xff {
+				req.Header.Add("X-Forwarded-For", xff)
+			}
+			if tt.unix {
+				req = req.WithContext(connContext(req.Context(), unixConn{}))
+			}
+			if got := ur.clientIP(req); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	ur := newProxyRustle(t)
+	ur.config.Server.SocketMode = defaultSocketMode
+	address := unixPrefix + filepath.Join(t.TempDir(), "test.sock")
+	path := strings.TrimPrefix(address, unixPrefix)
+	// a stale socket of a server that didn't stop cleanly
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := ur.listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Fatalf("socket mode %v", info.Mode().Perm())
+	}
+	srv := &http.Server{
+		Addr: address,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, ur.clientIP(r))
+		}),
+		ConnContext: connContext,
+	}
+	go srv.Serve(listener)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	req, _ := http.NewRequest(http.MethodGet, "http://unix/", nil)
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.7")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "203.0.113.7" {
+		t.Fatalf("got client %s", body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ur.shutdown(ctx, srv)
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("the socket is left after shutdown: %v", err)
+	}
+}
+
+func TestListenRefusesToRemoveFiles(t *testing.T) {
+	ur := newProxyRustle(t)
+	ur.config.Server.SocketMode = defaultSocketMode
+	path := filepath.Join(t.TempDir(), "not-a-socket")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ur.listen(unixPrefix + path); err == nil {
+		t.Fatal("listened over a file")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("the file was removed: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultMaintenanceInterval = time.Minute * 10
+	// pruneBatchSize bounds how many users are deleted per transaction
+	pruneBatchSize = 500
+)
+
+// prunedRows counts the rows the maintenance job deleted per table
+var prunedRows = expvar.NewMap("pruned_rows")
+
+// maintenance prunes rows that are no longer needed every
+// maintenance.interval until ctx is done.
+func (ur *UnRustleLogs) maintenance(ctx context.Context) {
+	ticker := time.NewTicker(ur.config.Maintenance.Interval.Duration)
+	defer ticker.Stop()
+	for {
+		ur.prune(ctx, time.Now().UTC())
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// prune deletes expired oauth states and revocations, opt-out changes past
+// maintenance.change_retention, and users undeleted for longer than
+// maintenance.inactive_user_retention if it's set. It returns the rows
+// removed per table.
+func (ur *UnRustleLogs) prune(ctx context.Context, now time.Time) map[string]int64 {
+	cfg := ur.config.Maintenance
+	db := ur.db.WithContext(ctx)
+	removed := map[string]int64{}
+	record := func(table string, n int64, err error) {
+		if err != nil && ctx.Err() == nil {
+			logrus.Errorf("failed pruning %s: %v", table, err)
+		}
+		if n > 0 {
+			removed[table] = n
+			prunedRows.Add(table, n)
+		}
+	}
+
+	// expired states are kept a while so late callbacks can still tell the
+	// user their login expired
+	res := db.Where("created_at < ?", now.Add(-ur.config.Server.StateTTL.Duration-cfg.StateRetention.Duration)).Delete(&OAuthState{})
+	record("oauth_states", res.RowsAffected, res.Error)
+
+	res = db.Where("expires_at < ?", now.Add(-cfg.RevokedTokenRetention.Duration)).Delete(&RevokedToken{})
+	record("revoked_tokens", res.RowsAffected, res.Error)
+
+	n, err := pruneChanges(db, now.Add(-cfg.ChangeRetention.Duration))
+	record("opt_out_changes", n, err)
+
+	if cfg.InactiveUserRetention.Duration > 0 {
+		n, err := pruneInactiveUsers(db, now.Add(-cfg.InactiveUserRetention.Duration))
+		record("users", n, err)
+	}
+
+	if len(removed) > 0 {
+		logrus.Infof("pruned %v", removed)
+	}
+	return removed
+}
+
+// pruneInactiveUsers deletes users deactivated before cutoff with their
+// channels, sessions and links. The audit log is kept.
+func pruneInactiveUsers(db *gorm.DB, cutoff time.Time) (int64, error) {
+	var total int64
+	for {
+		var ids []string
+		res := db.Model(&User{}).Where("active = ? and deactivated_at < ?", false, cutoff).Limit(pruneBatchSize).Pluck("id", &ids)
+		if res.Error != nil || len(ids) == 0 {
+			return total, res.Error
+		}
+		var n int64
+		txErr := db.Transaction(func(tx *gorm.DB) error {
+			// users that logged in again since are kept
+			res := tx.Where("id in ? and active = ?", ids, false).Delete(&User{})
+			if res.Error != nil {
+				return res.Error
+			}
+			n = res.RowsAffected
+			gone := tx.Model(&User{}).Select("id")
+			if err := tx.Where("user_row_id in ? and user_row_id not in (?)", ids, gone).Delete(&OptOutChannel{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("user_id in ? and user_id not in (?)", ids, gone).Delete(&Session{}).Error; err != nil {
+				return err
+			}
+			return tx.Where("(twitch_user_id in ? and twitch_user_id not in (?)) or (destinygg_user_id in ? and destinygg_user_id not in (?))", ids, gone, ids, gone).Delete(&AccountLink{}).Error
+		})
+		if txErr != nil {
+			return total, txErr
+		}
+		total += n
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	rateLimitAPI   = "api"
+	rateLimitLogin = "login"
+
+	defaultAPIRate    = 10
+	defaultAPIBurst   = 100
+	defaultLoginRate  = 0.5
+	defaultLoginBurst = 10
+	// rateLimitSweepInterval is how often full buckets are forgotten
+	rateLimitSweepInterval = time.Minute
+)
+
+// rateLimited counts the requests answered with 429 per route group
+var rateLimited = expvar.NewMap("rate_limited")
+
+// RateLimitConfig allows Burst requests at once, refilled at Rate per second
+type RateLimitConfig struct {
+	Rate  float64
+	Burst int
+}
+
+// rateLimiter keeps a token bucket per client of a route group.
+type rateLimiter struct {
+	name  string
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(name string, cfg RateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		name:    name,
+		rate:    cfg.Rate,
+		burst:   float64(cfg.Burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// take spends a token of key if there is one. It returns the tokens left
+// and how long until the bucket is full again, or until the next token if
+// none was left.
+func (l *rateLimiter) take(key string, now time.Time) (ok bool, remaining int, wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, found := l.buckets[key]
+	if !found {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, 0, l.refill(1 - b.tokens)
+	}
+	b.tokens--
+	return true, int(b.tokens), l.refill(l.burst - b.tokens)
+}
+
+func (l *rateLimiter) refill(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// sweep forgets the buckets that refilled completely, they are the same as
+// new ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitsEnabled reports whether requests are limited, unless
+// ratelimit.enabled is false they are.
+func (ur *UnRustleLogs) rateLimitsEnabled() bool {
+	return ur.config.RateLimit.Enabled == nil || *ur.config.RateLimit.Enabled
+}
+
+func (ur *UnRustleLogs) setupRateLimits() {
+	if !ur.rateLimitsEnabled() {
+		return
+	}
+	ur.rateLimiters = map[string]*rateLimiter{
+		rateLimitAPI:   newRateLimiter(rateLimitAPI, ur.config.RateLimit.API),
+		rateLimitLogin: newRateLimiter(rateLimitLogin, ur.config.RateLimit.Login),
+	}
+}
+
+// rateLimit returns a middleware limiting the requests of every client to
+// the group, set in the X-RateLimit headers. Clients are told apart by
+// their api key if they send a valid one, by their IP otherwise.
+func (ur *UnRustleLogs) rateLimit(group string) gin.HandlerFunc {
+	l, ok := ur.rateLimiters[group]
+	if !ok {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return func(c *gin.Context) {
+		ok, remaining, wait := l.take(ur.rateLimitKey(c), time.Now())
+		reset := strconv.Itoa(int(math.Ceil(wait.Seconds())))
+		c.Header("X-RateLimit-Limit", strconv.Itoa(int(l.burst)))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		c.Header("X-RateLimit-Reset", reset)
+		if !ok {
+			rateLimited.Add(l.name, 1)
+			c.Header("Retry-After", reset)
+			apiError(c, http.StatusTooManyRequests, codeRateLimited, "too many requests, retry in "+reset+"s")
+			return
+		}
+		c.Next()
+	}
+}
+
+// rateLimitKey only trusts api keys that exist, made up ones would each get
+// a fresh bucket.
+func (ur *UnRustleLogs) rateLimitKey(c *gin.Context) string {
+	if key, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		if apiKey, ok := ur.findAPIKey(strings.TrimSpace(key)); ok {
+			return "key:" + apiKey.Label
+		}
+	}
+	return "ip:" + ur.clientIP(c.Request)
+}
+
+// sweepRateLimits forgets idle clients until ctx is done.
+func (ur *UnRustleLogs) sweepRateLimits(ctx context.Context) {
+	if len(ur.rateLimiters) == 0 {
+		return
+	}
+	ticker := time.NewTicker(rateLimitSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, l := range ur.rateLimiters {
+				l.sweep(now)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	retryAttempts = 3
+	retryBaseWait = time.Millisecond * 250
+)
+
+// retryCounter counts retried provider calls per service
+var retryCounter = expvar.NewMap("provider_retries")
+
+// statusError is returned by provider calls that got a non 200 response.
+type statusError struct {
+	Service    string
+	StatusCode int
+	Body       string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s api error, status: %d, body: %s", e.Service, e.StatusCode, e.Body)
+}
+
+// isRetryable reports whether err is a network error or a 5xx response.
+func isRetryable(err error) bool {
+	switch e := err.(type) {
+	case *statusError:
+		return e.StatusCode >= 500
+	case *url.Error:
+		return true
+	case net.Error:
+		return true
+	}
+	return false
+}
+
+// withRetry runs fn up to retryAttempts times with exponential backoff and
+// jitter, retrying only transient errors. It stops waiting once ctx is done
+// and returns ctx's error then.
+func withRetry(ctx context.Context, service, op string, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < retryAttempts; attempt++ {
+		if attempt > 0 {
+			wait := retryBaseWait << uint(attempt-1)
+			wait += time.Duration(rand.Int63n(int64(wait)))
+			retryCounter.Add(service, 1)
+			logrus.Warnf("retrying %s %s in %s (attempt %d): %v", service, op, wait, attempt+1, err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+		err = fn()
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+	}
+	return err
+}
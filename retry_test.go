@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWithRetryStopsWhenTheContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	start := time.Now()
+	err := withRetry(ctx, TWITCHSERVICE, "test", func() error {
+		calls++
+		cancel()
+		return &statusError{Service: TWITCHSERVICE, StatusCode: 502}
+	})
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Fatalf("got %v after %d calls, want %v after 1", err, calls, context.Canceled)
+	}
+	if waited := time.Since(start); waited >= retryBaseWait {
+		t.Fatalf("waited %s for the retry", waited)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// revokedRefreshInterval is how often the revoked jti cache is reloaded
+const revokedRefreshInterval = time.Minute
+
+// RevokedToken is a session that was logged out before it expired
+type RevokedToken struct {
+	JTI       string `gorm:"primaryKey"`
+	ExpiresAt time.Time
+}
+
+// TableName ...
+func (RevokedToken) TableName() string {
+	return "revoked_tokens"
+}
+
+// newJTI returns a random id for a new session.
+func newJTI() string {
+	id, _ := uuid.NewRandom()
+	return id.String()
+}
+
+// RevokeToken rejects the session with jti until it expires anyway.
+func (ur *UnRustleLogs) RevokeToken(jti string, expiresAt int64) {
+	if jti == "" {
+		return
+	}
+	expires := time.Unix(expiresAt, 0).UTC()
+	// stored first so a concurrent reload can't drop it from the cache
+	if ur.db != nil {
+		err := ur.db.Where(RevokedToken{JTI: jti}).Assign(RevokedToken{ExpiresAt: expires}).FirstOrCreate(&RevokedToken{}).Error
+		if err != nil {
+			logrus.Errorf("failed storing revoked token: %v", err)
+		}
+	}
+	ur.revokedMutex.Lock()
+	ur.revoked[jti] = expires
+	ur.revokedMutex.Unlock()
+}
+
+// tokenRevoked only checks the cache, it is kept in sync with the database
+// by refreshRevokedTokens.
+func (ur *UnRustleLogs) tokenRevoked(jti string) bool {
+	if jti == "" {
+		return false
+	}
+	ur.revokedMutex.RLock()
+	_, ok := ur.revoked[jti]
+	ur.revokedMutex.RUnlock()
+	return ok
+}
+
+// loadRevokedTokens replaces the cache with the unexpired revocations, the
+// maintenance job prunes the expired ones.
+func (ur *UnRustleLogs) loadRevokedTokens() {
+	if ur.db == nil {
+		return
+	}
+	var rows []RevokedToken
+	if err := ur.db.Where("expires_at >= ?", time.Now().UTC()).Find(&rows).Error; err != nil {
+		logrus.Errorf("failed loading revoked tokens: %v", err)
+		return
+	}
+	revoked := make(map[string]time.Time, len(rows))
+	for _, row := range rows {
+		revoked[row.JTI] = row.ExpiresAt
+	}
+	ur.revokedMutex.Lock()
+	ur.revoked = revoked
+	ur.revokedMutex.Unlock()
+}
+
+// refreshRevokedTokens reloads the revoked jti cache until ctx is done, so
+// revocations by other instances are picked up.
+func (ur *UnRustleLogs) refreshRevokedTokens(ctx context.Context) {
+	ticker := time.NewTicker(revokedRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ur.loadRevokedTokens()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// secretFile is an option that can be read from the file of its _file
+// variant instead
+type secretFile struct {
+	option string
+	value  *string
+	file   string
+}
+
+// secretFiles are the options holding secrets, the ones Docker and
+// Kubernetes mount as files.
+func (cfg *Config) secretFiles() []secretFile {
+	files := []secretFile{
+		{"twitch.client_secret", &cfg.Twitch.ClientSecret, cfg.Twitch.ClientSecretFile},
+		{"destinygg.client_secret", &cfg.Destinygg.ClientSecret, cfg.Destinygg.ClientSecretFile},
+		{"discord.client_secret", &cfg.Discord.ClientSecret, cfg.Discord.ClientSecretFile},
+		{"youtube.client_secret", &cfg.YouTube.ClientSecret, cfg.YouTube.ClientSecretFile},
+		{"kick.client_secret", &cfg.Kick.ClientSecret, cfg.Kick.ClientSecretFile},
+		{"admin.client_secret", &cfg.Admin.ClientSecret, cfg.Admin.ClientSecretFile},
+		{"server.jwt_secret", &cfg.Server.JWTSecret, cfg.Server.JWTSecretFile},
+		{"server.token_key", &cfg.Server.TokenKey, cfg.Server.TokenKeyFile},
+		{"database.dsn", &cfg.Database.DSN, cfg.Database.DSNFile},
+		{"database.email_key", &cfg.Database.EmailKey, cfg.Database.EmailKeyFile},
+	}
+	for i := range cfg.Server.JWTSecrets {
+		s := &cfg.Server.JWTSecrets[i]
+		files = append(files, secretFile{fmt.Sprintf("server.jwt_secrets[%d].secret", i), &s.Secret, s.SecretFile})
+	}
+	for i := range cfg.OIDCProviders {
+		pc := &cfg.OIDCProviders[i]
+		files = append(files, secretFile{fmt.Sprintf("oidc_providers[%d].client_secret", i), &pc.ClientSecret, pc.ClientSecretFile})
+	}
+	for i := range cfg.API.Keys {
+		k := &cfg.API.Keys[i]
+		files = append(files, secretFile{fmt.Sprintf("api.keys[%d].key", i), &k.Key, k.KeyFile})
+	}
+	return files
+}
+
+// loadSecretFiles reads every set _file option into its option, without
+// the trailing newline. Setting both is a mistake, as is a file that can't
+// be read, all of them are reported as ConfigErrors.
+func (cfg *Config) loadSecretFiles() error {
+	var problems ConfigErrors
+	for _, s := range cfg.secretFiles() {
+		if s.file == "" {
+			continue
+		}
+		if *s.value != "" {
+			problems = append(problems, fmt.Sprintf("set either %s or %s_file", s.option, s.option))
+			continue
+		}
+		data, err := ioutil.ReadFile(s.file)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s_file: %v", s.option, err))
+			continue
+		}
+		*s.value = strings.TrimRight(string(data), "\r\n")
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	sessionBackendJWT      = "jwt"
+	sessionBackendDatabase = "database"
+
+	// defaultSessionIdleTimeout ends database sessions that weren't used for
+	// this long unless server.session_idle_timeout is set
+	defaultSessionIdleTimeout = time.Hour * 24 * 7
+	// sessionSweepInterval is how often dead database sessions are removed
+	sessionSweepInterval = time.Minute * 10
+	// sessionTouchInterval limits how often last_seen is written
+	sessionTouchInterval = time.Minute
+	sessionBytes         = 32
+)
+
+var (
+	// sessions that ended normally are not worth logging
+	errSessionExpired = errors.New("session expired")
+	errSessionRevoked = errors.New("session revoked")
+	errSessionUnknown = errors.New("unknown session")
+)
+
+// SessionManager stores the logins of users, the value it returns is what
+// ends up in the provider cookie.
+type SessionManager interface {
+	Create(claims *jwtClaims) (string, error)
+	Get(value string) (*jwtClaims, error)
+	// Destroy ends the session so the value can't be used anymore
+	Destroy(value string, claims *jwtClaims)
+}
+
+func (ur *UnRustleLogs) setupSessions() error {
+	switch strings.ToLower(ur.config.Server.SessionBackend) {
+	case "", sessionBackendJWT:
+		ur.sessions = &jwtSessions{ur}
+	case sessionBackendDatabase:
+		if ur.db == nil {
+			return errors.New("session_backend = \"database\" requires the database")
+		}
+		ur.sessions = &dbSessions{ur}
+	default:
+		return fmt.Errorf("unsupported server.session_backend %q, use jwt or database", ur.config.Server.SessionBackend)
+	}
+	return nil
+}
+
+// sessionHalfSpent reports whether more than half of the lifetime of the
+// session is over. Sessions from before iat was set and ones that already
+// expire at server.session_absolute_max are never renewed.
+func (ur *UnRustleLogs) sessionHalfSpent(claims *jwtClaims) bool {
+	if claims.IssuedAt == 0 || claims.AuthTime == 0 {
+		return false
+	}
+	limit := time.Unix(claims.AuthTime, 0).Add(ur.config.Server.SessionAbsoluteMax.Duration)
+	if claims.ExpiresAt >= limit.Unix() {
+		return false
+	}
+	lifetime := claims.ExpiresAt - claims.IssuedAt
+	return ur.now().Unix()-claims.IssuedAt > lifetime/2
+}
+
+// jwtSessions keeps the claims in the cookie as a signed JWT.
+type jwtSessions struct {
+	ur *UnRustleLogs
+}
+
+// Create ...
+func (s *jwtSessions) Create(claims *jwtClaims) (string, error) {
+	return s.ur.signJWT(claims)
+}
+
+// Get ...
+func (s *jwtSessions) Get(value string) (*jwtClaims, error) {
+	claims, err := s.ur.parseClaims(value)
+	if tokenExpired(err) {
+		return nil, errSessionExpired
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.ur.tokenRevoked(claims.Id) {
+		return nil, errSessionRevoked
+	}
+	return claims, nil
+}
+
+// Destroy ...
+func (s *jwtSessions) Destroy(value string, claims *jwtClaims) {
+	s.ur.RevokeToken(claims.Id, claims.ExpiresAt)
+}
+
+// Session is a login of the database session backend, the cookie only holds
+// the random id whose hash is stored here.
+type Session struct {
+	ID            string `gorm:"primaryKey"`
+	UserID        string `gorm:"index"`
+	Audience      string
+	EmailVerified bool
+	Remember      bool
+	AuthTime      time.Time
+	CreatedAt     time.Time
+	LastSeen      time.Time
+	ExpiresAt     time.Time `gorm:"index"`
+}
+
+// TableName ...
+func (Session) TableName() string {
+	return "sessions"
+}
+
+// dbSessions keeps the claims in the sessions table.
+type dbSessions struct {
+	ur *UnRustleLogs
+}
+
+// hashSessionID keeps a leaked database from containing usable cookies.
+func hashSessionID(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create ...
+func (s *dbSessions) Create(claims *jwtClaims) (string, error) {
+	value, err := generateSecureToken(sessionBytes)
+	if err != nil {
+		return "", err
+	}
+	now := s.ur.now().UTC()
+	err = s.ur.db.Create(&Session{
+		ID:            hashSessionID(value),
+		UserID:        claims.ID,
+		Audience:      claims.Audience,
+		EmailVerified: claims.EmailVerified,
+		Remember:      claims.Remember,
+		AuthTime:      time.Unix(claims.AuthTime, 0).UTC(),
+		CreatedAt:     now,
+		LastSeen:      now,
+		ExpiresAt:     time.Unix(claims.ExpiresAt, 0).UTC(),
+	}).Error
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// Get ...
+func (s *dbSessions) Get(value string) (*jwtClaims, error) {
+	var session Session
+	if err := s.ur.db.Where("id = ?", hashSessionID(value)).First(&session).Error; err != nil {
+		return nil, errSessionUnknown
+	}
+	now := s.ur.now().UTC()
+	if now.After(session.ExpiresAt) || now.Sub(session.LastSeen) > s.ur.config.Server.SessionIdleTimeout.Duration {
+		s.ur.db.Delete(&session)
+		return nil, errSessionExpired
+	}
+	if now.Sub(session.LastSeen) > sessionTouchInterval {
+		s.ur.db.Model(&session).Update("last_seen", now)
+	}
+	claims := &jwtClaims{
+		ID:            session.UserID,
+		EmailVerified: session.EmailVerified,
+		Remember:      session.Remember,
+		AuthTime:      session.AuthTime.Unix(),
+	}
+	claims.Id = session.ID
+	claims.Audience = session.Audience
+	claims.IssuedAt = session.CreatedAt.Unix()
+	claims.ExpiresAt = session.ExpiresAt.Unix()
+	return claims, nil
+}
+
+// Destroy ...
+func (s *dbSessions) Destroy(value string, claims *jwtClaims) {
+	if err := s.ur.db.Where("id = ?", hashSessionID(value)).Delete(&Session{}).Error; err != nil {
+		logrus.Errorf("failed deleting session: %v", err)
+	}
+}
+
+// sweepSessions removes expired and idle database sessions until ctx is
+// done.
+func (ur *UnRustleLogs) sweepSessions(ctx context.Context) {
+	if _, ok := ur.sessions.(*dbSessions); !ok {
+		return
+	}
+	ticker := time.NewTicker(sessionSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now().UTC()
+			res := ur.db.Where("expires_at < ? or last_seen < ?", now, now.Add(-ur.config.Server.SessionIdleTimeout.Duration)).Delete(&Session{})
+			if res.Error != nil {
+				logrus.Errorf("failed sweeping sessions: %v", res.Error)
+			} else if res.RowsAffected > 0 {
+				logrus.Infof("deleted %d expired sessions", res.RowsAffected)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
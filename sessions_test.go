@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// stubLogin runs the callback of a stub twitch login of foo with the
+// remember me choice and returns the session cookie it set.
+func stubLogin(t *testing.T, ur *UnRustleLogs, remember bool) *http.Cookie {
+	t.Helper()
+	p := &stubProvider{
+		Provider: testProvider(t, ur, TWITCHSERVICE),
+		ident:    &Identity{UserID: "foo-id", Name: "foo"},
+	}
+	router := gin.New()
+	router.GET("/twitch/callback", ur.callbackHandler(p))
+	if err := ur.putState(TWITCHSERVICE, "192.0.2.1", "state", "verifier", "/", remember, ""); err != nil {
+		t.Fatal(err)
+	}
+	return findCookie(t, testRequest(router, http.MethodGet, "/twitch/callback?state=state&code=code", nil), "twitch")
+}
+
+// sessionClaims are the claims of the session in cookie.
+func sessionClaims(t *testing.T, ur *UnRustleLogs, cookie *http.Cookie) *jwtClaims {
+	t.Helper()
+	claims, err := ur.sessions.Get(claimsValue(t, cookie))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func TestRememberMe(t *testing.T) {
+	tests := []struct {
+		name     string
+		remember bool
+		ttl      time.Duration
+		maxAge   int
+	}{
+		{name: "session cookie", ttl: defaultSessionTTL},
+		{name: "remembered", remember: true, ttl: defaultJWTTTL, maxAge: int(defaultJWTTTL.Seconds())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := newStateRustle(t)
+			cookie := stubLogin(t, ur, tt.remember)
+			if cookie.MaxAge != tt.maxAge {
+				t.Fatalf("max age %d, want %d", cookie.MaxAge, tt.maxAge)
+			}
+			claims := sessionClaims(t, ur, cookie)
+			if claims.Remember != tt.remember {
+				t.Fatalf("remember claim %v, want %v", claims.Remember, tt.remember)
+			}
+			if got := time.Duration(claims.ExpiresAt-claims.IssuedAt) * time.Second; got != tt.ttl {
+				t.Fatalf("lifetime %s, want %s", got, tt.ttl)
+			}
+
+			w := testRequest(newTestRouter(t, ur), http.MethodGet, "/twitch/logout", nil, cookie)
+			if deleted := findCookie(t, w, "twitch"); deleted.MaxAge >= 0 || deleted.Path != cookie.Path {
+				t.Fatalf("logout set %s", deleted)
+			}
+			if _, err := ur.sessions.Get(claimsValue(t, cookie)); err != errSessionRevoked {
+				t.Fatalf("session after logout: %v, want %v", err, errSessionRevoked)
+			}
+		})
+	}
+}
+
+// claimsValue is the session value in cookie.
+func claimsValue(t *testing.T, cookie *http.Cookie) string {
+	t.Helper()
+	value, err := url.QueryUnescape(cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestSlidingRenewal(t *testing.T) {
+	tests := []struct {
+		name    string
+		sliding bool
+		// age is how long ago the session was issued
+		age         time.Duration
+		absoluteMax time.Duration
+		renewed     bool
+	}{
+		{name: "fresh", sliding: true, age: time.Hour, absoluteMax: defaultSessionAbsoluteMax},
+		{name: "half spent", sliding: true, age: 7 * time.Hour, absoluteMax: defaultSessionAbsoluteMax, renewed: true},
+		{name: "sliding disabled", age: 7 * time.Hour, absoluteMax: defaultSessionAbsoluteMax},
+		{name: "at the absolute max", sliding: true, age: 7 * time.Hour, absoluteMax: 12 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := newTestRustle(t)
+			ur.config.Server.SessionSliding = tt.sliding
+			ur.config.Server.SessionAbsoluteMax.Duration = tt.absoluteMax
+			id := addTestUser(t, ur, TWITCHSERVICE, "foo")
+			issued := time.Now().Add(-tt.age)
+			ur.now = func() time.Time { return issued }
+			cookie := sessionCookie(t, ur, testProvider(t, ur, TWITCHSERVICE), id)
+			ur.now = time.Now
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+			c.Request.AddCookie(cookie)
+			user, claims, ok := ur.getSession(c, "twitch")
+			if !ok || user.ID != id {
+				t.Fatal("the session isn't valid")
+			}
+			renewed := len(w.Result().Cookies()) > 0
+			if renewed != tt.renewed {
+				t.Fatalf("renewed %v, want %v", renewed, tt.renewed)
+			}
+			if !renewed {
+				return
+			}
+			fresh := sessionClaims(t, ur, findCookie(t, w, "twitch"))
+			if fresh.IssuedAt <= issued.Unix() || fresh.ExpiresAt <= claims.IssuedAt || fresh.AuthTime != issued.Unix() {
+				t.Fatalf("renewed session issued %d expires %d after a login at %d", fresh.IssuedAt, fresh.ExpiresAt, fresh.AuthTime)
+			}
+			if _, err := ur.sessions.Get(claimsValue(t, cookie)); err != errSessionRevoked {
+				t.Fatalf("replaced session: %v, want %v", err, errSessionRevoked)
+			}
+		})
+	}
+}
+
+func TestSlidingRenewalStopsAtTheAbsoluteMax(t *testing.T) {
+	ur := newTestRustle(t)
+	ur.config.Server.SessionSliding = true
+	ur.config.Server.SessionAbsoluteMax.Duration = 20 * time.Hour
+	login := time.Now().Add(-10 * time.Hour)
+	ur.now = func() time.Time { return login }
+	claims := &jwtClaims{ID: "id"}
+	claims.Audience = TWITCHSERVICE
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	if err := ur.setSessionCookie(c, "twitch", claims); err != nil {
+		t.Fatal(err)
+	}
+	ur.now = time.Now
+	renewed, err := ur.renewSession(c, "twitch", claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit := login.Add(20 * time.Hour).Unix(); renewed.ExpiresAt != limit {
+		t.Fatalf("renewed session expires at %d, want the absolute max %d", renewed.ExpiresAt, limit)
+	}
+	if ur.sessionHalfSpent(renewed) {
+		t.Fatal("a session at the absolute max would be renewed again")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// settingJWTLegacySince is when sessions started getting iss and aud, only
+// set on databases that had users before
+const settingJWTLegacySince = "jwt_legacy_since"
+
+// Setting is a value the server keeps across restarts
+type Setting struct {
+	Name  string `gorm:"primaryKey"`
+	Value string
+}
+
+// TableName ...
+func (Setting) TableName() string {
+	return "settings"
+}
+
+// setting returns the value of the setting, ok is false if it isn't set.
+func (ur *UnRustleLogs) setting(name string) (value string, ok bool, err error) {
+	var s Setting
+	err = ur.db.Where("name = ?", name).First(&s).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", false, nil
+	}
+	return s.Value, err == nil, err
+}
+
+// markLegacySessions records now as the start of the legacy session grace
+// if the database has users, whose sessions may predate iss and aud. New
+// databases have no such sessions.
+func markLegacySessions(tx *gorm.DB) error {
+	var users int64
+	if err := tx.Model(&User{}).Count(&users).Error; err != nil {
+		return err
+	}
+	if users == 0 {
+		return nil
+	}
+	return tx.Create(&Setting{Name: settingJWTLegacySince, Value: time.Now().UTC().Format(time.RFC3339)}).Error
+}
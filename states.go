@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultStateTTL is how long a pending OAuth login stays valid unless
+	// server.state_ttl is set
+	defaultStateTTL = time.Minute * 5
+	minStateTTL     = time.Minute
+	maxStateTTL     = time.Hour
+	// stateSweepInterval is how often expired states are removed
+	stateSweepInterval = time.Second * 30
+	// stateBytes is the entropy of a state, 43 characters once encoded
+	stateBytes = 32
+	// verifierBytes is the entropy of a PKCE verifier, 64 characters once
+	// encoded which is within the allowed 43 to 128
+	verifierBytes = 48
+
+	defaultMaxPendingStatesPerIP = 10
+	defaultMaxPendingStates      = 10000
+)
+
+var (
+	errTooManyStates = errors.New("too many pending logins")
+	errStateUnknown  = errors.New("unknown oauth state")
+	errStateExpired  = errors.New("expired oauth state")
+)
+
+// OAuthState is a pending OAuth login persisted so restarts don't break it
+type OAuthState struct {
+	State     string `gorm:"primaryKey"`
+	Verifier  string
+	Service   string
+	ClientIP  string `gorm:"index"`
+	Redirect  string
+	Remember  bool
+	Duration  string
+	CreatedAt time.Time
+}
+
+// TableName ...
+func (OAuthState) TableName() string {
+	return "oauth_states"
+}
+
+func (s *state) expired(ttl time.Duration) bool {
+	return time.Since(s.time) > ttl
+}
+
+// stateErrorCode maps a consumeState error to a loginErrorMessages code.
+func stateErrorCode(err error) string {
+	if err == errStateExpired {
+		return "login_expired"
+	}
+	return "invalid_state"
+}
+
+// codeChallengeS256 derives the S256 PKCE challenge for a verifier.
+func codeChallengeS256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// pendingLogins are the unfinished logins started since the server did, per
+// client IP and state, wherever their states are stored.
+type pendingLogins struct {
+	mu    sync.Mutex
+	byIP  map[string]map[string]time.Time
+	total int
+}
+
+// add counts the login of state s unless ip already has perIP or the server
+// max unfinished logins, expired ones don't count.
+func (p *pendingLogins) add(ip, s string, now time.Time, ttl time.Duration, perIP, max int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.byIP == nil {
+		p.byIP = make(map[string]map[string]time.Time)
+	}
+	if p.total >= max {
+		p.removeExpired(now, ttl)
+	}
+	logins := p.byIP[ip]
+	for k, started := range logins {
+		if now.Sub(started) > ttl {
+			delete(logins, k)
+			p.total--
+		}
+	}
+	if len(logins) >= perIP || p.total >= max {
+		return false
+	}
+	if logins == nil {
+		logins = make(map[string]time.Time)
+		p.byIP[ip] = logins
+	}
+	logins[s] = now
+	p.total++
+	return true
+}
+
+// remove stops counting the login of state s once it's consumed.
+func (p *pendingLogins) remove(ip, s string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.byIP[ip][s]; !ok {
+		return
+	}
+	delete(p.byIP[ip], s)
+	p.total--
+	if len(p.byIP[ip]) == 0 {
+		delete(p.byIP, ip)
+	}
+}
+
+// removeExpired stops counting the logins older than ttl. The caller must
+// hold mu.
+func (p *pendingLogins) removeExpired(now time.Time, ttl time.Duration) {
+	for ip, logins := range p.byIP {
+		for s, started := range logins {
+			if now.Sub(started) > ttl {
+				delete(logins, s)
+				p.total--
+			}
+		}
+		if len(logins) == 0 {
+			delete(p.byIP, ip)
+		}
+	}
+}
+
+// putState stores a pending login in the database, or in memory if the
+// database is unavailable. It fails with errTooManyStates once ip or the
+// server has too many unfinished logins.
+func (ur *UnRustleLogs) putState(service, ip, s, verifier, redirect string, remember bool, duration string) error {
+	now := time.Now().UTC()
+	if !ur.pendingLogins.add(ip, s, now, ur.config.Server.StateTTL.Duration, ur.config.Server.MaxPendingStatesPerIP, ur.config.Server.MaxPendingStates) {
+		return errTooManyStates
+	}
+	if ur.db != nil {
+		err := ur.db.Create(&OAuthState{
+			State:     s,
+			Verifier:  verifier,
+			Service:   service,
+			ClientIP:  ip,
+			Redirect:  redirect,
+			Remember:  remember,
+			Duration:  duration,
+			CreatedAt: now,
+		}).Error
+		if err == nil {
+			return nil
+		}
+		logrus.Errorf("failed persisting %s state, keeping it in memory: %v", service, err)
+	}
+	ur.stateMutex.Lock()
+	defer ur.stateMutex.Unlock()
+	ur.states[s] = &state{
+		verifier: verifier,
+		service:  service,
+		ip:       ip,
+		redirect: redirect,
+		remember: remember,
+		duration: duration,
+		time:     now,
+	}
+	return nil
+}
+
+// consumeState looks up and removes a pending login of service so it can
+// only be used once. Expired states fail with errStateExpired even if the
+// sweep hasn't removed them yet.
+func (ur *UnRustleLogs) consumeState(service, s string) (*state, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, errStateUnknown
+	}
+	ur.stateMutex.Lock()
+	st, ok := ur.states[s]
+	if ok && st.service == service {
+		delete(ur.states, s)
+		ur.pendingLogins.remove(st.ip, s)
+	}
+	ur.stateMutex.Unlock()
+	if !ok && ur.db != nil {
+		var row OAuthState
+		err := ur.db.Where("state = ? and service = ?", s, service).First(&row).Error
+		if err != nil {
+			return nil, errStateUnknown
+		}
+		// only whoever actually deletes the row gets to use it
+		res := ur.db.Where("state = ? and service = ?", s, service).Delete(&OAuthState{})
+		if res.Error != nil || res.RowsAffected != 1 {
+			return nil, errStateUnknown
+		}
+		ur.pendingLogins.remove(row.ClientIP, s)
+		st, ok = &state{
+			verifier: row.Verifier,
+			service:  row.Service,
+			ip:       row.ClientIP,
+			redirect: row.Redirect,
+			remember: row.Remember,
+			duration: row.Duration,
+			time:     row.CreatedAt,
+		}, true
+	}
+	if !ok || st.service != service {
+		return nil, errStateUnknown
+	}
+	if st.expired(ur.config.Server.StateTTL.Duration) {
+		return nil, errStateExpired
+	}
+	return st, nil
+}
+
+// sweepStates periodically removes expired states from memory until ctx is
+// done, the maintenance job prunes the database.
+func (ur *UnRustleLogs) sweepStates(ctx context.Context) {
+	ticker := time.NewTicker(stateSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ur.removeExpiredStates()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// removeExpiredStates drops in-memory states once they are expired for
+// another TTL, until then callbacks can still tell the user their login
+// expired.
+func (ur *UnRustleLogs) removeExpiredStates() {
+	keep := ur.config.Server.StateTTL.Duration * 2
+	ur.pendingLogins.mu.Lock()
+	ur.pendingLogins.removeExpired(time.Now().UTC(), ur.config.Server.StateTTL.Duration)
+	ur.pendingLogins.mu.Unlock()
+	ur.stateMutex.Lock()
+	for k, s := range ur.states {
+		if s.expired(keep) {
+			delete(ur.states, k)
+		}
+	}
+	ur.stateMutex.Unlock()
+}
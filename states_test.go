@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newMemoryStateRustle is newStateRustle without a database, its states are
+// kept in memory.
+func newMemoryStateRustle(t *testing.T) *UnRustleLogs {
+	t.Helper()
+	ur := NewUnRustleLogs(context.Background())
+	ur.config = newStateRustle(t).config
+	return ur
+}
+
+// stateStores are the places putState keeps pending logins in
+var stateStores = []struct {
+	name string
+	new  func(t *testing.T) *UnRustleLogs
+}{
+	{name: "database", new: newStateRustle},
+	{name: "memory", new: newMemoryStateRustle},
+}
+
+// newStateRustle is newTestRustle with the default limits of pending logins.
+func newStateRustle(t *testing.T) *UnRustleLogs {
+	t.Helper()
+	ur := newTestRustle(t)
+	ur.config.Server.MaxPendingStatesPerIP = defaultMaxPendingStatesPerIP
+	ur.config.Server.MaxPendingStates = defaultMaxPendingStates
+	return ur
+}
+
+func TestConsumeStateChecksService(t *testing.T) {
+	for _, store := range stateStores {
+		t.Run(store.name, func(t *testing.T) {
+			ur := store.new(t)
+			if err := ur.putState(DESTINYGGSERVICE, "127.0.0.1", "state", "verifier", "/", false, ""); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ur.consumeState(TWITCHSERVICE, "state"); err != errStateUnknown {
+				t.Fatalf("twitch consumed a dgg state: %v", err)
+			}
+			st, err := ur.consumeState(DESTINYGGSERVICE, "state")
+			if err != nil {
+				t.Fatalf("the twitch attempt removed the dgg state: %v", err)
+			}
+			if st.service != DESTINYGGSERVICE || st.verifier != "verifier" {
+				t.Fatalf("got %s state with verifier %q", st.service, st.verifier)
+			}
+		})
+	}
+}
+
+// backdateState moves the creation of a pending login age into the past.
+func backdateState(t *testing.T, ur *UnRustleLogs, s string, age time.Duration) {
+	t.Helper()
+	created := time.Now().UTC().Add(-age)
+	for _, logins := range ur.pendingLogins.byIP {
+		if _, ok := logins[s]; ok {
+			logins[s] = created
+		}
+	}
+	if st, ok := ur.states[s]; ok {
+		st.time = created
+		return
+	}
+	if err := ur.db.Model(&OAuthState{}).Where("state = ?", s).Update("created_at", created).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsumeStateExpiredBeforeSweep(t *testing.T) {
+	for _, store := range stateStores {
+		t.Run(store.name, func(t *testing.T) {
+			ur := store.new(t)
+			if err := ur.putState(TWITCHSERVICE, "127.0.0.1", "state", "verifier", "/", false, ""); err != nil {
+				t.Fatal(err)
+			}
+			backdateState(t, ur, "state", ur.config.Server.StateTTL.Duration+time.Minute)
+			if _, err := ur.consumeState(TWITCHSERVICE, "state"); err != errStateExpired {
+				t.Fatalf("got %v, want %v", err, errStateExpired)
+			}
+		})
+	}
+}
+
+func TestPutStateLimits(t *testing.T) {
+	for _, store := range stateStores {
+		t.Run(store.name, func(t *testing.T) {
+			ur := store.new(t)
+			ur.config.Server.MaxPendingStatesPerIP = 2
+			ur.config.Server.MaxPendingStates = 3
+			put := func(ip, s string) error {
+				return ur.putState(TWITCHSERVICE, ip, s, "verifier", "/", false, "")
+			}
+			for _, s := range []string{"a1", "a2"} {
+				if err := put("10.0.0.1", s); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := put("10.0.0.1", "a3"); err != errTooManyStates {
+				t.Fatalf("third login of the ip got %v", err)
+			}
+			if err := put("10.0.0.2", "b1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := put("10.0.0.3", "c1"); err != errTooManyStates {
+				t.Fatalf("login over the server limit got %v", err)
+			}
+			if _, err := ur.consumeState(TWITCHSERVICE, "a1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := put("10.0.0.1", "a3"); err != nil {
+				t.Fatalf("the consumed login still counts: %v", err)
+			}
+			backdateState(t, ur, "a2", ur.config.Server.StateTTL.Duration+time.Minute)
+			if err := put("10.0.0.1", "a4"); err != nil {
+				t.Fatalf("the expired login still counts: %v", err)
+			}
+		})
+	}
+}
+
+func TestPutStateLimitsConcurrently(t *testing.T) {
+	ur := newMemoryStateRustle(t)
+	var wg sync.WaitGroup
+	var started int64
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if ur.putState(TWITCHSERVICE, "10.0.0.1", fmt.Sprint("state", i), "verifier", "/", false, "") == nil {
+				atomic.AddInt64(&started, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if started != defaultMaxPendingStatesPerIP {
+		t.Fatalf("%d logins started, want %d", started, defaultMaxPendingStatesPerIP)
+	}
+}
+
+func TestRemoveExpiredStates(t *testing.T) {
+	ur := newMemoryStateRustle(t)
+	ttl := ur.config.Server.StateTTL.Duration
+	for s, age := range map[string]time.Duration{"fresh": 0, "expired": ttl + time.Minute, "old": 2*ttl + time.Minute} {
+		if err := ur.putState(TWITCHSERVICE, "127.0.0.1", s, "verifier", "/", false, ""); err != nil {
+			t.Fatal(err)
+		}
+		backdateState(t, ur, s, age)
+	}
+	ur.removeExpiredStates()
+	// expired states are kept for a while to tell users their login expired
+	for s, want := range map[string]bool{"fresh": true, "expired": true, "old": false} {
+		if _, ok := ur.states[s]; ok != want {
+			t.Errorf("%s state kept: %v, want %v", s, ok, want)
+		}
+	}
+}
+
+func TestSweepStatesStops(t *testing.T) {
+	ur := newMemoryStateRustle(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ur.sweepStates(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sweepStates kept running after ctx was done")
+	}
+}
+
+func TestConsumeStateUnknown(t *testing.T) {
+	for _, store := range stateStores {
+		t.Run(store.name, func(t *testing.T) {
+			ur := store.new(t)
+			if err := ur.putState(DESTINYGGSERVICE, "127.0.0.1", "state", "verifier", "/", false, ""); err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range []string{"", " ", "missing", "State"} {
+				st, err := ur.consumeState(DESTINYGGSERVICE, s)
+				if err != errStateUnknown || st != nil {
+					t.Fatalf("state %q: got %v and %v, want %v", s, st, err, errStateUnknown)
+				}
+			}
+		})
+	}
+}
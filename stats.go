@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// statsRefreshInterval is how often the opt-out counts of /stats are
+// recounted
+const statsRefreshInterval = time.Minute
+
+// optOutStats caches the number of active opt-outs per service.
+type optOutStats struct {
+	mu        sync.RWMutex
+	active    map[string]int64
+	updatedAt time.Time
+}
+
+// ServiceStats ...
+type ServiceStats struct {
+	Active int64 `json:"active"`
+}
+
+// snapshot returns a copy of the counts and when they were taken, a zero
+// time if they weren't yet.
+func (s *optOutStats) snapshot() (map[string]int64, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	active := make(map[string]int64, len(s.active))
+	for service, n := range s.active {
+		active[service] = n
+	}
+	return active, s.updatedAt
+}
+
+// countOptOuts counts the active, unexpired opt-outs per service.
+func (ur *UnRustleLogs) countOptOuts() error {
+	var rows []struct {
+		Service string
+		Count   int64
+	}
+	now := time.Now().UTC()
+	q := unexpired(ur.db.Model(&User{}).Where("active = ?", true), now)
+	if err := q.Select("service, count(*) as count").Group("service").Scan(&rows).Error; err != nil {
+		return err
+	}
+	active := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		active[row.Service] = row.Count
+	}
+	ur.stats.mu.Lock()
+	ur.stats.active = active
+	ur.stats.updatedAt = now
+	ur.stats.mu.Unlock()
+	return nil
+}
+
+// refreshStats recounts the opt-outs every statsRefreshInterval until ctx is
+// done.
+func (ur *UnRustleLogs) refreshStats(ctx context.Context) {
+	ticker := time.NewTicker(statsRefreshInterval)
+	defer ticker.Stop()
+	for {
+		if err := ur.countOptOuts(); err != nil {
+			logrus.Errorf("failed counting opt-outs: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// statsHandler reports the active opt-outs of every provider as of
+// updated_at, which is null until they were counted once.
+func (ur *UnRustleLogs) statsHandler(c *gin.Context) {
+	active, updatedAt := ur.stats.snapshot()
+	res := gin.H{"updated_at": nil}
+	if !updatedAt.IsZero() {
+		res["updated_at"] = updatedAt
+	}
+	for _, p := range ur.providers {
+		res[p.Service()] = ServiceStats{Active: active[p.Service()]}
+	}
+	c.Header("Cache-Control", "public, max-age=60")
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	defaultACMECacheDir    = "/data/autocert"
+	defaultACMEHTTPAddress = ":80"
+)
+
+// TLSConfig serves https with either CertFile and KeyFile or certificates
+// for Hostnames from Let's Encrypt if ACME is set
+type TLSConfig struct {
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	ACME     bool
+	// Hostnames are the only names certificates are requested for
+	Hostnames []string
+	// Email is told about problems with the certificates by Let's Encrypt
+	Email string
+	// CacheDir keeps the certificates across restarts
+	CacheDir string `toml:"cache_dir"`
+	// HTTPAddress answers the HTTP-01 challenges and redirects everything
+	// else to https
+	HTTPAddress string `toml:"http_address"`
+}
+
+// setupTLS checks server.tls, loading the certificate right away so a
+// broken one fails on startup instead of on the first handshake.
+func (ur *UnRustleLogs) setupTLS() error {
+	cfg := ur.config.Server.TLS
+	static := cfg.CertFile != "" || cfg.KeyFile != ""
+	switch {
+	case static && cfg.ACME:
+		return errors.New("server.tls: use either cert_file and key_file or acme")
+	case static:
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return errors.New("server.tls needs both cert_file and key_file")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed loading server.tls certificate: %v", err)
+		}
+		ur.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	case cfg.ACME:
+		if len(cfg.Hostnames) == 0 {
+			return errors.New("server.tls.acme needs the hostnames to request certificates for")
+		}
+		ur.acme = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.Hostnames...),
+			Cache:      autocert.DirCache(cfg.CacheDir),
+			Email:      cfg.Email,
+		}
+		ur.tlsConfig = ur.acme.TLSConfig()
+		ur.tlsConfig.MinVersion = tls.VersionTLS12
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tokenRefreshMargin is how close to expiry a token may get before
+// GetValidToken refreshes it.
+const tokenRefreshMargin = time.Minute * 5
+
+// Token ...
+type Token struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Service      string `gorm:"uniqueIndex:idx_token_service_user"`
+	UserID       string `gorm:"uniqueIndex:idx_token_service_user"`
+	AccessToken  string
+	RefreshToken string
+	Expiry       time.Time
+}
+
+var errTokenStoreDisabled = errors.New("token store is disabled, no token_key configured")
+
+func (ur *UnRustleLogs) setupTokenStore() error {
+	if ur.config.Server.TokenKey == "" {
+		logrus.Warn("no token_key configured, provider tokens will not be persisted")
+		return nil
+	}
+	aead, err := newAEAD(ur.config.Server.TokenKey)
+	if err != nil {
+		return err
+	}
+	ur.tokenAEAD = aead
+	return nil
+}
+
+// SaveToken encrypts and stores the provider tokens for a user.
+func (ur *UnRustleLogs) SaveToken(service, userID, accessToken, refreshToken string, expiresIn int) error {
+	if ur.tokenAEAD == nil {
+		return errTokenStoreDisabled
+	}
+	access, err := encryptString(ur.tokenAEAD, accessToken)
+	if err != nil {
+		return err
+	}
+	refresh, err := encryptString(ur.tokenAEAD, refreshToken)
+	if err != nil {
+		return err
+	}
+	var t Token
+	ur.db.Where(Token{Service: service, UserID: userID}).FirstOrInit(&t)
+	t.AccessToken = access
+	t.RefreshToken = refresh
+	t.Expiry = time.Now().UTC().Add(time.Duration(expiresIn) * time.Second)
+	return ur.db.Save(&t).Error
+}
+
+func (ur *UnRustleLogs) getToken(service, userID string) (*Token, error) {
+	if ur.tokenAEAD == nil {
+		return nil, errTokenStoreDisabled
+	}
+	var t Token
+	err := ur.db.Where("service = ? and user_id = ?", service, userID).First(&t).Error
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// RefreshToken performs the refresh-grant for the stored token of a user.
+func (ur *UnRustleLogs) RefreshToken(service, userID string) error {
+	t, err := ur.getToken(service, userID)
+	if err != nil {
+		return err
+	}
+	refreshToken, err := decryptString(ur.tokenAEAD, t.RefreshToken)
+	if err != nil {
+		return err
+	}
+	if refreshToken == "" {
+		return fmt.Errorf("no refresh token stored for %s user %s", service, userID)
+	}
+
+	switch service {
+	case TWITCHSERVICE:
+		resp, err := twitchClient.RefreshUserAccessToken(refreshToken)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != 200 {
+			return fmt.Errorf("error refreshing twitch token, status: %d, message: %s", resp.StatusCode, resp.ErrorMessage)
+		}
+		return ur.SaveToken(service, userID, resp.Data.AccessToken, resp.Data.RefreshToken, resp.Data.ExpiresIn)
+	case DESTINYGGSERVICE:
+		resp, err := destinggClient.RenewAccessToken(refreshToken)
+		if err != nil {
+			return err
+		}
+		return ur.SaveToken(service, userID, resp.AccessToken, resp.RefreshToken, resp.ExpiresIn)
+	}
+	return fmt.Errorf("refreshing tokens is not supported for %s", service)
+}
+
+// GetValidToken returns a decrypted access token for a user, refreshing it
+// first if it is expired or about to expire.
+func (ur *UnRustleLogs) GetValidToken(service, userID string) (string, error) {
+	t, err := ur.getToken(service, userID)
+	if err != nil {
+		return "", err
+	}
+	if time.Now().UTC().Add(tokenRefreshMargin).After(t.Expiry) {
+		err = ur.RefreshToken(service, userID)
+		if err != nil {
+			return "", err
+		}
+		t, err = ur.getToken(service, userID)
+		if err != nil {
+			return "", err
+		}
+	}
+	return decryptString(ur.tokenAEAD, t.AccessToken)
+}
+
+// DeleteToken removes the stored tokens of a user.
+func (ur *UnRustleLogs) DeleteToken(service, userID string) {
+	ur.db.Where("service = ? and user_id = ?", service, userID).Delete(&Token{})
+}
+
+// storedAccessToken returns the decrypted access token without refreshing it.
+func (ur *UnRustleLogs) storedAccessToken(service, userID string) (string, error) {
+	t, err := ur.getToken(service, userID)
+	if err != nil {
+		return "", err
+	}
+	return decryptString(ur.tokenAEAD, t.AccessToken)
+}
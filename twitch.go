@@ -1,18 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
-	"github.com/dchest/uniuri"
 	"github.com/sirupsen/logrus"
 
-	"github.com/gin-gonic/gin"
-
-	"github.com/dgrijalva/jwt-go"
 	"github.com/nicklaw5/helix"
 )
 
@@ -39,16 +38,22 @@ type oauthResponse struct {
 	Scope        []string `json:"scope"`
 }
 
-var twitchHTTPClient = http.Client{}
-
 var twitchClient *helix.Client
 
+// defaultTwitchScopes are requested when no scopes are configured,
+// user_read is needed to get the email of the user
+var defaultTwitchScopes = []string{"user_read"}
+
 func (ur *UnRustleLogs) setupTwitchClient() error {
+	if len(ur.config.Twitch.Scopes) == 0 {
+		ur.config.Twitch.Scopes = defaultTwitchScopes
+	}
 	client, err := helix.NewClient(&helix.Options{
 		ClientID:     ur.config.Twitch.ClientID,
 		ClientSecret: ur.config.Twitch.ClientSecret,
 		RedirectURI:  ur.config.Twitch.RedirectURL,
 		Scopes:       ur.config.Twitch.Scopes,
+		HTTPClient:   ur.httpClient,
 	})
 	if err != nil {
 		logrus.Error(err)
@@ -58,9 +63,9 @@ func (ur *UnRustleLogs) setupTwitchClient() error {
 	return nil
 }
 
-func (ur *UnRustleLogs) getUserByOAuthToken(accessToken string) (*TwitchUser, error) {
+func (ur *UnRustleLogs) getUserByOAuthToken(ctx context.Context, accessToken string) (*TwitchUser, error) {
 	userAPI := "https://api.twitch.tv/kraken/user"
-	req, err := http.NewRequest("GET", userAPI, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", userAPI, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -69,7 +74,7 @@ func (ur *UnRustleLogs) getUserByOAuthToken(accessToken string) (*TwitchUser, er
 	req.Header.Add("Client-ID", ur.config.Twitch.ClientID)
 	req.Header.Add("Accept", "application/vnd.twitchtv.v5+json")
 
-	response, err := twitchHTTPClient.Do(req)
+	response, err := ur.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -80,6 +85,9 @@ func (ur *UnRustleLogs) getUserByOAuthToken(accessToken string) (*TwitchUser, er
 	if err != nil {
 		return nil, err
 	}
+	if response.StatusCode != http.StatusOK {
+		return nil, &statusError{Service: TWITCHSERVICE, StatusCode: response.StatusCode, Body: string(body)}
+	}
 	var user TwitchUser
 
 	err = json.Unmarshal(body, &user)
@@ -89,81 +97,166 @@ func (ur *UnRustleLogs) getUserByOAuthToken(accessToken string) (*TwitchUser, er
 	return &user, nil
 }
 
-// TwitchLoginHandle ...
-func (ur *UnRustleLogs) TwitchLoginHandle(c *gin.Context) {
-	state := uniuri.New()
-	ur.addTwitchState(state)
+// getTwitchAccessToken exchanges the code for a token, passing the PKCE
+// verifier which helix.GetUserAccessToken has no support for.
+func (ur *UnRustleLogs) getTwitchAccessToken(ctx context.Context, code, verifier, redirectURI string) (*oauthResponse, error) {
+	v := url.Values{}
+	v.Set("client_id", ur.config.Twitch.ClientID)
+	v.Set("client_secret", ur.config.Twitch.ClientSecret)
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", redirectURI)
+	v.Set("code_verifier", verifier)
 
-	url := twitchClient.GetAuthorizationURL(state, true)
+	response, err := postForm(ctx, ur.httpClient, helix.AuthBaseURL+"/token", v)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
 
-	c.Header("Location", url)
-	c.Redirect(http.StatusFound, url)
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, &statusError{Service: TWITCHSERVICE, StatusCode: response.StatusCode, Body: string(body)}
+	}
+	var token oauthResponse
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
 }
 
-// TwitchLogoutHandle ...
-func (ur *UnRustleLogs) TwitchLogoutHandle(c *gin.Context) {
-	ur.deleteCookie(c, ur.config.Twitch.Cookie)
-	c.Redirect(http.StatusFound, "/")
+// missingScopes returns the scopes in required that are not in granted.
+func missingScopes(required, granted []string) []string {
+	has := make(map[string]bool, len(granted))
+	for _, s := range granted {
+		has[s] = true
+	}
+	var missing []string
+	for _, s := range required {
+		if !has[s] {
+			missing = append(missing, s)
+		}
+	}
+	return missing
 }
 
-func (ur *UnRustleLogs) deleteCookie(c *gin.Context, cookie string) {
-	c.SetCookie(cookie, "", -1, "/", fmt.Sprintf("%s", c.Request.Host), c.Request.URL.Scheme == "https", false)
+type twitchProvider struct {
+	ur *UnRustleLogs
 }
 
-// TwitchCallbackHandle ...
-func (ur *UnRustleLogs) TwitchCallbackHandle(c *gin.Context) {
-	state := c.Query("state")
-	if !ur.hasTwitchState(state) {
-		c.Redirect(http.StatusFound, "/")
-		return
-	}
-	go ur.deleteTwitchState(state)
-	code := c.Query("code")
-	errorMsg := c.Query("error")
-	if errorMsg != "" {
-		c.String(http.StatusUnauthorized, "Authentication could not be completed because the server is misconfigured")
-		return
-	}
-	if code == "" {
-		c.String(http.StatusUnauthorized, "Authentication failed without error")
-		return
+// Service ...
+func (p *twitchProvider) Service() string {
+	return TWITCHSERVICE
+}
+
+// Name ...
+func (p *twitchProvider) Name() string {
+	return "Twitch.tv"
+}
+
+// Path ...
+func (p *twitchProvider) Path() string {
+	return "/twitch"
+}
+
+// CookieName ...
+func (p *twitchProvider) CookieName() string {
+	return p.ur.config.Twitch.Cookie
+}
+
+// RedirectURL ...
+func (p *twitchProvider) RedirectURL() string {
+	return p.ur.config.Twitch.RedirectURL
+}
+
+// AuthURL ...
+func (p *twitchProvider) AuthURL(req authRequest) string {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ur.config.Twitch.ClientID)
+	v.Set("redirect_uri", req.RedirectURI)
+	v.Set("scope", strings.Join(p.ur.config.Twitch.Scopes, " "))
+	v.Set("state", req.State)
+	// make twitch ask for the account again instead of reusing the active one
+	if req.Force {
+		v.Set("force_verify", "true")
 	}
+	v.Set("code_challenge", codeChallengeS256(req.Verifier))
+	v.Set("code_challenge_method", "S256")
+	return helix.AuthBaseURL + "/authorize?" + v.Encode()
+}
 
-	oauth, err := twitchClient.GetUserAccessToken(code)
+// Exchange ...
+func (p *twitchProvider) Exchange(ctx context.Context, redirectURI, code, verifier string) (*Identity, error) {
+	var oauth *oauthResponse
+	err := withRetry(ctx, TWITCHSERVICE, "token exchange", func() (err error) {
+		oauth, err = p.ur.getTwitchAccessToken(ctx, code, verifier, redirectURI)
+		return err
+	})
 	if err != nil {
-		logrus.Error(err)
-		c.String(http.StatusUnauthorized, "Failed to get token from OAuth exchange code")
-		return
+		return nil, err
 	}
 
-	user, err := ur.getUserByOAuthToken(oauth.Data.AccessToken)
-	if err != nil {
-		logrus.Error(err)
-		c.String(http.StatusServiceUnavailable, "Twitch API failure while retrieving user")
-		return
+	if missing := missingScopes(p.ur.config.Twitch.Scopes, oauth.Scope); len(missing) > 0 {
+		logrus.Warnf("twitch scopes not granted: %v", missing)
+		return nil, errMissingScope
 	}
 
-	id := ur.AddTwitchUser(user)
-	// Set custom claims
-	claims := &jwtClaims{
-		id,
-		jwt.StandardClaims{
-			// 1 month expire
-			ExpiresAt: time.Now().Add((time.Hour * 24) * 31).Unix(),
-		},
+	var user *TwitchUser
+	err = withRetry(ctx, TWITCHSERVICE, "userinfo", func() (err error) {
+		user, err = p.ur.getUserByOAuthToken(ctx, oauth.AccessToken)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	if p.ur.config.Twitch.RequireVerifiedEmail {
+		if user.Email == "" {
+			return nil, errEmailMissing
+		}
+		if !user.EmailVerified {
+			return nil, errEmailUnverified
+		}
+	}
+	return &Identity{
+		UserID:        user.ID,
+		Name:          user.Name,
+		DisplayName:   user.DisplayName,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		AccessToken:   oauth.AccessToken,
+		RefreshToken:  oauth.RefreshToken,
+		ExpiresIn:     oauth.ExpiresIn,
+	}, nil
+}
 
-	// Create token with claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+// RevokeOnLogout ...
+func (p *twitchProvider) RevokeOnLogout() bool {
+	return p.ur.config.Twitch.RevokeOnLogout
+}
 
-	// Generate encoded token and send it as response.
-	t, err := token.SignedString([]byte(ur.config.Server.JWTSecret))
+// Revoke ...
+func (p *twitchProvider) Revoke(userID string) error {
+	return p.ur.revokeTwitchToken(userID)
+}
+
+// revokeTwitchToken revokes the stored OAuth grant of a user on Twitch's side.
+func (ur *UnRustleLogs) revokeTwitchToken(userID string) error {
+	accessToken, err := ur.storedAccessToken(TWITCHSERVICE, userID)
 	if err != nil {
-		logrus.Error(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed signing jwt"})
-		return
+		return err
 	}
-
-	c.SetCookie(ur.config.Twitch.Cookie, t, 604800, "/", fmt.Sprintf("%s", c.Request.Host), c.Request.URL.Scheme == "https", false)
-	c.Redirect(http.StatusFound, "/")
+	resp, err := twitchClient.RevokeUserAccessToken(accessToken)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error revoking twitch token, status: %d, message: %s", resp.StatusCode, resp.ErrorMessage)
+	}
+	ur.DeleteToken(TWITCHSERVICE, userID)
+	return nil
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultUserCacheTTL = time.Minute
+	// userCacheMaxEntries bounds the memory of lookups for users that never
+	// opted out
+	userCacheMaxEntries = 100000
+)
+
+// userCache remembers UserInDatabase results for ttl, per user and channel.
+// AddUser, DeleteUser and SetUserChannels invalidate the users they change, a
+// nil cache is disabled.
+type userCache struct {
+	mu      sync.RWMutex
+	ttl     time.Duration
+	entries map[string]map[string]userCacheEntry
+	// generation changes on every invalidation, lookups that started before
+	// one don't store their possibly outdated result
+	generation uint64
+}
+
+type userCacheEntry struct {
+	id      string
+	ok      bool
+	expires time.Time
+}
+
+func newUserCache(ttl time.Duration) *userCache {
+	return &userCache{ttl: ttl, entries: make(map[string]map[string]userCacheEntry)}
+}
+
+func userCacheKey(name, service string) string {
+	return service + "\x00" + name
+}
+
+// get returns the cached result and the generation to pass to put.
+func (c *userCache) get(key, channel string) (id string, ok, hit bool, generation uint64) {
+	if c == nil {
+		return "", false, false, 0
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	e, hit := c.entries[key][channel]
+	if hit && time.Now().After(e.expires) {
+		hit = false
+	}
+	return e.id, e.ok, hit, c.generation
+}
+
+func (c *userCache) put(key, channel, id string, ok bool, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	now := time.Now()
+	if len(c.entries) >= userCacheMaxEntries {
+		for k, channels := range c.entries {
+			for channel, e := range channels {
+				if now.After(e.expires) {
+					delete(channels, channel)
+				}
+			}
+			if len(channels) == 0 {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= userCacheMaxEntries {
+			c.entries = make(map[string]map[string]userCacheEntry)
+		}
+	}
+	channels, found := c.entries[key]
+	if !found {
+		channels = make(map[string]userCacheEntry)
+		c.entries[key] = channels
+	}
+	channels[channel] = userCacheEntry{id: id, ok: ok, expires: now.Add(c.ttl)}
+}
+
+func (c *userCache) invalidate(keys ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for _, k := range keys {
+		delete(c.entries, k)
+	}
+}
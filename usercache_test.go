@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// newCachedRustle is newTestRustle with a user cache that doesn't expire
+// during the test.
+func newCachedRustle(t *testing.T) *UnRustleLogs {
+	t.Helper()
+	ur := newTestRustle(t)
+	ur.userCache = newUserCache(time.Hour)
+	return ur
+}
+
+func TestUserCacheServesLookups(t *testing.T) {
+	ur := newCachedRustle(t)
+	id := addTestUser(t, ur, TWITCHSERVICE, "foo")
+	if _, ok := ur.UserInDatabase("foo", TWITCHSERVICE, ""); !ok {
+		t.Fatal("foo isn't opted out")
+	}
+	// changed behind the back of the cache
+	if err := ur.db.Model(&User{}).Where("id = ?", id).Update("active", false).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ur.UserInDatabase("foo", TWITCHSERVICE, ""); !ok {
+		t.Fatal("the lookup wasn't cached")
+	}
+}
+
+func TestUserCacheInvalidation(t *testing.T) {
+	ur := newCachedRustle(t)
+	lookup := func(want bool) {
+		t.Helper()
+		if _, ok := ur.UserInDatabase("Foo", TWITCHSERVICE, ""); ok != want {
+			t.Fatalf("opted out %v, want %v", ok, want)
+		}
+	}
+	lookup(false)
+	addTestUser(t, ur, TWITCHSERVICE, "foo")
+	lookup(true)
+	if err := ur.DeleteUser("foo", TWITCHSERVICE, "foo-id"); err != nil {
+		t.Fatal(err)
+	}
+	lookup(false)
+	if _, _, err := ur.AddUser(TWITCHSERVICE, &Identity{UserID: "foo-id", Name: "foo"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	lookup(true)
+	if _, _, err := ur.AddUser(TWITCHSERVICE, &Identity{UserID: "foo-id", Name: "bar"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	lookup(false)
+}
+
+func TestUserCacheIgnoresOutdatedResults(t *testing.T) {
+	c := newUserCache(time.Hour)
+	key := userCacheKey("foo", TWITCHSERVICE)
+	_, _, _, generation := c.get(key, "")
+	// a lookup that raced with a delete
+	c.invalidate(key)
+	c.put(key, "", "id", true, generation)
+	if _, _, hit, _ := c.get(key, ""); hit {
+		t.Fatal("the result of the outdated lookup was cached")
+	}
+}
+
+func TestDisabledUserCache(t *testing.T) {
+	var c *userCache
+	c.put("key", "", "id", true, 0)
+	c.invalidate("key")
+	if _, _, hit, _ := c.get("key", ""); hit {
+		t.Fatal("a disabled cache had a hit")
+	}
+}
+
+func TestUserCacheConcurrency(t *testing.T) {
+	ur := newCachedRustle(t)
+	addTestUser(t, ur, TWITCHSERVICE, "foo")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if i == 0 && j%10 == 0 {
+					ur.userCache.invalidate(userCacheKey("foo", TWITCHSERVICE))
+				}
+				ur.UserInDatabase("foo", TWITCHSERVICE, "")
+			}
+		}(i)
+	}
+	wg.Wait()
+	if _, ok := ur.UserInDatabase("foo", TWITCHSERVICE, ""); !ok {
+		t.Fatal("foo isn't opted out")
+	}
+}
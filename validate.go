@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// minJWTSecretLength is the least bytes an HS256 secret needs to not be
+// guessable
+const minJWTSecretLength = 32
+
+// negativeDurations may be negative, see their options
+var negativeDurations = map[string]bool{"server.drain_delay": true}
+
+// ConfigErrors are all the problems Validate found.
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+	return "invalid config: " + strings.Join(e, "; ")
+}
+
+// Validate checks the config for mistakes that would otherwise only show
+// once a login or request fails, reporting all of them at once as
+// ConfigErrors.
+func (cfg *Config) Validate() error {
+	var problems ConfigErrors
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch strings.ToUpper(cfg.Server.JWTAlgorithm) {
+	case "", jwtHS256:
+		if len(cfg.Server.JWTSecrets) == 0 && len(cfg.Server.JWTSecret) < minJWTSecretLength {
+			problem("server.jwt_secret needs at least %d bytes, e.g. openssl rand -hex 32", minJWTSecretLength)
+		}
+		for i, s := range cfg.Server.JWTSecrets {
+			if len(s.Secret) < minJWTSecretLength {
+				problem("server.jwt_secrets[%d] needs at least %d bytes", i, minJWTSecretLength)
+			}
+		}
+	case jwtRS256:
+		if cfg.Server.JWTPrivateKeyFile == "" || cfg.Server.JWTPublicKeyFile == "" {
+			problem("server.jwt_algorithm RS256 needs server.jwt_private_key_file and server.jwt_public_key_file")
+		}
+	default:
+		problem("server.jwt_algorithm must be HS256 or RS256, got %q", cfg.Server.JWTAlgorithm)
+	}
+
+	redirectDerived := cfg.Server.CallbackBaseURL != "" || len(cfg.Server.AllowedHosts) > 0
+	cookies := make(map[string]string)
+	provider := func(section string, clientID, clientSecret, redirectURL, cookie string) {
+		if clientID == "" {
+			problem("%s.client_id is missing", section)
+		}
+		if clientSecret == "" {
+			problem("%s.client_secret is missing", section)
+		}
+		if redirectURL == "" && !redirectDerived {
+			problem("%s.redirect_url is missing, or set server.callback_base_url", section)
+		}
+		if cookie == "" {
+			problem("%s.cookie is missing", section)
+		} else if other, taken := cookies[cookie]; taken {
+			problem("%s.cookie %q is already the cookie of %s", section, cookie, other)
+		} else {
+			cookies[cookie] = section
+		}
+	}
+	provider("twitch", cfg.Twitch.ClientID, cfg.Twitch.ClientSecret, cfg.Twitch.RedirectURL, cfg.Twitch.Cookie)
+	provider("destinygg", cfg.Destinygg.ClientID, cfg.Destinygg.ClientSecret, cfg.Destinygg.RedirectURL, cfg.Destinygg.Cookie)
+	if cfg.Discord.ClientID != "" {
+		provider("discord", cfg.Discord.ClientID, cfg.Discord.ClientSecret, cfg.Discord.RedirectURL, cfg.Discord.Cookie)
+	}
+	if cfg.YouTube.ClientID != "" {
+		provider("youtube", cfg.YouTube.ClientID, cfg.YouTube.ClientSecret, cfg.YouTube.RedirectURL, cfg.YouTube.Cookie)
+	}
+	if cfg.Kick.ClientID != "" {
+		provider("kick", cfg.Kick.ClientID, cfg.Kick.ClientSecret, cfg.Kick.RedirectURL, cfg.Kick.Cookie)
+	}
+	if cfg.Admin.ClientID != "" {
+		// the cookies of admin and the oidc providers have defaults
+		cookie := cfg.Admin.Cookie
+		if cookie == "" {
+			cookie = "admin"
+		}
+		provider("admin", cfg.Admin.ClientID, cfg.Admin.ClientSecret, cfg.Admin.RedirectURL, cookie)
+	}
+	for i, pc := range cfg.OIDCProviders {
+		section := fmt.Sprintf("oidc_providers[%d]", i)
+		if pc.Issuer == "" {
+			problem("%s.issuer is missing", section)
+		}
+		cookie := pc.Cookie
+		if cookie == "" {
+			cookie = pc.Slug
+		}
+		provider(section, pc.ClientID, pc.ClientSecret, pc.RedirectURL, cookie)
+	}
+
+	// without an address net/http listens on :80
+	if cfg.Server.Address != "" {
+		if err := validateAddress(cfg.Server.Address, true); err != nil {
+			problem("server.address: %v", err)
+		}
+	}
+	if cfg.Server.GRPCAddress != "" {
+		if err := validateAddress(cfg.Server.GRPCAddress, false); err != nil {
+			problem("server.grpc_address: %v", err)
+		}
+	}
+	if cfg.Server.TLS.ACME && cfg.Server.TLS.HTTPAddress != "" {
+		if err := validateAddress(cfg.Server.TLS.HTTPAddress, false); err != nil {
+			problem("server.tls.http_address: %v", err)
+		}
+	}
+
+	// 0 is the default, negative ones are reported below
+	if ttl := cfg.Server.StateTTL.Duration; ttl > 0 && (ttl < minStateTTL || ttl > maxStateTTL) {
+		problem("server.state_ttl must be between %s and %s, got %s", minStateTTL, maxStateTTL, ttl)
+	}
+	switch cfg.Server.Mode {
+	case "", gin.ReleaseMode, gin.DebugMode, gin.TestMode:
+	default:
+		problem("server.mode must be release, debug or test, got %q", cfg.Server.Mode)
+	}
+
+	for _, name := range negativeDurationOptions(reflect.ValueOf(cfg).Elem(), "") {
+		problem("%s can't be negative", name)
+	}
+
+	for i, hook := range cfg.Webhooks {
+		if u, err := url.Parse(hook.URL); err != nil || u.Host == "" || (u.Scheme != "https" && !(u.Scheme == "http" && isLoopback(u.Hostname()))) {
+			problem("webhooks[%d].url %q has to be an absolute https url", i, hook.URL)
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems
+}
+
+// validateAddress checks a host:port address, or a unix: socket path if
+// unix is allowed.
+func validateAddress(address string, unix bool) error {
+	if path, ok := strings.CutPrefix(address, unixPrefix); ok && unix {
+		if path == "" {
+			return fmt.Errorf("%q has no socket path", address)
+		}
+		return nil
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%q isn't host:port", address)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("%q has an invalid port", address)
+	}
+	return nil
+}
+
+// negativeDurationOptions are the options of v below prefix holding a
+// negative duration, named like in the toml file.
+func negativeDurationOptions(v reflect.Value, prefix string) []string {
+	var names []string
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("toml")
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		switch fv := v.Field(i); {
+		case field.Type == reflect.TypeOf(duration{}):
+			if fv.Interface().(duration).Duration < 0 && !negativeDurations[name] {
+				names = append(names, name)
+			}
+		case fv.Kind() == reflect.Struct:
+			names = append(names, negativeDurationOptions(fv, name)...)
+		}
+	}
+	return names
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
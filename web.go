@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultAssetsMaxAge = time.Hour
+	// immutableMaxAge is the max-age of asset urls with the current
+	// fingerprint, a change gets a new url
+	immutableMaxAge = 365 * 24 * time.Hour
+)
+
+// webFS has the templates and assets, so the binary runs from any directory
+//
+//go:embed templates assets
+var webFS embed.FS
+
+// setupWeb loads the templates and serves /assets from the binary, or from
+// templatesDir and assetsDir on disk if they are set, for development.
+func (ur *UnRustleLogs) setupWeb(router *gin.Engine, templatesDir, assetsDir string) error {
+	assets := &assetTable{files: make(map[string]asset), maxAge: ur.config.Server.AssetsMaxAge.Duration}
+	if assetsDir == "" {
+		sub, err := fs.Sub(webFS, "assets")
+		if err != nil {
+			return err
+		}
+		if err := assets.load(sub); err != nil {
+			return fmt.Errorf("failed loading the embedded assets: %v", err)
+		}
+	}
+	funcs := template.FuncMap{"asset": assets.url}
+
+	if templatesDir != "" {
+		pattern := filepath.Join(templatesDir, "*")
+		if matches, _ := filepath.Glob(pattern); len(matches) == 0 {
+			return fmt.Errorf("no templates in %s", templatesDir)
+		}
+		router.SetFuncMap(funcs)
+		// in debug mode they are reloaded on every request
+		router.LoadHTMLGlob(pattern)
+	} else {
+		tmpl, err := template.New("").Funcs(funcs).ParseFS(webFS, "templates/*")
+		if err != nil {
+			return fmt.Errorf("failed parsing the embedded templates: %v", err)
+		}
+		router.SetHTMLTemplate(tmpl)
+	}
+
+	if assetsDir != "" {
+		router.Static("/assets", assetsDir)
+		return nil
+	}
+	router.GET("/assets/*filepath", assets.handler)
+	router.HEAD("/assets/*filepath", assets.handler)
+	return nil
+}
+
+// asset is a file under /assets, kept in memory with the hash of its
+// content as ETag and fingerprint.
+type asset struct {
+	data []byte
+	hash string
+}
+
+// assetTable serves the embedded assets with Cache-Control and ETags. Urls
+// from the asset template func carry the fingerprint in v, those are cached
+// for good since a change gets a new url, the others for maxAge.
+type assetTable struct {
+	files  map[string]asset
+	maxAge time.Duration
+}
+
+func (a *assetTable) load(fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		a.files[name] = asset{data: data, hash: hex.EncodeToString(sum[:8])}
+		return nil
+	})
+}
+
+// url is the asset template func, the url of the asset name with its
+// fingerprint. Assets served from disk have none.
+func (a *assetTable) url(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	if f, ok := a.files[name]; ok {
+		return "/assets/" + name + "?v=" + f.hash
+	}
+	return "/assets/" + name
+}
+
+func (a *assetTable) handler(c *gin.Context) {
+	name := strings.TrimPrefix(path.Clean(c.Param("filepath")), "/")
+	f, ok := a.files[name]
+	if !ok {
+		c.String(http.StatusNotFound, "404 page not found")
+		return
+	}
+	maxAge, immutable := a.maxAge, c.Query("v") == f.hash
+	if immutable {
+		maxAge = immutableMaxAge
+	}
+	cacheControl := "public, max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+	if immutable {
+		cacheControl += ", immutable"
+	}
+	c.Header("Cache-Control", cacheControl)
+	c.Header("ETag", `"`+f.hash+`"`)
+	// ServeContent answers If-None-Match with a 304 and sets the
+	// Content-Type from the extension
+	http.ServeContent(c.Writer, c.Request, name, time.Time{}, bytes.NewReader(f.data))
+}
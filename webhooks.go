@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	webhookOptOut = "opt_out"
+	webhookOptIn  = "opt_in"
+
+	// webhookQueueSize bounds the events waiting for delivery, later ones
+	// are dropped
+	webhookQueueSize = 1000
+)
+
+// webhookEvents counts the events per outcome, sent, failed or dropped
+var webhookEvents = expvar.NewMap("webhook_events")
+
+// WebhookConfig is a subscriber to opt-out changes
+type WebhookConfig struct {
+	URL string
+	// Services limits the events to these services, all of them if empty
+	Services []string
+}
+
+// WebhookEvent is POSTed as JSON to the subscribers of the service
+type WebhookEvent struct {
+	Service   string    `json:"service"`
+	Name      string    `json:"name"`
+	Action    string    `json:"action"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// webhooks delivers events from a bounded queue in the background so slow
+// subscribers can't hold up requests.
+type webhooks struct {
+	hooks  []WebhookConfig
+	client *http.Client
+	queue  chan WebhookEvent
+	done   chan struct{}
+	// ctx aborts deliveries once the shutdown deadline passed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex  sync.RWMutex
+	closed bool
+}
+
+func (ur *UnRustleLogs) setupWebhooks() error {
+	if len(ur.config.Webhooks) == 0 {
+		return nil
+	}
+	for i, hook := range ur.config.Webhooks {
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhooks[%d]: invalid url %q", i, hook.URL)
+		}
+		for _, service := range hook.Services {
+			if _, ok := ur.provider(service); !ok {
+				return fmt.Errorf("webhooks[%d]: unknown service %q", i, service)
+			}
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &webhooks{
+		hooks:  ur.config.Webhooks,
+		client: ur.httpClient,
+		queue:  make(chan WebhookEvent, webhookQueueSize),
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	go w.run()
+	ur.webhooks = w
+	return nil
+}
+
+// notifyAll notifies the service, name and action of every event in order.
+func (ur *UnRustleLogs) notifyAll(events []WebhookEvent) {
+	for _, e := range events {
+		ur.notify(e.Service, e.Name, e.Action)
+	}
+}
+
+// notify queues an event for the webhooks and change streams of service, it
+// never blocks.
+func (ur *UnRustleLogs) notify(service, name, action string) {
+	event := WebhookEvent{Service: service, Name: name, Action: action, Timestamp: time.Now().UTC()}
+	ur.changes.publish(event)
+	w := ur.webhooks
+	if w == nil {
+		return
+	}
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	if w.closed {
+		logrus.Warnf("dropped webhook event %s of %s user %s, shutting down", action, service, name)
+		webhookEvents.Add("dropped", 1)
+		return
+	}
+	select {
+	case w.queue <- event:
+	default:
+		logrus.Warnf("dropped webhook event %s of %s user %s, the queue is full", action, service, name)
+		webhookEvents.Add("dropped", 1)
+	}
+}
+
+// run delivers queued events until the queue is closed and empty.
+func (w *webhooks) run() {
+	defer close(w.done)
+	for event := range w.queue {
+		if w.ctx.Err() != nil {
+			// past the shutdown deadline, close reports it
+			webhookEvents.Add("dropped", 1)
+			continue
+		}
+		body, err := json.Marshal(event)
+		if err != nil {
+			logrus.Errorf("failed encoding webhook event: %v", err)
+			continue
+		}
+		for _, hook := range w.hooks {
+			if !hook.subscribed(event.Service) {
+				continue
+			}
+			if err := w.deliver(hook.URL, body); err != nil {
+				logrus.Errorf("failed delivering webhook event %s of %s user %s to %s: %v", event.Action, event.Service, event.Name, hook.URL, err)
+				webhookEvents.Add("failed", 1)
+				continue
+			}
+			webhookEvents.Add("sent", 1)
+		}
+	}
+}
+
+func (hook WebhookConfig) subscribed(service string) bool {
+	if len(hook.Services) == 0 {
+		return true
+	}
+	for _, s := range hook.Services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *webhooks) deliver(target string, body []byte) error {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	response, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 4096))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return nil
+}
+
+// close stops accepting events and waits until the queued ones are
+// delivered, abandoning the rest once ctx is done.
+func (w *webhooks) close(ctx context.Context) error {
+	w.mutex.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mutex.Unlock()
+	select {
+	case <-w.done:
+		w.cancel()
+		return nil
+	case <-ctx.Done():
+		w.cancel()
+		<-w.done
+		return errors.New("webhook events weren't delivered in time")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	googleAuthURL      = "https://accounts.google.com/o/oauth2/v2/auth"
+	googleTokenURL     = "https://oauth2.googleapis.com/token"
+	youtubeChannelsURL = "https://www.googleapis.com/youtube/v3/channels?part=snippet&mine=true"
+)
+
+// YouTubeChannel ...
+type YouTubeChannel struct {
+	ID      string `json:"id"`
+	Snippet struct {
+		Title     string `json:"title"`
+		CustomURL string `json:"customUrl"`
+	} `json:"snippet"`
+}
+
+type youtubeChannelsResponse struct {
+	Items []YouTubeChannel `json:"items"`
+}
+
+type googleTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	TokenType    string `json:"token_type"`
+}
+
+func (ur *UnRustleLogs) youtubeEnabled() bool {
+	return ur.config.YouTube.ClientID != ""
+}
+
+func (ur *UnRustleLogs) getYouTubeAccessToken(ctx context.Context, code, redirectURI string) (*googleTokenResponse, error) {
+	v := url.Values{}
+	v.Set("client_id", ur.config.YouTube.ClientID)
+	v.Set("client_secret", ur.config.YouTube.ClientSecret)
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", redirectURI)
+
+	response, err := postForm(ctx, ur.httpClient, googleTokenURL, v)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting google access_token, status: %d, body: %s", response.StatusCode, body)
+	}
+	var token googleTokenResponse
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// getYouTubeChannel resolves the channel owned by the authenticated user.
+// The channel id is used as the opt-out key since titles are not unique.
+func (ur *UnRustleLogs) getYouTubeChannel(ctx context.Context, accessToken string) (*YouTubeChannel, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", youtubeChannelsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+
+	response, err := ur.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting youtube channel, status: %d, body: %s", response.StatusCode, body)
+	}
+	var channels youtubeChannelsResponse
+	err = json.Unmarshal(body, &channels)
+	if err != nil {
+		return nil, err
+	}
+	if len(channels.Items) == 0 {
+		return nil, errors.New("google account has no youtube channel")
+	}
+	return &channels.Items[0], nil
+}
+
+type youtubeProvider struct {
+	ur *UnRustleLogs
+}
+
+// Service ...
+func (p *youtubeProvider) Service() string {
+	return YOUTUBESERVICE
+}
+
+// Name ...
+func (p *youtubeProvider) Name() string {
+	return "YouTube"
+}
+
+// Path ...
+func (p *youtubeProvider) Path() string {
+	return "/youtube"
+}
+
+// CookieName ...
+func (p *youtubeProvider) CookieName() string {
+	return p.ur.config.YouTube.Cookie
+}
+
+// RedirectURL ...
+func (p *youtubeProvider) RedirectURL() string {
+	return p.ur.config.YouTube.RedirectURL
+}
+
+// AuthURL ...
+func (p *youtubeProvider) AuthURL(req authRequest) string {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ur.config.YouTube.ClientID)
+	v.Set("redirect_uri", req.RedirectURI)
+	v.Set("scope", strings.Join(p.ur.config.YouTube.Scopes, " "))
+	v.Set("state", req.State)
+	return fmt.Sprintf("%s?%s", googleAuthURL, v.Encode())
+}
+
+// Exchange ...
+func (p *youtubeProvider) Exchange(ctx context.Context, redirectURI, code, verifier string) (*Identity, error) {
+	access, err := p.ur.getYouTubeAccessToken(ctx, code, redirectURI)
+	if err != nil {
+		return nil, err
+	}
+	channel, err := p.ur.getYouTubeChannel(ctx, access.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		UserID:       channel.ID,
+		Name:         channel.ID,
+		DisplayName:  channel.Snippet.Title,
+		Nick:         channel.Snippet.CustomURL,
+		AccessToken:  access.AccessToken,
+		RefreshToken: access.RefreshToken,
+		ExpiresIn:    access.ExpiresIn,
+	}, nil
+}